@@ -0,0 +1,213 @@
+package xmppcore
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAdmissionDenied     = errors.New("address denied")
+	ErrAdmissionRate       = errors.New("accept rate exceeded")
+	ErrAdmissionConns      = errors.New("too many connections")
+	ErrAdmissionConnsPerIP = errors.New("too many connections of the address")
+)
+
+// the reasons rejected conns are counted by
+const (
+	AdmissionDenied     = "denied"
+	AdmissionRate       = "rate"
+	AdmissionConns      = "conns"
+	AdmissionConnsPerIP = "conns_per_ip"
+)
+
+var admissionReasons = map[error]string{
+	ErrAdmissionDenied:     AdmissionDenied,
+	ErrAdmissionRate:       AdmissionRate,
+	ErrAdmissionConns:      AdmissionConns,
+	ErrAdmissionConnsPerIP: AdmissionConnsPerIP,
+}
+
+// AdmissionConfig limits the conns admitted, a zero is no limit
+type AdmissionConfig struct {
+	MaxConns      int
+	MaxConnsPerIP int
+	// conns accepted per second, and how many may be accepted at once
+	AcceptRate  float64
+	AcceptBurst int
+}
+
+var DefaultAdmissionConfig = AdmissionConfig{
+	MaxConns:      10000,
+	MaxConnsPerIP: 32,
+	AcceptRate:    100,
+	AcceptBurst:   200,
+}
+
+type AdmissionStats struct {
+	Conns    int
+	Admitted uint64
+	Rejected map[string]uint64
+}
+
+// Admission decides which conns are admitted, one shared by the grabbers limits conns of
+// all the listeners. a conn admitted holds its place until it's released
+type Admission struct {
+	conf AdmissionConfig
+
+	mu     sync.Mutex
+	conns  int
+	perIP  map[string]int
+	tokens float64
+	last   time.Time
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+
+	admitted uint64
+	rejected map[string]uint64
+	logger   StructuredLogger
+}
+
+func NewAdmission(conf AdmissionConfig) *Admission {
+	return &Admission{
+		conf:     conf,
+		perIP:    make(map[string]int),
+		tokens:   float64(conf.AcceptBurst),
+		last:     time.Now(),
+		rejected: make(map[string]uint64),
+		logger:   NewLogger(io.Discard).Sub(LogSubAdmit)}
+}
+
+func (a *Admission) SetLogger(logger Logger) {
+	a.logger = Structured(logger).Sub(LogSubAdmit)
+}
+
+// SetAccessLists replaces the cidrs allowed and denied, which may be done at any time. a
+// denied address is rejected even if it's allowed, and with any allowed, the addresses
+// not allowed are rejected
+func (a *Admission) SetAccessLists(allow, deny []string) error {
+	allowed, err := parseCIDRs(allow)
+	if err != nil {
+		return err
+	}
+	denied, err := parseCIDRs(deny)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.allow, a.deny = allowed, denied
+	a.mu.Unlock()
+	return nil
+}
+
+// Admit admits a conn of addr, release gives its place back and may be called many times
+func (a *Admission) Admit(addr net.Addr) (release func(), err error) {
+	return a.AdmitIP(netAddrIP(addr))
+}
+
+// AdmitIP admits a conn of ip, the limits of an address don't apply to a nil ip
+func (a *Admission) AdmitIP(ip net.IP) (release func(), err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := ""
+	if ip != nil {
+		key = ip.String()
+	}
+	if err = a.check(ip, key); err != nil {
+		a.rejected[admissionReasons[err]]++
+		a.logger.Log(LogInfo, "conn rejected", Field(LogKeyRemote, key), Field(LogKeyErr, err))
+		return nil, err
+	}
+	a.admitted++
+	a.conns++
+	if ip != nil {
+		a.perIP[key]++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.conns--
+			if ip == nil {
+				return
+			}
+			if a.perIP[key]--; a.perIP[key] <= 0 {
+				delete(a.perIP, key)
+			}
+		})
+	}, nil
+}
+
+// check is called with mu locked
+func (a *Admission) check(ip net.IP, key string) error {
+	if ip != nil {
+		if cidrsContain(a.deny, ip) || len(a.allow) > 0 && !cidrsContain(a.allow, ip) {
+			return ErrAdmissionDenied
+		}
+	}
+	if a.conf.AcceptRate > 0 {
+		now := time.Now()
+		a.tokens += now.Sub(a.last).Seconds() * a.conf.AcceptRate
+		a.last = now
+		if burst := float64(a.conf.AcceptBurst); a.tokens > burst {
+			a.tokens = burst
+		}
+		if a.tokens < 1 {
+			return ErrAdmissionRate
+		}
+		a.tokens--
+	}
+	if a.conf.MaxConns > 0 && a.conns >= a.conf.MaxConns {
+		return ErrAdmissionConns
+	}
+	if ip != nil && a.conf.MaxConnsPerIP > 0 && a.perIP[key] >= a.conf.MaxConnsPerIP {
+		return ErrAdmissionConnsPerIP
+	}
+	return nil
+}
+
+func (a *Admission) Stats() AdmissionStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := AdmissionStats{Conns: a.conns, Admitted: a.admitted, Rejected: make(map[string]uint64)}
+	for reason, n := range a.rejected {
+		stats.Rejected[reason] = n
+	}
+	return stats
+}
+
+// admissionStatus is the http status of a request rejected
+func admissionStatus(err error) int {
+	if err == ErrAdmissionDenied {
+		return http.StatusForbidden
+	}
+	return http.StatusServiceUnavailable
+}
+
+// acceptBackoff is how long to wait after accept errors, which are usually out of file
+// descriptors, doubled each time in a row
+type acceptBackoff struct {
+	delay time.Duration
+}
+
+const (
+	acceptBackoffMin = time.Millisecond * 5
+	acceptBackoffMax = time.Second
+)
+
+func (b *acceptBackoff) next() time.Duration {
+	if b.delay == 0 {
+		b.delay = acceptBackoffMin
+	} else if b.delay *= 2; b.delay > acceptBackoffMax {
+		b.delay = acceptBackoffMax
+	}
+	return b.delay
+}
+
+func (b *acceptBackoff) reset() {
+	b.delay = 0
+}
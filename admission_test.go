@@ -0,0 +1,108 @@
+package xmppcore
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	a := NewAdmission(AdmissionConfig{MaxConns: 3, MaxConnsPerIP: 2})
+	ip1, ip2 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	release1, err := a.AdmitIP(ip1)
+	if err != nil {
+		t.Fatalf("admit error: %s", err.Error())
+	}
+	if _, err := a.AdmitIP(ip1); err != nil {
+		t.Fatalf("admit error: %s", err.Error())
+	}
+	if _, err := a.AdmitIP(ip1); err != ErrAdmissionConnsPerIP {
+		t.Fatalf("conns of an address should be limited, got %v", err)
+	}
+	if _, err := a.AdmitIP(ip2); err != nil {
+		t.Fatalf("admit error: %s", err.Error())
+	}
+	if _, err := a.AdmitIP(net.ParseIP("192.0.2.3")); err != ErrAdmissionConns {
+		t.Fatalf("conns should be limited, got %v", err)
+	}
+	release1()
+	release1()
+	if stats := a.Stats(); stats.Conns != 2 || stats.Admitted != 3 ||
+		stats.Rejected[AdmissionConnsPerIP] != 1 || stats.Rejected[AdmissionConns] != 1 {
+		t.Fatalf("stats error: %+v", stats)
+	}
+
+	if err := a.SetAccessLists(nil, []string{"192.0.2.0/24"}); err != nil {
+		t.Fatalf("set access lists error: %s", err.Error())
+	}
+	if _, err := a.AdmitIP(ip1); err != ErrAdmissionDenied {
+		t.Fatalf("denied address should be rejected, got %v", err)
+	}
+	a.SetAccessLists([]string{"198.51.100.0/24"}, nil)
+	if _, err := a.AdmitIP(ip1); err != ErrAdmissionDenied {
+		t.Fatalf("address not allowed should be rejected, got %v", err)
+	}
+	if _, err := a.AdmitIP(net.ParseIP("198.51.100.1")); err != nil {
+		t.Fatalf("allowed address should be admitted, got %v", err)
+	}
+	if err := a.SetAccessLists([]string{"not a cidr"}, nil); err == nil {
+		t.Fatalf("invalid cidr should fail")
+	}
+}
+
+func TestAdmissionRate(t *testing.T) {
+	a := NewAdmission(AdmissionConfig{AcceptRate: 20, AcceptBurst: 2})
+	for i := 0; i < 2; i++ {
+		if _, err := a.AdmitIP(nil); err != nil {
+			t.Fatalf("burst should be admitted, got %v", err)
+		}
+	}
+	if _, err := a.AdmitIP(nil); err != ErrAdmissionRate {
+		t.Fatalf("accept rate should be limited, got %v", err)
+	}
+	time.Sleep(time.Millisecond * 60)
+	if _, err := a.AdmitIP(nil); err != nil {
+		t.Fatalf("tokens should be refilled, got %v", err)
+	}
+}
+
+func TestTcpGrabberAdmission(t *testing.T) {
+	grabber := NewTcpConnGrabber("127.0.0.1:0", ForC2S, NewLogger(io.Discard))
+	grabber.UseAdmission(NewAdmission(AdmissionConfig{MaxConnsPerIP: 1}))
+	conns := make(chan Conn)
+	if err := grabber.Grab(conns); err != nil {
+		t.Fatalf("grab error: %s", err.Error())
+	}
+	defer grabber.Cancel()
+	dial := func() net.Conn {
+		client, err := net.Dial("tcp", grabber.ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial error: %s", err.Error())
+		}
+		return client
+	}
+	first := dial()
+	defer first.Close()
+	var conn Conn
+	select {
+	case conn = <-conns:
+	case <-time.After(time.Second):
+		t.Fatalf("first conn not grabbed")
+	}
+	second := dial()
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("conn over the limit should be closed, got %v", err)
+	}
+	conn.Close()
+	third := dial()
+	defer third.Close()
+	select {
+	case conn = <-conns:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatalf("conn should be admitted once the first is closed")
+	}
+}
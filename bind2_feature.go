@@ -0,0 +1,69 @@
+package xmppcore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/google/uuid"
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+const (
+	NSBind2 = "urn:xmpp:bind:0"
+)
+
+type bind2Inline struct {
+	bind *bindFeature
+}
+
+// Bind2Inline binds the resource inline of a sasl2 authentication by the ResourceBinder of
+// bind, xep-0386. bind is handled once the resource is bound inline
+func Bind2Inline(bind *bindFeature) bind2Inline {
+	return bind2Inline{bind: bind}
+}
+
+func (bi bind2Inline) InlineElem() stravaganza.Element {
+	return stravaganza.NewBuilder("bind").WithAttribute("xmlns", NSBind2).Build()
+}
+
+func (bi bind2Inline) Sasl2Success(auth Sasl2Authenticate, part Part) ([]stravaganza.Element, error) {
+	req := auth.Elem.Child("bind")
+	if req == nil || req.Attribute("xmlns") != NSBind2 {
+		return nil, nil
+	}
+	var tag string
+	if t := req.Child("tag"); t != nil {
+		tag = t.Text()
+	}
+	rsc, err := PrepResourcepart(bind2Resource(tag, auth.UserAgent.ID))
+	if err != nil {
+		return nil, err
+	}
+	full, err := bi.bind.rsb.BindResource(part, rsc)
+	if err != nil {
+		return nil, err
+	}
+	var jid JID
+	if err := ParseJID(full, &jid); err != nil {
+		return nil, err
+	}
+	part.Attr().JID = jid
+	bi.bind.handled = true
+	return []stravaganza.Element{stravaganza.NewBuilder("bound").WithAttribute("xmlns", NSBind2).Build()}, nil
+}
+
+// bind2Resource is the tag followed by a part derived from the user agent, so a client
+// gets the same resource across its logins. it's random if there's no user agent
+func bind2Resource(tag, userAgent string) string {
+	var suffix string
+	if userAgent != "" {
+		sum := sha256.Sum256([]byte(userAgent))
+		suffix = hex.EncodeToString(sum[:4])
+	} else {
+		suffix = uuid.New().String()[:8]
+	}
+	if tag == "" {
+		return suffix
+	}
+	return tag + "." + suffix
+}
@@ -0,0 +1,50 @@
+package xmppcore
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestBind2Resource(t *testing.T) {
+	ua := "d4565fa7-4d72-4749-b3d3-740edbf87770"
+	if bind2Resource("AwesomeXMPP", ua) != bind2Resource("AwesomeXMPP", ua) {
+		t.Fatalf("the resource of a user agent should be stable")
+	}
+	if !strings.HasPrefix(bind2Resource("AwesomeXMPP", ua), "AwesomeXMPP.") {
+		t.Fatalf("the resource should start with the tag")
+	}
+	if bind2Resource("", "") == bind2Resource("", "") {
+		t.Fatalf("the resource without a user agent should be random")
+	}
+}
+
+func TestBind2Login(t *testing.T) {
+	serverConn, clientConn := tlsTestConns(t, tls.VersionTLS13)
+	authorized := NewMemoryAuthorized()
+	sasl := SASLFeature(authorized)
+	sasl.AdvertiseChannelBindings(serverConn)
+	sasl.Support(SM_SCRAM_SHA_256_PLUS, NewScramAuth(scramTestUsers(), sha256.New, true))
+	bind := BindFeature(authorized)
+	sasl2 := SASL2Feature(&sasl)
+	sasl2.WithInline(Bind2Inline(&bind))
+	clientSasl2 := ClientSASL2Feature(Sasl2UserAgent{ID: "d4565fa7-4d72-4749-b3d3-740edbf87770"})
+	clientSasl2.Support(SM_SCRAM_SHA_256_PLUS, NewScramToAuth("juliet", "r0m30myr0m30", SM_SCRAM_SHA_256_PLUS, true))
+	clientSasl2.WithInline(ClientBind2Inline(NewMemoryAuthorized(), "AwesomeXMPP"))
+	server, client, err := negotiateParts(t, serverConn, clientConn, []Feature{&sasl, &sasl2, &bind}, []ElemHandler{clientSasl2})
+	if err != nil {
+		t.Fatalf("negotiate error: %s", err.Error())
+	}
+	jid := server.Attr().JID
+	if !jid.IsFull() || jid.Bare().String() != "juliet@hello-world.im" || !strings.HasPrefix(jid.Resource, "AwesomeXMPP.") {
+		t.Fatalf("bound %q", jid.String())
+	}
+	if !client.Attr().JID.Equal(jid) {
+		t.Fatalf("client told it's %q, bound %q", client.Attr().JID.String(), jid.String())
+	}
+	// the login is done in the authentication, bind isn't offered after it
+	if !bind.Handled() || len(client.ServerFeatures()) != 0 {
+		t.Fatalf("bind should be done inline, offered %d features after", len(client.ServerFeatures()))
+	}
+}
@@ -2,7 +2,6 @@ package xmppcore
 
 import (
 	"errors"
-	"strings"
 
 	"github.com/jackal-xmpp/stravaganza/v2"
 )
@@ -56,24 +55,24 @@ type ResourceBinder interface {
 }
 
 const (
-	NSBind   = "urn:ietf:params:xml:ns:xmpp-bind"
-	NSStanza = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	NSBind = "urn:ietf:params:xml:ns:xmpp-bind"
+)
 
-	BEResourceConstraint = "wait: resource constraint"
-	BENotAllowed         = "cancel: not allowed"
+// errors a ResourceBinder returns, rfc6120 7.6.2
+var (
+	BEResourceConstraint = NewErr(ECResourceConstraint, "")
+	BENotAllowed         = NewErr(ECNotAllowed, "")
+	BEConflict           = NewErr(ECConflict, "")
 )
 
 func BindErrFromError(id string, err error) StanzaErr {
-	ss := strings.Split(err.Error(), ":")
-	errTag := strings.Trim(ss[1], " ")
 	return StanzaErr{
 		Stanza: Stanza{
+			Name: NameIQ,
 			ID:   id,
 			Type: TypeError,
-		}, Err: Err{
-			Type: ss[0],
-			Desc: []ErrDesc{{Tag: errTag, Xmlns: NSStanza}},
 		},
+		Err: ErrFromError(err),
 	}
 }
 
@@ -112,10 +111,16 @@ func (bf *bindFeature) Handle(elem stravaganza.Element, part Part) (cached bool,
 		return false, nil
 	}
 	bf.handled = true
-	rsc, err := bf.rsb.BindResource(part, bf.ib.Resource)
+	rsc := bf.ib.Resource
+	if rsc != "" {
+		if rsc, err = PrepResourcepart(rsc); err != nil {
+			SendErrReply(part, elem, err)
+			return
+		}
+	}
+	rsc, err = bf.rsb.BindResource(part, rsc)
 	if err != nil {
-		BindErrFromError(bf.ib.IQ.ID, err).ToElem(&elem)
-		part.Channel().SendElement(elem)
+		SendErrReply(part, elem, err)
 		return
 	}
 	IqBind{IQ: Stanza{
@@ -0,0 +1,736 @@
+package xmppcore
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+const (
+	NSHttpBind = "http://jabber.org/protocol/httpbind"
+	NSXBosh    = "urn:xmpp:xbosh"
+
+	boshVersion = "1.11"
+)
+
+// xep-0124 17.2, the conditions of terminating a session
+const (
+	BoshBadRequest         = "bad-request"
+	BoshHostGone           = "host-gone"
+	BoshItemNotFound       = "item-not-found"
+	BoshPolicyViolation    = "policy-violation"
+	BoshRemoteStreamError  = "remote-stream-error"
+	BoshSystemShutdown     = "system-shutdown"
+	BoshUndefinedCondition = "undefined-condition"
+)
+
+var (
+	ErrBoshNotBody = errors.New("not a bosh body")
+)
+
+// BoshConfig bounds what a client may ask for a session
+type BoshConfig struct {
+	// MaxWait is the longest time a request is held
+	MaxWait time.Duration
+	// MaxHold is the max number of requests held at once
+	MaxHold int
+	// Inactivity is how long a session lives without any request
+	Inactivity time.Duration
+	// Polling is the shortest interval of empty requests when no request is held
+	Polling time.Duration
+	// MaxBodySize is the max size of a request body
+	MaxBodySize int
+}
+
+var DefaultBoshConfig = BoshConfig{
+	MaxWait:     time.Second * 60,
+	MaxHold:     1,
+	Inactivity:  time.Second * 60,
+	Polling:     time.Second * 2,
+	MaxBodySize: 64 * 1024,
+}
+
+// BoshConnGrabber serves xep-0124 sessions, each one is grabbed as a BoshConn, over which
+// the stream is framed as xep-0206 defines
+type BoshConnGrabber struct {
+	listenOn string
+	path     string
+	logger   StructuredLogger
+	conf     BoshConfig
+
+	certFile, keyFile string
+	certs             *CertStore
+	admission         *Admission
+
+	sessions map[string]*BoshConn
+	mu       sync.Mutex
+	quit     chan struct{}
+	quitOnce sync.Once
+	// the sessions being handed to connChan, it's closed once they're all handed
+	handoffs sync.WaitGroup
+	sweeping sync.Once
+	srv      *http.Server
+}
+
+func NewBoshConnGrabber(listenOn, path string, logger Logger) *BoshConnGrabber {
+	return &BoshConnGrabber{
+		listenOn: listenOn,
+		path:     path,
+		logger:   listenerLogger(logger, listenOn),
+		conf:     DefaultBoshConfig,
+		sessions: map[string]*BoshConn{},
+		quit:     make(chan struct{}),
+	}
+}
+
+func (bg *BoshConnGrabber) SetConfig(conf BoshConfig) {
+	bg.conf = conf
+}
+
+func (bg *BoshConnGrabber) UpgradeToTls(certFile, keyFile string) error {
+	if bg.srv != nil {
+		return errors.New("can't update to tls within grabbing")
+	}
+	bg.certFile = certFile
+	bg.keyFile = keyFile
+	return nil
+}
+
+// UseCertStore serves over tls with certificates picked from the store by sni
+func (bg *BoshConnGrabber) UseCertStore(certs *CertStore) error {
+	if bg.srv != nil {
+		return errors.New("can't update to tls within grabbing")
+	}
+	bg.certs = certs
+	return nil
+}
+
+// UseAdmission admits a session by the admission, which holds its place until it's over
+func (bg *BoshConnGrabber) UseAdmission(admission *Admission) error {
+	if bg.srv != nil {
+		return errors.New("can't use admission within grabbing")
+	}
+	bg.admission = admission
+	return nil
+}
+
+func (bg *BoshConnGrabber) isTls() bool {
+	return bg.certs != nil || bg.certFile != "" && bg.keyFile != ""
+}
+
+func (bg *BoshConnGrabber) Grab(connChan chan Conn) error {
+	var certs *CertStore
+	if bg.isTls() {
+		var err error
+		if certs, err = grabberCerts(bg.certs, bg.certFile, bg.keyFile); err != nil {
+			return err
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle(bg.path, bg.Handler(connChan))
+	bg.srv = &http.Server{Handler: mux, Addr: bg.listenOn}
+	go func() {
+		bg.logger.Log(LogInfo, "bosh connection listen for C2S")
+		if err := serveHttp(bg.srv, certs, ClientCertPolicy{}); err != nil && err != http.ErrServerClosed {
+			bg.logger.Log(LogInfo, "bosh server close unexpected", Field(LogKeyErr, err))
+		}
+		// no session is created once cancelled, connChan is closed after the ones created
+		// before are handed
+		<-bg.quit
+		bg.handoffs.Wait()
+		close(connChan)
+	}()
+	return nil
+}
+
+func (bg *BoshConnGrabber) Cancel() {
+	bg.mu.Lock()
+	bg.quitOnce.Do(func() {
+		close(bg.quit)
+	})
+	for _, s := range bg.sessions {
+		s.terminate(BoshSystemShutdown)
+	}
+	bg.mu.Unlock()
+	if bg.srv != nil {
+		bg.srv.Shutdown(context.Background())
+	}
+}
+
+func (bg *BoshConnGrabber) For() ConnFor {
+	return ForC2S
+}
+
+func (bg *BoshConnGrabber) Type() ConnType {
+	if bg.isTls() {
+		return BOSHTLSConn
+	}
+	return BOSHConn
+}
+
+// Handler serves the requests of sessions, a new session is sent to connChan
+func (bg *BoshConnGrabber) Handler(connChan chan Conn) http.Handler {
+	bg.sweeping.Do(func() {
+		go bg.sweep()
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		if r.Method == http.MethodOptions {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "bosh requires post", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		body, err := parseBoshBody(r.Body, bg.conf.MaxBodySize)
+		if err != nil {
+			w.Write(terminateBody(BoshBadRequest))
+			return
+		}
+		sid := body.Attribute("sid")
+		if sid == "" {
+			w.Write(bg.create(body, r, connChan))
+			return
+		}
+		bg.mu.Lock()
+		s, ok := bg.sessions[sid]
+		bg.mu.Unlock()
+		if !ok {
+			w.Write(terminateBody(BoshItemNotFound))
+			return
+		}
+		w.Write(s.handle(body))
+	})
+}
+
+func (bg *BoshConnGrabber) create(body stravaganza.Element, r *http.Request, connChan chan Conn) []byte {
+	rid, err := strconv.ParseInt(body.Attribute("rid"), 10, 64)
+	if err != nil || body.Attribute("to") == "" {
+		return terminateBody(BoshBadRequest)
+	}
+	release := func() {}
+	if bg.admission != nil {
+		if release, err = bg.admission.AdmitIP(addrIP(r.RemoteAddr)); err != nil {
+			return terminateBody(BoshPolicyViolation)
+		}
+	}
+	s := newBoshConn(bg.conf, body, rid, r)
+	s.onTerminated = func() {
+		release()
+		bg.mu.Lock()
+		delete(bg.sessions, s.sid)
+		bg.mu.Unlock()
+	}
+	bg.mu.Lock()
+	select {
+	case <-bg.quit:
+		bg.mu.Unlock()
+		release()
+		return terminateBody(BoshSystemShutdown)
+	default:
+	}
+	bg.handoffs.Add(1)
+	defer bg.handoffs.Done()
+	bg.sessions[s.sid] = s
+	bg.mu.Unlock()
+	bg.logger.Log(LogInfo, "comming a bosh session", Field(LogKeyRemote, s.remoteAddr.String()), Field("sid", s.sid))
+	select {
+	case connChan <- s:
+	case <-bg.quit:
+		s.terminate(BoshSystemShutdown)
+	}
+	return s.created(rid)
+}
+
+// sweep terminates the sessions inactive for too long
+func (bg *BoshConnGrabber) sweep() {
+	tick := bg.conf.Inactivity / 4
+	if tick <= 0 || tick > time.Second {
+		tick = time.Second
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bg.quit:
+			return
+		case now := <-ticker.C:
+			bg.mu.Lock()
+			sessions := make([]*BoshConn, 0, len(bg.sessions))
+			for _, s := range bg.sessions {
+				sessions = append(sessions, s)
+			}
+			bg.mu.Unlock()
+			for _, s := range sessions {
+				if s.inactive(now) {
+					s.terminate("")
+				}
+			}
+		}
+	}
+}
+
+func parseBoshBody(r io.Reader, maxSize int) (stravaganza.Element, error) {
+	p := NewFastParser(io.LimitReader(r, int64(maxSize)+1), maxSize)
+	defer p.Release()
+	for {
+		i, err := p.Next()
+		if err != nil {
+			return nil, err
+		}
+		if elem, ok := i.(stravaganza.Element); ok {
+			if elem.Name() != "body" || elem.Attribute("xmlns") != NSHttpBind {
+				return nil, ErrBoshNotBody
+			}
+			return elem, nil
+		}
+	}
+}
+
+func terminateBody(condition string) []byte {
+	return []byte(`<body xmlns="` + NSHttpBind + `" type="terminate" condition="` + condition + `"/>`)
+}
+
+type boshAddr string
+
+func (addr boshAddr) Network() string {
+	return "bosh"
+}
+
+func (addr boshAddr) String() string {
+	return string(addr)
+}
+
+// BoshConn is a bosh session. the payloads of the requests are read in the order of rid,
+// and the elements written are delivered by the requests held. the part reads an open
+// element when the session is created or restarted, and a close element when the client
+// terminates it
+type BoshConn struct {
+	sid        string
+	wait       time.Duration
+	hold       int
+	requests   int64
+	inactivity time.Duration
+	polling    time.Duration
+	to         string
+	remoteAddr net.Addr
+	localAddr  net.Addr
+
+	mu sync.Mutex
+	// wakes the requests waiting their turn or data to deliver
+	cond         *sync.Cond
+	in           bytes.Buffer
+	inNotify     chan struct{}
+	readDeadline time.Time
+	framer       elemFramer
+	out          [][]byte
+	streamID     string
+	streamErr    bool
+	// the part closed its stream, or the session is over
+	terminated bool
+	condition  string
+	closed     bool
+	nextRid    int64
+	// the requests with rid up to releaseRid return at once, so that no more than hold
+	// requests are held
+	releaseRid int64
+	held       int
+	lastActive time.Time
+	lastEmpty  time.Time
+	responses  map[int64][]byte
+
+	onTerminated func()
+	terminateOne sync.Once
+}
+
+func newBoshConn(conf BoshConfig, body stravaganza.Element, rid int64, r *http.Request) *BoshConn {
+	s := &BoshConn{
+		sid:        uuid.New().String(),
+		wait:       conf.MaxWait,
+		hold:       conf.MaxHold,
+		inactivity: conf.Inactivity,
+		polling:    conf.Polling,
+		to:         body.Attribute("to"),
+		remoteAddr: boshAddr(r.RemoteAddr),
+		localAddr:  boshAddr(r.Host),
+		inNotify:   make(chan struct{}, 1),
+		nextRid:    rid + 1,
+		lastActive: time.Now(),
+		responses:  map[int64][]byte{},
+	}
+	s.cond = sync.NewCond(&s.mu)
+	if wait, err := strconv.Atoi(body.Attribute("wait")); err == nil && wait >= 0 && time.Duration(wait)*time.Second < s.wait {
+		s.wait = time.Duration(wait) * time.Second
+	}
+	if hold, err := strconv.Atoi(body.Attribute("hold")); err == nil && hold >= 0 && hold < s.hold {
+		s.hold = hold
+	}
+	s.requests = int64(s.hold) + 1
+	var open stravaganza.Element
+	boshOpenElement(body, &open)
+	WriteElement(&s.in, open)
+	return s
+}
+
+// boshOpenElement makes the open element the part reads from a body creating or
+// restarting the session
+func boshOpenElement(body stravaganza.Element, open *stravaganza.Element) {
+	b := stravaganza.NewBuilder("open").
+		WithAttribute("xmlns", NSFraming).
+		WithAttribute("to", body.Attribute("to")).
+		WithAttribute("version", "1.0")
+	if lang := body.Attribute("xml:lang"); lang != "" {
+		b.WithAttribute("xml:lang", lang)
+	}
+	if from := body.Attribute("from"); from != "" {
+		b.WithAttribute("from", from)
+	}
+	*open = b.Build()
+}
+
+func (s *BoshConn) framed() bool {
+	return true
+}
+
+// created waits the header and the features of the part, which make the response of
+// the request creating the session
+func (s *BoshConn) created(rid int64) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held++
+	s.waitUntil(time.Now().Add(s.wait), func() bool {
+		return s.streamID != "" && len(s.out) > 0 || s.terminated
+	})
+	s.held--
+	s.lastActive = time.Now()
+	attrs := []xml.Attr{
+		{Name: xml.Name{Local: "sid"}, Value: s.sid},
+		{Name: xml.Name{Local: "wait"}, Value: strconv.Itoa(int(s.wait / time.Second))},
+		{Name: xml.Name{Local: "hold"}, Value: strconv.Itoa(s.hold)},
+		{Name: xml.Name{Local: "requests"}, Value: strconv.FormatInt(s.requests, 10)},
+		{Name: xml.Name{Local: "inactivity"}, Value: strconv.Itoa(int(s.inactivity / time.Second))},
+		{Name: xml.Name{Local: "polling"}, Value: strconv.Itoa(int(s.polling / time.Second))},
+		{Name: xml.Name{Local: "ver"}, Value: boshVersion},
+		{Name: xml.Name{Local: "from"}, Value: s.to},
+		{Name: xml.Name{Local: "authid"}, Value: s.streamID},
+		{Name: xml.Name{Local: "xmlns:xmpp"}, Value: NSXBosh},
+		{Name: xml.Name{Local: "xmpp:version"}, Value: "1.0"},
+		{Name: xml.Name{Local: "xmpp:restartlogic"}, Value: "true"},
+	}
+	resp := s.response(attrs)
+	s.responses[rid] = resp
+	return resp
+}
+
+// handle takes the payload of a request in the order of rid, and holds the request
+// until there's something to deliver
+func (s *BoshConn) handle(body stravaganza.Element) []byte {
+	rid, err := strconv.ParseInt(body.Attribute("rid"), 10, 64)
+	if err != nil {
+		s.terminate(BoshBadRequest)
+		return terminateBody(BoshBadRequest)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActive = time.Now()
+	if resp, ok := s.responses[rid]; ok {
+		// the response is lost, the client sends the request again
+		return resp
+	}
+	if rid < s.nextRid || rid >= s.nextRid+s.requests {
+		s.terminateLocked(BoshItemNotFound)
+		return terminateBody(BoshItemNotFound)
+	}
+	deadline := time.Now().Add(s.wait)
+	s.held++
+	// the requests before it are handled first
+	s.waitUntil(deadline, func() bool {
+		return rid == s.nextRid || s.terminated
+	})
+	s.held--
+	if rid != s.nextRid {
+		if !s.terminated {
+			s.terminateLocked(BoshItemNotFound)
+		}
+		return s.response(nil)
+	}
+	s.nextRid++
+	s.releaseRid = rid - int64(s.hold)
+	s.cond.Broadcast()
+
+	payload := body.AllChildren()
+	arrived := time.Now()
+	empty := len(payload) == 0 && body.Attribute("xmpp:restart") != "true" && body.Attribute("type") != "terminate"
+	if empty && s.held == 0 && !s.lastEmpty.IsZero() && arrived.Sub(s.lastEmpty) < s.polling {
+		// xep-0124 12, polling faster than allowed
+		s.terminateLocked(BoshPolicyViolation)
+		return s.response(nil)
+	}
+	for _, elem := range payload {
+		WriteElement(&s.in, elem)
+	}
+	if body.Attribute("xmpp:restart") == "true" {
+		var open stravaganza.Element
+		boshOpenElement(body, &open)
+		WriteElement(&s.in, open)
+	}
+	if body.Attribute("type") == "terminate" {
+		s.in.WriteString(`<close xmlns="` + NSFraming + `"/>`)
+	}
+	s.notifyReader()
+	s.held++
+	if body.Attribute("type") == "terminate" {
+		// the part closes its stream in turn
+		s.waitUntil(deadline, func() bool {
+			return s.terminated
+		})
+	} else if s.hold > 0 {
+		s.waitUntil(deadline, func() bool {
+			return len(s.out) > 0 || s.terminated || rid <= s.releaseRid
+		})
+	}
+	s.held--
+	s.lastActive = time.Now()
+	// an empty exchange counts for polling
+	s.lastEmpty = time.Time{}
+	if empty && len(s.out) == 0 && !s.terminated {
+		s.lastEmpty = arrived
+	}
+	var attrs []xml.Attr
+	if rid < s.nextRid-1 {
+		// xep-0124 9.1, a later request is handled already
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "ack"}, Value: strconv.FormatInt(s.nextRid-1, 10)})
+	}
+	resp := s.response(attrs)
+	s.responses[rid] = resp
+	delete(s.responses, rid-s.requests)
+	return resp
+}
+
+// waitUntil waits ok or the deadline, s.mu must be locked
+func (s *BoshConn) waitUntil(deadline time.Time, ok func() bool) {
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.cond.Broadcast()
+	})
+	defer timer.Stop()
+	for !ok() && time.Now().Before(deadline) {
+		s.cond.Wait()
+	}
+}
+
+// response takes what's to deliver, s.mu must be locked
+func (s *BoshConn) response(attrs []xml.Attr) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`<body xmlns="` + NSHttpBind + `"`)
+	for _, attr := range attrs {
+		buf.WriteString(" " + attr.Name.Local + `="`)
+		escapeXML(&buf, attr.Value, true)
+		buf.WriteByte('"')
+	}
+	if s.terminated {
+		buf.WriteString(` type="terminate"`)
+		if s.condition != "" {
+			buf.WriteString(` condition="` + s.condition + `"`)
+		}
+		s.finish()
+	}
+	if len(s.out) == 0 {
+		buf.WriteString("/>")
+		return buf.Bytes()
+	}
+	buf.WriteByte('>')
+	for _, frame := range s.out {
+		buf.Write(frame)
+	}
+	s.out = s.out[:0]
+	buf.WriteString("</body>")
+	return buf.Bytes()
+}
+
+func (s *BoshConn) inactive(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.held == 0 && now.Sub(s.lastActive) > s.inactivity
+}
+
+func (s *BoshConn) terminate(condition string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.terminateLocked(condition)
+}
+
+// terminateLocked ends the session, the part reads the end of the conn. the requests held
+// return with the terminate body
+func (s *BoshConn) terminateLocked(condition string) {
+	if !s.terminated {
+		s.terminated = true
+		s.condition = condition
+	}
+	s.closed = true
+	s.cond.Broadcast()
+	s.notifyReader()
+	if s.held == 0 {
+		s.finish()
+	}
+}
+
+// finish forgets the session once the client is told it's terminated
+func (s *BoshConn) finish() {
+	s.closed = true
+	s.notifyReader()
+	s.terminateOne.Do(func() {
+		if s.onTerminated != nil {
+			go s.onTerminated()
+		}
+	})
+}
+
+func (s *BoshConn) notifyReader() {
+	select {
+	case s.inNotify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *BoshConn) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.in.Len() > 0 {
+			n, _ := s.in.Read(b)
+			s.mu.Unlock()
+			return n, nil
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		var deadline <-chan time.Time
+		var timer *time.Timer
+		if !s.readDeadline.IsZero() {
+			timer = time.NewTimer(time.Until(s.readDeadline))
+			deadline = timer.C
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.inNotify:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-deadline:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Write delivers the elements to the client. the open element gives the stream id, the
+// close element terminates the session, whitespace keepalives are useless over bosh
+func (s *BoshConn) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	s.framer.write(b, func(frame []byte) error {
+		switch {
+		case isXMLSpace(frame):
+		case bytes.HasPrefix(frame, []byte("<open")):
+			var header xml.StartElement
+			if t, err := xml.NewDecoder(bytes.NewReader(frame)).Token(); err == nil {
+				header, _ = t.(xml.StartElement)
+			}
+			for _, attr := range header.Attr {
+				if attr.Name.Local == "id" {
+					s.streamID = attr.Value
+				}
+			}
+		case bytes.HasPrefix(frame, []byte("<close")):
+			if s.streamErr {
+				s.terminated, s.condition = true, BoshRemoteStreamError
+			} else {
+				s.terminated = true
+			}
+		default:
+			if bytes.HasPrefix(frame, []byte("<error")) && bytes.Contains(frame, []byte(NSStream)) {
+				s.streamErr = true
+			}
+			s.out = append(s.out, append([]byte{}, frame...))
+		}
+		return nil
+	})
+	s.cond.Broadcast()
+	return len(b), nil
+}
+
+// Close terminates the session, the requests held are told
+func (s *BoshConn) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.terminated {
+		// the stream is broken without its close element
+		s.terminateLocked(BoshUndefinedCondition)
+		return nil
+	}
+	s.closed = true
+	s.cond.Broadcast()
+	s.notifyReader()
+	if s.held == 0 && len(s.out) == 0 {
+		s.finish()
+	}
+	return nil
+}
+
+func (s *BoshConn) SID() string {
+	return s.sid
+}
+
+func (s *BoshConn) LocalAddr() net.Addr {
+	return s.localAddr
+}
+
+func (s *BoshConn) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+func (s *BoshConn) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+func (s *BoshConn) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline = t
+	s.notifyReader()
+	return nil
+}
+
+// SetWriteDeadline does nothing, writing never blocks
+func (s *BoshConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// StartTLS does nothing, https secures the requests
+func (s *BoshConn) StartTLS(*tls.Config) {}
+
+// StartCompress does nothing, the requests may be compressed by http
+func (s *BoshConn) StartCompress(BuildCompressor) {}
+
+// BindTlsUnique is not supported, the requests of a session may come from many tls conns
+func (s *BoshConn) BindTlsUnique(io.Writer) error {
+	return ErrBindTlsUniqueNotSupported
+}
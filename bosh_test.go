@@ -0,0 +1,221 @@
+package xmppcore
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+// serveTestBosh runs a part for each session of the server returned
+func serveTestBosh(t *testing.T, conf BoshConfig) (*httptest.Server, *BoshConnGrabber, chan *XPart) {
+	grabber := NewBoshConnGrabber(":0", "/http-bind", NewLogger(io.Discard))
+	grabber.SetConfig(conf)
+	conns := make(chan Conn)
+	parts := make(chan *XPart, 4)
+	srv := httptest.NewServer(grabber.Handler(conns))
+	go func() {
+		for conn := range conns {
+			part := NewXPart(conn, "hello-world.im", NewLogger(io.Discard))
+			part.EnableLiveness(LivenessConfig{})
+			part.Run()
+			parts <- part
+		}
+	}()
+	t.Cleanup(func() {
+		srv.Close()
+		grabber.Cancel()
+	})
+	return srv, grabber, parts
+}
+
+func doTestPost(srv *httptest.Server, body string) (stravaganza.Element, error) {
+	resp, err := http.Post(srv.URL, "text/xml; charset=utf-8", strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return parseBoshBody(resp.Body, 1024*1024)
+}
+
+func postTestBody(t *testing.T, srv *httptest.Server, body string) stravaganza.Element {
+	elem, err := doTestPost(srv, body)
+	if err != nil {
+		t.Fatalf("post body error: %s", err.Error())
+	}
+	return elem
+}
+
+func createTestBoshSession(t *testing.T, srv *httptest.Server, hold, wait string) stravaganza.Element {
+	body := postTestBody(t, srv, `<body rid="100" to="hello-world.im" wait="`+wait+`" hold="`+hold+`" xml:lang="en" `+
+		`ver="1.11" xmpp:version="1.0" xmlns:xmpp="urn:xmpp:xbosh" xmlns="http://jabber.org/protocol/httpbind"/>`)
+	if body.Attribute("sid") == "" || body.Attribute("type") == "terminate" {
+		t.Fatalf("create session error: %s", body.GoString())
+	}
+	return body
+}
+
+func testBody(sid, rid, attrs, payload string) string {
+	return `<body rid="` + rid + `" sid="` + sid + `" ` + attrs + ` xmlns:xmpp="urn:xmpp:xbosh" xmlns="http://jabber.org/protocol/httpbind">` +
+		payload + `</body>`
+}
+
+func TestBoshSession(t *testing.T) {
+	srv, _, parts := serveTestBosh(t, DefaultBoshConfig)
+	created := createTestBoshSession(t, srv, "1", "1")
+	sid := created.Attribute("sid")
+	if created.Attribute("authid") == "" || created.Attribute("requests") != "2" || created.Attribute("wait") != "1" ||
+		created.Child("features") == nil || created.Child("features").Attribute("xmlns") != NSStream {
+		t.Fatalf("session creation response error: %s", created.GoString())
+	}
+	ping := `<iq xmlns="jabber:client" type="get" id="b1"><ping xmlns="urn:xmpp:ping"/></iq>`
+	pong := postTestBody(t, srv, testBody(sid, "101", "", ping))
+	if iq := pong.Child("iq"); iq == nil || iq.Attribute("id") != "b1" || iq.Attribute("type") != "result" {
+		t.Fatalf("pong response error: %s", pong.GoString())
+	}
+	if again := postTestBody(t, srv, testBody(sid, "101", "", ping)); again.GoString() != pong.GoString() {
+		t.Fatalf("a request sent again should get the same response: %s", again.GoString())
+	}
+	began := time.Now()
+	if empty := postTestBody(t, srv, testBody(sid, "102", "", "")); empty.ChildrenCount() != 0 || time.Since(began) < time.Millisecond*500 {
+		t.Fatalf("an empty request should be held until wait: %s", empty.GoString())
+	}
+	restarted := postTestBody(t, srv, testBody(sid, "103", `xmpp:restart="true" to="hello-world.im"`, ""))
+	if restarted.Child("features") == nil {
+		t.Fatalf("restart response error: %s", restarted.GoString())
+	}
+	if terminated := postTestBody(t, srv, testBody(sid, "104", `type="terminate"`, "")); terminated.Attribute("type") != "terminate" {
+		t.Fatalf("terminate response error: %s", terminated.GoString())
+	}
+	part := <-parts
+	waitTestClosed(t, part.Closed(), time.Second)
+	if err := part.Channel().Err(); err != nil {
+		t.Fatalf("terminated session should close the stream gracefully, got %s", err.Error())
+	}
+	gone := postTestBody(t, srv, testBody(sid, "105", "", ""))
+	if gone.Attribute("type") != "terminate" || gone.Attribute("condition") != BoshItemNotFound {
+		t.Fatalf("terminated session should be gone: %s", gone.GoString())
+	}
+}
+
+func TestBoshHoldRelease(t *testing.T) {
+	srv, _, _ := serveTestBosh(t, DefaultBoshConfig)
+	sid := createTestBoshSession(t, srv, "1", "2").Attribute("sid")
+	released := make(chan time.Time, 1)
+	go func() {
+		doTestPost(srv, testBody(sid, "101", "", ""))
+		released <- time.Now()
+	}()
+	time.Sleep(time.Millisecond * 100)
+	sent := time.Now()
+	go doTestPost(srv, testBody(sid, "102", "", ""))
+	select {
+	case at := <-released:
+		if at.Sub(sent) > time.Millisecond*500 {
+			t.Fatalf("the held request should be released by the next one")
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatalf("the held request should be released by the next one")
+	}
+}
+
+func TestBoshRidWindow(t *testing.T) {
+	srv, _, parts := serveTestBosh(t, DefaultBoshConfig)
+	sid := createTestBoshSession(t, srv, "1", "1").Attribute("sid")
+	body := postTestBody(t, srv, testBody(sid, "110", "", ""))
+	if body.Attribute("type") != "terminate" || body.Attribute("condition") != BoshItemNotFound {
+		t.Fatalf("rid out of the window should terminate the session: %s", body.GoString())
+	}
+	waitTestClosed(t, (<-parts).Closed(), time.Second*3)
+}
+
+func TestBoshPolling(t *testing.T) {
+	conf := DefaultBoshConfig
+	conf.Polling = time.Second
+	srv, _, _ := serveTestBosh(t, conf)
+	sid := createTestBoshSession(t, srv, "0", "1").Attribute("sid")
+	if body := postTestBody(t, srv, testBody(sid, "101", "", "")); body.Attribute("type") == "terminate" {
+		t.Fatalf("first poll should be answered: %s", body.GoString())
+	}
+	body := postTestBody(t, srv, testBody(sid, "102", "", ""))
+	if body.Attribute("type") != "terminate" || body.Attribute("condition") != BoshPolicyViolation {
+		t.Fatalf("polling too fast should terminate the session: %s", body.GoString())
+	}
+}
+
+func TestBoshInactivity(t *testing.T) {
+	conf := DefaultBoshConfig
+	conf.Inactivity = time.Millisecond * 200
+	srv, _, parts := serveTestBosh(t, conf)
+	sid := createTestBoshSession(t, srv, "1", "1").Attribute("sid")
+	waitTestClosed(t, (<-parts).Closed(), time.Second*3)
+	body := postTestBody(t, srv, testBody(sid, "101", "", ""))
+	if body.Attribute("type") != "terminate" || body.Attribute("condition") != BoshItemNotFound {
+		t.Fatalf("inactive session should be gone: %s", body.GoString())
+	}
+}
+
+func TestBoshGrabberCancel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %s", err.Error())
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	grabber := NewBoshConnGrabber(addr, "/http-bind", NewLogger(io.Discard))
+	// nobody takes the sessions, their creation is in flight when cancelled
+	conns := make(chan Conn)
+	if err := grabber.Grab(conns); err != nil {
+		t.Fatalf("grab error: %s", err.Error())
+	}
+	created := make(chan stravaganza.Element, 1)
+	go func() {
+		for {
+			resp, err := http.Post("http://"+addr+"/http-bind", "text/xml; charset=utf-8", strings.NewReader(
+				`<body rid="100" to="hello-world.im" wait="1" hold="1" ver="1.11" xmpp:version="1.0" `+
+					`xmlns:xmpp="urn:xmpp:xbosh" xmlns="http://jabber.org/protocol/httpbind"/>`))
+			if err != nil {
+				time.Sleep(time.Millisecond * 10)
+				continue
+			}
+			body, _ := parseBoshBody(resp.Body, 1024*1024)
+			resp.Body.Close()
+			created <- body
+			return
+		}
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		grabber.mu.Lock()
+		n := len(grabber.sessions)
+		grabber.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session should be in creation")
+		}
+	}
+	grabber.Cancel()
+	grabber.Cancel()
+	select {
+	case body := <-created:
+		if body == nil || body.Attribute("type") != "terminate" || body.Attribute("condition") != BoshSystemShutdown {
+			t.Fatalf("session in creation should be terminated: %v", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("session creation should return once cancelled")
+	}
+	select {
+	case _, ok := <-conns:
+		if ok {
+			t.Fatalf("no session should be handed once cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("conn chan should be closed once cancelled")
+	}
+}
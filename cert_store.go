@@ -0,0 +1,405 @@
+package xmppcore
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// xep-0368 alpn protocol ids
+const (
+	ALPNClient = "xmpp-client"
+	ALPNServer = "xmpp-server"
+)
+
+var (
+	ErrNoCertificate      = errors.New("no certificate")
+	ErrCertificateNoName  = errors.New("certificate without any dns name")
+	ErrCertificateExpired = errors.New("certificate expired")
+)
+
+// CertExpiry tells when the certificate of names lapses
+type CertExpiry struct {
+	Names    []string
+	NotAfter time.Time
+}
+
+type certFilePair struct {
+	certFile, keyFile string
+}
+
+// CertStore keeps certificates by the dns names they're issued for, so one tls listener
+// serves many domains, each handshake gets the certificate matching its sni hostname.
+// certificates added from files are reloaded by Reload, Watch or ReloadOn, a reload swaps
+// all of them at once, and only if every pair loads and is valid
+type CertStore struct {
+	certs map[string]*tls.Certificate
+	// the first certificate added, for handshakes without sni or with an unknown one
+	def *tls.Certificate
+	// what's reloaded, certificates added directly are kept as they are
+	added    []tls.Certificate
+	pairs    []certFilePair
+	modTimes map[string]time.Time
+	mu       sync.RWMutex
+	reloadMu sync.Mutex
+
+	expiring   time.Duration
+	onExpiring func(CertExpiry)
+	// fingerprints of the certificates reported, a reload parses them again
+	notified map[[sha256.Size]byte]bool
+
+	logger   StructuredLogger
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewCertStore() *CertStore {
+	return &CertStore{
+		certs:    make(map[string]*tls.Certificate),
+		modTimes: make(map[string]time.Time),
+		notified: make(map[[sha256.Size]byte]bool),
+		logger:   NewLogger(io.Discard).Sub(LogSubCerts),
+		quit:     make(chan struct{})}
+}
+
+func (cs *CertStore) SetLogger(logger Logger) {
+	cs.logger = Structured(logger).Sub(LogSubCerts)
+}
+
+// Add adds a certificate under the names of its leaf, a name already there is replaced
+func (cs *CertStore) Add(cert tls.Certificate) error {
+	if err := validateCert(&cert); err != nil {
+		return err
+	}
+	cs.reloadMu.Lock()
+	defer cs.reloadMu.Unlock()
+	cs.mu.Lock()
+	cs.added = append(cs.added, cert)
+	cs.put(&cert)
+	cs.mu.Unlock()
+	cs.checkExpiry()
+	return nil
+}
+
+// AddFile adds a certificate which is reloaded from the files, a pair added twice is
+// loaded once
+func (cs *CertStore) AddFile(certFile, keyFile string) error {
+	pair := certFilePair{certFile, keyFile}
+	cs.mu.RLock()
+	for _, p := range cs.pairs {
+		if p == pair {
+			cs.mu.RUnlock()
+			return nil
+		}
+	}
+	cs.mu.RUnlock()
+	cert, err := loadCertPair(pair)
+	if err != nil {
+		return err
+	}
+	cs.reloadMu.Lock()
+	defer cs.reloadMu.Unlock()
+	cs.mu.Lock()
+	cs.pairs = append(cs.pairs, pair)
+	cs.put(cert)
+	cs.mu.Unlock()
+	cs.modTimes[certFile] = modTime(certFile)
+	cs.modTimes[keyFile] = modTime(keyFile)
+	cs.checkExpiry()
+	return nil
+}
+
+// Reload loads the certificate files again, the store is left as it is if any of them
+// fails, so a handshake never sees a half written pair
+func (cs *CertStore) Reload() error {
+	cs.reloadMu.Lock()
+	defer cs.reloadMu.Unlock()
+	return cs.reload()
+}
+
+func (cs *CertStore) reload() error {
+	cs.mu.RLock()
+	pairs := append([]certFilePair{}, cs.pairs...)
+	cs.mu.RUnlock()
+	loaded := make([]*tls.Certificate, 0, len(pairs))
+	modTimes := make(map[string]time.Time)
+	for _, pair := range pairs {
+		cert, err := loadCertPair(pair)
+		if err != nil {
+			cs.logger.Log(LogError, "reload certificate error", Field("cert", pair.certFile), Field(LogKeyErr, err))
+			return err
+		}
+		loaded = append(loaded, cert)
+		modTimes[pair.certFile] = modTime(pair.certFile)
+		modTimes[pair.keyFile] = modTime(pair.keyFile)
+	}
+	cs.mu.Lock()
+	cs.certs = make(map[string]*tls.Certificate)
+	cs.def = nil
+	for i := range cs.added {
+		cs.put(&cs.added[i])
+	}
+	for _, cert := range loaded {
+		cs.put(cert)
+	}
+	cs.mu.Unlock()
+	cs.modTimes = modTimes
+	cs.logger.Log(LogInfo, "certificates reloaded", Field("count", len(loaded)))
+	cs.checkExpiry()
+	return nil
+}
+
+// Watch reloads the store once a certificate file changes, checking every interval
+func (cs *CertStore) Watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cs.quit:
+				return
+			case <-ticker.C:
+				cs.reloadMu.Lock()
+				if cs.changed() {
+					cs.reload()
+				} else {
+					cs.checkExpiry()
+				}
+				cs.reloadMu.Unlock()
+			}
+		}
+	}()
+}
+
+// ReloadOn reloads the store on the signals, a SIGHUP usually
+func (cs *CertStore) ReloadOn(sigs ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-cs.quit:
+				return
+			case <-ch:
+				cs.Reload()
+			}
+		}
+	}()
+}
+
+// Stop stops watching and reloading on signals
+func (cs *CertStore) Stop() {
+	cs.stopOnce.Do(func() {
+		close(cs.quit)
+	})
+}
+
+// OnExpiring calls notify once for each certificate lapsing within the duration, when
+// it's added or reloaded, or found so while watching
+func (cs *CertStore) OnExpiring(within time.Duration, notify func(CertExpiry)) {
+	cs.reloadMu.Lock()
+	defer cs.reloadMu.Unlock()
+	cs.expiring = within
+	cs.onExpiring = notify
+	cs.checkExpiry()
+}
+
+// Expiries returns when each certificate lapses, the earliest first
+func (cs *CertStore) Expiries() []CertExpiry {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	seen := make(map[*tls.Certificate]bool)
+	expiries := []CertExpiry{}
+	for _, cert := range cs.certs {
+		if seen[cert] {
+			continue
+		}
+		seen[cert] = true
+		expiries = append(expiries, CertExpiry{Names: certNames(cert.Leaf), NotAfter: cert.Leaf.NotAfter})
+	}
+	sort.Slice(expiries, func(i, j int) bool {
+		return expiries[i].NotAfter.Before(expiries[j].NotAfter)
+	})
+	return expiries
+}
+
+// checkExpiry is called with reloadMu locked
+func (cs *CertStore) checkExpiry() {
+	cs.mu.RLock()
+	leaves := []*x509.Certificate{}
+	for _, cert := range cs.certs {
+		leaves = append(leaves, cert.Leaf)
+	}
+	cs.mu.RUnlock()
+	deadline := time.Now().Add(cs.expiring)
+	stored := make(map[[sha256.Size]byte]bool, len(leaves))
+	for _, leaf := range leaves {
+		fingerprint := sha256.Sum256(leaf.Raw)
+		stored[fingerprint] = true
+		if cs.notified[fingerprint] || leaf.NotAfter.After(deadline) {
+			continue
+		}
+		cs.notified[fingerprint] = true
+		expiry := CertExpiry{Names: certNames(leaf), NotAfter: leaf.NotAfter}
+		cs.logger.Log(LogWarning, "certificate expiring", Field("names", strings.Join(expiry.Names, ",")),
+			Field("not_after", expiry.NotAfter.Format(time.RFC3339)))
+		if cs.onExpiring != nil {
+			cs.onExpiring(expiry)
+		}
+	}
+	for fingerprint := range cs.notified {
+		if !stored[fingerprint] {
+			delete(cs.notified, fingerprint)
+		}
+	}
+}
+
+// changed is called with reloadMu locked
+func (cs *CertStore) changed() bool {
+	for file, t := range cs.modTimes {
+		if !modTime(file).Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// put is called with mu locked
+func (cs *CertStore) put(cert *tls.Certificate) {
+	for _, name := range certNames(cert.Leaf) {
+		cs.certs[name] = cert
+	}
+	if cs.def == nil {
+		cs.def = cert
+	}
+}
+
+// Certificate finds the certificate of a name, a wildcard one matches the leftmost label
+func (cs *CertStore) Certificate(name string) (*tls.Certificate, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if cert, ok := cs.certs[name]; ok {
+		return cert, true
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := cs.certs["*"+name[i:]]; ok {
+			return cert, true
+		}
+	}
+	return nil, false
+}
+
+// GetCertificate is for tls.Config.GetCertificate
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert, ok := cs.Certificate(hello.ServerName); ok {
+		return cert, nil
+	}
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if cs.def == nil {
+		return nil, ErrNoCertificate
+	}
+	return cs.def, nil
+}
+
+// Domains returns the names there're certificates for
+func (cs *CertStore) Domains() []string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	domains := make([]string, 0, len(cs.certs))
+	for name := range cs.certs {
+		domains = append(domains, name)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// TLSConfig builds a server config picking certificates from the store and negotiating one
+// of the alpn protocols, a client offering none of them fails the handshake
+func (cs *CertStore) TLSConfig(protos ...string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: cs.GetCertificate,
+		NextProtos:     protos,
+		MinVersion:     tls.VersionTLS12}
+}
+
+// ClientCertPolicy asks clients for certificates verified against CAs in the tls
+// handshake, for sasl external. a client without one fails the handshake if it's required
+type ClientCertPolicy struct {
+	CAs      *x509.CertPool
+	Required bool
+}
+
+// apply sets the policy to conf, nothing is asked without CAs
+func (p ClientCertPolicy) apply(conf *tls.Config) *tls.Config {
+	if p.CAs == nil {
+		return conf
+	}
+	conf.ClientCAs = p.CAs
+	conf.ClientAuth = tls.VerifyClientCertIfGiven
+	if p.Required {
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf
+}
+
+func loadCertPair(pair certFilePair) (*tls.Certificate, error) {
+	// the key is checked to match the certificate
+	cert, err := tls.LoadX509KeyPair(pair.certFile, pair.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateCert(&cert); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func validateCert(cert *tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return ErrNoCertificate
+	}
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+	}
+	if len(certNames(cert.Leaf)) == 0 {
+		return ErrCertificateNoName
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return ErrCertificateExpired
+	}
+	return nil
+}
+
+func modTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func certNames(leaf *x509.Certificate) []string {
+	names := []string{}
+	for _, name := range leaf.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = append(names, strings.ToLower(leaf.Subject.CommonName))
+	}
+	return names
+}
@@ -0,0 +1,188 @@
+package xmppcore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate makes a self signed certificate valid for names
+func testCertificate(t *testing.T, notAfter time.Time, names ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key error: %s", err.Error())
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate error: %s", err.Error())
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writeTestCertificate(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("marshal key error: %s", err.Error())
+	}
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+}
+
+func TestCertStore(t *testing.T) {
+	store := NewCertStore()
+	if _, err := store.GetCertificate(&tls.ClientHelloInfo{}); err != ErrNoCertificate {
+		t.Fatalf("empty store should have no certificate")
+	}
+	a := testCertificate(t, time.Now().Add(time.Hour), "a.example")
+	b := testCertificate(t, time.Now().Add(time.Hour), "b.example", "*.b.example")
+	store.Add(a)
+	store.Add(b)
+	for name, expected := range map[string]*tls.Certificate{
+		"a.example":        &a,
+		"B.example.":       &b,
+		"conf.b.example":   &b,
+		"x.conf.b.example": &a,
+		"":                 &a,
+	} {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil || cert.Leaf != expected.Leaf {
+			t.Fatalf("sni %q got the wrong certificate", name)
+		}
+	}
+	if _, ok := store.Certificate("c.example"); ok {
+		t.Fatalf("no certificate for c.example")
+	}
+}
+
+func TestDirectTlsGrabber(t *testing.T) {
+	store := NewCertStore()
+	a := testCertificate(t, time.Now().Add(time.Hour), "a.example")
+	b := testCertificate(t, time.Now().Add(time.Hour), "b.example")
+	store.Add(a)
+	store.Add(b)
+	roots := x509.NewCertPool()
+	roots.AddCert(a.Leaf)
+	roots.AddCert(b.Leaf)
+
+	grabber := NewTcpConnGrabber("127.0.0.1:0", ForC2S, NewLogger(io.Discard))
+	grabber.UpgradeToDirectTls(store, ALPNClient, ALPNServer)
+	conns := make(chan Conn)
+	if err := grabber.Grab(conns); err != nil {
+		t.Fatalf("grab error: %s", err.Error())
+	}
+	defer grabber.Cancel()
+	if grabber.Type() != TLSConn {
+		t.Fatalf("direct tls grabber should grab tls conns")
+	}
+	for _, c := range []struct {
+		sni, alpn string
+		connFor   ConnFor
+	}{{"a.example", ALPNClient, ForC2S}, {"b.example", ALPNServer, ForS2S}} {
+		client, err := tls.Dial("tcp", grabber.ln.Addr().String(), &tls.Config{
+			ServerName: c.sni, NextProtos: []string{c.alpn}, RootCAs: roots})
+		if err != nil {
+			t.Fatalf("dial %s error: %s", c.sni, err.Error())
+		}
+		defer client.Close()
+		select {
+		case conn := <-conns:
+			defer conn.Close()
+			if ConnServerName(conn) != c.sni || ConnALPN(conn) != c.alpn || ConnForALPN(ConnALPN(conn), ForC2S) != c.connFor {
+				t.Fatalf("conn negotiated sni %q alpn %q", ConnServerName(conn), ConnALPN(conn))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("conn of %s not grabbed", c.sni)
+		}
+	}
+	if _, err := tls.Dial("tcp", grabber.ln.Addr().String(), &tls.Config{
+		ServerName: "a.example", NextProtos: []string{"h2"}, RootCAs: roots}); err == nil {
+		t.Fatalf("unknown alpn protocol should fail the handshake")
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	old := testCertificate(t, time.Now().Add(time.Hour*24*365), "a.example")
+	writeTestCertificate(t, old, certFile, keyFile)
+	store := NewCertStore()
+	if err := store.AddFile(certFile, keyFile); err != nil {
+		t.Fatalf("add file error: %s", err.Error())
+	}
+	expiring := make(chan CertExpiry, 4)
+	store.OnExpiring(time.Hour*24*30, func(expiry CertExpiry) {
+		expiring <- expiry
+	})
+	store.Watch(time.Millisecond * 20)
+	defer store.Stop()
+
+	// a cert not matching the key is refused, the old one is kept
+	rotated := testCertificate(t, time.Now().Add(time.Hour*24), "a.example")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rotated.Certificate[0]}), 0600)
+	if err := store.Reload(); err == nil {
+		t.Fatalf("mismatched key pair should not be loaded")
+	}
+	if cert, _ := store.Certificate("a.example"); !cert.Leaf.NotAfter.Equal(old.Leaf.NotAfter) {
+		t.Fatalf("failed reload should keep the old certificate")
+	}
+	writeTestCertificate(t, rotated, certFile, keyFile)
+	select {
+	case expiry := <-expiring:
+		if expiry.Names[0] != "a.example" || !expiry.NotAfter.Equal(rotated.Leaf.NotAfter) {
+			t.Fatalf("expiry of the rotated certificate error: %v", expiry)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("changed files should be reloaded and the expiring certificate reported")
+	}
+	if cert, _ := store.Certificate("a.example"); !cert.Leaf.NotAfter.Equal(rotated.Leaf.NotAfter) {
+		t.Fatalf("changed files should be reloaded")
+	}
+	if expiries := store.Expiries(); len(expiries) != 1 || !expiries[0].NotAfter.Equal(rotated.Leaf.NotAfter) {
+		t.Fatalf("expiries error: %v", expiries)
+	}
+
+	// reloading the same certificate doesn't report it again
+	for i := 0; i < 3; i++ {
+		if err := store.Reload(); err != nil {
+			t.Fatalf("reload error: %s", err.Error())
+		}
+	}
+	select {
+	case expiry := <-expiring:
+		t.Fatalf("reloaded certificate should be reported once, got %v again", expiry)
+	case <-time.After(time.Millisecond * 100):
+	}
+	// the certificates gone from the store are forgotten
+	writeTestCertificate(t, testCertificate(t, time.Now().Add(time.Hour*24*365), "a.example"), certFile, keyFile)
+	if err := store.Reload(); err != nil {
+		t.Fatalf("reload error: %s", err.Error())
+	}
+	store.reloadMu.Lock()
+	notified := len(store.notified)
+	store.reloadMu.Unlock()
+	if notified != 0 {
+		t.Fatalf("replaced certificate should be forgotten, %d kept", notified)
+	}
+}
@@ -1,13 +1,16 @@
 package xmppcore
 
 import (
+	"bytes"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/jackal-xmpp/stravaganza/v2"
 )
 
@@ -22,10 +25,13 @@ type Receiver interface {
 	next() (interface{}, error)
 }
 
+// Sender queues what is sent, it's safe to send from multiple goroutines. Flush blocks
+// until everything sent is written to the conn
 type Sender interface {
 	Send([]byte) error
 	SendToken(xml.Token) error
 	SendElement(stravaganza.Element) error
+	Flush() error
 }
 
 type Channel interface {
@@ -34,10 +40,26 @@ type Channel interface {
 	WaitHeader(*xml.StartElement) error
 	Open(attr *PartAttr) error
 	SetLogger(Logger)
+	CloseWithStreamError(StreamError) error
+	CloseWithError(error)
+	Activity() ChannelActivity
 	Close()
+	// Closed is closed once the conn is closed and the stanzas never written are bounced
+	Closed() <-chan struct{}
+	// Err tells why the channel is closed, nil when it's closed gracefully
+	Err() error
+}
+
+// ChannelActivity tells how much a channel has received and written so far
+type ChannelActivity struct {
+	Received uint64
+	Written  uint64
+	Closed   bool
 }
 
 const (
+	NSClient  = "jabber:client"
+	NSServer  = "jabber:server"
 	NSStream  = "http://etherx.jabber.org/streams"
 	NSFraming = "urn:ietf:params:xml:ns:xmpp-framing"
 
@@ -45,70 +67,103 @@ const (
 	stateWSOpened  = 1
 	stateTCPOpened = 2
 	stateClosed    = 3
+	// our closing tag is sent, waiting the peer's
+	stateClosing = 4
 )
 
-var (
-	ErrUnproperFromAttr     = errors.New("unproper from attr")
-	ErrIncorrectJidEncoding = errors.New("incorrect jid encoding")
-)
+type XChannel struct {
+	// received is a 64-bit atomic counter, first to be aligned on 32-bit platforms
+	received       uint64
+	conn           io.ReadWriteCloser
+	isServer       bool
+	framed         bool // the conn frames the stream as rfc7395, such as a websocket
+	waitSecOnClose int
+	parser         ElementParser
+	logger         StructuredLogger
 
-type JID struct {
-	Username string
-	Domain   string
-	Resource string
+	// mu serializes senders, the order of queued stanzas is the order of sending
+	mu          sync.Mutex
+	state       int
+	encoder     *xml.Encoder
+	tokenBuf    bytes.Buffer
+	queueConfig SendQueueConfig
+	queue       *sendQueue
+	closeTimer  *time.Timer
+	closeErr    error
+	connClosed  bool
+	closedCh    chan struct{}
 }
 
-func ParseJID(src string, jid *JID) error {
-	v := strings.Split(src, "@")
-	if len(v) != 2 {
-		return ErrIncorrectJidEncoding
-	}
-	jid.Username = v[0]
-	idx := strings.Index(v[1], "/")
-	if idx > 0 {
-		jid.Domain = v[1][:idx]
-		jid.Resource = v[1][idx:]
-		return nil
+func NewXChannel(conn Conn, isServer bool) *XChannel {
+	xc := &XChannel{
+		conn:           conn,
+		isServer:       isServer,
+		framed:         isFramedConn(conn),
+		state:          stateInit,
+		waitSecOnClose: 2,
+		queueConfig:    DefaultSendQueueConfig,
+		closedCh:       make(chan struct{}),
 	}
-	jid.Domain = v[1]
-	return nil
+	xc.parser = NewFastParser(countReader{conn, &xc.received}, 1024*1024*2)
+	xc.encoder = xml.NewEncoder(&xc.tokenBuf)
+	return xc
+}
+
+type countReader struct {
+	r     io.Reader
+	count *uint64
 }
 
-func (jid JID) String() string {
-	rsc := strings.Trim(jid.Resource, "/")
-	if rsc != "" {
-		return fmt.Sprintf("%s@%s/%s", jid.Username, jid.Domain, rsc)
+func (cr countReader) Read(bs []byte) (int, error) {
+	n, err := cr.r.Read(bs)
+	atomic.AddUint64(cr.count, uint64(n))
+	return n, err
+}
+
+// SetLogger enables logging the traffic at debug level, the secrets are redacted unless
+// the logger allows them
+func (xc *XChannel) SetLogger(logger Logger) {
+	if logger == nil {
+		xc.logger = nil
+		return
 	}
-	return fmt.Sprintf("%s@%s", jid.Username, jid.Domain)
+	xc.logger = Structured(logger).Sub(LogSubChannel)
 }
 
-func (jid JID) Equal(a JID) bool {
-	return jid.Username == a.Username && jid.Domain == a.Domain && jid.Resource == a.Resource
+// SetParserLimits hardens the parser of the channel
+func (xc *XChannel) SetParserLimits(limits ParserLimits) {
+	xc.parser.SetLimits(limits)
 }
 
-type XChannel struct {
-	conn           io.ReadWriteCloser
-	isServer       bool
-	encoder        *xml.Encoder
-	state          int
-	waitSecOnClose int
-	parser         *Parser
-	logger         Logger
+// SetSendQueueConfig configures the outbound queue, it takes effect only before anything
+// is sent
+func (xc *XChannel) SetSendQueueConfig(config SendQueueConfig) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.queueConfig = config
 }
 
-func NewXChannel(conn Conn, isServer bool) *XChannel {
-	return &XChannel{
-		conn:           conn,
-		isServer:       isServer,
-		encoder:        xml.NewEncoder(conn),
-		state:          stateInit,
-		parser:         NewParser(conn, 1024*1024*2),
-		waitSecOnClose: 2,
+func (xc *XChannel) SendQueueStats() SendQueueStats {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if xc.queue == nil {
+		return SendQueueStats{}
 	}
+	return xc.queue.stats()
 }
 
-func (xc *XChannel) SetLogger(logger Logger) {
-	xc.logger = logger
+// Activity tells how much the channel has received and written, whitespaces included
+func (xc *XChannel) Activity() ChannelActivity {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	activity := ChannelActivity{
+		Received: atomic.LoadUint64(&xc.received),
+		Closed:   xc.state == stateClosing || xc.state == stateClosed,
+	}
+	if xc.queue != nil {
+		activity.Written = xc.queue.stats().Written
+	}
+	return activity
 }
 
 func (xc *XChannel) WaitSecOnClose(sec int) {
@@ -127,161 +182,485 @@ func (xc *XChannel) WaitHeader(header *xml.StartElement) error {
 		case xml.StartElement:
 			*header = t
 			return nil
+		case xml.EndElement:
+			return ErrChannelClosed
 		}
 	}
 }
 
+// NextElement waits the next element, whitespace keepalives in between are skipped
 func (xc *XChannel) NextElement(elem *stravaganza.Element) error {
-	i, err := xc.next()
-	if err != nil {
-		return err
-	}
-	switch t := i.(type) {
-	case stravaganza.Element:
-		*elem = t
-	default:
-		return ErrUnexpectedToken
+	for {
+		i, err := xc.next()
+		if err != nil {
+			return err
+		}
+		switch t := i.(type) {
+		case stravaganza.Element:
+			*elem = t
+			return nil
+		case xml.CharData:
+		case xml.EndElement:
+			return ErrChannelClosed
+		default:
+			return ErrUnexpectedToken
+		}
 	}
-	return nil
 }
 
 func (xc *XChannel) next() (interface{}, error) {
-	if xc.state == stateClosed {
+	if xc.closed() {
 		return nil, ErrChannelClosed
 	}
 	i, e := xc.parser.Next()
 	if e != nil {
+		if e != ErrNoElement {
+			// the error sticks, nothing more is parsed
+			releaseParser(xc.parser)
+		}
+		if _, ok := StreamErrorFromError(e); !ok {
+			// the conn is broken, nothing more to read or write
+			xc.mu.Lock()
+			xc.setErr(e)
+			xc.closeConn(false)
+			xc.mu.Unlock()
+		}
 		return i, e
 	}
-	if _, ok := i.(xml.EndElement); ok {
-		xc.Close()
-		return nil, ErrChannelClosed
+	if isStreamEnd(i) {
+		xc.mu.Lock()
+		defer xc.mu.Unlock()
+		// the peer closed its side, both sides are closed once ours is. the end is told
+		// as the closing tag, whether the stream is framed or not
+		xc.close()
+		xc.closeConn(true)
+		releaseParser(xc.parser)
+		return xml.EndElement{Name: xml.Name{Space: NSStream, Local: "stream"}}, nil
 	}
 	if xc.logger != nil {
 		switch t := i.(type) {
 		case stravaganza.Element:
-			xc.logElement("RECV", t)
+			xc.logElement("in", t)
 		default:
-			xc.logToken("RECV", t)
+			xc.logToken("in", t)
+		}
+	}
+	if elem, ok := i.(stravaganza.Element); ok {
+		var se StreamError
+		if err := se.FromElem(elem); err == nil {
+			// the peer is closing the stream, close our side
+			xc.mu.Lock()
+			xc.setErr(se)
+			xc.close()
+			xc.mu.Unlock()
+			return nil, se
 		}
 	}
 	return i, nil
 }
 
+// closed tells nothing more can be read, a closing channel still reads until the peer
+// closes its side
+func (xc *XChannel) closed() bool {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	return xc.state == stateClosed
+}
+
+func (xc *XChannel) sendable() bool {
+	return xc.state != stateClosing && xc.state != stateClosed
+}
+
+func (xc *XChannel) setErr(err error) {
+	if xc.closeErr == nil {
+		xc.closeErr = err
+	}
+}
+
+func (xc *XChannel) Err() error {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	return xc.closeErr
+}
+
+func (xc *XChannel) Closed() <-chan struct{} {
+	return xc.closedCh
+}
+
+// CloseWithStreamError sends a stream error and then closes the stream. a server which
+// didn't send its header yet opens the stream first as rfc6120 4.9.1.1 requires
+func (xc *XChannel) CloseWithStreamError(se StreamError) error {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	return xc.closeWithStreamError(se)
+}
+
+func (xc *XChannel) closeWithStreamError(se StreamError) error {
+	switch xc.state {
+	case stateClosing, stateClosed:
+		return ErrChannelClosed
+	case stateInit:
+		xc.setErr(se)
+		if !xc.isServer {
+			xc.close()
+			return nil
+		}
+		if err := xc.open(&PartAttr{ID: uuid.New().String(), Version: "1.0", OpenTag: xc.framed}); err != nil {
+			xc.closeConn(false)
+			return err
+		}
+	}
+	xc.setErr(se)
+	var elem stravaganza.Element
+	se.ToElem(&elem)
+	xc.closeWith(elem)
+	return nil
+}
+
+// CloseWithError closes the stream because of err. the peer is told with the stream error
+// err maps to, or an internal-server-error. a nil err closes the stream gracefully
+func (xc *XChannel) CloseWithError(err error) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if err == nil {
+		xc.close()
+		return
+	}
+	se, ok := StreamErrorFromError(err)
+	if !ok {
+		se = StreamError{Condition: SEInternalServerError}
+	}
+	xc.setErr(err)
+	xc.closeWithStreamError(se)
+}
+
+// Close sends the closing tag, the stanzas received until the peer's closing tag are still
+// delivered. the conn is closed once the peer closes its side, or after waitSecOnClose
 func (xc *XChannel) Close() {
-	var token xml.Token
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.close()
+}
+
+func (xc *XChannel) close() {
 	switch xc.state {
 	case stateInit:
-		xc.conn.Close()
+		xc.closeConn(false)
 		return
-	case stateWSOpened:
-		token = xml.EndElement{Name: xml.Name{Local: "open", Space: NSFraming}}
-	case stateTCPOpened:
-		token = xml.EndElement{Name: xml.Name{Local: "stream", Space: NSStream}}
-	case stateClosed:
+	case stateClosing, stateClosed:
 		return
 	}
-	if err := xc.SendToken(token); err != nil {
-		if xc.logger != nil {
-			xc.logger.Printf(LogError, "send close stream token error: %s", err.Error())
+	xc.closeWith(nil)
+}
+
+// closeWith closes our side of the stream after elem, if any. elem and the end are queued as
+// one item, nothing queued after is written. it doesn't wait for room in the queue, the
+// close timer closes the conn of a peer which doesn't read
+func (xc *XChannel) closeWith(elem stravaganza.Element) {
+	buf := getXMLBuf()
+	if elem != nil {
+		elem = xc.frameElement(elem)
+		WriteElement(buf, elem)
+		xc.logElement("out", elem)
+	}
+	end := xc.endData()
+	buf.Write(end)
+	xc.logData("out", end)
+	xc.closing()
+	if xc.queue == nil {
+		xc.queue = newSendQueue(xc.conn, xc.queueConfig)
+	}
+	xc.queue.pushEnd(buf)
+}
+
+// endData is the end of the stream, the close element of a framed stream
+func (xc *XChannel) endData() []byte {
+	if xc.state == stateWSOpened {
+		return []byte(`<close xmlns="` + NSFraming + `"/>`)
+	}
+	xc.encoder.EncodeToken(xml.EndElement{Name: xml.Name{Local: "stream", Space: NSStream}})
+	xc.encoder.Flush()
+	end := append([]byte{}, xc.tokenBuf.Bytes()...)
+	xc.tokenBuf.Reset()
+	return end
+}
+
+// isStreamEnd tells the closing tag of a stream, or the close element of a framed stream
+func isStreamEnd(i interface{}) bool {
+	switch t := i.(type) {
+	case xml.EndElement:
+		return true
+	case stravaganza.Element:
+		return t.Name() == "close" && t.Attribute("xmlns") == NSFraming
+	}
+	return false
+}
+
+// openElement makes the open element of a framed stream from its header
+func openElement(header xml.StartElement) stravaganza.Element {
+	b := stravaganza.NewBuilder("open").WithAttribute("xmlns", NSFraming)
+	for _, attr := range header.Attr {
+		label := attr.Name.Local
+		if attr.Name.Space == NSXML {
+			label = "xml:" + label
+		}
+		b.WithAttribute(label, attr.Value)
+	}
+	return b.Build()
+}
+
+// closing waits the peer to close its side after ours is closed
+func (xc *XChannel) closing() {
+	xc.state = stateClosing
+	xc.closeTimer = time.AfterFunc(time.Second*time.Duration(xc.waitSecOnClose), func() {
+		xc.mu.Lock()
+		defer xc.mu.Unlock()
+		if xc.logger != nil && !xc.connClosed {
+			xc.logger.Log(LogInfo, "peer didn't close its side of the stream in time")
 		}
+		xc.closeConn(false)
+	})
+}
+
+// closeConn closes the conn, after what is queued is written when flush
+func (xc *XChannel) closeConn(flush bool) {
+	if xc.connClosed {
+		return
 	}
+	xc.connClosed = true
 	xc.state = stateClosed
-	time.AfterFunc(time.Second*time.Duration(xc.waitSecOnClose), func() {
+	if xc.closeTimer != nil {
+		xc.closeTimer.Stop()
+	}
+	queue := xc.queue
+	wait := time.Second * time.Duration(xc.waitSecOnClose)
+	go func() {
+		if queue != nil {
+			if flush {
+				written := make(chan struct{})
+				go func() {
+					queue.wait()
+					close(written)
+				}()
+				select {
+				case <-written:
+				case <-time.After(wait):
+				}
+			}
+			queue.stop()
+		}
 		xc.conn.Close()
-	})
+		if queue != nil {
+			// closing the conn unblocks the write in progress, the rest is bounced
+			<-queue.exited
+		}
+		close(xc.closedCh)
+	}()
+}
+
+// abort closes the stream of a peer which doesn't read fast enough. the queued stanzas are
+// dropped, the stream error and the end of the stream are queued as one item once the
+// queue has room, or the conn is closed
+func (xc *XChannel) abort() {
+	if xc.logger != nil {
+		xc.logger.Log(LogError, "send queue full, close the stream of a slow consumer")
+	}
+	xc.setErr(ErrSlowConsumer)
+	if xc.state == stateInit {
+		xc.close()
+		return
+	}
+	xc.queue.discardStanzas(ErrSlowConsumer)
+	var elem stravaganza.Element
+	StreamError{Condition: SEResourceConstraint}.ToElem(&elem)
+	xc.closeWith(elem)
 }
 
 func (xc *XChannel) Open(attr *PartAttr) error {
-	if attr.OpenTag {
-		xc.state = stateWSOpened
-	} else {
-		xc.state = stateTCPOpened
+	return xc.sendWait(func() error {
+		return xc.open(attr)
+	})
+}
+
+// sendWait calls send with mu held. while the queue is full, it waits for room with mu
+// released and calls send again, which checks the state again
+func (xc *XChannel) sendWait(send func() error) error {
+	for {
+		xc.mu.Lock()
+		err := send()
+		queue := xc.queue
+		xc.mu.Unlock()
+		if err != errQueueFull {
+			return err
+		}
+		if err := queue.waitRoom(); err != nil {
+			return err
+		}
 	}
-	xc.Send([]byte("<?xml version='1.0'?>"))
+}
+
+func (xc *XChannel) open(attr *PartAttr) error {
 	var elem xml.StartElement
 	if xc.isServer {
 		attr.ToClientHead(&elem)
-		return xc.SendToken(elem)
-	}
-	attr.ToServerHead(&elem)
-	return xc.SendToken(elem)
-}
-
-func (gs *XChannel) Send(bs []byte) error {
-	if gs.state == stateClosed {
-		return ErrChannelClosed
+	} else {
+		attr.ToServerHead(&elem)
 	}
-	sent := 0
-	total := len(bs)
-	for sent < total {
-		s, err := gs.conn.Write(bs)
-		if err != nil {
+	// the state is opened once the header is queued, nothing is queued when the queue is full
+	if attr.OpenTag {
+		// rfc7395 3.3.3, a framed stream has no xml declaration and a complete open element
+		if err := xc.sendElement(openElement(elem)); err != nil {
 			return err
 		}
-		sent = sent + s
+		xc.state = stateWSOpened
+		return nil
 	}
-	if gs.logger != nil {
-		gs.logOther("SEND", string(bs))
+	if err := xc.sendTokenAfter([]byte("<?xml version='1.0'?>"), elem); err != nil {
+		return err
 	}
+	xc.state = stateTCPOpened
 	return nil
 }
 
-func (gs *XChannel) logOther(rs, other interface{}) {
-	tmp := "%s: \n%v"
-	if gs.isServer {
-		tmp = "server [%d] " + tmp
-	} else {
-		tmp = "client [%d] " + tmp
-	}
-	gs.logger.Printf(LogDebug, tmp, gs.state, rs, other)
+func (xc *XChannel) Send(bs []byte) error {
+	return xc.sendWait(func() error {
+		return xc.send(bs)
+	})
 }
 
-func (gs *XChannel) SendToken(token xml.Token) error {
-	if gs.state == stateClosed {
+func (xc *XChannel) send(bs []byte) error {
+	if !xc.sendable() {
 		return ErrChannelClosed
 	}
-	err := gs.encoder.EncodeToken(token)
-	gs.encoder.Flush()
-	gs.logToken("SEND", token)
+	buf := getXMLBuf()
+	buf.Write(bs)
+	if err := xc.push(buf, nil, false); err != nil {
+		return err
+	}
+	xc.logData("out", bs)
+	return nil
+}
+
+func (xc *XChannel) push(buf *bytes.Buffer, elem stravaganza.Element, droppable bool) error {
+	if xc.queue == nil {
+		xc.queue = newSendQueue(xc.conn, xc.queueConfig)
+	}
+	queue := xc.queue
+	err := queue.push(buf, elem, droppable)
+	switch err {
+	case errQueueFull:
+		// mu isn't held while waiting for room, see sendWait, a peer which doesn't read would
+		// block the ones reading the state or closing the stream otherwise
+		putXMLBuf(buf)
+	case ErrSlowConsumer:
+		xc.abort()
+	}
 	return err
 }
 
-func (gs *XChannel) SendElement(elem stravaganza.Element) error {
-	if gs.state == stateClosed {
+// Flush blocks until everything sent so far is written, it must be called before the conn
+// is switched to tls or compression
+func (xc *XChannel) Flush() error {
+	xc.mu.Lock()
+	queue := xc.queue
+	xc.mu.Unlock()
+	if queue == nil {
+		return nil
+	}
+	return queue.wait()
+}
+
+func (xc *XChannel) SendToken(token xml.Token) error {
+	return xc.sendWait(func() error {
+		return xc.sendToken(token)
+	})
+}
+
+func (xc *XChannel) sendToken(token xml.Token) error {
+	return xc.sendTokenAfter(nil, token)
+}
+
+// sendTokenAfter queues data and token as one item
+func (xc *XChannel) sendTokenAfter(data []byte, token xml.Token) error {
+	if !xc.sendable() {
 		return ErrChannelClosed
 	}
-	_, err := gs.conn.Write([]byte(elem.GoString()))
-	gs.logElement("SEND", elem)
-	return err
+	if err := xc.encoder.EncodeToken(token); err != nil {
+		return err
+	}
+	xc.encoder.Flush()
+	buf := getXMLBuf()
+	buf.Write(data)
+	buf.Write(xc.tokenBuf.Bytes())
+	xc.tokenBuf.Reset()
+	if err := xc.push(buf, nil, false); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		xc.logData("out", data)
+	}
+	xc.logToken("out", token)
+	return nil
 }
 
-func (gs *XChannel) logElement(leading string, elem stravaganza.Element) {
-	if gs.logger == nil {
-		return
+func (xc *XChannel) SendElement(elem stravaganza.Element) error {
+	return xc.sendWait(func() error {
+		return xc.sendElement(elem)
+	})
+}
+
+func (xc *XChannel) sendElement(elem stravaganza.Element) error {
+	if !xc.sendable() {
+		return ErrChannelClosed
 	}
-	tmp := leading + ": \n %s"
-	if gs.isServer {
-		tmp = "server [%d] " + tmp
-	} else {
-		tmp = "client [%d] " + tmp
+	elem = xc.frameElement(elem)
+	buf := getXMLBuf()
+	WriteElement(buf, elem)
+	var stanza stravaganza.Element
+	if IsStanza(elem) {
+		stanza = elem
+	}
+	droppable := xc.queueConfig.Policy == SlowConsumerDrop && xc.queueConfig.Droppable != nil && xc.queueConfig.Droppable(elem)
+	if err := xc.push(buf, stanza, droppable); err != nil {
+		return err
 	}
-	gs.logger.Printf(LogDebug, tmp, gs.state, elem.GoString())
+	xc.logElement("out", elem)
+	return nil
 }
 
-func (gs *XChannel) logToken(leading string, token xml.Token) {
-	if gs.logger == nil {
+// frameElement declares the namespace of elem in a framed stream, as rfc7395 3.3.3 requires
+func (xc *XChannel) frameElement(elem stravaganza.Element) stravaganza.Element {
+	if xc.state == stateWSOpened && elem.Attribute("xmlns") == "" {
+		return stravaganza.NewBuilderFromElement(elem).WithAttribute("xmlns", NSClient).Build()
+	}
+	return elem
+}
+
+func (xc *XChannel) logElement(dir string, elem stravaganza.Element) {
+	if xc.logger == nil || !xc.logger.Enabled(LogDebug) {
 		return
 	}
-	tmp := leading + ": "
-	if gs.isServer {
-		tmp = "server [%d] " + tmp
-	} else {
-		tmp = "client [%d] " + tmp
+	xc.logger.Log(LogDebug, RedactElement(elem, xc.logger.Secrets()).GoString(), xc.logFields(dir)...)
+}
+
+func (xc *XChannel) logToken(dir string, token xml.Token) {
+	if xc.logger == nil || !xc.logger.Enabled(LogDebug) {
+		return
 	}
-	gs.logger.Printf(LogDebug, tmp, gs.state)
-	encoder := xml.NewEncoder(gs.logger.Writer())
+	var buf bytes.Buffer
+	encoder := xml.NewEncoder(&buf)
 	encoder.EncodeToken(token)
 	encoder.Flush()
-	gs.logger.Writer().Write([]byte("\n"))
+	xc.logger.Log(LogDebug, buf.String(), xc.logFields(dir)...)
+}
+
+func (xc *XChannel) logData(dir string, bs []byte) {
+	if xc.logger == nil || !xc.logger.Enabled(LogDebug) {
+		return
+	}
+	xc.logger.Log(LogDebug, string(bs), xc.logFields(dir)...)
+}
+
+func (xc *XChannel) logFields(dir string) []LogField {
+	return []LogField{Field(LogKeyDir, dir), Field("server", xc.isServer)}
 }
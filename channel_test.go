@@ -0,0 +1,188 @@
+package xmppcore
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+// openTestStream opens a server channel to which the peer has sent its header
+func openTestStream(t *testing.T, config SendQueueConfig) (*XChannel, *LocalConn) {
+	xc, peer := openTestChannel(t, config)
+	go peer.Write([]byte(testClientHeader))
+	var head xml.StartElement
+	if err := xc.WaitHeader(&head); err != nil {
+		t.Fatalf("wait header error: %s", err.Error())
+	}
+	return xc, peer
+}
+
+func isTestEnd(i interface{}) bool {
+	_, ok := i.(xml.EndElement)
+	return ok
+}
+
+func waitTestClosed(t *testing.T, closed <-chan struct{}, timeout time.Duration) {
+	select {
+	case <-closed:
+	case <-time.After(timeout):
+		t.Fatalf("wait closed timeout")
+	}
+}
+
+func TestXChannelCloseHandshake(t *testing.T) {
+	xc, peer := openTestStream(t, DefaultSendQueueConfig)
+	tokens := collectTestTokens(peer)
+	xc.Close()
+	waitTestToken(t, tokens, time.Second, isTestEnd)
+	if err := xc.SendElement(stravaganza.NewBuilder("message").Build()); err != ErrChannelClosed {
+		t.Fatalf("nothing should be sent after the closing tag, got %v", err)
+	}
+	// the peer hasn't seen our closing tag when it sends its last stanza
+	go peer.Write([]byte(`<message id="late"><body>good night</body></message></stream:stream>`))
+	var elem stravaganza.Element
+	if err := xc.NextElement(&elem); err != nil || elem.Attribute("id") != "late" {
+		t.Fatalf("stanza received while closing should be delivered, got %v", err)
+	}
+	if err := xc.NextElement(&elem); err != ErrChannelClosed {
+		t.Fatalf("require closed channel, got %v", err)
+	}
+	waitTestClosed(t, xc.Closed(), time.Second)
+	if err := xc.Err(); err != nil {
+		t.Fatalf("graceful close should have no error, got %s", err.Error())
+	}
+}
+
+func TestXChannelCloseTimeout(t *testing.T) {
+	xc, peer := openTestStream(t, DefaultSendQueueConfig)
+	xc.WaitSecOnClose(1)
+	collectTestTokens(peer)
+	closedAt := time.Now()
+	xc.Close()
+	waitTestClosed(t, xc.Closed(), time.Second*3)
+	if time.Since(closedAt) < time.Millisecond*500 {
+		t.Fatalf("conn should not be closed before the peer is waited")
+	}
+	if _, err := peer.Write([]byte(`</stream:stream>`)); err == nil {
+		t.Fatalf("conn should be closed")
+	}
+}
+
+func TestXChannelPeerClose(t *testing.T) {
+	xc, peer := openTestStream(t, DefaultSendQueueConfig)
+	tokens := collectTestTokens(peer)
+	go peer.Write([]byte(`</stream:stream>`))
+	var elem stravaganza.Element
+	if err := xc.NextElement(&elem); err != ErrChannelClosed {
+		t.Fatalf("require closed channel, got %v", err)
+	}
+	waitTestToken(t, tokens, time.Second, isTestEnd)
+	waitTestClosed(t, xc.Closed(), time.Second)
+}
+
+func TestXChannelCloseWithErrorBounce(t *testing.T) {
+	bounced := make(chan stravaganza.Element, 16)
+	config := DefaultSendQueueConfig
+	config.Bounce = func(elem stravaganza.Element) {
+		bounced <- elem
+	}
+	xc, _ := openTestChannel(t, config)
+	xc.WaitSecOnClose(1)
+	// nobody reads, the header is being written and the stanzas wait behind it
+	for i := 0; i < 3; i++ {
+		xc.SendElement(stravaganza.NewBuilder("message").
+			WithChild(stravaganza.NewBuilder("body").WithText("never written").Build()).Build())
+	}
+	cause := errors.New("roster storage down")
+	xc.CloseWithError(cause)
+	waitTestClosed(t, xc.Closed(), time.Second*3)
+	if len(bounced) != 3 {
+		t.Fatalf("require 3 stanzas bounced, got %d", len(bounced))
+	}
+	for len(bounced) > 0 {
+		if elem := <-bounced; elem.Name() != NameMsg {
+			t.Fatalf("only stanzas should be bounced, got %s", elem.GoString())
+		}
+	}
+	if err := xc.Err(); err != cause {
+		t.Fatalf("require the cause of closing, got %v", err)
+	}
+}
+
+func TestXPartClosed(t *testing.T) {
+	pair := NewLocalConnPair(NewLocalConnAddr(":1"), NewLocalConnAddr(":2"))
+	part := NewXPart(pair[0], "hello-world.im", NewLogger(io.Discard))
+	errChan := part.Run()
+	tokens := collectTestTokens(pair[1])
+	if _, err := pair[1].Write([]byte(testClientHeader)); err != nil {
+		t.Fatalf("write header error: %s", err.Error())
+	}
+	waitTestToken(t, tokens, time.Second, func(i interface{}) bool {
+		elem, ok := i.(stravaganza.Element)
+		return ok && elem.Name() == "features"
+	})
+	part.CloseWithError(ErrTooLargeStanza)
+	waitTestToken(t, tokens, time.Second, isTestStreamError(SEPolicyViolation))
+	waitTestToken(t, tokens, time.Second, isTestEnd)
+	if _, err := pair[1].Write([]byte(`</stream:stream>`)); err != nil {
+		t.Fatalf("write closing tag error: %s", err.Error())
+	}
+	waitTestClosed(t, part.Closed(), time.Second)
+	if err := part.Channel().Err(); err != ErrTooLargeStanza {
+		t.Fatalf("require the cause of closing, got %v", err)
+	}
+	select {
+	case <-errChan:
+	case <-time.After(time.Second):
+		t.Fatalf("part should stop once closed")
+	}
+}
+
+func TestXPartPeerClose(t *testing.T) {
+	pair := NewLocalConnPair(NewLocalConnAddr(":1"), NewLocalConnAddr(":2"))
+	part := NewXPart(pair[0], "hello-world.im", NewLogger(io.Discard))
+	errChan := part.Run()
+	tokens := collectTestTokens(pair[1])
+	if _, err := pair[1].Write([]byte(testClientHeader)); err != nil {
+		t.Fatalf("write header error: %s", err.Error())
+	}
+	if _, err := pair[1].Write([]byte(`</stream:stream>`)); err != nil {
+		t.Fatalf("write closing tag error: %s", err.Error())
+	}
+	waitTestToken(t, tokens, time.Second, isTestEnd)
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Fatalf("graceful close should quit without error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("part should stop once the peer closes the stream")
+	}
+	waitTestClosed(t, part.Closed(), time.Second)
+}
+
+func TestXPartDomainPrepared(t *testing.T) {
+	pair := NewLocalConnPair(NewLocalConnAddr(":1"), NewLocalConnAddr(":2"))
+	part := NewXPart(pair[0], "Hello-World.IM.", NewLogger(io.Discard))
+	if part.Attr().Domain != "hello-world.im" {
+		t.Fatalf("domain of the part should be prepared, got %s", part.Attr().Domain)
+	}
+	header := xml.StartElement{Name: xml.Name{Space: NSStream, Local: "stream"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "to"}, Value: "HELLO-world.im"}}}
+	if err := part.Attr().ParseToServer(header); err != nil {
+		t.Fatalf("header to the domain should be accepted, got %s", err.Error())
+	}
+	part.EnableLiveness(LivenessConfig{})
+	if !part.liveness.addressed("Hello-World.im") {
+		t.Fatalf("ping to the domain should be answered")
+	}
+	ca := testCertificate(t, time.Now().Add(time.Hour), "ca.hello-world.im")
+	cert := testClientCertificate(t, ca, "device", "juliet@HELLO-world.im")
+	if username, err := XmppAddrCertMapper.CertUsername(cert.Leaf, "", part); err != nil || username != "juliet" {
+		t.Fatalf("certificate of the domain should be mapped, got %q %v", username, err)
+	}
+}
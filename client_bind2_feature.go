@@ -0,0 +1,40 @@
+package xmppcore
+
+import (
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+type clientBind2Inline struct {
+	rb  ResourceBinder
+	tag string
+}
+
+// ClientBind2Inline asks the server to bind a resource of tag inline of a sasl2
+// authentication, the resource bound is told to rb
+func ClientBind2Inline(rb ResourceBinder, tag string) clientBind2Inline {
+	return clientBind2Inline{rb: rb, tag: tag}
+}
+
+func (cbi clientBind2Inline) Sasl2Request(mechanism string, inline stravaganza.Element, part Part) []stravaganza.Element {
+	if inline == nil {
+		return nil
+	}
+	if offered := inline.Child("bind"); offered == nil || offered.Attribute("xmlns") != NSBind2 {
+		return nil
+	}
+	req := stravaganza.NewBuilder("bind").WithAttribute("xmlns", NSBind2)
+	if cbi.tag != "" {
+		req.WithChild(stravaganza.NewBuilder("tag").WithText(cbi.tag).Build())
+	}
+	return []stravaganza.Element{req.Build()}
+}
+
+// Sasl2Success takes the resource of the authorization identifier, which is the full jid
+// once bound
+func (cbi clientBind2Inline) Sasl2Success(success stravaganza.Element, part Part) error {
+	if bound := success.Child("bound"); bound == nil || bound.Attribute("xmlns") != NSBind2 {
+		return nil
+	}
+	_, err := cbi.rb.BindResource(part, part.Attr().JID.Resource)
+	return err
+}
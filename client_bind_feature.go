@@ -28,7 +28,7 @@ func (cbf clientBindFeature) Handle(elem stravaganza.Element, part Part) (catche
 	var src stravaganza.Element
 	IqBind{IQ: Stanza{Name: NameIQ, ID: cbf.ID(), Type: TypeSet}, Resource: cbf.resource}.ToElem(&src)
 	if err = part.Channel().SendElement(src); err != nil {
-		part.Logger().Printf(LogError, "send bind message error: %s", err.Error())
+		part.Logger().Log(LogError, "send bind message error", Field(LogKeyErr, err))
 		return
 	}
 	if err = part.Channel().NextElement(&elem); err != nil {
@@ -36,7 +36,8 @@ func (cbf clientBindFeature) Handle(elem stravaganza.Element, part Part) (catche
 	}
 	var ie StanzaErr
 	if e := ie.FromElem(elem, NameIQ); e == nil {
-		err = ie.Err
+		err = ie
+		return
 	}
 	var ib IqBind
 	if err = ib.FromElem(elem); err != nil {
@@ -47,7 +48,9 @@ func (cbf clientBindFeature) Handle(elem stravaganza.Element, part Part) (catche
 		return
 	}
 	var jid JID
-	ParseJID(ib.JID, &jid)
-	cbf.rb.BindResource(part, jid.Resource)
+	if err = ParseJID(ib.JID, &jid); err != nil {
+		return
+	}
+	_, err = cbf.rb.BindResource(part, jid.Resource)
 	return
 }
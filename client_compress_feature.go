@@ -6,46 +6,62 @@ import (
 
 type clientCompressFeature struct {
 	supported map[string]BuildCompressor
+	policy    CompressPolicy
 	IDAble
 }
 
 func ClientCompressFeature() clientCompressFeature {
-	return clientCompressFeature{supported: make(map[string]BuildCompressor), IDAble: CreateIDAble()}
+	return clientCompressFeature{supported: make(map[string]BuildCompressor), policy: DefaultCompressPolicy, IDAble: CreateIDAble()}
 }
 
 func (ccf *clientCompressFeature) Support(name string, b BuildCompressor) {
 	ccf.supported[name] = b
 }
 
+// SetPolicy sets the policy, the methods of the policy are tried in the order the server
+// offers them
+func (ccf *clientCompressFeature) SetPolicy(policy CompressPolicy) {
+	ccf.policy = policy
+}
+
 func (ccf clientCompressFeature) Match(elem stravaganza.Element) bool {
-	return elem.Name() == "compression"
+	return elem.Name() == "compression" && elem.Attribute("xmlns") == NSCompress
 }
 
+// Handle tries the methods offered the client supports one by one, till one of them is
+// accepted or the server fails to set up. the feature isn't handled without compression
 func (ccf clientCompressFeature) Handle(elem stravaganza.Element, part Part) (catched bool, err error) {
-	if !ccf.Match(elem) {
+	if !ccf.Match(elem) || !ccf.policy.allows(part.Conn()) {
 		return false, nil
 	}
-	catched = true
-	methods := elem.AllChildren()
-	var selected string
-	for _, m := range methods {
-		if _, o := ccf.supported[m.Text()]; o {
-			selected = m.Text()
-			break
+	methods := ccf.policy.methods(ccf.supported)
+	for _, m := range elem.Children("method") {
+		selected := m.Text()
+		if !containsString(methods, selected) {
+			continue
+		}
+		compress := stravaganza.NewBuilder("compress").
+			WithAttribute("xmlns", NSCompress).
+			WithChild(stravaganza.NewBuilder("method").WithText(selected).Build()).Build()
+		if err = part.Channel().SendElement(compress); err != nil {
+			return
+		}
+		var resp stravaganza.Element
+		if err = part.Channel().NextElement(&resp); err != nil {
+			return
+		}
+		if resp.Name() == "compressed" {
+			part.Conn().StartCompress(ccf.supported[selected])
+			return true, nil
+		}
+		var failure CompressFailure
+		if err = failure.FromElem(resp); err != nil {
+			return
+		}
+		part.Logger().Log(LogWarning, "compression failed", Field("method", selected), Field("reason", failure.DescTag))
+		if failure.DescTag != CEUnsupportedMethod {
+			return false, nil
 		}
 	}
-	compress := stravaganza.NewBuilder("compress").
-		WithAttribute("xmlns", NSCompress).
-		WithChild(stravaganza.NewBuilder("method").WithText(selected).Build()).Build()
-
-	if err = part.Channel().SendElement(compress); err != nil {
-		return
-	}
-	if err = part.Channel().NextElement(&elem); err != nil {
-		return
-	}
-	if elem.Name() == "compressed" {
-		part.Conn().StartCompress(ccf.supported[selected])
-	}
-	return
+	return false, nil
 }
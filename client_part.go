@@ -9,12 +9,20 @@ import (
 	"github.com/jackal-xmpp/stravaganza/v2"
 )
 
+// featuresPart is a part which knows the features the server offered
+type featuresPart interface {
+	ServerFeatures() []stravaganza.Element
+}
+
 type ClientPart struct {
 	features []ElemHandler
+	// the features the server offered last
+	offered  []stravaganza.Element
 	channel  Channel
 	attr     PartAttr
-	logger   Logger
+	logger   StructuredLogger
 	conn     Conn
+	liveness *Liveness
 	elemRunner
 }
 
@@ -23,10 +31,11 @@ func NewClientPart(conn Conn, logger Logger, s *PartAttr) *ClientPart {
 	if s.ID == "" {
 		s.ID = uuid.New().String()
 	}
+	s.Domain = prepDomain(s.Domain)
 	return &ClientPart{
 		features:   []ElemHandler{},
 		channel:    channel,
-		logger:     logger,
+		logger:     partLogger(logger, s.ID, conn),
 		elemRunner: ElemRunner(channel),
 		attr:       *s,
 		conn:       conn,
@@ -45,8 +54,9 @@ func (od *ClientPart) WithFeature(h ElemHandler) {
 	od.features = append(od.features, h)
 }
 
-func (od *ClientPart) Logger() Logger {
-	return od.logger
+// Logger logs with the context of the part, the jid included once it's bound
+func (od *ClientPart) Logger() StructuredLogger {
+	return withJIDLogger(od.logger, od.attr.JID)
 }
 
 func (od *ClientPart) ID() string {
@@ -67,6 +77,9 @@ func (od *ClientPart) Negotiate() error {
 }
 
 func (od *ClientPart) Stop() {
+	if od.liveness != nil {
+		od.liveness.Stop()
+	}
 	od.Quit()
 }
 
@@ -122,7 +135,7 @@ func (od *ClientPart) handleFeatures(header xml.StartElement) error {
 			return err
 		}
 		f, rest := od.selectOne(features)
-		handled, err := od.handle(f)
+		handled, restart, err := od.handle(f)
 		if err != nil {
 			return err
 		}
@@ -130,6 +143,9 @@ func (od *ClientPart) handleFeatures(header xml.StartElement) error {
 			features = rest
 			goto handle
 		}
+		if !restart {
+			continue
+		}
 		if err := od.Channel().Open(od.Attr()); err != nil {
 			return err
 		}
@@ -139,16 +155,27 @@ func (od *ClientPart) handleFeatures(header xml.StartElement) error {
 	}
 }
 
+// EnableLiveness keeps the stream alive and closes it once the server is dead while the
+// part is running
+func (od *ClientPart) EnableLiveness(conf LivenessConfig) {
+	od.liveness = newLiveness(od, false, conf)
+	od.WithElemHandler(od.liveness)
+}
+
 func (od *ClientPart) Run() chan error {
+	if od.liveness != nil {
+		od.liveness.Start()
+	}
 	return od.elemRunner.Run(od)
 }
 
-func (od *ClientPart) handle(f stravaganza.Element) (handled bool, err error) {
+func (od *ClientPart) handle(f stravaganza.Element) (handled, restart bool, err error) {
 	for _, h := range od.features {
 		if handled, err = h.Handle(f, od); handled {
 			if err != nil {
 				return
 			}
+			restart = restartsStream(h)
 			break
 		}
 	}
@@ -164,12 +191,28 @@ func (od *ClientPart) OnOpenHeader(header xml.StartElement) error {
 
 func (od *ClientPart) OnWhiteSpace(bs []byte) {}
 
+// CloseWithError closes the stream because of err, see Channel.CloseWithError
+func (od *ClientPart) CloseWithError(err error) {
+	if od.liveness != nil {
+		od.liveness.Stop()
+	}
+	od.channel.CloseWithError(err)
+}
+
+// Closed is closed once the stream and its conn are closed, Channel().Err() tells why
+func (od *ClientPart) Closed() <-chan struct{} {
+	return od.channel.Closed()
+}
+
 func (od *ClientPart) OnCloseToken() {
+	if od.liveness != nil {
+		od.liveness.Stop()
+	}
 	od.Quit()
 }
 
 func (od *ClientPart) selectOne(features []stravaganza.Element) (f stravaganza.Element, rest []stravaganza.Element) {
-	priorities := []string{"starttls", "mechanisms", "bind"}
+	priorities := []string{"starttls", "authentication", "mechanisms", "bind"}
 	for _, s := range priorities {
 		var i int
 		for i, f = range features {
@@ -188,7 +231,8 @@ func (od *ClientPart) isMandatory(elem stravaganza.Element) bool {
 	if elem.Name() == "starttls" || elem.Name() == "bind" {
 		return elem.Child("required") != nil
 	}
-	if elem.Name() == "compression" {
+	// sasl is offered along with sasl2, either of them authenticates
+	if elem.Name() == "compression" || elem.Name() == "sasl-channel-binding" || elem.Name() == "authentication" {
 		return false
 	}
 	return true
@@ -203,5 +247,12 @@ func (od *ClientPart) serverFeatures() (res []stravaganza.Element, err error) {
 		return
 	}
 	res = elem.AllChildren()
+	od.offered = append([]stravaganza.Element{}, res...)
 	return
 }
+
+// ServerFeatures returns the features the server offered last, a feature handler looks
+// for what's offered along with its own
+func (od *ClientPart) ServerFeatures() []stravaganza.Element {
+	return od.offered
+}
@@ -0,0 +1,163 @@
+package xmppcore
+
+import (
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+// ClientSasl2Inline asks for a feature inline of a sasl2 authentication
+type ClientSasl2Inline interface {
+	// Sasl2Request is what's put in the authenticate with mechanism, inline is what the
+	// server offers inline, nil if nothing
+	Sasl2Request(mechanism string, inline stravaganza.Element, part Part) []stravaganza.Element
+	// Sasl2Success handles what the success tells of the feature
+	Sasl2Success(success stravaganza.Element, part Part) error
+}
+
+// ClientSasl2Mechanisms is a ClientSasl2Inline which authenticates with mechanisms of its
+// own the server offers inline, it's preferred to the mechanisms supported
+type ClientSasl2Mechanisms interface {
+	// Sasl2ToAuth returns the mechanism to authenticate with, a nil auth if there's none
+	Sasl2ToAuth(inline stravaganza.Element, part Part) (mechanism string, auth ToAuth)
+}
+
+// sasl2ClientChannel translates what a mechanism of ToAuth sends and receives, its auth
+// becomes an authenticate along with extra
+type sasl2ClientChannel struct {
+	Channel
+	extra   []stravaganza.Element
+	success stravaganza.Element
+}
+
+func (c *sasl2ClientChannel) SendElement(elem stravaganza.Element) error {
+	if elem.Attribute("xmlns") != NSSasl {
+		return c.Channel.SendElement(elem)
+	}
+	switch elem.Name() {
+	case "auth":
+		children := []stravaganza.Element{}
+		if elem.Text() != "" {
+			children = append(children, stravaganza.NewBuilder("initial-response").WithText(elem.Text()).Build())
+		}
+		return c.Channel.SendElement(stravaganza.NewBuilder("authenticate").
+			WithAttribute("xmlns", NSSasl2).
+			WithAttribute("mechanism", elem.Attribute("mechanism")).
+			WithChildren(append(children, c.extra...)...).Build())
+	case "response", "abort":
+		return c.Channel.SendElement(withXmlns(elem, NSSasl2))
+	}
+	return c.Channel.SendElement(elem)
+}
+
+func (c *sasl2ClientChannel) NextElement(elem *stravaganza.Element) error {
+	if err := c.Channel.NextElement(elem); err != nil {
+		return err
+	}
+	if (*elem).Attribute("xmlns") != NSSasl2 {
+		return nil
+	}
+	switch (*elem).Name() {
+	case "challenge":
+		*elem = withXmlns(*elem, NSSasl)
+	case "success":
+		c.success = *elem
+		success := stravaganza.NewBuilder("success").WithAttribute("xmlns", NSSasl)
+		if data := (*elem).Child("additional-data"); data != nil {
+			success.WithText(data.Text())
+		}
+		*elem = success.Build()
+	case "failure":
+		return sasl2Failure(*elem)
+	case "continue":
+		return ErrSasl2Continue
+	}
+	return nil
+}
+
+type clientSASL2Feature struct {
+	supports  map[string]ToAuth
+	userAgent Sasl2UserAgent
+	inlines   []ClientSasl2Inline
+	IDAble
+}
+
+// ClientSASL2Feature authenticates by sasl2 as userAgent, the server picks it over sasl
+// once both are offered
+func ClientSASL2Feature(userAgent Sasl2UserAgent) clientSASL2Feature {
+	return clientSASL2Feature{supports: make(map[string]ToAuth), userAgent: userAgent, IDAble: CreateIDAble()}
+}
+
+func (csf *clientSASL2Feature) Support(name string, auth ToAuth) {
+	csf.supports[name] = auth
+}
+
+// WithInline asks for inline along with the authentication
+func (csf *clientSASL2Feature) WithInline(inline ClientSasl2Inline) {
+	csf.inlines = append(csf.inlines, inline)
+}
+
+// RestartsStream is false, the stream goes on once authenticated
+func (csf clientSASL2Feature) RestartsStream() bool {
+	return false
+}
+
+func (csf clientSASL2Feature) Match(elem stravaganza.Element) bool {
+	return elem.Name() == "authentication" && elem.Attribute("xmlns") == NSSasl2
+}
+
+// Handle leaves the authentication to sasl if none of the mechanisms is supported
+func (csf clientSASL2Feature) Handle(elem stravaganza.Element, part Part) (catched bool, err error) {
+	if !csf.Match(elem) {
+		return false, nil
+	}
+	inline := elem.Child("inline")
+	mech, auth := csf.selectMechanism(elem, inline, part)
+	if auth == nil {
+		return false, nil
+	}
+	catched = true
+	channel := &sasl2ClientChannel{Channel: part.Channel()}
+	if csf.userAgent != (Sasl2UserAgent{}) {
+		var ua stravaganza.Element
+		csf.userAgent.ToElem(&ua)
+		channel.extra = append(channel.extra, ua)
+	}
+	for _, i := range csf.inlines {
+		channel.extra = append(channel.extra, i.Sasl2Request(mech, inline, part)...)
+	}
+	if err = auth.ToAuth(mech, sasl2Part{Part: part, channel: channel}); err != nil {
+		return
+	}
+	if channel.success == nil {
+		err = ErrSasl2NoSuccess
+		return
+	}
+	if id := channel.success.Child("authorization-identifier"); id != nil {
+		var jid JID
+		if err = ParseJID(id.Text(), &jid); err != nil {
+			return
+		}
+		part.Attr().JID = jid
+	}
+	for _, i := range csf.inlines {
+		if err = i.Sasl2Success(channel.success, part); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (csf clientSASL2Feature) selectMechanism(elem, inline stravaganza.Element, part Part) (string, ToAuth) {
+	for _, i := range csf.inlines {
+		if m, ok := i.(ClientSasl2Mechanisms); ok {
+			if mech, auth := m.Sasl2ToAuth(inline, part); auth != nil {
+				return mech, auth
+			}
+		}
+	}
+	for _, m := range elem.Children("mechanism") {
+		if auth, ok := csf.supports[m.Text()]; ok {
+			return m.Text(), auth
+		}
+	}
+	return "", nil
+}
@@ -2,35 +2,123 @@ package xmppcore
 
 import (
 	"compress/zlib"
+	"errors"
 	"io"
 )
 
+var (
+	ErrCompressionBomb = errors.New("compressed data inflates beyond the limits")
+)
+
 type BuildCompressor func(io.ReadWriter) Compressor
 
 type Compressor interface {
 	io.ReadWriter
 }
 
+// CompressLimits guard against decompression bombs, a zero is no limit
+type CompressLimits struct {
+	// the most inflated out of what's read from the conn at once
+	MaxSize int64
+	// the most inflated per byte compressed, measured once a window is inflated
+	MaxRatio int64
+	Window   int64
+}
+
+var DefaultCompressLimits = CompressLimits{
+	MaxSize:  1024 * 1024,
+	MaxRatio: 100,
+	Window:   256 * 1024,
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n += int64(n)
+	return n, err
+}
+
+// inflateGuard counts what's read from the conn and what's inflated out of it
+type inflateGuard struct {
+	in     countingReader
+	limits CompressLimits
+	err    error
+
+	// inflated since the last read of the conn, and in the ratio window
+	inflatedAtOnce   int64
+	lastRead         int64
+	windowInflated   int64
+	windowCompressed int64
+}
+
+func (g *inflateGuard) check(inflated int64) error {
+	compressed := g.in.n - g.lastRead
+	g.lastRead = g.in.n
+	if compressed > 0 {
+		g.inflatedAtOnce = 0
+	}
+	g.inflatedAtOnce += inflated
+	g.windowInflated += inflated
+	g.windowCompressed += compressed
+	limits := g.limits
+	if limits.MaxSize > 0 && g.inflatedAtOnce > limits.MaxSize {
+		g.err = ErrCompressionBomb
+	} else if limits.MaxRatio > 0 && g.windowInflated >= limits.Window {
+		if g.windowInflated > limits.MaxRatio*g.windowCompressed {
+			g.err = ErrCompressionBomb
+		}
+		g.windowInflated, g.windowCompressed = 0, 0
+	}
+	return g.err
+}
+
+// CompZlib is a xep-0138 zlib stream, each direction keeps one deflate context for the
+// whole stream, and what's written is sync flushed, so the peer inflates it at once
 type CompZlib struct {
-	rw io.ReadWriter
+	zw *zlib.Writer
+	zr io.ReadCloser
+	inflateGuard
 }
 
 func NewCompZlib(rw io.ReadWriter) *CompZlib {
-	return &CompZlib{rw: rw}
+	return NewCompZlibWithLimits(rw, DefaultCompressLimits)
+}
+
+func NewCompZlibWithLimits(rw io.ReadWriter, limits CompressLimits) *CompZlib {
+	return &CompZlib{zw: zlib.NewWriter(rw), inflateGuard: inflateGuard{in: countingReader{r: rw}, limits: limits}}
 }
 
 func (comp *CompZlib) Write(b []byte) (int, error) {
-	zw := zlib.NewWriter(comp.rw)
-	zw.Flush()
-	defer zw.Close()
-	return zw.Write(b)
+	n, err := comp.zw.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, comp.zw.Flush()
 }
 
+// Read inflates the stream, the zlib header is read with the first of it. the conn closing
+// after a sync flush ends the stream as well as the final block does
 func (comp *CompZlib) Read(b []byte) (int, error) {
-	zr, err := zlib.NewReader(comp.rw)
-	if err != nil {
-		return 0, err
+	if comp.err != nil {
+		return 0, comp.err
+	}
+	if comp.zr == nil {
+		zr, err := zlib.NewReader(&comp.in)
+		if err != nil {
+			return 0, err
+		}
+		comp.zr = zr
+	}
+	n, err := comp.zr.Read(b)
+	if e := comp.check(int64(n)); e != nil {
+		return 0, e
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
 	}
-	defer zr.Close()
-	return zr.Read(b)
+	return n, err
 }
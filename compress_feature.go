@@ -1,6 +1,8 @@
 package xmppcore
 
 import (
+	"sort"
+
 	"github.com/jackal-xmpp/stravaganza/v2"
 )
 
@@ -31,15 +33,69 @@ func (cf CompressFailure) ToElem(elem *stravaganza.Element) {
 	Failure{Xmlns: NSCompress, DescTag: cf.DescTag}.ToElem(elem)
 }
 
+// CompressPolicy decides if and how xep-0138 compression is negotiated
+type CompressPolicy struct {
+	Enabled bool
+	// compressed under tls, the size of what's sent leaks secrets, as crime and breach do
+	AllowOverTLS bool
+	// the methods, the preferred first, all supported if empty
+	Methods []string
+}
+
+var DefaultCompressPolicy = CompressPolicy{Enabled: true}
+
+// allows tells if compression is negotiable on the conn
+func (policy CompressPolicy) allows(conn Conn) bool {
+	if !policy.Enabled {
+		return false
+	}
+	if _, isTls := connTLSState(conn); isTls && !policy.AllowOverTLS {
+		return false
+	}
+	return true
+}
+
+// methods are the ones of the policy supported, zlib first if the policy tells none
+func (policy CompressPolicy) methods(supported map[string]BuildCompressor) []string {
+	names := policy.Methods
+	if len(names) == 0 {
+		names = []string{ZLIB}
+		others := []string{}
+		for name := range supported {
+			if name != ZLIB {
+				others = append(others, name)
+			}
+		}
+		sort.Strings(others)
+		names = append(names, others...)
+	}
+	methods := []string{}
+	for _, name := range names {
+		if _, ok := supported[name]; ok {
+			methods = append(methods, name)
+		}
+	}
+	return methods
+}
+
 type compressionFeature struct {
 	supported map[string]BuildCompressor
+	policy    CompressPolicy
+	conn      Conn
 	handled   bool
 	mandatory bool
 	IDAble
 }
 
 func CompressFeature() compressionFeature {
-	return compressionFeature{supported: make(map[string]BuildCompressor), handled: false, mandatory: false, IDAble: CreateIDAble()}
+	return compressionFeature{supported: make(map[string]BuildCompressor), policy: DefaultCompressPolicy, handled: false, mandatory: false, IDAble: CreateIDAble()}
+}
+
+// SetPolicy sets the policy of the conn, the feature isn't advertised when the policy
+// doesn't allow compression on it
+func (cf *compressionFeature) SetPolicy(policy CompressPolicy, conn Conn) {
+	cf.policy = policy
+	cf.conn = conn
 }
 
 func (cf compressionFeature) Mandatory() bool {
@@ -52,14 +108,22 @@ func (cf compressionFeature) Handled() bool {
 
 func (cf compressionFeature) Elem() stravaganza.Element {
 	children := []stravaganza.Element{}
-	for supported := range cf.supported {
-		children = append(children, stravaganza.NewBuilder("method").WithText(supported).Build())
+	for _, method := range cf.policy.methods(cf.supported) {
+		children = append(children, stravaganza.NewBuilder("method").WithText(method).Build())
 	}
 	return stravaganza.NewBuilder("compression").
 		WithAttribute(stravaganza.Namespace, NSCompress).
 		WithChildren(children...).Build()
 }
 
+// Elems advertises nothing when compression isn't allowed on the conn
+func (cf compressionFeature) Elems() []stravaganza.Element {
+	if cf.conn != nil && !cf.policy.allows(cf.conn) || len(cf.policy.methods(cf.supported)) == 0 {
+		return []stravaganza.Element{}
+	}
+	return []stravaganza.Element{cf.Elem()}
+}
+
 func (cf *compressionFeature) Support(name string, build BuildCompressor) {
 	cf.supported[name] = build
 }
@@ -73,24 +137,37 @@ func (cf *compressionFeature) Handle(elem stravaganza.Element, part Part) (catch
 		return false, nil
 	}
 	catched = true
-	cf.handled = true
 	method := elem.Child("method")
-	if method == nil || len(method.Text()) == 0 {
+	if method == nil || len(method.Text()) == 0 || !cf.policy.allows(part.Conn()) {
 		CompressFailure{DescTag: CESetupFailed}.ToElem(&elem)
 		err = part.Channel().SendElement(elem)
 		return
 	}
 	build, ok := cf.supported[method.Text()]
-	if !ok {
+	if !ok || !containsString(cf.policy.methods(cf.supported), method.Text()) {
+		// the client may try another one
 		CompressFailure{DescTag: CEUnsupportedMethod}.ToElem(&elem)
 		err = part.Channel().SendElement(elem)
 		return
 	}
+	cf.handled = true
 	if err = part.Channel().SendElement(stravaganza.NewBuilder("compressed").
 		WithAttribute(stravaganza.Namespace, NSCompress).
 		Build()); err != nil {
 		return
 	}
+	if err = part.Channel().Flush(); err != nil {
+		return
+	}
 	part.Conn().StartCompress(build)
 	return
 }
+
+func containsString(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -2,7 +2,11 @@ package xmppcore
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"crypto/tls"
 	"io"
+	"net"
 	"testing"
 )
 
@@ -24,3 +28,170 @@ func TestZLibReadWrite(t *testing.T) {
 		t.Fatalf("write and read not equal. write: %s\t, read: %s\n", str, res)
 	}
 }
+
+// flateStream inflates a zlib stream by compress/flate, apart from the zlib reader
+func flateStream(t *testing.T, r io.Reader) io.Reader {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("read zlib header error: %s", err.Error())
+	}
+	if header[0]&0x0f != 8 || (uint16(header[0])<<8|uint16(header[1]))%31 != 0 {
+		t.Fatalf("invalid zlib header %x", header)
+	}
+	return flate.NewReader(r)
+}
+
+func TestZlibStream(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	comp := NewCompZlib(server)
+	stanzas := []string{"<message to='juliet@hello-world.im'><body>hi</body></message>", "<presence/>", "<iq type='get' id='1'/>"}
+	go func() {
+		for _, stanza := range stanzas {
+			comp.Write([]byte(stanza))
+		}
+	}()
+	// each stanza is inflated as soon as it's written, before the next one
+	inflater := flateStream(t, client)
+	for _, stanza := range stanzas {
+		b := make([]byte, len(stanza))
+		if _, err := io.ReadFull(inflater, b); err != nil || string(b) != stanza {
+			t.Fatalf("inflated %q, expected %q, error %v", b, stanza, err)
+		}
+	}
+
+	// a stream of another deflater sync flushing is read across reads
+	var buf bytes.Buffer
+	buf.Write([]byte{0x78, 0x9c})
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	for _, stanza := range stanzas {
+		fw.Write([]byte(stanza))
+		fw.Flush()
+	}
+	reader := NewCompZlib(&buf)
+	for _, stanza := range stanzas {
+		b := make([]byte, len(stanza))
+		if _, err := io.ReadFull(reader, b); err != nil || string(b) != stanza {
+			t.Fatalf("read %q, expected %q, error %v", b, stanza, err)
+		}
+	}
+}
+
+func TestZlibBomb(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(make([]byte, 16*1024*1024))
+	zw.Close()
+	for _, limits := range []CompressLimits{
+		{MaxSize: 1024 * 1024},
+		{MaxRatio: 100, Window: 256 * 1024},
+	} {
+		comp := NewCompZlibWithLimits(bytes.NewBuffer(buf.Bytes()), limits)
+		if _, err := io.Copy(io.Discard, comp); err != ErrCompressionBomb {
+			t.Fatalf("%+v should stop the bomb, got %v", limits, err)
+		}
+	}
+	comp := NewCompZlibWithLimits(bytes.NewBuffer(buf.Bytes()), CompressLimits{})
+	if n, err := io.Copy(io.Discard, comp); err != nil || n != 16*1024*1024 {
+		t.Fatalf("without limits %d inflated, error %v", n, err)
+	}
+}
+
+func TestCompressPolicy(t *testing.T) {
+	supported := map[string]BuildCompressor{"x-custom": nil, LZW: nil, ZLIB: nil}
+	if methods := DefaultCompressPolicy.methods(supported); len(methods) != 3 || methods[0] != ZLIB || methods[1] != LZW {
+		t.Fatalf("default methods %v", methods)
+	}
+	if methods := (CompressPolicy{Methods: []string{LZW, "deflate"}}).methods(supported); len(methods) != 1 || methods[0] != LZW {
+		t.Fatalf("methods of the policy %v", methods)
+	}
+	server, client := tlsTestConns(t, tls.VersionTLS13)
+	defer server.Close()
+	defer client.Close()
+	if DefaultCompressPolicy.allows(server) {
+		t.Fatalf("compression over tls should be refused by default")
+	}
+	if !(CompressPolicy{Enabled: true, AllowOverTLS: true}).allows(server) {
+		t.Fatalf("compression over tls should be allowed explicitly")
+	}
+}
+
+// tcpTestConns connects a server and a client TcpConn
+func tcpTestConns(t *testing.T) (server, client *TcpConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %s", err.Error())
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %s", err.Error())
+	}
+	return NewTcpConn(<-accepted, false), NewTcpConn(raw, true)
+}
+
+// identityTestComp is a method which doesn't compress, only the negotiation is tested
+type identityTestComp struct {
+	io.ReadWriter
+}
+
+const identityTestMethod = "x-identity"
+
+func newIdentityTestComp(rw io.ReadWriter) Compressor {
+	return &identityTestComp{rw}
+}
+
+func TestCompressNegotiation(t *testing.T) {
+	for _, c := range []struct {
+		tls          bool
+		serverPolicy CompressPolicy
+		clientHas    []string
+		expected     string
+	}{
+		{false, DefaultCompressPolicy, []string{identityTestMethod}, identityTestMethod},
+		{false, DefaultCompressPolicy, []string{ZLIB, identityTestMethod}, ZLIB},
+		{false, CompressPolicy{Enabled: true, Methods: []string{ZLIB}}, []string{identityTestMethod}, ""},
+		{true, DefaultCompressPolicy, []string{ZLIB}, ""},
+		{true, CompressPolicy{Enabled: true, AllowOverTLS: true}, []string{ZLIB}, ZLIB},
+	} {
+		var serverConn, clientConn *TcpConn
+		if c.tls {
+			serverConn, clientConn = tlsTestConns(t, tls.VersionTLS13)
+		} else {
+			serverConn, clientConn = tcpTestConns(t)
+		}
+		compress := CompressFeature()
+		compress.SetPolicy(c.serverPolicy, serverConn)
+		compress.Support(ZLIB, func(rw io.ReadWriter) Compressor { return NewCompZlib(rw) })
+		compress.Support(identityTestMethod, newIdentityTestComp)
+		clientCompress := ClientCompressFeature()
+		clientCompress.SetPolicy(CompressPolicy{Enabled: true, AllowOverTLS: true})
+		for _, method := range c.clientHas {
+			switch method {
+			case ZLIB:
+				clientCompress.Support(ZLIB, func(rw io.ReadWriter) Compressor { return NewCompZlib(rw) })
+			case identityTestMethod:
+				clientCompress.Support(identityTestMethod, newIdentityTestComp)
+			}
+		}
+		if _, _, err := negotiateParts(t, serverConn, clientConn, []Feature{&compress}, []ElemHandler{clientCompress}); err != nil {
+			t.Fatalf("%+v negotiate error: %s", c, err.Error())
+		}
+		var negotiated string
+		switch clientConn.comp.(type) {
+		case *CompZlib:
+			negotiated = ZLIB
+		case *identityTestComp:
+			negotiated = identityTestMethod
+		}
+		if negotiated != c.expected {
+			t.Fatalf("%+v negotiated %q", c, negotiated)
+		}
+	}
+}
@@ -1,17 +1,32 @@
 package xmppcore
 
 import (
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	ErrBindTlsUniqueNotSupported = errors.New("bind tls unique not supported")
+	ErrBindTlsUniqueNotSupported  = errors.New("bind tls unique not supported")
+	ErrChannelBindingNotSupported = errors.New("channel binding not supported")
 )
 
+// channel binding types, rfc5929 and rfc9266
+const (
+	CBTlsExporter       = "tls-exporter"
+	CBTlsServerEndPoint = "tls-server-end-point"
+	CBTlsUnique         = "tls-unique"
+)
+
+// rfc9266 2
+const cbExporterLabel = "EXPORTER-Channel-Binding"
+
 type Conn interface {
 	net.Conn
 	StartTLS(*tls.Config)
@@ -19,19 +34,121 @@ type Conn interface {
 	StartCompress(BuildCompressor)
 }
 
+// TLSStateConn is a conn which knows what's negotiated in its tls handshake
+type TLSStateConn interface {
+	TLSState() (tls.ConnectionState, bool)
+}
+
+func connTLSState(conn Conn) (tls.ConnectionState, bool) {
+	if c, ok := conn.(TLSStateConn); ok {
+		return c.TLSState()
+	}
+	return tls.ConnectionState{}, false
+}
+
+// ConnALPN returns the alpn protocol negotiated on a direct tls conn
+func ConnALPN(conn Conn) string {
+	cs, _ := connTLSState(conn)
+	return cs.NegotiatedProtocol
+}
+
+// ConnServerName returns the sni hostname the client asked for, which is the domain the
+// part serves on a multi-domain listener
+func ConnServerName(conn Conn) string {
+	cs, _ := connTLSState(conn)
+	return cs.ServerName
+}
+
+// ConnForALPN tells c2s or s2s by the alpn protocol, def if there's none
+func ConnForALPN(alpn string, def ConnFor) ConnFor {
+	switch alpn {
+	case ALPNClient:
+		return ForC2S
+	case ALPNServer:
+		return ForS2S
+	}
+	return def
+}
+
+// ChannelBindingTypes returns the channel binding types available on the conn, the
+// preferred first
+func ChannelBindingTypes(conn Conn) []string {
+	types := []string{}
+	for _, cbType := range []string{CBTlsExporter, CBTlsServerEndPoint, CBTlsUnique} {
+		if _, err := ChannelBinding(conn, cbType); err == nil {
+			types = append(types, cbType)
+		}
+	}
+	return types
+}
+
+// ChannelBinding returns the data of the channel binding type of the conn
+func ChannelBinding(conn Conn, cbType string) ([]byte, error) {
+	cs, ok := connTLSState(conn)
+	if !ok {
+		return nil, ErrChannelBindingNotSupported
+	}
+	switch cbType {
+	case CBTlsExporter:
+		// tls 1.2 exports only with the extended master secret
+		data, err := cs.ExportKeyingMaterial(cbExporterLabel, nil, 32)
+		if err != nil {
+			return nil, ErrChannelBindingNotSupported
+		}
+		return data, nil
+	case CBTlsServerEndPoint:
+		if c, ok := conn.(serverCertConn); ok {
+			if cert := c.serverCertificate(); cert != nil {
+				return serverEndPoint(cert), nil
+			}
+		}
+	case CBTlsUnique:
+		// rfc9266 3, tls-unique is undefined for tls 1.3
+		if cs.Version < tls.VersionTLS13 && len(cs.TLSUnique) > 0 {
+			return cs.TLSUnique, nil
+		}
+	}
+	return nil, ErrChannelBindingNotSupported
+}
+
+// serverCertConn is a conn which knows the certificate of the server side
+type serverCertConn interface {
+	serverCertificate() *x509.Certificate
+}
+
+// serverEndPoint hashes the certificate with the hash of its signature, sha-256 instead
+// of md5 and sha-1, rfc5929 4.1
+func serverEndPoint(cert *x509.Certificate) []byte {
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		sum := sha512.Sum384(cert.Raw)
+		return sum[:]
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		sum := sha512.Sum512(cert.Raw)
+		return sum[:]
+	}
+	sum := sha256.Sum256(cert.Raw)
+	return sum[:]
+}
+
 type TcpConn struct {
 	underlying net.Conn
 	comp       Compressor
 	isClient   bool
+	// the certificate served in the handshake of the server side
+	served atomic.Value
+	// gives the place admitted back
+	release func()
 }
 
 func NewTcpConn(underlying net.Conn, isClient bool) *TcpConn {
 	_, isTcp := underlying.(*net.TCPConn)
 	_, isTls := underlying.(*tls.Conn)
-	if !isTcp && !isTls {
+	_, isProxied := underlying.(*proxyConn)
+	if !isTcp && !isTls && !isProxied {
 		panic("not a tcp conn nor a tls conn")
 	}
-	return &TcpConn{underlying, nil, isClient}
+	return &TcpConn{underlying: underlying, isClient: isClient}
 }
 
 func (conn *TcpConn) Read(b []byte) (int, error) {
@@ -49,6 +166,9 @@ func (conn *TcpConn) Write(b []byte) (int, error) {
 }
 
 func (conn *TcpConn) Close() error {
+	if conn.release != nil {
+		conn.release()
+	}
 	return conn.underlying.Close()
 }
 
@@ -73,9 +193,26 @@ func (conn *TcpConn) SetWriteDeadline(t time.Time) error {
 }
 
 func (conn *TcpConn) BindTlsUnique(w io.Writer) error {
-	if c, ok := conn.underlying.(*tls.Conn); ok {
+	return bindTlsUnique(conn.underlying, w)
+}
+
+func (conn *TcpConn) TLSState() (tls.ConnectionState, bool) {
+	return tlsState(conn.underlying)
+}
+
+func tlsState(conn net.Conn) (tls.ConnectionState, bool) {
+	if c, ok := conn.(*tls.Conn); ok {
 		cs := c.ConnectionState()
-		if cs.Version < tls.VersionTLS13 {
+		return cs, cs.HandshakeComplete
+	}
+	return tls.ConnectionState{}, false
+}
+
+func bindTlsUnique(conn net.Conn, w io.Writer) error {
+	if c, ok := conn.(*tls.Conn); ok {
+		cs := c.ConnectionState()
+		// tls-unique is undefined for tls 1.3
+		if cs.Version >= tls.VersionTLS13 {
 			return ErrBindTlsUniqueNotSupported
 		}
 		w.Write([]byte(cs.TLSUnique))
@@ -89,7 +226,7 @@ func (conn *TcpConn) StartTLS(conf *tls.Config) {
 		return
 	}
 	if !conn.isClient {
-		conn.underlying = tls.Server(conn.underlying, conf)
+		conn.underlying = tls.Server(conn.underlying, conn.serverConfig(conf))
 		return
 	}
 	conn.underlying = tls.Client(conn.underlying, conf)
@@ -98,3 +235,57 @@ func (conn *TcpConn) StartTLS(conf *tls.Config) {
 func (conn *TcpConn) StartCompress(buildCompress BuildCompressor) {
 	conn.comp = buildCompress(conn.underlying)
 }
+
+// serverConfig remembers the certificate served for tls-server-end-point, as the state of a
+// server side conn doesn't tell
+func (conn *TcpConn) serverConfig(conf *tls.Config) *tls.Config {
+	conf = conf.Clone()
+	getCertificate := conf.GetCertificate
+	certs := conf.Certificates
+	conf.Certificates = nil
+	conf.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		var cert *tls.Certificate
+		if getCertificate != nil {
+			c, err := getCertificate(hello)
+			if err != nil {
+				return nil, err
+			}
+			cert = c
+		}
+		for i := 0; cert == nil && i < len(certs); i++ {
+			if hello.SupportsCertificate(&certs[i]) == nil {
+				cert = &certs[i]
+			}
+		}
+		if cert == nil && len(certs) > 0 {
+			cert = &certs[0]
+		}
+		if cert == nil {
+			return nil, ErrNoCertificate
+		}
+		conn.served.Store(cert)
+		return cert, nil
+	}
+	return conf
+}
+
+func (conn *TcpConn) serverCertificate() *x509.Certificate {
+	if conn.isClient {
+		if cs, ok := conn.TLSState(); ok && len(cs.PeerCertificates) > 0 {
+			return cs.PeerCertificates[0]
+		}
+		return nil
+	}
+	cert, _ := conn.served.Load().(*tls.Certificate)
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil
+	}
+	if cert.Leaf != nil {
+		return cert.Leaf
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
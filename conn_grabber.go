@@ -6,6 +6,8 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -17,10 +19,12 @@ const (
 	ForC2S = ConnFor("C2S")
 	ForS2S = ConnFor("S2S")
 
-	TCPConn   = ConnType("TCP")
-	TLSConn   = ConnType("TLS")
-	WSConn    = ConnType("WS-TCP")
-	WSTLSConn = ConnType("WS-TLS")
+	TCPConn     = ConnType("TCP")
+	TLSConn     = ConnType("TLS")
+	WSConn      = ConnType("WS-TCP")
+	WSTLSConn   = ConnType("WS-TLS")
+	BOSHConn    = ConnType("BOSH")
+	BOSHTLSConn = ConnType("BOSH-TLS")
 )
 
 type ConnGrabber interface {
@@ -30,13 +34,45 @@ type ConnGrabber interface {
 	Type() ConnType
 }
 
+// grabberCerts returns the store shared, or one loaded from the files
+func grabberCerts(certs *CertStore, certFile, keyFile string) (*CertStore, error) {
+	if certs != nil {
+		return certs, nil
+	}
+	certs = NewCertStore()
+	if err := certs.AddFile(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// serveHttp serves srv on its address, over tls with certificates of the store if it's given
+func serveHttp(srv *http.Server, certs *CertStore, clientCerts ClientCertPolicy) error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	if certs != nil {
+		ln = tls.NewListener(ln, clientCerts.apply(certs.TLSConfig("http/1.1")))
+	}
+	return srv.Serve(ln)
+}
+
+func listenerLogger(logger Logger, listenOn string) StructuredLogger {
+	return Structured(logger).Sub(LogSubListener).With(Field(LogKeyListener, listenOn))
+}
+
 type WsConnGrabber struct {
 	upgrader websocket.Upgrader
-	logger   Logger
+	logger   StructuredLogger
 	path     string
 	listenOn string
 
 	certFile, keyFile string
+	certs             *CertStore
+	clientCerts       ClientCertPolicy
+	proxies           TrustedProxies
+	admission         *Admission
 
 	grabbing bool
 
@@ -44,11 +80,12 @@ type WsConnGrabber struct {
 }
 
 func NewWsConnGrabber(listenOn string, path string, upgrader websocket.Upgrader, logger Logger) *WsConnGrabber {
+	upgrader.Subprotocols = []string{WsSubprotocol}
 	return &WsConnGrabber{
 		upgrader: upgrader,
 		grabbing: false,
 		path:     path,
-		listenOn: listenOn, logger: logger}
+		listenOn: listenOn, logger: listenerLogger(logger, listenOn)}
 }
 
 func (wsc *WsConnGrabber) UpgradeToTls(certFile, keyFile string) error {
@@ -60,18 +97,88 @@ func (wsc *WsConnGrabber) UpgradeToTls(certFile, keyFile string) error {
 	return nil
 }
 
+// UseCertStore serves over tls with certificates picked from the store by sni
+func (wsc *WsConnGrabber) UseCertStore(certs *CertStore) error {
+	if wsc.grabbing {
+		return errors.New("can't update to tls within grabbing")
+	}
+	wsc.certs = certs
+	return nil
+}
+
+// RequestClientCerts asks ws clients over tls for certificates by the policy
+func (wsc *WsConnGrabber) RequestClientCerts(policy ClientCertPolicy) error {
+	if wsc.grabbing {
+		return errors.New("can't update to tls within grabbing")
+	}
+	wsc.clientCerts = policy
+	return nil
+}
+
+// TrustForwardedFor takes the client of a request from a trusted proxy by X-Forwarded-For
+func (wsc *WsConnGrabber) TrustForwardedFor(proxies TrustedProxies) error {
+	if wsc.grabbing {
+		return errors.New("can't trust proxies within grabbing")
+	}
+	wsc.proxies = proxies
+	return nil
+}
+
+// UseAdmission admits ws conns by the admission, the client told by a trusted proxy is
+// what's limited
+func (wsc *WsConnGrabber) UseAdmission(admission *Admission) error {
+	if wsc.grabbing {
+		return errors.New("can't use admission within grabbing")
+	}
+	wsc.admission = admission
+	return nil
+}
+
+func (wsc *WsConnGrabber) isTls() bool {
+	return wsc.certs != nil || wsc.certFile != "" && wsc.keyFile != ""
+}
+
 func (wsc *WsConnGrabber) Grab(connChan chan Conn) error {
+	var certs *CertStore
+	if wsc.isTls() {
+		var err error
+		if certs, err = grabberCerts(wsc.certs, wsc.certFile, wsc.keyFile); err != nil {
+			return err
+		}
+	}
 	mux := http.NewServeMux()
 	mux.Handle(wsc.path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsWsRequest(r) {
+			// rfc7395 3.2, the handshake fails without the xmpp subprotocol
+			http.Error(w, "xmpp subprotocol required", http.StatusBadRequest)
+			return
+		}
+		remote := wsc.proxies.ForwardedFor(r)
+		var release func()
+		if wsc.admission != nil {
+			ip := addrIP(r.RemoteAddr)
+			if remote != nil {
+				ip = netAddrIP(remote)
+			}
+			var e error
+			if release, e = wsc.admission.AdmitIP(ip); e != nil {
+				http.Error(w, e.Error(), admissionStatus(e))
+				return
+			}
+		}
 		wsconn, e := wsc.upgrader.Upgrade(w, r, nil)
 		if e != nil {
-			wsc.logger.Printf(LogError, "upgrade ws conn err: %s\n", e.Error())
+			if release != nil {
+				release()
+			}
+			wsc.logger.Log(LogError, "upgrade ws conn error", Field(LogKeyErr, e))
 			return
 		}
-		uc := wsconn.UnderlyingConn()
-		wsc.logger.Printf(LogInfo, "comming a ws connection from %s\n", uc.RemoteAddr().String())
-		c, _ := uc.(*net.TCPConn)
-		connChan <- NewTcpConn(c, false)
+		conn := NewWsConn(wsconn)
+		conn.remote = remote
+		conn.release = release
+		wsc.logger.Log(LogInfo, "comming a ws connection", Field(LogKeyRemote, conn.RemoteAddr().String()))
+		connChan <- conn
 	}))
 	wsc.srv = &http.Server{Handler: mux, Addr: wsc.listenOn}
 	wsc.srv.RegisterOnShutdown(func() {
@@ -82,18 +189,12 @@ func (wsc *WsConnGrabber) Grab(connChan chan Conn) error {
 		defer func() {
 			wsc.grabbing = false
 		}()
-		wsc.logger.Printf(LogInfo, "ws connection listen on %s for C2S\n", wsc.listenOn)
-		var err error
-		if wsc.certFile != "" && wsc.keyFile != "" {
-			err = wsc.srv.ListenAndServeTLS(wsc.certFile, wsc.keyFile)
-		} else {
-			err = wsc.srv.ListenAndServe()
-		}
-		if err != nil {
-			wsc.logger.Printf(LogInfo, "ws conn server close unexpected: %s\n", err.Error())
+		wsc.logger.Log(LogInfo, "ws connection listen for C2S")
+		if err := serveHttp(wsc.srv, certs, wsc.clientCerts); err != nil {
+			wsc.logger.Log(LogInfo, "ws conn server close unexpected", Field(LogKeyErr, err))
 			return
 		}
-		wsc.logger.Printf(LogInfo, "ws server quit normally\n")
+		wsc.logger.Log(LogInfo, "ws server quit normally")
 	}()
 	return nil
 }
@@ -109,27 +210,37 @@ func (wsc *WsConnGrabber) For() ConnFor {
 }
 
 func (wsc *WsConnGrabber) Type() ConnType {
-	if wsc.certFile != "" && wsc.keyFile != "" {
+	if wsc.isTls() {
 		return WSTLSConn
 	}
 	return WSConn
 }
 
+// the time a direct tls client has to finish the handshake
+const tlsHandshakeTimeout = time.Second * 10
+
 type TcpConnGrabber struct {
 	listenOn string
 	connFor  ConnFor
-	logger   Logger
+	logger   StructuredLogger
 	grabbing bool
 
-	keyFile  string
-	certFile string
+	keyFile     string
+	certFile    string
+	store       *CertStore
+	protos      []string
+	clientCerts ClientCertPolicy
+	proxies     TrustedProxies
+	admission   *Admission
 
-	quit chan bool
-	ln   net.Listener
+	config     *tls.Config
+	quit       chan bool
+	ln         net.Listener
+	handshakes sync.WaitGroup
 }
 
 func NewTcpConnGrabber(listenOn string, connFor ConnFor, logger Logger) *TcpConnGrabber {
-	return &TcpConnGrabber{listenOn: listenOn, connFor: connFor, quit: make(chan bool), logger: logger}
+	return &TcpConnGrabber{listenOn: listenOn, connFor: connFor, quit: make(chan bool), logger: listenerLogger(logger, listenOn)}
 }
 
 func (tc *TcpConnGrabber) UpgradeToTls(certFile, keyFile string) error {
@@ -141,23 +252,77 @@ func (tc *TcpConnGrabber) UpgradeToTls(certFile, keyFile string) error {
 	return nil
 }
 
+// UpgradeToDirectTls makes the listener xep-0368 direct tls, certificates are picked from
+// the store by sni and one of protos is negotiated by alpn, the alpn protocol of the conn
+// grabbed is by default
+func (tc *TcpConnGrabber) UpgradeToDirectTls(store *CertStore, protos ...string) error {
+	if tc.grabbing {
+		return errors.New("tcp conn grabber grabbing, can't upgrade to tls")
+	}
+	tc.store = store
+	tc.protos = protos
+	return nil
+}
+
+// RequestClientCerts asks direct tls clients for certificates by the policy
+func (tc *TcpConnGrabber) RequestClientCerts(policy ClientCertPolicy) error {
+	if tc.grabbing {
+		return errors.New("tcp conn grabber grabbing, can't request client certs")
+	}
+	tc.clientCerts = policy
+	return nil
+}
+
+// AcceptProxyProtocol reads a proxy protocol header of conns from the proxies, before the
+// tls handshake if it's direct tls, the conns grabbed have the addresses it tells
+func (tc *TcpConnGrabber) AcceptProxyProtocol(proxies TrustedProxies) error {
+	if tc.grabbing {
+		return errors.New("tcp conn grabber grabbing, can't accept proxy protocol")
+	}
+	tc.proxies = proxies
+	return nil
+}
+
+// UseAdmission admits conns by the admission, the client told by a trusted proxy is
+// what's limited
+func (tc *TcpConnGrabber) UseAdmission(admission *Admission) error {
+	if tc.grabbing {
+		return errors.New("tcp conn grabber grabbing, can't use admission")
+	}
+	tc.admission = admission
+	return nil
+}
+
 func (tc *TcpConnGrabber) ReplaceLogger(logger Logger) {
-	tc.logger = logger
+	tc.logger = listenerLogger(logger, tc.listenOn)
+}
+
+func (tc *TcpConnGrabber) tlsConfig() (*tls.Config, error) {
+	store, err := grabberCerts(tc.store, tc.certFile, tc.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	protos := tc.protos
+	if len(protos) == 0 {
+		protos = []string{ALPNClient}
+		if tc.connFor == ForS2S {
+			protos = []string{ALPNServer}
+		}
+	}
+	return tc.clientCerts.apply(store.TLSConfig(protos...)), nil
 }
 
 func (tc *TcpConnGrabber) Grab(connChan chan Conn) error {
 	var err error
-	if tc.certFile != "" && tc.keyFile != "" {
-		cert, e := tls.LoadX509KeyPair(tc.certFile, tc.keyFile)
+	if tc.isTls() {
+		config, e := tc.tlsConfig()
 		if e != nil {
 			return e
 		}
-		config := tls.Config{Certificates: []tls.Certificate{cert}}
-		tc.ln, err = tls.Listen("tcp", tc.listenOn, &config)
-	} else {
-		tc.ln, err = net.Listen("tcp", tc.listenOn)
+		tc.config = config
 	}
-	tc.logger.Printf(LogInfo, "tcp connection Listen on %s for %s\n", tc.listenOn, tc.connFor)
+	tc.ln, err = net.Listen("tcp", tc.listenOn)
+	tc.logger.Log(LogInfo, "tcp connection listen", Field("for", tc.connFor))
 	if err != nil {
 		return err
 	}
@@ -166,28 +331,87 @@ func (tc *TcpConnGrabber) Grab(connChan chan Conn) error {
 		defer func() {
 			tc.grabbing = false
 		}()
+		var backoff acceptBackoff
 		for {
-			select {
-			case <-tc.quit:
-				close(connChan)
-				return
-			default:
-				conn, err := tc.ln.Accept()
-				if err != nil {
-					continue
+			conn, err := tc.ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					tc.logger.Log(LogError, "accept tcp conn error", Field(LogKeyErr, err))
 				}
-				if conn == nil {
+				select {
+				case <-tc.quit:
+					tc.handshakes.Wait()
 					close(connChan)
 					return
+				case <-time.After(backoff.next()):
 				}
-				tc.logger.Printf(LogInfo, "comming a tcp connection from %s on %s\n", conn.RemoteAddr().String(), tc.listenOn)
-				connChan <- NewTcpConn(conn, false)
+				continue
+			}
+			backoff.reset()
+			if tc.config != nil || tc.proxies.Trusts(conn.RemoteAddr()) {
+				tc.handshakes.Add(1)
+				go tc.handshake(conn, connChan)
+				continue
+			}
+			if c, ok := tc.admit(conn); ok {
+				connChan <- c
 			}
 		}
 	}()
 	return nil
 }
 
+// admit makes the conn grabbed if it's admitted, or closes it
+func (tc *TcpConnGrabber) admit(raw net.Conn) (*TcpConn, bool) {
+	var release func()
+	if tc.admission != nil {
+		var err error
+		if release, err = tc.admission.Admit(raw.RemoteAddr()); err != nil {
+			raw.Close()
+			return nil, false
+		}
+	}
+	tc.logger.Log(LogInfo, "comming a tcp connection", Field(LogKeyRemote, raw.RemoteAddr().String()))
+	conn := NewTcpConn(raw, false)
+	conn.release = release
+	return conn, true
+}
+
+// handshake reads the proxy protocol header of a trusted proxy and finishes the tls
+// handshake before the conn is grabbed, so the client, alpn and sni are known
+func (tc *TcpConnGrabber) handshake(raw net.Conn, connChan chan Conn) {
+	defer tc.handshakes.Done()
+	if tc.proxies.Trusts(raw.RemoteAddr()) {
+		proxied, err := ReadProxyHeader(raw)
+		if err != nil {
+			tc.logger.Log(LogWarning, "proxy protocol header error", Field("proxy", raw.RemoteAddr().String()), Field(LogKeyErr, err))
+			raw.Close()
+			return
+		}
+		raw = proxied
+	}
+	conn, ok := tc.admit(raw)
+	if !ok {
+		return
+	}
+	if tc.config == nil {
+		connChan <- conn
+		return
+	}
+	conn.StartTLS(tc.config)
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.underlying.(*tls.Conn).Handshake(); err != nil {
+		tc.logger.Log(LogWarning, "tls handshake error", Field(LogKeyRemote, conn.RemoteAddr().String()), Field(LogKeyErr, err))
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	cs, _ := conn.TLSState()
+	tc.logger.Log(LogDebug, "tls handshake done", Field(LogKeyRemote, conn.RemoteAddr().String()),
+		Field("alpn", cs.NegotiatedProtocol), Field("sni", cs.ServerName))
+	connChan <- conn
+}
+
 func (tc *TcpConnGrabber) Cancel() {
 	tc.ln.Close()
 	tc.quit <- true
@@ -197,8 +421,12 @@ func (tc *TcpConnGrabber) For() ConnFor {
 	return tc.connFor
 }
 
+func (tc *TcpConnGrabber) isTls() bool {
+	return tc.store != nil || tc.certFile != "" && tc.keyFile != ""
+}
+
 func (tc *TcpConnGrabber) Type() ConnType {
-	if tc.certFile != "" && tc.keyFile != "" {
+	if tc.isTls() {
 		return TLSConn
 	}
 	return TCPConn
@@ -23,7 +23,7 @@ func Start() {
 		return
 	}
 	attr := xmppcore.PartAttr{
-		JID:     xmppcore.JID{Domain: "hello-world.im", Resource: "/hello-world", Username: "test"},
+		JID:     xmppcore.JID{Domain: "hello-world.im", Resource: "hello-world", Username: "test"},
 		Version: "1.0",
 		Domain:  "hello-world.im",
 	}
@@ -40,7 +40,7 @@ func Start() {
 	// 	return xmppcore.NewCompZlib(rw)
 	// })
 	// client.WithFeature(comp)
-	client.Channel().SetLogger(logger)
+	client.Channel().SetLogger(client.Logger())
 	if err := client.Negotiate(); err != nil {
 		fmt.Printf("client negotiate error: %s\n", err.Error())
 	}
@@ -10,6 +10,16 @@ type WsConnConfig struct {
 	ReadBufSize  uint   `yml:"read_buf_size"`
 	WriteBufSize uint   `yml:"write_buf_size"`
 
+	CertFile string `yml:"cert_file"`
+	KeyFile  string `yml:"key_file"`
+	// cidrs of the proxies of which X-Forwarded-For is trusted
+	TrustedProxies []string `yml:"trusted_proxies"`
+}
+
+type BoshConnConfig struct {
+	ListenOn string `yml:"listen_on"`
+	Path     string `yml:"path"`
+
 	CertFile string `yml:"cert_file"`
 	KeyFile  string `yml:"key_file"`
 }
@@ -20,14 +30,25 @@ type TcpConnConfig struct {
 
 	CertFile string `yml:"cert_file"`
 	KeyFile  string `yml:"key_file"`
+	// cidrs of the proxies which send a proxy protocol header
+	TrustedProxies []string `yml:"trusted_proxies"`
+	// xep-0138 compression, off if it's not enabled
+	Compression xmppcore.CompressPolicy `yml:"compression"`
 }
 
 type Config struct {
-	WsConns  []WsConnConfig  `yml:"ws_conns"`
-	TcpConns []TcpConnConfig `yml:"tcp_conns"`
-	Domain   string          `yml:"domain"`
-	CertFile string          `yml:"cert_file"`
-	KeyFile  string          `yml:"key_file"`
+	WsConns   []WsConnConfig   `yml:"ws_conns"`
+	BoshConns []BoshConnConfig `yml:"bosh_conns"`
+	TcpConns  []TcpConnConfig  `yml:"tcp_conns"`
+	Domain    string           `yml:"domain"`
+	CertFile  string           `yml:"cert_file"`
+	KeyFile   string           `yml:"key_file"`
+	// clients with certificates of the cas may log in by sasl external
+	ClientCAFile string `yml:"client_ca_file"`
+	// limits the conns of all the listeners
+	Admission xmppcore.AdmissionConfig `yml:"admission"`
+	Allow     []string                 `yml:"allow"`
+	Deny      []string                 `yml:"deny"`
 }
 
 var DefaultConfig Config
@@ -40,13 +61,17 @@ func init() {
 			{ListenOn: ":80", Path: "/ws", ReadBufSize: 1024, WriteBufSize: 1024},
 			{ListenOn: ":443", Path: "/ws", ReadBufSize: 1024, WriteBufSize: 1024, CertFile: cf, KeyFile: kf},
 		},
+		BoshConns: []BoshConnConfig{
+			{ListenOn: ":5280", Path: "/http-bind"},
+		},
 		TcpConns: []TcpConnConfig{
-			{ListenOn: ":5221", For: xmppcore.ForC2S},
-			{ListenOn: ":5222", For: xmppcore.ForC2S, CertFile: cf, KeyFile: kf},
-			{ListenOn: ":5223", For: xmppcore.ForS2S},
+			{ListenOn: ":5221", For: xmppcore.ForC2S, Compression: xmppcore.DefaultCompressPolicy},
+			{ListenOn: ":5222", For: xmppcore.ForC2S, CertFile: cf, KeyFile: kf, Compression: xmppcore.DefaultCompressPolicy},
+			{ListenOn: ":5223", For: xmppcore.ForS2S, Compression: xmppcore.DefaultCompressPolicy},
 		},
-		Domain:   "hello-world.im",
-		CertFile: cf,
-		KeyFile:  kf,
+		Domain:    "hello-world.im",
+		CertFile:  cf,
+		KeyFile:   kf,
+		Admission: xmppcore.DefaultAdmissionConfig,
 	}
 }
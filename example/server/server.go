@@ -5,10 +5,14 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/x509"
+	"errors"
 	"hash"
 	"io"
 	"os"
 	"sync"
+	"syscall"
+	"time"
 
 	xmppcore "github.com/yang-zzhong/xmpp-core"
 
@@ -20,7 +24,11 @@ type Server struct {
 	logger xmppcore.Logger
 
 	connGrabbers []xmppcore.ConnGrabber
-	conns        []xmppcore.Conn
+	certs        *xmppcore.CertStore
+	clientCerts  xmppcore.ClientCertPolicy
+	admission    *xmppcore.Admission
+	conns        map[xmppcore.Conn]struct{}
+	connsMu      sync.Mutex
 	wg           sync.WaitGroup
 }
 
@@ -28,11 +36,42 @@ func New(conf *Config) *Server {
 	return &Server{
 		config:       conf,
 		connGrabbers: []xmppcore.ConnGrabber{},
-		conns:        []xmppcore.Conn{},
+		certs:        xmppcore.NewCertStore(),
+		conns:        make(map[xmppcore.Conn]struct{}),
 		logger:       xmppcore.NewLogger(os.Stdout)}
 }
 
 func (s *Server) Start() error {
+	admissionConfig := DefaultConfig.Admission
+	if s.config.Admission != (xmppcore.AdmissionConfig{}) {
+		admissionConfig = s.config.Admission
+	}
+	s.admission = xmppcore.NewAdmission(admissionConfig)
+	s.admission.SetLogger(s.logger)
+	if err := s.SetAccessLists(s.config.Allow, s.config.Deny); err != nil {
+		return err
+	}
+	s.certs.SetLogger(s.logger)
+	if s.config.CertFile != "" && s.config.KeyFile != "" {
+		if err := s.certs.AddFile(s.config.CertFile, s.config.KeyFile); err != nil {
+			return err
+		}
+	}
+	if s.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(s.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		s.clientCerts.CAs = x509.NewCertPool()
+		if !s.clientCerts.CAs.AppendCertsFromPEM(pem) {
+			return errors.New("no certificate in the client ca file")
+		}
+	}
+	s.certs.OnExpiring(time.Hour*24*30, func(expiry xmppcore.CertExpiry) {
+		s.logger.Printf(xmppcore.LogWarning, "certificate of %v lapses at %s", expiry.Names, expiry.NotAfter)
+	})
+	s.certs.Watch(time.Minute)
+	s.certs.ReloadOn(syscall.SIGHUP)
 	wsConnsConfig := DefaultConfig.WsConns
 	if len(s.config.WsConns) > 0 {
 		wsConnsConfig = s.config.WsConns
@@ -40,12 +79,34 @@ func (s *Server) Start() error {
 	for _, conf := range wsConnsConfig {
 		s.initConnGrabber(conf, func(c interface{}) xmppcore.ConnGrabber {
 			conf := c.(WsConnConfig)
-			return xmppcore.NewWsConnGrabber(
+			grabber := xmppcore.NewWsConnGrabber(
 				conf.ListenOn,
 				conf.Path,
 				websocket.Upgrader{
 					ReadBufferSize:  int(conf.ReadBufSize),
 					WriteBufferSize: int(conf.WriteBufSize)}, s.logger)
+			if conf.CertFile != "" && conf.KeyFile != "" {
+				if err := s.certs.AddFile(conf.CertFile, conf.KeyFile); err != nil {
+					panic(err)
+				}
+				grabber.UseCertStore(s.certs)
+				grabber.RequestClientCerts(s.clientCerts)
+			}
+			grabber.TrustForwardedFor(trustedProxies(conf.TrustedProxies))
+			grabber.UseAdmission(s.admission)
+			return grabber
+		})
+	}
+	boshConnsConfig := DefaultConfig.BoshConns
+	if len(s.config.BoshConns) > 0 {
+		boshConnsConfig = s.config.BoshConns
+	}
+	for _, conf := range boshConnsConfig {
+		s.initConnGrabber(conf, func(c interface{}) xmppcore.ConnGrabber {
+			conf := c.(BoshConnConfig)
+			grabber := xmppcore.NewBoshConnGrabber(conf.ListenOn, conf.Path, s.logger)
+			grabber.UseAdmission(s.admission)
+			return grabber
 		})
 	}
 	tcpConnsConfig := DefaultConfig.TcpConns
@@ -55,13 +116,32 @@ func (s *Server) Start() error {
 	for _, conf := range tcpConnsConfig {
 		s.initConnGrabber(conf, func(c interface{}) xmppcore.ConnGrabber {
 			conf := c.(TcpConnConfig)
-			return xmppcore.NewTcpConnGrabber(conf.ListenOn, conf.For, s.logger)
+			grabber := xmppcore.NewTcpConnGrabber(conf.ListenOn, conf.For, s.logger)
+			if conf.CertFile != "" && conf.KeyFile != "" {
+				// xep-0368, direct tls for both c2s and s2s told by alpn
+				if err := s.certs.AddFile(conf.CertFile, conf.KeyFile); err != nil {
+					panic(err)
+				}
+				grabber.UpgradeToDirectTls(s.certs, xmppcore.ALPNClient, xmppcore.ALPNServer)
+				grabber.RequestClientCerts(s.clientCerts)
+			}
+			grabber.AcceptProxyProtocol(trustedProxies(conf.TrustedProxies))
+			grabber.UseAdmission(s.admission)
+			return compressingGrabber{ConnGrabber: grabber, policy: conf.Compression}
 		})
 	}
 	s.wg.Wait()
 	return nil
 }
 
+func trustedProxies(cidrs []string) xmppcore.TrustedProxies {
+	proxies, err := xmppcore.ParseTrustedProxies(cidrs...)
+	if err != nil {
+		panic(err)
+	}
+	return proxies
+}
+
 type connGrabberBuilder func(interface{}) xmppcore.ConnGrabber
 
 func (s *Server) initConnGrabber(conf interface{}, builder connGrabberBuilder) {
@@ -79,27 +159,44 @@ func (s *Server) initConnGrabber(conf interface{}, builder connGrabberBuilder) {
 				s.wg.Done()
 				return
 			}
-			s.conns = append(s.conns, conn)
+			s.connsMu.Lock()
+			s.conns[conn] = struct{}{}
+			s.connsMu.Unlock()
 			go func() {
-				s.onConn(conn, grabber.For(), grabber.Type())
+				defer func() {
+					conn.Close()
+					s.connsMu.Lock()
+					delete(s.conns, conn)
+					s.connsMu.Unlock()
+				}()
+				s.onConn(conn, grabber)
 			}()
 		}
 	}()
 }
 
+// SetAccessLists replaces the cidrs allowed and denied of all the listeners
+func (s *Server) SetAccessLists(allow, deny []string) error {
+	return s.admission.SetAccessLists(allow, deny)
+}
+
 func (s *Server) Stop() {
-	for _, conn := range s.conns {
+	s.connsMu.Lock()
+	for conn := range s.conns {
 		conn.Close()
 	}
+	s.connsMu.Unlock()
 	for _, grabber := range s.connGrabbers {
 		grabber.Cancel()
 	}
+	s.certs.Stop()
 }
 
 var (
 	memoryAuthUserFetcher      *xmppcore.MemoryAuthUserFetcher
 	memoryPlainAuthUserFetcher *xmppcore.MemoryPlainAuthUserFetcher
 	memoryAuthorized           *xmppcore.MemoryAuthorized
+	memoryTokenStore           *xmppcore.MemoryTokenStore
 )
 
 func init() {
@@ -113,26 +210,50 @@ func init() {
 	memoryPlainAuthUserFetcher = xmppcore.NewMemoryPlainAuthUserFetcher()
 	memoryPlainAuthUserFetcher.Add(xmppcore.NewMemoryPlainAuthUser("test", string(md5.New().Sum([]byte("123456")))))
 	memoryAuthorized = xmppcore.NewMemoryAuthorized()
+	memoryTokenStore = xmppcore.NewMemoryTokenStore()
 }
 
-func (s *Server) onConn(conn xmppcore.Conn, connFor xmppcore.ConnFor, connType xmppcore.ConnType) {
+// compressingGrabber is a grabber of which conns may be compressed by the policy
+type compressingGrabber struct {
+	xmppcore.ConnGrabber
+	policy xmppcore.CompressPolicy
+}
+
+func (s *Server) onConn(conn xmppcore.Conn, grabber xmppcore.ConnGrabber) {
+	connFor := xmppcore.ConnForALPN(xmppcore.ConnALPN(conn), grabber.For())
+	// rfc7395 3.8 and xep-0206 leave compression to the transport, so ws and bosh conns
+	// are never compressed
+	var compression xmppcore.CompressPolicy
+	if cg, ok := grabber.(compressingGrabber); ok {
+		compression = cg.policy
+	}
 	if connFor == xmppcore.ForC2S {
-		s.c2sHandler(conn, connType)
+		s.c2sHandler(conn, grabber.Type(), compression)
 	} else if connFor == xmppcore.ForS2S {
-		s.s2sHandler(conn, connType)
+		s.s2sHandler(conn, grabber.Type(), compression)
 	}
 }
 
-func (s *Server) c2sHandler(conn xmppcore.Conn, connType xmppcore.ConnType) {
-	c2s := xmppcore.NewXPart(conn, s.config.Domain, s.logger)
-	c2s.Channel().SetLogger(s.logger)
+func (s *Server) c2sHandler(conn xmppcore.Conn, connType xmppcore.ConnType, compression xmppcore.CompressPolicy) {
+	c2s := xmppcore.NewXPart(conn, s.domain(conn), s.logger)
+	c2s.Channel().SetLogger(c2s.Logger())
+	if channel, ok := c2s.Channel().(*xmppcore.XChannel); ok {
+		channel.SetParserLimits(xmppcore.DefaultParserLimits)
+	}
+	c2s.EnableLiveness(xmppcore.DefaultLivenessConfig)
 	sasl := xmppcore.SASLFeature(memoryAuthorized)
 	sasl.Support(xmppcore.SM_PLAIN, xmppcore.NewPlainAuth(memoryPlainAuthUserFetcher, md5.New))
 	if s.config.CertFile != "" && s.config.KeyFile != "" || connType == xmppcore.TLSConn || connType == xmppcore.WSTLSConn {
-		if connType == xmppcore.TCPConn || connType == xmppcore.WSConn {
-			tls := xmppcore.TlsFeature(s.config.CertFile, s.config.KeyFile, true)
+		if connType == xmppcore.TCPConn {
+			tls := xmppcore.CertsTlsFeature(s.certs, true)
+			tls.RequestClientCerts(s.clientCerts)
 			c2s.WithFeature(&tls)
 		}
+		sasl.AdvertiseChannelBindings(conn)
+		if s.clientCerts.CAs != nil {
+			// fails without a client certificate verified, after starttls there may be one
+			sasl.Support(xmppcore.SM_EXTERNAL, xmppcore.NewExternalAuth(xmppcore.XmppAddrCertMapper))
+		}
 		sasl.Support(xmppcore.SM_SCRAM_SHA_1_PLUS, xmppcore.NewScramAuth(memoryAuthUserFetcher, sha1.New, true))
 		sasl.Support(xmppcore.SM_SCRAM_SHA_256_PLUS, xmppcore.NewScramAuth(memoryAuthUserFetcher, sha256.New, true))
 		sasl.Support(xmppcore.SM_SCRAM_SHA_512_PLUS, xmppcore.NewScramAuth(memoryAuthUserFetcher, sha512.New, true))
@@ -142,18 +263,39 @@ func (s *Server) c2sHandler(conn xmppcore.Conn, connType xmppcore.ConnType) {
 		sasl.Support(xmppcore.SM_SCRAM_SHA_512, xmppcore.NewScramAuth(memoryAuthUserFetcher, sha512.New, true))
 	}
 	c2s.WithFeature(&sasl)
-	compress := xmppcore.CompressFeature()
-	compress.Support(xmppcore.ZLIB, func(conn io.ReadWriter) xmppcore.Compressor {
-		return xmppcore.NewCompZlib(conn)
-	})
-	c2s.WithFeature(&compress)
 	bind := xmppcore.BindFeature(memoryAuthorized)
+	// xep-0388, authenticated by either of them, and bound inline by xep-0386
+	sasl2 := xmppcore.SASL2Feature(&sasl)
+	sasl2.WithInline(xmppcore.Bind2Inline(&bind))
+	// xep-0484, reconnecting clients log in with a token rather than the password
+	fast := xmppcore.FastInline(memoryTokenStore, xmppcore.DefaultFastTokenLifetime)
+	fast.AdvertiseChannelBindings(conn)
+	sasl2.WithInline(fast)
+	c2s.WithFeature(&sasl2)
+	if compression.Enabled {
+		compress := xmppcore.CompressFeature()
+		compress.SetPolicy(compression, conn)
+		compress.Support(xmppcore.ZLIB, func(conn io.ReadWriter) xmppcore.Compressor {
+			return xmppcore.NewCompZlib(conn)
+		})
+		c2s.WithFeature(&compress)
+	}
 	c2s.WithFeature(&bind)
 	if err := <-c2s.Run(); err != nil {
 		s.logger.Printf(xmppcore.LogError, err.Error())
 	}
 }
 
-func (s *Server) s2sHandler(conn xmppcore.Conn, connType xmppcore.ConnType) {
-	s.c2sHandler(conn, connType)
+// domain is the sni hostname if there's a certificate for it, the configured one otherwise
+func (s *Server) domain(conn xmppcore.Conn) string {
+	if name := xmppcore.ConnServerName(conn); name != "" {
+		if _, ok := s.certs.Certificate(name); ok {
+			return name
+		}
+	}
+	return s.config.Domain
+}
+
+func (s *Server) s2sHandler(conn xmppcore.Conn, connType xmppcore.ConnType, compression xmppcore.CompressPolicy) {
+	s.c2sHandler(conn, connType, compression)
 }
@@ -0,0 +1,189 @@
+package xmppcore
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+// xep-0178, sasl external authenticates with the client certificate verified in the tls
+// handshake
+
+var (
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	// id-on-xmppAddr, rfc6120 13.7.1.4
+	oidXmppAddr = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 8, 5}
+)
+
+// CertMapper maps the certificate of a client to a username, authzid is the jid the client
+// asks to be, empty if it doesn't
+type CertMapper interface {
+	CertUsername(cert *x509.Certificate, authzid string, part Part) (string, error)
+}
+
+type CertMapperFunc func(cert *x509.Certificate, authzid string, part Part) (string, error)
+
+func (f CertMapperFunc) CertUsername(cert *x509.Certificate, authzid string, part Part) (string, error) {
+	return f(cert, authzid, part)
+}
+
+// XmppAddrCertMapper maps a certificate by the xmppAddrs of its subject alternative names
+// to the localpart of the jid of the domain of the part. a certificate of more than one jid
+// requires the client to tell which by authzid
+var XmppAddrCertMapper = CertMapperFunc(func(cert *x509.Certificate, authzid string, part Part) (string, error) {
+	return mapCertAddrs(CertXmppAddrs(cert), authzid, part)
+})
+
+// CommonNameCertMapper maps a certificate as XmppAddrCertMapper does, but takes the common name
+// of its subject as the jid when it has no xmppAddr. it's for legacy certificates only, the
+// common name is not meant to carry a jid
+var CommonNameCertMapper = CertMapperFunc(func(cert *x509.Certificate, authzid string, part Part) (string, error) {
+	addrs := CertXmppAddrs(cert)
+	if len(addrs) == 0 && cert.Subject.CommonName != "" {
+		addrs = []string{cert.Subject.CommonName}
+	}
+	return mapCertAddrs(addrs, authzid, part)
+})
+
+func mapCertAddrs(addrs []string, authzid string, part Part) (string, error) {
+	var asked JID
+	if authzid != "" {
+		if err := ParseJID(authzid, &asked); err != nil {
+			return "", SaslFailureError(SFInvalidAuthzid, "")
+		}
+	}
+	users := []string{}
+	for _, addr := range addrs {
+		var jid JID
+		if err := ParseJID(addr, &jid); err != nil || jid.Username == "" || jid.Domain != part.Attr().Domain {
+			continue
+		}
+		if authzid != "" && !jid.Bare().Equal(asked.Bare()) {
+			continue
+		}
+		users = append(users, UnescapeLocalpart(jid.Username))
+	}
+	switch {
+	case len(users) == 1:
+		return users[0], nil
+	case len(users) > 1:
+		return "", SaslFailureError(SFInvalidAuthzid, "certificate of many jids, authzid required")
+	case authzid != "":
+		return "", SaslFailureError(SFInvalidAuthzid, "")
+	}
+	return "", SaslFailureError(SFNotAuthorized, "no jid of the domain in the certificate")
+}
+
+// CertXmppAddrs returns the xmppAddrs in the subject alternative names of cert
+func CertXmppAddrs(cert *x509.Certificate) []string {
+	addrs := []string{}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var names asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			continue
+		}
+		for rest := names.Bytes; len(rest) > 0; {
+			var name asn1.RawValue
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &name); err != nil {
+				break
+			}
+			// otherName [0] { type-id, [0] EXPLICIT value }
+			if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+				continue
+			}
+			var id asn1.ObjectIdentifier
+			value, err := asn1.Unmarshal(name.Bytes, &id)
+			if err != nil || !id.Equal(oidXmppAddr) {
+				continue
+			}
+			var explicit asn1.RawValue
+			if _, err := asn1.Unmarshal(value, &explicit); err != nil {
+				continue
+			}
+			var addr string
+			if _, err := asn1.UnmarshalWithParams(explicit.Bytes, &addr, "utf8"); err == nil {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// VerifiedPeerCertificate returns the certificate of the peer verified in the tls handshake
+// of the conn, nil if there's none
+func VerifiedPeerCertificate(conn Conn) *x509.Certificate {
+	cs, ok := connTLSState(conn)
+	if !ok || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return cs.VerifiedChains[0][0]
+}
+
+type ExternalAuth struct {
+	mapper CertMapper
+}
+
+func NewExternalAuth(mapper CertMapper) *ExternalAuth {
+	return &ExternalAuth{mapper: mapper}
+}
+
+func (auth *ExternalAuth) Auth(mechanism, authInfo string, part Part) (username string, err error) {
+	cert := VerifiedPeerCertificate(part.Conn())
+	if cert == nil {
+		if _, ok := connTLSState(part.Conn()); !ok {
+			return "", SaslFailureError(SFEncryptionRequired, "")
+		}
+		return "", SaslFailureError(SFNotAuthorized, "no client certificate verified")
+	}
+	// xep-0178, = is an empty response
+	var authzid string
+	if authInfo != "=" && authInfo != "" {
+		if err = AuthPayload(authInfo, &authzid); err != nil {
+			return
+		}
+	}
+	if username, err = auth.mapper.CertUsername(cert, authzid, part); err != nil {
+		return
+	}
+	part.Logger().Sub(LogSubAuth).Log(LogDebug, "external authenticated", Field("subject", cert.Subject.String()))
+	err = part.Channel().SendElement(stravaganza.NewBuilder("success").WithAttribute("xmlns", NSSasl).Build())
+	return
+}
+
+// ExternalToAuth authenticates with the client certificate of the tls config, authzid is
+// the jid to be, empty to let the server tell by the certificate
+type ExternalToAuth struct {
+	authzid string
+}
+
+func NewExternalToAuth(authzid string) *ExternalToAuth {
+	return &ExternalToAuth{authzid: authzid}
+}
+
+func (eta *ExternalToAuth) ToAuth(mech string, part Part) error {
+	payload := "="
+	if eta.authzid != "" {
+		payload = base64.StdEncoding.EncodeToString([]byte(eta.authzid))
+	}
+	elem := stravaganza.NewBuilder("auth").
+		WithAttribute("xmlns", NSSasl).
+		WithAttribute("mechanism", SM_EXTERNAL).
+		WithText(payload).Build()
+	if err := part.Channel().SendElement(elem); err != nil {
+		return err
+	}
+	if err := part.Channel().NextElement(&elem); err != nil {
+		return err
+	}
+	if elem.Name() != "success" {
+		return errors.New("server failed auth")
+	}
+	return nil
+}
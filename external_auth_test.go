@@ -0,0 +1,119 @@
+package xmppcore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testClientCertificate makes a client certificate signed by ca, of which subject
+// alternative names carry the xmppAddrs
+func testClientCertificate(t *testing.T, ca tls.Certificate, cn string, addrs ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key error: %s", err.Error())
+	}
+	names := []byte{}
+	for _, addr := range addrs {
+		oid, _ := asn1.Marshal(oidXmppAddr)
+		value, _ := asn1.MarshalWithParams(addr, "utf8")
+		explicit, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value})
+		name, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: append(oid, explicit...)})
+		names = append(names, name...)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if len(addrs) > 0 {
+		san, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: names})
+		tmpl.ExtraExtensions = []pkix.Extension{{Id: oidSubjectAltName, Value: san}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		t.Fatalf("create certificate error: %s", err.Error())
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestXmppAddrCertMapper(t *testing.T) {
+	ca := testCertificate(t, time.Now().Add(time.Hour), "ca.hello-world.im")
+	conn, client := tlsTestConns(t, tls.VersionTLS13)
+	defer conn.Close()
+	defer client.Close()
+	part := NewXPart(conn, "hello-world.im", NewLogger(io.Discard))
+	for _, c := range []struct {
+		mapper   CertMapper
+		cn       string
+		addrs    []string
+		authzid  string
+		username string
+		failure  string
+	}{
+		{XmppAddrCertMapper, "device", []string{"juliet@hello-world.im"}, "", "juliet", ""},
+		{XmppAddrCertMapper, "juliet@hello-world.im", nil, "", "", SFNotAuthorized},
+		{XmppAddrCertMapper, "device", []string{"juliet@hello-world.im", "romeo@hello-world.im"}, "", "", SFInvalidAuthzid},
+		{XmppAddrCertMapper, "device", []string{"juliet@hello-world.im", "romeo@hello-world.im"}, "romeo@hello-world.im", "romeo", ""},
+		{XmppAddrCertMapper, "device", []string{"juliet@hello-world.im"}, "romeo@hello-world.im", "", SFInvalidAuthzid},
+		{XmppAddrCertMapper, "device", []string{"juliet@capulet.example"}, "", "", SFNotAuthorized},
+		{CommonNameCertMapper, "juliet@hello-world.im", nil, "", "juliet", ""},
+		{CommonNameCertMapper, "juliet@hello-world.im", []string{"romeo@hello-world.im"}, "", "romeo", ""},
+		{CommonNameCertMapper, "device", nil, "", "", SFNotAuthorized},
+	} {
+		cert := testClientCertificate(t, ca, c.cn, c.addrs...)
+		username, err := c.mapper.CertUsername(cert.Leaf, c.authzid, part)
+		if c.failure == "" {
+			if err != nil || username != c.username {
+				t.Fatalf("%v authzid %q mapped to %q %v", c.addrs, c.authzid, username, err)
+			}
+			continue
+		}
+		if failure, ok := err.(Failure); !ok || failure.DescTag != c.failure {
+			t.Fatalf("%v authzid %q should fail by %s, got %v", c.addrs, c.authzid, c.failure, err)
+		}
+	}
+}
+
+func TestExternalOverTls(t *testing.T) {
+	serverCert := testCertificate(t, time.Now().Add(time.Hour), "hello-world.im")
+	ca := testCertificate(t, time.Now().Add(time.Hour), "ca.hello-world.im")
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.Leaf)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	clientCert := testClientCertificate(t, ca, "device", "juliet@hello-world.im")
+
+	serverConf := ClientCertPolicy{CAs: clientCAs}.apply(&tls.Config{Certificates: []tls.Certificate{serverCert}})
+	if serverConf.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Fatalf("client certificates should be verified if given")
+	}
+	serverConn, clientConn := tlsTestConnsWith(t, serverConf, &tls.Config{
+		RootCAs: roots, ServerName: "hello-world.im", Certificates: []tls.Certificate{clientCert}})
+	if cert := VerifiedPeerCertificate(serverConn); cert == nil || cert.Subject.CommonName != "device" {
+		t.Fatalf("the client certificate should be verified")
+	}
+	sasl := SASLFeature(NewMemoryAuthorized())
+	sasl.Support(SM_EXTERNAL, NewExternalAuth(XmppAddrCertMapper))
+	clientSasl := ClientSASLFeature()
+	clientSasl.Support(SM_EXTERNAL, NewExternalToAuth(""))
+	server, _, err := negotiateParts(t, serverConn, clientConn, []Feature{&sasl}, []ElemHandler{clientSasl})
+	if err != nil {
+		t.Fatalf("negotiate error: %s", err.Error())
+	}
+	if server.Attr().JID.String() != "juliet@hello-world.im" {
+		t.Fatalf("authenticated as %q", server.Attr().JID.String())
+	}
+}
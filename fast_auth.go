@@ -0,0 +1,250 @@
+package xmppcore
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+var (
+	ErrFastTokenReplayed = errors.New("fast token count replayed")
+	ErrFastMechanism     = errors.New("not a fast mechanism")
+	ErrFastNoToken       = errors.New("no fast token to authenticate with")
+	ErrFastServerProof   = errors.New("server failed to prove the fast token")
+)
+
+const (
+	NSFast = "urn:xmpp:fast:0"
+
+	// the hashed token mechanisms of xep-0484, by the channel binding type bound
+	SM_HT_SHA_256_NONE = "HT-SHA-256-NONE"
+	SM_HT_SHA_256_UNIQ = "HT-SHA-256-UNIQ"
+	SM_HT_SHA_256_ENDP = "HT-SHA-256-ENDP"
+	SM_HT_SHA_256_EXPR = "HT-SHA-256-EXPR"
+
+	DefaultFastTokenLifetime = time.Hour * 24 * 14
+)
+
+// htMechanisms are the ht mechanisms, the most preferred first
+var htMechanisms = []string{SM_HT_SHA_256_EXPR, SM_HT_SHA_256_ENDP, SM_HT_SHA_256_UNIQ, SM_HT_SHA_256_NONE}
+
+var htChannelBindings = map[string]string{
+	SM_HT_SHA_256_EXPR: CBTlsExporter,
+	SM_HT_SHA_256_ENDP: CBTlsServerEndPoint,
+	SM_HT_SHA_256_UNIQ: CBTlsUnique,
+	SM_HT_SHA_256_NONE: "",
+}
+
+// FastToken is a token of xep-0484, bound to the user agent it's issued to
+type FastToken struct {
+	Username  string
+	UserAgent string
+	Mechanism string
+	Token     string
+	Expiry    time.Time
+	// Count is of the last authentication with the token
+	Count uint64
+}
+
+func (t FastToken) Expired() bool {
+	return !t.Expiry.IsZero() && time.Now().After(t.Expiry)
+}
+
+// TokenStore keeps the fast tokens of user agents, the server keeps what it issues and the
+// client what it's issued
+type TokenStore interface {
+	// Tokens returns the tokens of the user agent of username, the newest first
+	Tokens(username, userAgent string) ([]FastToken, error)
+	// SaveToken adds token of its user agent. the newest of the ones saved stays valid until
+	// token is used, so a client missing token isn't locked out
+	SaveToken(token FastToken) error
+	// UseToken records count of an authentication with token, it fails with
+	// ErrFastTokenReplayed unless count is above the one recorded. the tokens older than
+	// token are dropped
+	UseToken(token FastToken, count uint64) error
+	// InvalidateTokens drops the tokens of the user agent of username, the tokens of all the
+	// user agents if userAgent is empty
+	InvalidateTokens(username, userAgent string) error
+}
+
+// htMechanismsOf are the ht mechanisms of which the channel binding is there in conn
+func htMechanismsOf(conn Conn) []string {
+	types := ChannelBindingTypes(conn)
+	mechs := []string{}
+	for _, mech := range htMechanisms {
+		if cbType := htChannelBindings[mech]; cbType == "" || containsString(types, cbType) {
+			mechs = append(mechs, mech)
+		}
+	}
+	return mechs
+}
+
+func htChannelBinding(mechanism string, conn Conn) ([]byte, error) {
+	cbType, ok := htChannelBindings[mechanism]
+	if !ok {
+		return nil, ErrFastMechanism
+	}
+	if cbType == "" {
+		return nil, nil
+	}
+	return ChannelBinding(conn, cbType)
+}
+
+// htHash proves token for the initiator or the responder, bound to the channel binding data
+func htHash(token, side string, cbData []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(side))
+	mac.Write(cbData)
+	return mac.Sum(nil)
+}
+
+func newFastToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// FastAuth authenticates by the tokens of store with the ht mechanisms. tokens are bound to
+// the user agent, so it authenticates inline of sasl2 only
+type FastAuth struct {
+	store TokenStore
+}
+
+func NewFastAuth(store TokenStore) *FastAuth {
+	return &FastAuth{store: store}
+}
+
+func (fa *FastAuth) Auth(mechanism, authInfo string, part Part) (username string, err error) {
+	req, ok := Sasl2AuthenticateOf(part)
+	if !ok || req.UserAgent.ID == "" {
+		return "", SaslFailureError(SFInvalidMechanism, "fast requires sasl2 with a user agent")
+	}
+	fast := req.Elem.Child("fast")
+	if fast == nil || fast.Attribute("xmlns") != NSFast {
+		return "", SaslFailureError(SFMalformedRequest, "fast required")
+	}
+	count, err := strconv.ParseUint(fast.Attribute("count"), 10, 64)
+	if err != nil {
+		return "", SaslFailureError(SFMalformedRequest, "invalid count")
+	}
+	var payload string
+	if err = AuthPayload(authInfo, &payload); err != nil {
+		return
+	}
+	i := strings.IndexByte(payload, 0)
+	if i < 0 {
+		return "", SaslFailureError(SFIncorrectEncoding, "")
+	}
+	username, hashed := payload[:i], []byte(payload[i+1:])
+	cbData, err := htChannelBinding(mechanism, part.Conn())
+	if err != nil {
+		return "", SaslFailureError(SFMalformedRequest, "channel binding not supported")
+	}
+	tokens, err := fa.store.Tokens(username, req.UserAgent.ID)
+	if err != nil {
+		return "", SaslFailureError(SFTemporaryAuthFailure, err.Error())
+	}
+	for _, t := range tokens {
+		if t.Mechanism != mechanism || t.Expired() || !hmac.Equal(hashed, htHash(t.Token, "Initiator", cbData)) {
+			continue
+		}
+		if err = fa.store.UseToken(t, count); err == ErrFastTokenReplayed {
+			return "", SaslFailureError(SFNotAuthorized, err.Error())
+		} else if err != nil {
+			return "", SaslFailureError(SFTemporaryAuthFailure, err.Error())
+		}
+		if invalidates(fast) {
+			if err = fa.store.InvalidateTokens(username, req.UserAgent.ID); err != nil {
+				return "", SaslFailureError(SFTemporaryAuthFailure, err.Error())
+			}
+		}
+		part.Logger().Sub(LogSubAuth).Log(LogDebug, "fast token used", Field("user_agent", req.UserAgent.ID), Field("count", count))
+		err = part.Channel().SendElement(stravaganza.NewBuilder("success").
+			WithAttribute("xmlns", NSSasl).
+			WithText(base64.StdEncoding.EncodeToString(htHash(t.Token, "Responder", cbData))).Build())
+		return username, err
+	}
+	return "", SaslFailureError(SFNotAuthorized, "")
+}
+
+func invalidates(fast stravaganza.Element) bool {
+	v := fast.Attribute("invalidate")
+	return v == "true" || v == "1"
+}
+
+type fastInline struct {
+	auth     *FastAuth
+	lifetime time.Duration
+	// the conn of which the ht mechanisms bound are advertised
+	cbConn Conn
+}
+
+// FastInline issues fast tokens of store inline of sasl2 and authenticates by them,
+// xep-0484. a token lives for lifetime, and is rotated each time it's used
+func FastInline(store TokenStore, lifetime time.Duration) fastInline {
+	return fastInline{auth: NewFastAuth(store), lifetime: lifetime}
+}
+
+// AdvertiseChannelBindings advertises the ht mechanisms bound to the channel binding types
+// of the conn, along with HT-SHA-256-NONE
+func (fi *fastInline) AdvertiseChannelBindings(conn Conn) {
+	fi.cbConn = conn
+}
+
+func (fi fastInline) InlineElem() stravaganza.Element {
+	mechs := []stravaganza.Element{}
+	for _, mech := range htMechanismsOf(fi.cbConn) {
+		mechs = append(mechs, stravaganza.NewBuilder("mechanism").WithText(mech).Build())
+	}
+	return stravaganza.NewBuilder("fast").WithAttribute("xmlns", NSFast).WithChildren(mechs...).Build()
+}
+
+func (fi fastInline) Sasl2Auth(mechanism string) (Auth, bool) {
+	if !containsString(htMechanismsOf(fi.cbConn), mechanism) {
+		return nil, false
+	}
+	return fi.auth, true
+}
+
+// Sasl2Success issues a token for the mechanism the client requests, or rotates the token
+// it authenticates with unless it's invalidated
+func (fi fastInline) Sasl2Success(auth Sasl2Authenticate, part Part) ([]stravaganza.Element, error) {
+	if auth.UserAgent.ID == "" {
+		return nil, nil
+	}
+	var mech string
+	if req := auth.Elem.Child("request-token"); req != nil && req.Attribute("xmlns") == NSFast {
+		mech = req.Attribute("mechanism")
+	} else if fast := auth.Elem.Child("fast"); fast != nil && fast.Attribute("xmlns") == NSFast && !invalidates(fast) {
+		mech = auth.Mechanism
+	}
+	if !containsString(htMechanismsOf(fi.cbConn), mech) {
+		return nil, nil
+	}
+	secret, err := newFastToken()
+	if err != nil {
+		return nil, err
+	}
+	token := FastToken{
+		Username:  UnescapeLocalpart(part.Attr().JID.Username),
+		UserAgent: auth.UserAgent.ID,
+		Mechanism: mech,
+		Token:     secret,
+		Expiry:    time.Now().Add(fi.lifetime).UTC().Truncate(time.Second)}
+	if err := fi.auth.store.SaveToken(token); err != nil {
+		return nil, err
+	}
+	return []stravaganza.Element{stravaganza.NewBuilder("token").
+		WithAttribute("xmlns", NSFast).
+		WithAttribute("expiry", token.Expiry.Format(time.RFC3339)).
+		WithAttribute("token", token.Token).Build()}, nil
+}
@@ -0,0 +1,123 @@
+package xmppcore
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"testing"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+func TestMemoryTokenStore(t *testing.T) {
+	store := NewMemoryTokenStore()
+	token := func(secret string) FastToken {
+		return FastToken{Username: "juliet", UserAgent: "ua", Mechanism: SM_HT_SHA_256_NONE, Token: secret}
+	}
+	store.SaveToken(token("t1"))
+	store.SaveToken(token("t2"))
+	store.SaveToken(token("t3"))
+	tokens, _ := store.Tokens("juliet", "ua")
+	if len(tokens) != 2 || tokens[0].Token != "t3" || tokens[1].Token != "t2" {
+		t.Fatalf("the newest and the one before should be kept: %+v", tokens)
+	}
+	if err := store.UseToken(token("t2"), 1); err != nil {
+		t.Fatalf("use token error: %s", err.Error())
+	}
+	if err := store.UseToken(token("t2"), 1); err != ErrFastTokenReplayed {
+		t.Fatalf("count should be above the one used, got %v", err)
+	}
+	if err := store.UseToken(token("t3"), 1); err != nil {
+		t.Fatalf("use token error: %s", err.Error())
+	}
+	if tokens, _ = store.Tokens("juliet", "ua"); len(tokens) != 1 || tokens[0].Token != "t3" {
+		t.Fatalf("the tokens older than the one used should be dropped: %+v", tokens)
+	}
+	store.SaveToken(FastToken{Username: "juliet", UserAgent: "ua2", Token: "t4"})
+	store.InvalidateTokens("juliet", "")
+	if tokens, _ = store.Tokens("juliet", "ua2"); len(tokens) != 0 {
+		t.Fatalf("tokens of all the user agents should be invalidated: %+v", tokens)
+	}
+}
+
+// fastLogin logs in with fast, and the password if it falls back to scram
+func fastLogin(t *testing.T, serverStore TokenStore, fast *FastToAuth, password string) (*XPart, error) {
+	serverConn, clientConn := tlsTestConns(t, tls.VersionTLS13)
+	sasl := SASLFeature(NewMemoryAuthorized())
+	sasl.AdvertiseChannelBindings(serverConn)
+	sasl.Support(SM_SCRAM_SHA_256_PLUS, NewScramAuth(scramTestUsers(), sha256.New, true))
+	sasl2 := SASL2Feature(&sasl)
+	fastInline := FastInline(serverStore, DefaultFastTokenLifetime)
+	fastInline.AdvertiseChannelBindings(serverConn)
+	sasl2.WithInline(fastInline)
+	clientSasl2 := ClientSASL2Feature(Sasl2UserAgent{ID: "d4565fa7-4d72-4749-b3d3-740edbf87770"})
+	clientSasl2.Support(SM_SCRAM_SHA_256_PLUS, NewScramToAuth("juliet", password, SM_SCRAM_SHA_256_PLUS, true))
+	clientSasl2.WithInline(fast)
+	server, _, err := negotiateParts(t, serverConn, clientConn, []Feature{&sasl, &sasl2}, []ElemHandler{clientSasl2})
+	return server, err
+}
+
+func TestFastLogin(t *testing.T) {
+	serverStore, clientStore := NewMemoryTokenStore(), NewMemoryTokenStore()
+	ua := "d4565fa7-4d72-4749-b3d3-740edbf87770"
+	fast := NewFastToAuth(clientStore, "juliet", ua)
+	// a token is issued along with a password login
+	if _, err := fastLogin(t, serverStore, fast, "r0m30myr0m30"); err != nil {
+		t.Fatalf("negotiate error: %s", err.Error())
+	}
+	issued, _ := clientStore.Tokens("juliet", ua)
+	if len(issued) != 1 || issued[0].Mechanism != SM_HT_SHA_256_EXPR {
+		t.Fatalf("a token bound to tls-exporter should be issued: %+v", issued)
+	}
+
+	// the token logs in, and is rotated
+	if server, err := fastLogin(t, serverStore, fast, "wrong"); err != nil || server.Attr().JID.String() != "juliet@hello-world.im" {
+		t.Fatalf("token login error: %v", err)
+	}
+	rotated, _ := clientStore.Tokens("juliet", ua)
+	if len(rotated) != 2 || rotated[0].Token == issued[0].Token || rotated[1].Count != 1 {
+		t.Fatalf("the token should be rotated: %+v", rotated)
+	}
+
+	// the count of the token used is replayed
+	replayed := rotated[0]
+	replayed.Count = 0
+	clientStore.InvalidateTokens("juliet", ua)
+	clientStore.SaveToken(replayed)
+	if _, err := fastLogin(t, serverStore, fast, "wrong"); err != nil {
+		t.Fatalf("token login error: %v", err)
+	}
+	clientStore.InvalidateTokens("juliet", ua)
+	clientStore.SaveToken(replayed)
+	var f Failure
+	if _, err := fastLogin(t, serverStore, fast, "wrong"); !errors.As(err, &f) || f.DescTag != SFNotAuthorized {
+		t.Fatalf("a replayed count should fail, got %v", err)
+	}
+	if tokens, _ := clientStore.Tokens("juliet", ua); len(tokens) != 0 {
+		t.Fatalf("tokens the server refuses should be dropped: %+v", tokens)
+	}
+
+	// a logout invalidates the tokens
+	token, _ := serverStore.Tokens("juliet", ua)
+	clientStore.SaveToken(FastToken{Username: "juliet", UserAgent: ua, Mechanism: token[0].Mechanism, Token: token[0].Token, Count: token[0].Count})
+	fast.Invalidate()
+	if _, err := fastLogin(t, serverStore, fast, "wrong"); err != nil {
+		t.Fatalf("token login error: %v", err)
+	}
+	if tokens, _ := serverStore.Tokens("juliet", ua); len(tokens) != 0 {
+		t.Fatalf("tokens should be invalidated: %+v", tokens)
+	}
+	if tokens, _ := clientStore.Tokens("juliet", ua); len(tokens) != 0 {
+		t.Fatalf("tokens of the client should be dropped: %+v", tokens)
+	}
+}
+
+func TestRedactFastToken(t *testing.T) {
+	token := stravaganza.NewBuilder("token").WithAttribute("xmlns", NSFast).
+		WithAttribute("expiry", "2020-03-12T14:36:15Z").WithAttribute("token", "WXZzciBwYmFmdmZnZiBqdmd1IGp2eXFhcmZm").Build()
+	success := stravaganza.NewBuilder("success").WithAttribute("xmlns", NSSasl2).WithChild(token).Build()
+	redacted := RedactElement(success, LogSecrets{})
+	if redacted.Child("token").Attribute("token") != redactedText || redacted.Child("token").Attribute("expiry") == redactedText {
+		t.Fatalf("token should be redacted: %s", redacted.GoString())
+	}
+}
@@ -0,0 +1,1032 @@
+package xmppcore
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+const fastParserBufSize = 4096
+
+// scratch state grown beyond it by a huge stanza isn't pooled
+const fastParserMaxPooled = 64 * 1024
+
+// fastParserState is the scratch state of a FastParser, it's pooled so that the parsers of
+// short lived streams, such as the ones of bosh requests, don't allocate it again
+type fastParserState struct {
+	buf     []byte
+	scratch []byte
+	attrs   []fastAttr
+	stack   []fastFrame
+}
+
+var fastParserStatePool = sync.Pool{
+	New: func() interface{} {
+		return &fastParserState{buf: make([]byte, fastParserBufSize)}
+	},
+}
+
+// names and values occurring in almost every stanza, they are shared instead of allocated per stanza
+var internedStrings = func() map[string]string {
+	m := map[string]string{}
+	for _, s := range []string{
+		// stanzas and common payloads
+		"message", "presence", "iq", "body", "subject", "thread", "show", "status", "priority",
+		"error", "text", "query", "bind", "resource", "jid", "session", "x", "c", "delay",
+		"ping", "active", "composing", "paused", "inactive", "gone", "request", "received",
+		"r", "a", "enable", "enabled", "item", "items", "pubsub", "event", "field", "value",
+		"auth", "response", "challenge", "success", "failure", "starttls", "proceed",
+		"compress", "compressed", "method", "mechanism", "mechanisms", "features",
+		// attributes
+		"id", "type", "to", "from", "xmlns", "xml:lang", "stamp", "node", "ver", "hash",
+		"var", "name", "h", "stream", "version",
+		// values
+		"chat", "groupchat", "headline", "normal", "get", "set", "result", "unavailable",
+		"subscribe", "subscribed", "unsubscribe", "unsubscribed", "probe", "away", "xa", "dnd",
+		"en", "1.0", "sha-1",
+		NSClient, NSServer, NSStream, NSFraming, NSXML, NSSasl, NSTls, NSBind, NSStanza, NSCompress,
+		"urn:xmpp:ping", "urn:xmpp:delay", "urn:xmpp:receipts", "urn:xmpp:sm:3",
+		"http://jabber.org/protocol/chatstates", "http://jabber.org/protocol/caps",
+		"jabber:iq:roster", "jabber:x:data",
+	} {
+		m[s] = s
+	}
+	return m
+}()
+
+var (
+	nameStopBytes = func() (t [256]bool) {
+		for _, c := range []byte(" \t\r\n/>=<?") {
+			t[c] = true
+		}
+		return
+	}()
+	textSpecialBytes = func() (t [256]bool) {
+		for _, c := range []byte("<&\r]>") {
+			t[c] = true
+		}
+		return
+	}()
+	attrSpecialBytes = func() (t [256]bool) {
+		for _, c := range []byte("<&\r\"'") {
+			t[c] = true
+		}
+		return
+	}()
+)
+
+type nsDecl struct {
+	prefix string
+	uri    string
+}
+
+type fastAttr struct {
+	name  string
+	value string
+}
+
+// fastFrame is an element under construction, frames are reused by the following elements
+type fastFrame struct {
+	pb    *stravaganza.PBElement
+	name  string
+	ns    string
+	decls []nsDecl
+	text  []byte
+}
+
+// FastParser has the same Next contract as Parser, but scans the input itself instead of going
+// through encoding/xml. it reuses its read buffer, scratch buffers and element frames between
+// stanzas and takes them from a pool, shares the common names, and builds the proto tree of an
+// element directly from per stanza slabs, so that a stanza costs roughly one allocation per string.
+type FastParser struct {
+	r             io.Reader
+	state         *fastParserState
+	buf           []byte
+	pos, end      int
+	offset        int64 // input offset of buf[0]
+	lines         int   // lines before buf[0]
+	readErr       error
+	err           error
+	lastOffset    int64
+	maxStanzaSize int64
+	limits        *ParserLimits
+	scratch       []byte
+	attrs         []fastAttr
+	stack         []fastFrame
+	depth         int
+	streamNS      []nsDecl
+
+	// the proto attributes and elements of a stanza are carved from slabs allocated once per
+	// stanza, sized by the stanza before. an element built keeps the slabs of its stanza
+	attrSlab  []stravaganza.PBAttribute
+	attrPtrs  []*stravaganza.PBAttribute
+	elemSlab  []stravaganza.PBElement
+	attrsUsed int
+	elemsUsed int
+	attrsHint int
+	elemsHint int
+}
+
+func NewFastParser(reader io.Reader, maxStanzaSize int) *FastParser {
+	state := fastParserStatePool.Get().(*fastParserState)
+	return &FastParser{
+		r:             reader,
+		state:         state,
+		buf:           state.buf,
+		scratch:       state.scratch,
+		attrs:         state.attrs,
+		stack:         state.stack,
+		maxStanzaSize: int64(maxStanzaSize),
+	}
+}
+
+// Release gives the scratch state of the parser back to the pool, the parser can't be
+// used anymore. it must not be called while Next is running
+func (p *FastParser) Release() {
+	if p.state == nil {
+		return
+	}
+	state := p.state
+	p.state = nil
+	if p.err == nil {
+		p.err = ErrParserReleased
+	}
+	if cap(p.scratch) > fastParserMaxPooled {
+		p.scratch = nil
+	}
+	for i := range p.stack {
+		p.stack[i].pb = nil
+		if cap(p.stack[i].text) > fastParserMaxPooled {
+			p.stack[i].text = nil
+		}
+	}
+	state.scratch, state.attrs, state.stack = p.scratch[:0], p.attrs[:0], p.stack[:0]
+	p.buf, p.scratch, p.attrs, p.stack = nil, nil, nil, nil
+	p.attrSlab, p.attrPtrs, p.elemSlab = nil, nil, nil
+	fastParserStatePool.Put(state)
+}
+
+// SetLimits hardens the parser the same way as Parser.SetLimits does
+func (p *FastParser) SetLimits(limits ParserLimits) {
+	p.limits = &limits
+}
+
+// Next parses next available top level token, it's one of xml.ProcInst, xml.StartElement
+// of the stream header, xml.CharData of whitespaces, xml.EndElement of the stream and
+// stravaganza.Element
+func (p *FastParser) Next() (interface{}, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	i, err := p.next()
+	if err != nil && err != ErrNoElement {
+		// the input can't be resumed once a token is broken
+		p.err = err
+	}
+	return i, err
+}
+
+func (p *FastParser) next() (interface{}, error) {
+	for {
+		c, err := p.readByte()
+		if err != nil {
+			if err == io.EOF && p.depth > 0 {
+				return nil, p.syntaxError("unexpected EOF")
+			}
+			return nil, err
+		}
+		if c != '<' {
+			p.pos--
+			if p.depth == 0 {
+				return p.topLevelText()
+			}
+			if err := p.text(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if c, err = p.readByte(); err != nil {
+			return nil, p.eof(err)
+		}
+		switch c {
+		case '?':
+			inst, err := p.procInst()
+			if err != nil {
+				return nil, err
+			}
+			if p.limits != nil && (inst.Target != "xml" || p.depth > 0) {
+				return nil, restrictedXMLError(ErrXMLProcInst)
+			}
+			if p.depth > 0 {
+				return nil, ErrNoElement
+			}
+			p.boundary()
+			return inst, nil
+		case '!':
+			if err := p.markupDecl(); err != nil {
+				return nil, err
+			}
+		case '/':
+			i, err := p.endTag()
+			if err != nil || i != nil {
+				return i, err
+			}
+		default:
+			p.pos--
+			i, err := p.startTag()
+			if err != nil || i != nil {
+				return i, err
+			}
+		}
+	}
+}
+
+func (p *FastParser) topLevelText() (interface{}, error) {
+	p.scratch = p.scratch[:0]
+	for {
+		if p.pos == p.end {
+			if err := p.fill(); err != nil {
+				if len(p.scratch) > 0 && err == io.EOF {
+					break
+				}
+				return nil, err
+			}
+		}
+		c := p.buf[p.pos]
+		if c == '<' {
+			break
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			p.pos++
+			return nil, ErrNoElement
+		}
+		p.scratch = append(p.scratch, c)
+		p.pos++
+	}
+	p.boundary()
+	return xml.CharData(append([]byte{}, p.scratch...)), nil
+}
+
+// text appends a text run to the current element
+func (p *FastParser) text() error {
+	f := &p.stack[p.depth-1]
+	start := len(f.text)
+	brackets := 0
+	for {
+		if p.pos == p.end {
+			if err := p.fill(); err != nil {
+				return p.eof(err)
+			}
+		}
+		i := p.pos
+		for i < p.end && !textSpecialBytes[p.buf[i]] {
+			i++
+		}
+		if i > p.pos {
+			brackets = 0
+			f.text = append(f.text, p.buf[p.pos:i]...)
+			p.pos = i
+			continue
+		}
+		c := p.buf[p.pos]
+		if c == '<' {
+			break
+		}
+		p.pos++
+		switch c {
+		case '&':
+			var err error
+			if f.text, err = p.entity(f.text); err != nil {
+				return err
+			}
+			brackets = 0
+			continue
+		case '\r':
+			f.text = p.newline(f.text)
+		case ']':
+			brackets++
+			f.text = append(f.text, c)
+			continue
+		case '>':
+			if brackets >= 2 {
+				return p.syntaxError("unescaped ]]> not in CDATA section")
+			}
+			f.text = append(f.text, c)
+		}
+		brackets = 0
+	}
+	if err := p.checkChars(f.text[start:]); err != nil {
+		return err
+	}
+	if p.limits != nil && p.limits.MaxTextSize > 0 && len(f.text) > p.limits.MaxTextSize {
+		return policyViolationError(ErrTooLargeText)
+	}
+	return nil
+}
+
+// newline normalizes \r\n and \r to \n, the \r is consumed already
+func (p *FastParser) newline(dst []byte) []byte {
+	if p.pos < p.end || p.fill() == nil {
+		if p.buf[p.pos] == '\n' {
+			p.pos++
+		}
+	}
+	return append(dst, '\n')
+}
+
+// entity decodes a predefined entity or a character reference, the & is consumed already
+func (p *FastParser) entity(dst []byte) ([]byte, error) {
+	var buf [10]byte
+	name := buf[:0]
+	for {
+		c, err := p.readByte()
+		if err != nil {
+			return dst, p.eof(err)
+		}
+		if c == ';' {
+			break
+		}
+		if len(name) == len(buf) {
+			return dst, p.syntaxError("invalid character entity &" + string(name))
+		}
+		name = append(name, c)
+	}
+	switch string(name) {
+	case "lt":
+		return append(dst, '<'), nil
+	case "gt":
+		return append(dst, '>'), nil
+	case "amp":
+		return append(dst, '&'), nil
+	case "apos":
+		return append(dst, '\''), nil
+	case "quot":
+		return append(dst, '"'), nil
+	}
+	if len(name) > 1 && name[0] == '#' {
+		var n uint64
+		var err error
+		if name[1] == 'x' {
+			n, err = strconv.ParseUint(string(name[2:]), 16, 32)
+		} else {
+			n, err = strconv.ParseUint(string(name[1:]), 10, 32)
+		}
+		if err == nil && isInCharacterRange(rune(n)) {
+			var rb [utf8.UTFMax]byte
+			return append(dst, rb[:utf8.EncodeRune(rb[:], rune(n))]...), nil
+		}
+	}
+	return dst, p.syntaxError("invalid character entity &" + string(name) + ";")
+}
+
+func (p *FastParser) procInst() (xml.ProcInst, error) {
+	target, err := p.name()
+	if err != nil {
+		return xml.ProcInst{}, err
+	}
+	p.scratch = p.scratch[:0]
+	for {
+		c, err := p.readByte()
+		if err != nil {
+			return xml.ProcInst{}, p.eof(err)
+		}
+		if c == '>' && len(p.scratch) > 0 && p.scratch[len(p.scratch)-1] == '?' {
+			break
+		}
+		p.scratch = append(p.scratch, c)
+	}
+	inst := bytes.TrimLeft(p.scratch[:len(p.scratch)-1], " \t\r\n")
+	return xml.ProcInst{Target: target, Inst: append([]byte{}, inst...)}, nil
+}
+
+// markupDecl handles comments, CDATA sections and DTD, the <! is consumed already
+func (p *FastParser) markupDecl() error {
+	c, err := p.readByte()
+	if err != nil {
+		return p.eof(err)
+	}
+	if c == '-' {
+		if c, err = p.readByte(); err != nil {
+			return p.eof(err)
+		}
+		if c != '-' {
+			return p.syntaxError("invalid sequence <!- not part of <!--")
+		}
+		if p.limits != nil {
+			return restrictedXMLError(ErrXMLComment)
+		}
+		return p.skipUntil("-->")
+	}
+	if c == '[' {
+		for _, r := range []byte("CDATA[") {
+			if c, err = p.readByte(); err != nil {
+				return p.eof(err)
+			}
+			if c != r {
+				return p.syntaxError("invalid <![ sequence")
+			}
+		}
+		if p.depth == 0 {
+			return p.syntaxError("CDATA section outside of element")
+		}
+		return p.cdata()
+	}
+	if p.limits != nil {
+		return restrictedXMLError(ErrXMLDirective)
+	}
+	return p.skipDirective()
+}
+
+func (p *FastParser) cdata() error {
+	f := &p.stack[p.depth-1]
+	start := len(f.text)
+	for {
+		c, err := p.readByte()
+		if err != nil {
+			return p.eof(err)
+		}
+		n := len(f.text)
+		if c == '>' && n-start >= 2 && f.text[n-1] == ']' && f.text[n-2] == ']' {
+			f.text = f.text[:n-2]
+			break
+		}
+		if c == '\r' {
+			f.text = p.newline(f.text)
+			continue
+		}
+		f.text = append(f.text, c)
+	}
+	if err := p.checkChars(f.text[start:]); err != nil {
+		return err
+	}
+	if p.limits != nil && p.limits.MaxTextSize > 0 && len(f.text) > p.limits.MaxTextSize {
+		return policyViolationError(ErrTooLargeText)
+	}
+	return nil
+}
+
+func (p *FastParser) skipUntil(end string) error {
+	matched := 0
+	for matched < len(end) {
+		c, err := p.readByte()
+		if err != nil {
+			return p.eof(err)
+		}
+		if c == end[matched] {
+			matched++
+		} else if c == end[0] {
+			matched = 1
+		} else {
+			matched = 0
+		}
+	}
+	return nil
+}
+
+func (p *FastParser) skipDirective() error {
+	depth := 0
+	var quote byte
+	for {
+		c, err := p.readByte()
+		if err != nil {
+			return p.eof(err)
+		}
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '<':
+			depth++
+		case c == '>':
+			if depth == 0 {
+				return nil
+			}
+			depth--
+		}
+	}
+}
+
+func (p *FastParser) startTag() (interface{}, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	p.attrs = p.attrs[:0]
+	selfClosing := false
+	for {
+		p.skipSpace()
+		c, err := p.readByte()
+		if err != nil {
+			return nil, p.eof(err)
+		}
+		if c == '>' {
+			break
+		}
+		if c == '/' {
+			if c, err = p.readByte(); err != nil {
+				return nil, p.eof(err)
+			}
+			if c != '>' {
+				return nil, p.syntaxError("expected /> in element")
+			}
+			selfClosing = true
+			break
+		}
+		p.pos--
+		if err := p.attr(); err != nil {
+			return nil, err
+		}
+	}
+	prefix, local := splitQName(name)
+	if p.depth == 0 && (local == streamName || local == openName) {
+		header, err := p.streamHeader(prefix, local)
+		if err != nil {
+			return nil, err
+		}
+		p.boundary()
+		return header, nil
+	}
+	if err := p.checkStartElement(); err != nil {
+		return nil, err
+	}
+	if err := p.pushFrame(name, prefix, local); err != nil {
+		return nil, err
+	}
+	if selfClosing {
+		return p.closeFrame(name)
+	}
+	return nil, nil
+}
+
+func (p *FastParser) attr() error {
+	name, err := p.name()
+	if err != nil {
+		return err
+	}
+	p.skipSpace()
+	c, err := p.readByte()
+	if err != nil {
+		return p.eof(err)
+	}
+	if c != '=' {
+		return p.syntaxError("attribute name without = in element")
+	}
+	p.skipSpace()
+	quote, err := p.readByte()
+	if err != nil {
+		return p.eof(err)
+	}
+	if quote != '"' && quote != '\'' {
+		return p.syntaxError("unquoted or missing attribute value in element")
+	}
+	p.scratch = p.scratch[:0]
+	for {
+		if p.pos == p.end {
+			if err := p.fill(); err != nil {
+				return p.eof(err)
+			}
+		}
+		i := p.pos
+		for i < p.end && !attrSpecialBytes[p.buf[i]] {
+			i++
+		}
+		if i > p.pos {
+			p.scratch = append(p.scratch, p.buf[p.pos:i]...)
+			p.pos = i
+			continue
+		}
+		c := p.buf[p.pos]
+		p.pos++
+		if c == quote {
+			break
+		}
+		switch c {
+		case '<':
+			return p.syntaxError("unescaped < inside quoted string")
+		case '&':
+			if p.scratch, err = p.entity(p.scratch); err != nil {
+				return err
+			}
+		case '\r':
+			p.scratch = p.newline(p.scratch)
+		default:
+			p.scratch = append(p.scratch, c)
+		}
+	}
+	if err := p.checkChars(p.scratch); err != nil {
+		return err
+	}
+	for _, a := range p.attrs {
+		if a.name == name {
+			return p.syntaxError("duplicate attribute " + name)
+		}
+	}
+	value := ""
+	if name == xmlnsPrefix || name == "type" || name == "xml:lang" || len(name) > 6 && name[:6] == "xmlns:" {
+		value = p.intern(p.scratch)
+	} else {
+		value = string(p.scratch)
+	}
+	p.attrs = append(p.attrs, fastAttr{name: name, value: value})
+	return nil
+}
+
+func (p *FastParser) checkStartElement() error {
+	if p.limits == nil {
+		return nil
+	}
+	if p.limits.MaxDepth > 0 && p.depth >= p.limits.MaxDepth {
+		return policyViolationError(ErrTooDeepElement)
+	}
+	if p.limits.MaxAttrs > 0 && len(p.attrs) > p.limits.MaxAttrs {
+		return policyViolationError(ErrTooManyAttrs)
+	}
+	if p.limits.MaxAttrValueSize > 0 {
+		for _, a := range p.attrs {
+			if len(a.value) > p.limits.MaxAttrValueSize {
+				return policyViolationError(ErrTooLargeAttr)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *FastParser) pushFrame(name, prefix, local string) error {
+	if p.depth == 0 {
+		p.newStanza()
+	}
+	if p.depth < len(p.stack) {
+		f := &p.stack[p.depth]
+		f.decls = f.decls[:0]
+		f.text = f.text[:0]
+	} else {
+		p.stack = append(p.stack, fastFrame{})
+	}
+	p.depth++
+	f := &p.stack[p.depth-1]
+	f.name = name
+	for _, a := range p.attrs {
+		if a.name == xmlnsPrefix {
+			f.decls = append(f.decls, nsDecl{prefix: "", uri: a.value})
+		} else if ap, al := splitQName(a.name); ap == xmlnsPrefix {
+			f.decls = append(f.decls, nsDecl{prefix: al, uri: a.value})
+		}
+	}
+	ns, ok := p.lookup(prefix)
+	if !ok {
+		return ErrUnboundPrefix
+	}
+	f.ns = ns
+	setNS := ns != "" && (p.depth == 1 || p.stack[p.depth-2].ns != ns)
+
+	// attributes, the declarations of the prefixes used by attributes and the namespace of the element
+	count := len(p.attrs) + 1
+	for _, a := range p.attrs {
+		if ap, _ := splitQName(a.name); ap != "" {
+			count++
+		}
+	}
+	slab, pbAttrs := p.newAttrs(count)
+	add := func(label, value string) {
+		if label == stravaganza.Namespace && setNS {
+			value = ns
+			setNS = false
+		}
+		a := &slab[len(pbAttrs)]
+		a.Label = label
+		a.Value = value
+		pbAttrs = append(pbAttrs, a)
+	}
+	for _, a := range p.attrs {
+		add(a.name, a.value)
+		ap, _ := splitQName(a.name)
+		if ap == "" || ap == xmlnsPrefix || ap == xmlPrefix || p.declaredOn(f.decls, ap) {
+			continue
+		}
+		uri, ok := p.lookup(ap)
+		if !ok {
+			return ErrUnboundPrefix
+		}
+		f.decls = append(f.decls, nsDecl{prefix: ap, uri: uri})
+		add(xmlnsPrefix+":"+ap, uri)
+	}
+	if setNS {
+		add(stravaganza.Namespace, ns)
+	}
+	f.pb = p.newElem()
+	f.pb.Name = local
+	f.pb.Attributes = pbAttrs
+	return nil
+}
+
+// newAttrs carves n attributes and a slice of n pointers to them, which can't be appended
+// over the next ones
+func (p *FastParser) newAttrs(n int) ([]stravaganza.PBAttribute, []*stravaganza.PBAttribute) {
+	p.attrsUsed += n
+	if len(p.attrSlab) < n {
+		size := n
+		if p.attrsHint > size {
+			size = p.attrsHint
+		}
+		p.attrSlab = make([]stravaganza.PBAttribute, size)
+		p.attrPtrs = make([]*stravaganza.PBAttribute, size)
+	}
+	slab, ptrs := p.attrSlab[:n:n], p.attrPtrs[:0:n]
+	p.attrSlab, p.attrPtrs = p.attrSlab[n:], p.attrPtrs[n:]
+	return slab, ptrs
+}
+
+func (p *FastParser) newElem() *stravaganza.PBElement {
+	p.elemsUsed++
+	if len(p.elemSlab) == 0 {
+		size := 1
+		if p.elemsHint > size {
+			size = p.elemsHint
+		}
+		p.elemSlab = make([]stravaganza.PBElement, size)
+	}
+	pb := &p.elemSlab[0]
+	p.elemSlab = p.elemSlab[1:]
+	return pb
+}
+
+// newStanza drops what's left of the slabs of the stanza before, so that a stanza doesn't
+// keep another one, and sizes the slabs of the next one by it
+func (p *FastParser) newStanza() {
+	p.attrsHint, p.elemsHint = p.attrsUsed, p.elemsUsed
+	p.attrsUsed, p.elemsUsed = 0, 0
+	p.attrSlab, p.attrPtrs, p.elemSlab = nil, nil, nil
+}
+
+func (p *FastParser) declaredOn(decls []nsDecl, prefix string) bool {
+	for _, d := range decls {
+		if d.prefix == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *FastParser) lookup(prefix string) (string, bool) {
+	if prefix == xmlPrefix {
+		return NSXML, true
+	}
+	for i := p.depth - 1; i >= 0; i-- {
+		decls := p.stack[i].decls
+		for j := len(decls) - 1; j >= 0; j-- {
+			if decls[j].prefix == prefix {
+				return decls[j].uri, true
+			}
+		}
+	}
+	for _, d := range p.streamNS {
+		if d.prefix == prefix {
+			return d.uri, true
+		}
+	}
+	return "", prefix == ""
+}
+
+func (p *FastParser) streamHeader(prefix, local string) (xml.StartElement, error) {
+	p.streamNS = p.streamNS[:0]
+	for _, a := range p.attrs {
+		if a.name == xmlnsPrefix {
+			p.streamNS = append(p.streamNS, nsDecl{prefix: "", uri: a.value})
+		} else if ap, al := splitQName(a.name); ap == xmlnsPrefix {
+			p.streamNS = append(p.streamNS, nsDecl{prefix: al, uri: a.value})
+		}
+	}
+	space, ok := p.lookup(prefix)
+	if !ok {
+		return xml.StartElement{}, ErrUnboundPrefix
+	}
+	if local == openName && prefix == "" {
+		// rfc7395, the open element doesn't enclose the stream, its namespace is not the
+		// default one of the elements which follow
+		for i := range p.streamNS {
+			if p.streamNS[i].prefix == "" {
+				p.streamNS[i].uri = NSClient
+			}
+		}
+	}
+	header := xml.StartElement{Name: xml.Name{Space: space, Local: local}}
+	for _, a := range p.attrs {
+		ap, al := splitQName(a.name)
+		if ap != "" && ap != xmlnsPrefix {
+			if ap, ok = p.lookup(ap); !ok {
+				return xml.StartElement{}, ErrUnboundPrefix
+			}
+		}
+		header.Attr = append(header.Attr, xml.Attr{Name: xml.Name{Space: ap, Local: al}, Value: a.value})
+	}
+	return header, nil
+}
+
+func (p *FastParser) endTag() (interface{}, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	c, err := p.readByte()
+	if err != nil {
+		return nil, p.eof(err)
+	}
+	if c != '>' {
+		return nil, p.syntaxError("invalid characters between </" + name + " and >")
+	}
+	if p.depth == 0 {
+		prefix, local := splitQName(name)
+		if local == streamName {
+			p.boundary()
+			space, _ := p.lookup(prefix)
+			return xml.EndElement{Name: xml.Name{Space: space, Local: local}}, nil
+		}
+		return nil, errUnexpectedEnd(name)
+	}
+	return p.closeFrame(name)
+}
+
+func (p *FastParser) closeFrame(name string) (interface{}, error) {
+	f := &p.stack[p.depth-1]
+	if f.name != name {
+		return nil, errUnexpectedEnd(name)
+	}
+	if len(f.text) > 0 {
+		f.pb.Text = string(f.text)
+	}
+	pb := f.pb
+	f.pb = nil
+	p.depth--
+	if p.depth > 0 {
+		parent := p.stack[p.depth-1].pb
+		parent.Elements = append(parent.Elements, pb)
+		return nil, nil
+	}
+	if err := p.checkStanzaSize(); err != nil {
+		return nil, err
+	}
+	p.boundary()
+	return stravaganza.NewBuilderFromProto(pb).Build(), nil
+}
+
+func (p *FastParser) name() (string, error) {
+	p.scratch = p.scratch[:0]
+	for {
+		if p.pos == p.end {
+			if err := p.fill(); err != nil {
+				return "", p.eof(err)
+			}
+		}
+		i := p.pos
+		for i < p.end && !nameStopBytes[p.buf[i]] {
+			i++
+		}
+		p.scratch = append(p.scratch, p.buf[p.pos:i]...)
+		p.pos = i
+		if i < p.end {
+			break
+		}
+	}
+	if len(p.scratch) == 0 || !isNameStart(p.scratch[0]) {
+		return "", p.syntaxError("invalid XML name: " + string(p.scratch))
+	}
+	return p.intern(p.scratch), nil
+}
+
+func (p *FastParser) intern(b []byte) string {
+	if s, ok := internedStrings[string(b)]; ok {
+		return s
+	}
+	return string(b)
+}
+
+func (p *FastParser) skipSpace() {
+	for {
+		if p.pos == p.end && p.fill() != nil {
+			return
+		}
+		switch p.buf[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *FastParser) readByte() (byte, error) {
+	if p.pos == p.end {
+		if err := p.fill(); err != nil {
+			return 0, err
+		}
+	}
+	c := p.buf[p.pos]
+	p.pos++
+	return c, nil
+}
+
+// fill reads more input into the buffer once all the buffered input is consumed
+func (p *FastParser) fill() error {
+	if p.readErr != nil {
+		return p.readErr
+	}
+	p.lines = p.lines + bytes.Count(p.buf[:p.end], []byte{'\n'})
+	p.offset = p.offset + int64(p.end)
+	p.pos, p.end = 0, 0
+	if err := p.checkStanzaSize(); err != nil {
+		return err
+	}
+	for {
+		n, err := p.r.Read(p.buf)
+		p.end = n
+		if err != nil {
+			p.readErr = err
+		}
+		if n > 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (p *FastParser) checkStanzaSize() error {
+	if p.maxStanzaSize <= 0 || p.offset+int64(p.pos)-p.lastOffset <= p.maxStanzaSize {
+		return nil
+	}
+	if p.limits != nil {
+		return policyViolationError(ErrTooLargeStanza)
+	}
+	return ErrTooLargeStanza
+}
+
+// boundary marks the end of a top level token
+func (p *FastParser) boundary() {
+	p.lastOffset = p.offset + int64(p.pos)
+}
+
+func (p *FastParser) checkChars(b []byte) error {
+	for i := 0; i < len(b); {
+		c := b[i]
+		if c < utf8.RuneSelf {
+			if c < 0x20 && c != '\t' && c != '\n' && c != '\r' {
+				return p.syntaxError("illegal character code " + strconv.QuoteRune(rune(c)))
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size == 1 {
+			return p.syntaxError("invalid UTF-8")
+		}
+		if !isInCharacterRange(r) {
+			return p.syntaxError("illegal character code " + strconv.QuoteRune(r))
+		}
+		i = i + size
+	}
+	return nil
+}
+
+func (p *FastParser) eof(err error) error {
+	if err == io.EOF {
+		return p.syntaxError("unexpected EOF")
+	}
+	return err
+}
+
+func (p *FastParser) syntaxError(msg string) error {
+	return &xml.SyntaxError{Msg: msg, Line: p.lines + bytes.Count(p.buf[:p.pos], []byte{'\n'}) + 1}
+}
+
+func splitQName(name string) (prefix, local string) {
+	for i := 0; i < len(name); i++ {
+		if name[i] == ':' {
+			return name[:i], name[i+1:]
+		}
+	}
+	return "", name
+}
+
+func isNameStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':' || c >= utf8.RuneSelf
+}
+
+// isInCharacterRange is the Char production of xml 1.0
+func isInCharacterRange(r rune) bool {
+	return r == 0x09 ||
+		r == 0x0A ||
+		r == 0x0D ||
+		r >= 0x20 && r <= 0xD7FF ||
+		r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0x10FFFF
+}
@@ -0,0 +1,153 @@
+package xmppcore
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+// oneByteReader returns the input byte by byte, so that every token spans buffer refills
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (obr oneByteReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return obr.r.Read(b[:1])
+}
+
+var fastParserCorpus = []string{
+	`<message to="romeo@example.net" from="juliet@example.com/balcony" type="chat" id="ktx72v49" xml:lang="en">` +
+		`<body>Art thou not Romeo, and a Montague?</body><thread>e0ffe42b28561960c6b12b944a092794b9683a38</thread>` +
+		`<active xmlns="http://jabber.org/protocol/chatstates"/></message>`,
+	`<presence from="juliet@example.com/balcony"><show>away</show><status>be right back</status><priority>0</priority>` +
+		`<c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="http://psi-im.org" ver="q07IKJEyjvHSyhy//CH0CxmKi8w="/></presence>`,
+	`<iq type="set" id="bind_1">` + "\n  " + `<bind xmlns="urn:ietf:params:xml:ns:xmpp-bind">` + "\n    " +
+		`<resource>balcony</resource>` + "\n  " + `</bind>` + "\n" + `</iq>`,
+	`<iq type='get' id='roster_1'><query xmlns='jabber:iq:roster'/></iq>`,
+	`<message><body>a &lt;b&gt; &amp; &apos;c&apos; &quot;d&quot; &#65;&#x42; ]] &gt;</body></message>`,
+	`<message a="x &amp; &#34;y&#34; 'z'" b='"q"'><body>line1` + "\r\n" + `line2` + "\r" + `line3</body></message>`,
+	`<message><body><![CDATA[<not>&an;element]]]></body></message>`,
+	`<message><body>mixed <b>bold</b> text</body></message>`,
+	`<stream:features><mechanisms xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><mechanism>PLAIN</mechanism>` +
+		`<mechanism>SCRAM-SHA-1</mechanism></mechanisms><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><required/></bind></stream:features>`,
+	`<message><x:data xmlns:x="jabber:x:data"><x:field x:var="v"/><value/></x:data></message>`,
+	`<foo:bar xmlns="urn:a" xmlns:foo="urn:b"><baz/></foo:bar>`,
+	`<message><body>中文 ünïcödé 😀</body></message>`,
+	` ` + "\n\t",
+	`<message/><presence/>`,
+	`<iq type="result" id="1"/></stream:stream>`,
+}
+
+type parsedToken struct {
+	kind  string
+	value string
+}
+
+func parseAllTokens(p ElementParser) ([]parsedToken, error) {
+	res := []parsedToken{}
+	for {
+		i, err := p.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+		switch t1 := i.(type) {
+		case xml.ProcInst:
+			res = append(res, parsedToken{"procinst", t1.Target + " " + string(t1.Inst)})
+		case xml.StartElement:
+			res = append(res, parsedToken{"header", fmt.Sprintf("%#v", t1)})
+		case xml.EndElement:
+			res = append(res, parsedToken{"end", fmt.Sprintf("%#v", t1)})
+		case xml.CharData:
+			res = append(res, parsedToken{"chardata", string(t1)})
+		case stravaganza.Element:
+			res = append(res, parsedToken{"element", t1.GoString()})
+		}
+	}
+}
+
+func TestFastParserEqualsParser(t *testing.T) {
+	for _, src := range fastParserCorpus {
+		src = testStreamHeader + src
+		require, err := parseAllTokens(NewParser(bytes.NewBufferString(src), 1024*1024))
+		if err != nil {
+			t.Fatalf("parse %s error: %s", src, err.Error())
+		}
+		for _, r := range []io.Reader{bytes.NewBufferString(src), oneByteReader{bytes.NewBufferString(src)}} {
+			got, err := parseAllTokens(NewFastParser(r, 1024*1024))
+			if err != nil {
+				t.Fatalf("fast parse %s error: %s", src, err.Error())
+			}
+			if !reflect.DeepEqual(require, got) {
+				t.Fatalf("fast parse %s error.\nrequire: %v\ngot:     %v", src, require, got)
+			}
+		}
+	}
+}
+
+func TestFastParserSyntaxError(t *testing.T) {
+	cases := []string{
+		`<message><body>unclosed</message>`,
+		`<message a=b/>`,
+		`<message a="<"/>`,
+		`<message a="1" a="2"/>`,
+		`<message>&unknown;</message>`,
+		`<message>&#0;</message>`,
+		`<message>]]></message>`,
+		"<message>\x01</message>",
+		"<message>\xff</message>",
+		`<1message/>`,
+		`<message><body>`,
+	}
+	for _, src := range cases {
+		p := NewFastParser(bytes.NewBufferString(testStreamHeader+src), 1024)
+		_, err := parseAllTokens(p)
+		if err == nil {
+			t.Fatalf("parse %s should fail", src)
+		}
+		if _, again := p.Next(); again != err {
+			t.Fatalf("parse %s error should be sticky", src)
+		}
+	}
+}
+
+func TestFastParserRelease(t *testing.T) {
+	src := testStreamHeader + `<message to="a@b"><body>first</body></message>`
+	p := NewFastParser(bytes.NewBufferString(src+`<presence/>`), 1024)
+	if _, err := p.Next(); err != nil {
+		t.Fatalf("parse header error: %s", err.Error())
+	}
+	p.Release()
+	p.Release()
+	if _, err := p.Next(); err != ErrParserReleased {
+		t.Fatalf("released parser should fail, got %v", err)
+	}
+	// the parsers after take the released state
+	for i := 0; i < 4; i++ {
+		_, elems := parseTestStream(func(r io.Reader, size int) ElementParser { return NewFastParser(bytes.NewBufferString(src), size) }, "")
+		if len(elems) != 1 || elems[0].Attribute("to") != "a@b" || elems[0].Child("body").Text() != "first" {
+			t.Fatalf("element parsed with released state error: %v", elems)
+		}
+	}
+}
+
+func TestFastParserReusesFrames(t *testing.T) {
+	src := testStreamHeader + `<message><body>first</body></message><presence><status>second</status></presence>`
+	_, elems := parseTestStream(func(r io.Reader, size int) ElementParser { return NewFastParser(bytes.NewBufferString(src), size) }, "")
+	if len(elems) != 2 {
+		t.Fatalf("require 2 elements, got %d", len(elems))
+	}
+	if elems[0].Child("body").Text() != "first" || elems[1].Child("status").Text() != "second" {
+		t.Fatalf("element built from reused frames error: %s %s", elems[0].GoString(), elems[1].GoString())
+	}
+}
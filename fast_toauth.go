@@ -0,0 +1,165 @@
+package xmppcore
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+// FastToAuth authenticates by the fast tokens of store, xep-0484. it's a ClientSasl2Inline
+// which asks for a token when authenticating otherwise and keeps the tokens rotated
+type FastToAuth struct {
+	store     TokenStore
+	username  string
+	userAgent string
+	// the token authenticating with, and the mechanism of the token asked for
+	using      *FastToken
+	requested  string
+	invalidate bool
+}
+
+func NewFastToAuth(store TokenStore, username, userAgent string) *FastToAuth {
+	return &FastToAuth{store: store, username: username, userAgent: userAgent}
+}
+
+// Invalidate asks the server to invalidate the tokens the next time one authenticates, as
+// logging out does
+func (fta *FastToAuth) Invalidate() {
+	fta.invalidate = true
+}
+
+// fastOffered are the ht mechanisms the server offers inline
+func fastOffered(inline stravaganza.Element) []string {
+	if inline == nil {
+		return nil
+	}
+	fast := inline.Child("fast")
+	if fast == nil || fast.Attribute("xmlns") != NSFast {
+		return nil
+	}
+	mechs := []string{}
+	for _, m := range fast.Children("mechanism") {
+		mechs = append(mechs, m.Text())
+	}
+	return mechs
+}
+
+// Sasl2ToAuth authenticates with the newest token the server offers the mechanism of
+func (fta *FastToAuth) Sasl2ToAuth(inline stravaganza.Element, part Part) (string, ToAuth) {
+	fta.using = nil
+	offered := fastOffered(inline)
+	tokens, err := fta.store.Tokens(fta.username, fta.userAgent)
+	if err != nil {
+		part.Logger().Sub(LogSubAuth).Log(LogError, "fast tokens error", Field(LogKeyErr, err))
+		return "", nil
+	}
+	supported := htMechanismsOf(part.Conn())
+	for _, t := range tokens {
+		if t.Expired() || !containsString(offered, t.Mechanism) || !containsString(supported, t.Mechanism) {
+			continue
+		}
+		fta.using = &t
+		return t.Mechanism, fta
+	}
+	return "", nil
+}
+
+func (fta *FastToAuth) Sasl2Request(mechanism string, inline stravaganza.Element, part Part) []stravaganza.Element {
+	fta.requested = ""
+	offered := fastOffered(inline)
+	if len(offered) == 0 {
+		return nil
+	}
+	if fta.using != nil && fta.using.Mechanism == mechanism {
+		count := fta.using.Count + 1
+		if err := fta.store.UseToken(*fta.using, count); err != nil {
+			part.Logger().Sub(LogSubAuth).Log(LogError, "fast token count error", Field(LogKeyErr, err))
+		}
+		fta.using.Count = count
+		fast := stravaganza.NewBuilder("fast").
+			WithAttribute("xmlns", NSFast).
+			WithAttribute("count", strconv.FormatUint(count, 10))
+		if fta.invalidate {
+			fast.WithAttribute("invalidate", "true")
+		} else {
+			// the server rotates the token
+			fta.requested = mechanism
+		}
+		return []stravaganza.Element{fast.Build()}
+	}
+	for _, mech := range htMechanismsOf(part.Conn()) {
+		if containsString(offered, mech) {
+			fta.requested = mech
+			return []stravaganza.Element{stravaganza.NewBuilder("request-token").
+				WithAttribute("xmlns", NSFast).
+				WithAttribute("mechanism", mech).Build()}
+		}
+	}
+	return nil
+}
+
+// Sasl2Success keeps the token the server issues
+func (fta *FastToAuth) Sasl2Success(success stravaganza.Element, part Part) error {
+	if fta.invalidate && fta.using != nil {
+		fta.invalidate = false
+		if err := fta.store.InvalidateTokens(fta.username, fta.userAgent); err != nil {
+			return err
+		}
+	}
+	token := success.Child("token")
+	if token == nil || token.Attribute("xmlns") != NSFast || fta.requested == "" {
+		return nil
+	}
+	expiry, err := time.Parse(time.RFC3339, token.Attribute("expiry"))
+	if err != nil {
+		return err
+	}
+	return fta.store.SaveToken(FastToken{
+		Username:  fta.username,
+		UserAgent: fta.userAgent,
+		Mechanism: fta.requested,
+		Token:     token.Attribute("token"),
+		Expiry:    expiry})
+}
+
+func (fta *FastToAuth) ToAuth(mech string, part Part) error {
+	if fta.using == nil || fta.using.Mechanism != mech {
+		return ErrFastNoToken
+	}
+	token := fta.using.Token
+	cbData, err := htChannelBinding(mech, part.Conn())
+	if err != nil {
+		return err
+	}
+	payload := fta.username + "\x00" + string(htHash(token, "Initiator", cbData))
+	elem := stravaganza.NewBuilder("auth").
+		WithAttribute("xmlns", NSSasl).
+		WithAttribute("mechanism", mech).
+		WithText(base64.StdEncoding.EncodeToString([]byte(payload))).Build()
+	if err := part.Channel().SendElement(elem); err != nil {
+		return err
+	}
+	if err := part.Channel().NextElement(&elem); err != nil {
+		var f Failure
+		if errors.As(err, &f) && f.DescTag == SFNotAuthorized {
+			// the server doesn't take the tokens anymore, the next login authenticates otherwise
+			fta.store.InvalidateTokens(fta.username, fta.userAgent)
+		}
+		return err
+	}
+	if elem.Name() != "success" {
+		return errors.New("server failed auth")
+	}
+	var proof string
+	if err := AuthPayload(elem.Text(), &proof); err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(proof), htHash(token, "Responder", cbData)) {
+		return ErrFastServerProof
+	}
+	return nil
+}
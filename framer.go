@@ -0,0 +1,105 @@
+package xmppcore
+
+import "io"
+
+// framedConn frames a stream as rfc7395 does: the stream is opened by an open element and
+// closed by a close element, each top level element is delivered at once. a conn wrapping
+// another one tells whether the one wrapped is framed
+type framedConn interface {
+	framed() bool
+}
+
+func isFramedConn(conn io.ReadWriteCloser) bool {
+	c, ok := conn.(framedConn)
+	return ok && c.framed()
+}
+
+// elemFramer splits a framed stream into top level elements. a write may end in the middle
+// of an element, which is kept until the rest comes. comments and cdata are not expected,
+// they're never written
+type elemFramer struct {
+	pending []byte
+	// scanned is the size of pending already scanned
+	scanned int
+	// start is the start of the top level element being scanned
+	start    int
+	tagStart int
+	depth    int
+	inTag    bool
+	quote    byte
+}
+
+func (f *elemFramer) write(b []byte, frame func([]byte) error) error {
+	f.pending = append(f.pending, b...)
+	for ; f.scanned < len(f.pending); f.scanned++ {
+		c := f.pending[f.scanned]
+		if !f.inTag {
+			if c == '<' {
+				if f.depth == 0 && f.start < f.scanned {
+					// whitespaces between top level elements
+					if err := frame(f.pending[f.start:f.scanned]); err != nil {
+						return err
+					}
+					f.start = f.scanned
+				}
+				f.inTag = true
+				f.tagStart = f.scanned
+			}
+			continue
+		}
+		if f.quote != 0 {
+			if c == f.quote {
+				f.quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'':
+			f.quote = c
+			continue
+		case '>':
+		default:
+			continue
+		}
+		f.inTag = false
+		switch f.pending[f.tagStart+1] {
+		case '/':
+			f.depth--
+		case '?', '!':
+		default:
+			if f.pending[f.scanned-1] != '/' {
+				f.depth++
+			}
+		}
+		if f.depth <= 0 {
+			f.depth = 0
+			if err := frame(f.pending[f.start : f.scanned+1]); err != nil {
+				return err
+			}
+			f.start = f.scanned + 1
+		}
+	}
+	if f.depth == 0 && !f.inTag && f.start < len(f.pending) {
+		// a whitespace keepalive
+		if err := frame(f.pending[f.start:]); err != nil {
+			return err
+		}
+		f.start = len(f.pending)
+	}
+	// keep the element not complete yet
+	n := copy(f.pending, f.pending[f.start:])
+	f.pending = f.pending[:n]
+	f.scanned -= f.start
+	f.tagStart -= f.start
+	f.start = 0
+	return nil
+}
+
+func isXMLSpace(bs []byte) bool {
+	for _, c := range bs {
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return false
+		}
+	}
+	return true
+}
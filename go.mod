@@ -7,7 +7,9 @@ require (
 	github.com/gorilla/websocket v1.4.2
 	github.com/jackal-xmpp/stravaganza/v2 v2.0.0
 	github.com/spf13/cobra v1.2.1
-	github.com/yang-zzhong/scram-auth v0.0.0-20210914032941-bb5a6826fb5a
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	golang.org/x/net v0.0.0-20210415231046-e915ea6b2b7d
+	golang.org/x/text v0.3.6
 	gosrc.io/xmpp v0.5.1
 )
 
@@ -15,9 +17,6 @@ require (
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5 // indirect
-	golang.org/x/net v0.0.0-20210415231046-e915ea6b2b7d // indirect
-	golang.org/x/text v0.3.6 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	google.golang.org/protobuf v1.26.0 // indirect
 	nhooyr.io/websocket v1.6.5 // indirect
@@ -0,0 +1,274 @@
+package xmppcore
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/secure/precis"
+)
+
+// rfc7622
+
+const (
+	JIDLocalpart    = "localpart"
+	JIDDomainpart   = "domainpart"
+	JIDResourcepart = "resourcepart"
+
+	// every part of a jid must not be longer than 1023 octets after preparation
+	maxJIDPartSize = 1023
+)
+
+var (
+	ErrUnproperFromAttr     = errors.New("unproper from attr")
+	ErrIncorrectJidEncoding = errors.New("incorrect jid encoding")
+	ErrJIDEmptyPart         = errors.New("empty part")
+	ErrJIDPartTooLong       = errors.New("part longer than 1023 octets")
+
+	domainpartProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.Transitional(false))
+)
+
+// JIDError describes why a jid or one of its parts can't be prepared. it's a jid-malformed
+// condition of stanza errors, or an invalid-from stream error when found in a stream header
+type JIDError struct {
+	Part string
+	Err  error
+}
+
+func (e *JIDError) Error() string {
+	return fmt.Sprintf("jid malformed: %s: %s", e.Part, e.Err.Error())
+}
+
+func (e *JIDError) Unwrap() error {
+	return e.Err
+}
+
+func (e *JIDError) Is(target error) bool {
+	return target == ErrIncorrectJidEncoding
+}
+
+// Condition returns the defined condition of stanza errors the error maps to
+func (e *JIDError) Condition() string {
+	return ECJIDMalformed
+}
+
+// JID is a prepared jid, the username is prepared with UsernameCaseMapped profile, the
+// domain is a lowercased IDNA U-label or an IP literal and the resource is prepared with
+// OpaqueString profile. a JID without Username is a domain jid
+type JID struct {
+	Username string
+	Domain   string
+	Resource string
+}
+
+// ParseJID parses and prepares jid in the form of [ localpart "@" ] domainpart [ "/" resourcepart ]
+func ParseJID(src string, jid *JID) error {
+	var username, domain, resource string
+	rest := src
+	if idx := strings.Index(rest, "/"); idx >= 0 {
+		resource = rest[idx+1:]
+		if resource == "" {
+			return &JIDError{Part: JIDResourcepart, Err: ErrJIDEmptyPart}
+		}
+		rest = rest[:idx]
+	}
+	if idx := strings.Index(rest, "@"); idx >= 0 {
+		username = rest[:idx]
+		if username == "" {
+			return &JIDError{Part: JIDLocalpart, Err: ErrJIDEmptyPart}
+		}
+		rest = rest[idx+1:]
+	}
+	domain = rest
+	j, err := NewJID(username, domain, resource)
+	if err != nil {
+		return err
+	}
+	*jid = *j
+	return nil
+}
+
+// NewJID prepares all parts and builds a jid, username and resource are optional
+func NewJID(username, domain, resource string) (*JID, error) {
+	var jid JID
+	var err error
+	if jid.Domain, err = PrepDomainpart(domain); err != nil {
+		return nil, err
+	}
+	if username != "" {
+		if jid.Username, err = PrepLocalpart(username); err != nil {
+			return nil, err
+		}
+	}
+	if resource != "" {
+		if jid.Resource, err = PrepResourcepart(resource); err != nil {
+			return nil, err
+		}
+	}
+	return &jid, nil
+}
+
+// PrepLocalpart enforces UsernameCaseMapped profile on localpart
+func PrepLocalpart(localpart string) (string, error) {
+	if localpart == "" {
+		return "", &JIDError{Part: JIDLocalpart, Err: ErrJIDEmptyPart}
+	}
+	res, err := precis.UsernameCaseMapped.String(localpart)
+	if err != nil {
+		return "", &JIDError{Part: JIDLocalpart, Err: err}
+	}
+	// characters forbidden in localpart by rfc7622 section 3.3.1
+	if strings.ContainsAny(res, "\"&'/:<>@") {
+		return "", &JIDError{Part: JIDLocalpart, Err: ErrIncorrectJidEncoding}
+	}
+	return res, checkJIDPartSize(JIDLocalpart, res)
+}
+
+// PrepDomainpart converts domainpart to its lowercased U-label form. IP literals are kept as is
+func PrepDomainpart(domainpart string) (string, error) {
+	domainpart = strings.TrimSuffix(domainpart, ".")
+	if domainpart == "" {
+		return "", &JIDError{Part: JIDDomainpart, Err: ErrJIDEmptyPart}
+	}
+	if strings.HasPrefix(domainpart, "[") && strings.HasSuffix(domainpart, "]") {
+		ip := net.ParseIP(domainpart[1 : len(domainpart)-1])
+		if ip == nil || ip.To4() != nil {
+			return "", &JIDError{Part: JIDDomainpart, Err: ErrIncorrectJidEncoding}
+		}
+		return "[" + ip.String() + "]", nil
+	}
+	if ip := net.ParseIP(domainpart); ip != nil && ip.To4() != nil {
+		return ip.String(), nil
+	}
+	if !utf8.ValidString(domainpart) {
+		return "", &JIDError{Part: JIDDomainpart, Err: ErrIncorrectJidEncoding}
+	}
+	res, err := domainpartProfile.ToUnicode(domainpart)
+	if err != nil {
+		return "", &JIDError{Part: JIDDomainpart, Err: err}
+	}
+	return res, checkJIDPartSize(JIDDomainpart, res)
+}
+
+// PrepResourcepart enforces OpaqueString profile on resourcepart
+func PrepResourcepart(resourcepart string) (string, error) {
+	if resourcepart == "" {
+		return "", &JIDError{Part: JIDResourcepart, Err: ErrJIDEmptyPart}
+	}
+	res, err := precis.OpaqueString.String(resourcepart)
+	if err != nil {
+		return "", &JIDError{Part: JIDResourcepart, Err: err}
+	}
+	return res, checkJIDPartSize(JIDResourcepart, res)
+}
+
+func checkJIDPartSize(part, val string) error {
+	if len(val) > maxJIDPartSize {
+		return &JIDError{Part: part, Err: ErrJIDPartTooLong}
+	}
+	return nil
+}
+
+func (jid JID) String() string {
+	res := jid.Domain
+	if jid.Username != "" {
+		res = jid.Username + "@" + res
+	}
+	if jid.Resource != "" {
+		res = res + "/" + jid.Resource
+	}
+	return res
+}
+
+// Bare returns jid without resource
+func (jid JID) Bare() JID {
+	return JID{Username: jid.Username, Domain: jid.Domain}
+}
+
+// IsFull tells whether the jid has a resource
+func (jid JID) IsFull() bool {
+	return jid.Resource != ""
+}
+
+// IsBare tells whether the jid has a username but no resource
+func (jid JID) IsBare() bool {
+	return jid.Username != "" && jid.Resource == ""
+}
+
+// IsDomain tells whether the jid is a domain jid, with or without resource
+func (jid JID) IsDomain() bool {
+	return jid.Username == ""
+}
+
+// Equal compares two prepared jid
+func (jid JID) Equal(a JID) bool {
+	return jid.Username == a.Username && jid.Domain == a.Domain && jid.Resource == a.Resource
+}
+
+// xep-0106
+
+var (
+	ErrJIDEscapeSpaceEdge = errors.New("leading or trailing space")
+
+	jidEscapes = map[byte]string{
+		' ': `\20`, '"': `\22`, '&': `\26`, '\'': `\27`, '/': `\2f`,
+		':': `\3a`, '<': `\3c`, '>': `\3e`, '@': `\40`, '\\': `\5c`,
+	}
+	jidUnescapes = map[string]byte{
+		`\20`: ' ', `\22`: '"', `\26`: '&', `\27`: '\'', `\2f`: '/',
+		`\3a`: ':', `\3c`: '<', `\3e`: '>', `\40`: '@', `\5c`: '\\',
+	}
+)
+
+// EscapeLocalpart maps a human readable name, such as an account name from a directory, to
+// a localpart. a backslash is escaped only when it's followed by an escape sequence, and the
+// name must not start or end with a space
+func EscapeLocalpart(name string) (string, error) {
+	if strings.HasPrefix(name, " ") || strings.HasSuffix(name, " ") {
+		return "", &JIDError{Part: JIDLocalpart, Err: ErrJIDEscapeSpaceEdge}
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '\\' && !isJIDEscapeSeq(name[i:]) {
+			b.WriteByte(c)
+			continue
+		}
+		if esc, ok := jidEscapes[c]; ok {
+			b.WriteString(esc)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+// UnescapeLocalpart maps an escaped localpart back to its human readable form
+func UnescapeLocalpart(localpart string) string {
+	var b strings.Builder
+	for i := 0; i < len(localpart); i++ {
+		if isJIDEscapeSeq(localpart[i:]) {
+			b.WriteByte(jidUnescapes[localpart[i:i+3]])
+			i = i + 2
+			continue
+		}
+		b.WriteByte(localpart[i])
+	}
+	return b.String()
+}
+
+func isJIDEscapeSeq(s string) bool {
+	if len(s) < 3 {
+		return false
+	}
+	_, ok := jidUnescapes[s[:3]]
+	return ok
+}
+
+// UnescapedString returns the jid for displaying, with localpart unescaped
+func (jid JID) UnescapedString() string {
+	return JID{Username: UnescapeLocalpart(jid.Username), Domain: jid.Domain, Resource: jid.Resource}.String()
+}
@@ -0,0 +1,148 @@
+package xmppcore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseJID(t *testing.T) {
+	cases := []struct {
+		src      string
+		username string
+		domain   string
+		resource string
+	}{
+		{"test@hello-world.im", "test", "hello-world.im", ""},
+		{"test@hello-world.im/res", "test", "hello-world.im", "res"},
+		{"hello-world.im", "", "hello-world.im", ""},
+		{"hello-world.im/res", "", "hello-world.im", "res"},
+		{"hello-world.im/res/with/slash@at", "", "hello-world.im", "res/with/slash@at"},
+		{"Test@Example.COM", "test", "example.com", ""},
+		{"test@example.com.", "test", "example.com", ""},
+		{"test@[::1]/res", "test", "[::1]", "res"},
+		{"test@127.0.0.1", "test", "127.0.0.1", ""},
+		{"juliet@xn--mnchen-3ya.de", "juliet", "münchen.de", ""},
+		{"ΣΑΣ@example.com", "σασ", "example.com", ""},
+	}
+	for _, c := range cases {
+		var jid JID
+		if err := ParseJID(c.src, &jid); err != nil {
+			t.Fatalf("parse %s error: %s", c.src, err.Error())
+		}
+		if jid.Username != c.username || jid.Domain != c.domain || jid.Resource != c.resource {
+			t.Fatalf("parse %s error: got %#v", c.src, jid)
+		}
+	}
+}
+
+func TestParseJIDMalformed(t *testing.T) {
+	cases := []struct {
+		src  string
+		part string
+	}{
+		{"", JIDDomainpart},
+		{"@hello-world.im", JIDLocalpart},
+		{"test@", JIDDomainpart},
+		{"test@hello-world.im/", JIDResourcepart},
+		{"a@b@hello-world.im", JIDDomainpart},
+		{"te st@hello-world.im", JIDLocalpart},
+		{"test@[1.1.1.1]", JIDDomainpart},
+		{strings.Repeat("a", 1024) + "@hello-world.im", JIDLocalpart},
+		{"test@hello-world.im/" + strings.Repeat("a", 1024), JIDResourcepart},
+	}
+	for _, c := range cases {
+		var jid JID
+		err := ParseJID(c.src, &jid)
+		var jidErr *JIDError
+		if !errors.As(err, &jidErr) {
+			t.Fatalf("parse %s should fail with JIDError, got %v", c.src, err)
+		}
+		if jidErr.Part != c.part {
+			t.Fatalf("parse %s should fail on %s, failed on %s", c.src, c.part, jidErr.Part)
+		}
+		if jidErr.Condition() != "jid-malformed" || !errors.Is(err, ErrIncorrectJidEncoding) {
+			t.Fatalf("parse %s error not a jid malformed error", c.src)
+		}
+	}
+}
+
+func TestJIDString(t *testing.T) {
+	for _, src := range []string{"hello-world.im", "hello-world.im/res", "test@hello-world.im", "test@hello-world.im/res"} {
+		var jid JID
+		if err := ParseJID(src, &jid); err != nil {
+			t.Fatalf("parse %s error: %s", src, err.Error())
+		}
+		if jid.String() != src {
+			t.Fatalf("jid string not equal. require: %s, got %s", src, jid.String())
+		}
+	}
+}
+
+func TestJIDEqualAndBare(t *testing.T) {
+	var a, b JID
+	ParseJID("Test@Example.COM/res", &a)
+	ParseJID("test@example.com/res", &b)
+	if !a.Equal(b) {
+		t.Fatalf("%s should equal to %s", a, b)
+	}
+	if !a.IsFull() || a.Bare().IsFull() || !a.Bare().IsBare() {
+		t.Fatalf("full and bare check error")
+	}
+	if a.Bare().String() != "test@example.com" {
+		t.Fatalf("bare jid error: %s", a.Bare())
+	}
+	var domain JID
+	ParseJID("example.com", &domain)
+	if !domain.IsDomain() || domain.IsBare() || domain.IsFull() {
+		t.Fatalf("domain jid check error")
+	}
+}
+
+var xep0106Examples = []struct {
+	unescaped string
+	escaped   string
+}{
+	{`space cadet`, `space\20cadet`},
+	{`call me "ishmael"`, `call\20me\20\22ishmael\22`},
+	{`at&t guy`, `at\26t\20guy`},
+	{`d'artagnan`, `d\27artagnan`},
+	{`/.fanboy`, `\2f.fanboy`},
+	{`::foo::`, `\3a\3afoo\3a\3a`},
+	{`<foo>`, `\3cfoo\3e`},
+	{`user@host`, `user\40host`},
+	{`c:\net`, `c\3a\net`},
+	{`c:\\net`, `c\3a\\net`},
+	{`c:\cool stuff`, `c\3a\cool\20stuff`},
+	{`c:\5commas`, `c\3a\5c5commas`},
+}
+
+func TestEscapeLocalpart(t *testing.T) {
+	for _, e := range xep0106Examples {
+		escaped, err := EscapeLocalpart(e.unescaped)
+		if err != nil {
+			t.Fatalf("escape %s error: %s", e.unescaped, err.Error())
+		}
+		if escaped != e.escaped {
+			t.Fatalf("escape %s error. require: %s, got: %s", e.unescaped, e.escaped, escaped)
+		}
+		if unescaped := UnescapeLocalpart(escaped); unescaped != e.unescaped {
+			t.Fatalf("unescape %s error. require: %s, got: %s", escaped, e.unescaped, unescaped)
+		}
+		var jid JID
+		if err := ParseJID(escaped+"@example.com", &jid); err != nil {
+			t.Fatalf("escaped localpart %s not valid: %s", escaped, err.Error())
+		}
+		if jid.UnescapedString() != e.unescaped+"@example.com" {
+			t.Fatalf("unescaped string error: %s", jid.UnescapedString())
+		}
+	}
+}
+
+func TestEscapeLocalpartSpaceEdge(t *testing.T) {
+	for _, name := range []string{" cadet", "cadet "} {
+		if _, err := EscapeLocalpart(name); !errors.Is(err, ErrJIDEscapeSpaceEdge) {
+			t.Fatalf("escape [%s] should fail", name)
+		}
+	}
+}
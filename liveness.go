@@ -0,0 +1,197 @@
+package xmppcore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+// xep-0199
+const NSPing = "urn:xmpp:ping"
+
+// LivenessConfig configures how a part keeps its stream alive and detects a dead peer. a
+// zero duration disables the related check
+type LivenessConfig struct {
+	// KeepaliveInterval is how long we may stay silent before a whitespace is sent
+	KeepaliveInterval time.Duration
+	// IdleTimeout is how long the peer may stay silent before it's suspected to be dead
+	IdleTimeout time.Duration
+	// PingTimeout is how long to wait for any data after pinging a suspected peer. without
+	// it, or before resource binding, the peer is dead once IdleTimeout passes
+	PingTimeout time.Duration
+}
+
+var DefaultLivenessConfig = LivenessConfig{
+	KeepaliveInterval: time.Second * 60,
+	IdleTimeout:       time.Second * 300,
+	PingTimeout:       time.Second * 30,
+}
+
+// Liveness watches the activity of the channel of a part. it's also the handler of pings,
+// both the replies of our pings and the pings from the peer
+type Liveness struct {
+	part     Part
+	isServer bool
+	conf     LivenessConfig
+	quit     chan struct{}
+	stopOnce sync.Once
+	pingID   string
+	mu       sync.Mutex
+	IDAble
+}
+
+func newLiveness(part Part, isServer bool, conf LivenessConfig) *Liveness {
+	return &Liveness{
+		part:     part,
+		isServer: isServer,
+		conf:     conf,
+		quit:     make(chan struct{}),
+		IDAble:   CreateIDAble(),
+	}
+}
+
+func (l *Liveness) Start() {
+	if l.tick() > 0 {
+		go l.run()
+	}
+}
+
+func (l *Liveness) Stop() {
+	l.stopOnce.Do(func() {
+		close(l.quit)
+	})
+}
+
+// tick is the period of checking, a quarter of the shortest duration configured
+func (l *Liveness) tick() time.Duration {
+	var tick time.Duration
+	for _, d := range []time.Duration{l.conf.KeepaliveInterval, l.conf.IdleTimeout, l.conf.PingTimeout} {
+		if d > 0 && (tick == 0 || d < tick) {
+			tick = d
+		}
+	}
+	return tick / 4
+}
+
+func (l *Liveness) run() {
+	ticker := time.NewTicker(l.tick())
+	defer ticker.Stop()
+	last := l.part.Channel().Activity()
+	receivedAt, writtenAt := time.Now(), time.Now()
+	var pingedAt time.Time
+	for {
+		select {
+		case <-l.quit:
+			return
+		case now := <-ticker.C:
+			activity := l.part.Channel().Activity()
+			if activity.Closed {
+				return
+			}
+			if activity.Received != last.Received {
+				receivedAt = now
+				pingedAt = time.Time{}
+			}
+			if activity.Written != last.Written {
+				writtenAt = now
+			}
+			last = activity
+			if l.conf.KeepaliveInterval > 0 && now.Sub(writtenAt) >= l.conf.KeepaliveInterval {
+				if err := l.part.Channel().Send([]byte(" ")); err != nil {
+					return
+				}
+				writtenAt = now
+			}
+			if l.conf.IdleTimeout == 0 || now.Sub(receivedAt) < l.conf.IdleTimeout {
+				continue
+			}
+			if pingedAt.IsZero() && l.conf.PingTimeout > 0 && l.part.Attr().JID.Resource != "" {
+				if err := l.ping(); err != nil {
+					return
+				}
+				pingedAt = now
+				continue
+			}
+			if pingedAt.IsZero() || now.Sub(pingedAt) >= l.conf.PingTimeout {
+				l.dead()
+				return
+			}
+		}
+	}
+}
+
+func (l *Liveness) ping() error {
+	stanza := Stanza{Name: NameIQ, Type: TypeGet, ID: "ping-" + uuid.New().String()}
+	if l.isServer {
+		stanza.From = l.part.Attr().Domain
+		stanza.To = l.part.Attr().JID.String()
+	} else {
+		stanza.From = l.part.Attr().JID.String()
+		stanza.To = l.part.Attr().Domain
+	}
+	l.mu.Lock()
+	l.pingID = stanza.ID
+	l.mu.Unlock()
+	return l.part.Channel().SendElement(stanza.ToElemBuilder().
+		WithChild(stravaganza.NewBuilder("ping").WithAttribute("xmlns", NSPing).Build()).
+		Build())
+}
+
+// dead closes the stream, the conn is closed soon after, which stops the part reading it
+func (l *Liveness) dead() {
+	l.part.Logger().Log(LogInfo, "peer is dead, close the stream")
+	l.part.Channel().CloseWithStreamError(StreamError{Condition: SEConnectionTimeout})
+}
+
+// addressed tells a ping to the stream, the one to the server or the account of the part.
+// the others are routed as any stanza
+func (l *Liveness) addressed(to string) bool {
+	if to == "" {
+		return true
+	}
+	var jid JID
+	if err := ParseJID(to, &jid); err != nil {
+		return false
+	}
+	attr := l.part.Attr()
+	if jid.IsDomain() {
+		return jid.Resource == "" && jid.Domain == attr.Domain
+	}
+	if !l.isServer && jid.Equal(attr.JID) {
+		return true
+	}
+	return jid.IsBare() && jid.Equal(attr.JID.Bare())
+}
+
+// Handle answers the pings from the peer and catches the replies of our pings. any reply,
+// an error one included, proves the peer alive, which is already known from the activity
+func (l *Liveness) Handle(elem stravaganza.Element, part Part) (catched bool, err error) {
+	if elem.Name() != NameIQ {
+		return false, nil
+	}
+	switch StanzaType(elem.Attribute("type")) {
+	case TypeGet:
+		if elem.ChildNamespace("ping", NSPing) == nil || !l.addressed(elem.Attribute("to")) {
+			return false, nil
+		}
+		err = part.Channel().SendElement(Stanza{
+			Name: NameIQ,
+			Type: TypeResult,
+			ID:   elem.Attribute("id"),
+			From: elem.Attribute("to"),
+			To:   elem.Attribute("from"),
+		}.ToElemBuilder().Build())
+		return true, err
+	case TypeResult, TypeError:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.pingID == "" || elem.Attribute("id") != l.pingID {
+			return false, nil
+		}
+		l.pingID = ""
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,167 @@
+package xmppcore
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+const testClientHeader = `<?xml version='1.0'?><stream:stream xmlns:stream="http://etherx.jabber.org/streams" ` +
+	`xmlns="jabber:client" version="1.0" to="hello-world.im">`
+
+func runLivenessPart(t *testing.T, conf LivenessConfig, jid JID) (chan error, *LocalConn) {
+	pair := NewLocalConnPair(NewLocalConnAddr(":1"), NewLocalConnAddr(":2"))
+	part := NewXPart(pair[0], "hello-world.im", NewLogger(io.Discard))
+	part.Attr().JID = jid
+	part.EnableLiveness(conf)
+	errChan := part.Run()
+	if _, err := pair[1].Write([]byte(testClientHeader)); err != nil {
+		t.Fatalf("write header error: %s", err.Error())
+	}
+	return errChan, pair[1]
+}
+
+func collectTestTokens(conn *LocalConn) chan interface{} {
+	tokens := make(chan interface{}, 64)
+	go func() {
+		p := NewFastParser(conn, 1024*1024)
+		for {
+			i, err := p.Next()
+			if err != nil {
+				close(tokens)
+				return
+			}
+			tokens <- i
+		}
+	}()
+	return tokens
+}
+
+// waitTestToken waits a token matched, the unmatched ones are skipped
+func waitTestToken(t *testing.T, tokens chan interface{}, timeout time.Duration, match func(interface{}) bool) interface{} {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case i, ok := <-tokens:
+			if !ok {
+				t.Fatalf("stream ended before the token required")
+			}
+			if match(i) {
+				return i
+			}
+		case <-deadline:
+			t.Fatalf("wait token timeout")
+		}
+	}
+}
+
+func isTestStreamError(condition string) func(interface{}) bool {
+	return func(i interface{}) bool {
+		elem, ok := i.(stravaganza.Element)
+		if !ok {
+			return false
+		}
+		var se StreamError
+		return se.FromElem(elem) == nil && se.Condition == condition
+	}
+}
+
+func isTestPing(i interface{}) bool {
+	elem, ok := i.(stravaganza.Element)
+	return ok && elem.Name() == NameIQ && elem.ChildNamespace("ping", NSPing) != nil
+}
+
+func TestLivenessKeepalive(t *testing.T) {
+	_, peer := runLivenessPart(t, LivenessConfig{KeepaliveInterval: time.Millisecond * 40}, JID{})
+	// whitespaces are read raw, the parser holds them until the next element
+	received := ""
+	bs := make([]byte, 4096)
+	for !strings.HasSuffix(received, "  ") {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := peer.Read(bs)
+		if err != nil {
+			t.Fatalf("read keepalives error: %s, received %q", err.Error(), received)
+		}
+		received = received + string(bs[:n])
+	}
+	if !strings.Contains(received, "features") {
+		t.Fatalf("keepalives should follow the features, received %q", received)
+	}
+}
+
+func TestLivenessDeadPeer(t *testing.T) {
+	errChan, peer := runLivenessPart(t, LivenessConfig{IdleTimeout: time.Millisecond * 80, PingTimeout: time.Millisecond * 80}, JID{})
+	tokens := collectTestTokens(peer)
+	// not bound yet, closed without pinging
+	i := waitTestToken(t, tokens, time.Second, func(i interface{}) bool {
+		return isTestPing(i) || isTestStreamError(SEConnectionTimeout)(i)
+	})
+	if isTestPing(i) {
+		t.Fatalf("a stream not bound should not be pinged")
+	}
+	select {
+	case err := <-errChan:
+		if err == nil {
+			t.Fatalf("part of a dead peer should stop with error")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("part of a dead peer should stop")
+	}
+}
+
+func TestLivenessPing(t *testing.T) {
+	jid := JID{Username: "juliet", Domain: "hello-world.im", Resource: "balcony"}
+	_, peer := runLivenessPart(t, LivenessConfig{IdleTimeout: time.Millisecond * 80, PingTimeout: time.Millisecond * 200}, jid)
+	tokens := collectTestTokens(peer)
+	if _, err := peer.Write([]byte(`<iq type="get" id="c2s1"><ping xmlns="urn:xmpp:ping"/></iq>`)); err != nil {
+		t.Fatalf("write ping error: %s", err.Error())
+	}
+	waitTestToken(t, tokens, time.Second, func(i interface{}) bool {
+		elem, ok := i.(stravaganza.Element)
+		return ok && elem.Name() == NameIQ && elem.Attribute("type") == "result" && elem.Attribute("id") == "c2s1"
+	})
+	for n := 0; n < 3; n++ {
+		ping := waitTestToken(t, tokens, time.Second, func(i interface{}) bool {
+			if isTestStreamError(SEConnectionTimeout)(i) {
+				t.Fatalf("a peer answering pings should be alive")
+			}
+			return isTestPing(i)
+		}).(stravaganza.Element)
+		if ping.Attribute("to") != jid.String() || ping.Attribute("from") != "hello-world.im" {
+			t.Fatalf("ping addressing error: %s", ping.GoString())
+		}
+		if _, err := peer.Write([]byte(`<iq type="result" id="` + ping.Attribute("id") + `" from="` + jid.String() + `"/>`)); err != nil {
+			t.Fatalf("write pong error: %s", err.Error())
+		}
+	}
+	waitTestToken(t, tokens, time.Second, isTestStreamError(SEConnectionTimeout))
+}
+
+func TestLivenessPingRouted(t *testing.T) {
+	jid := JID{Username: "juliet", Domain: "hello-world.im", Resource: "balcony"}
+	_, peer := runLivenessPart(t, LivenessConfig{}, jid)
+	tokens := collectTestTokens(peer)
+	// the pings to another entity are routed, the ones to the server or the account answered
+	for _, ping := range []string{
+		`<iq type="get" id="c2s1" to="romeo@hello-world.im"><ping xmlns="urn:xmpp:ping"/></iq>`,
+		`<iq type="get" id="c2s2" to="juliet@hello-world.im/chamber"><ping xmlns="urn:xmpp:ping"/></iq>`,
+		`<iq type="get" id="c2s3" to="juliet@hello-world.im"><ping xmlns="urn:xmpp:ping"/></iq>`,
+		`<iq type="get" id="c2s4" to="hello-world.im"><ping xmlns="urn:xmpp:ping"/></iq>`,
+	} {
+		if _, err := peer.Write([]byte(ping)); err != nil {
+			t.Fatalf("write ping error: %s", err.Error())
+		}
+	}
+	for _, id := range []string{"c2s3", "c2s4"} {
+		result := waitTestToken(t, tokens, time.Second, func(i interface{}) bool {
+			elem, ok := i.(stravaganza.Element)
+			return ok && elem.Name() == NameIQ && elem.Attribute("type") == "result"
+		}).(stravaganza.Element)
+		if result.Attribute("id") != id {
+			t.Fatalf("ping %s should be routed", result.Attribute("id"))
+		}
+	}
+}
@@ -3,10 +3,10 @@ package xmppcore
 import (
 	"bytes"
 	"crypto/tls"
-	"fmt"
 	"io"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -40,15 +40,31 @@ type LocalConn struct {
 	buf                  *bytes.Buffer
 	localAddr            net.Addr
 	remoteAddr           net.Addr
+	pipe                 *localPipe
+}
+
+// localPipe is shared by both ends of a pair, closing one end closes the other too. the
+// chans of data are never closed, so that closing never races with writing
+type localPipe struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newLocalPipe() *localPipe {
+	return &localPipe{closed: make(chan struct{})}
 }
 
 func NewLocalConnPair(oneAddr, twoAddr net.Addr) []*LocalConn {
 	one := make(chan []byte)
 	two := make(chan []byte)
-	return []*LocalConn{
+	pipe := newLocalPipe()
+	pair := []*LocalConn{
 		NewLocalConn(one, two, oneAddr, twoAddr),
 		NewLocalConn(two, one, twoAddr, oneAddr),
 	}
+	pair[0].pipe = pipe
+	pair[1].pipe = pipe
+	return pair
 }
 
 func NewLocalConn(comming, going chan []byte, localAddr, remoteAddr net.Addr) *LocalConn {
@@ -61,51 +77,58 @@ func NewLocalConn(comming, going chan []byte, localAddr, remoteAddr net.Addr) *L
 		readDeadlineEnabled:  false,
 		writeDeadlineEnabled: false,
 		localAddr:            localAddr,
-		remoteAddr:           remoteAddr}
+		remoteAddr:           remoteAddr,
+		pipe:                 newLocalPipe()}
 }
 
 func (lc *LocalConn) Read(b []byte) (n int, err error) {
-	if !lc.readDeadlineEnabled {
-		c := copy(b, <-lc.comming)
-		return c, nil
+	// the rest of a chunk which didn't fit in the last read
+	if lc.buf.Len() > 0 {
+		return lc.buf.Read(b)
 	}
-	du := time.Until(lc.readDeadline)
-	to := make(chan bool)
-	timer := time.AfterFunc(du, func() {
-		to <- true
-	})
+	var deadline <-chan time.Time
+	if lc.readDeadlineEnabled {
+		timer := time.NewTimer(time.Until(lc.readDeadline))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	var tb []byte
 	select {
-	case tb := <-lc.comming:
-		timer.Stop()
-		return copy(b, tb), nil
-	case <-to:
+	case tb = <-lc.comming:
+	case <-deadline:
 		return 0, os.ErrDeadlineExceeded
+	case <-lc.pipe.closed:
+		return 0, io.EOF
 	}
+	n = copy(b, tb)
+	lc.buf.Write(tb[n:])
+	return n, nil
 }
 
 func (lc *LocalConn) Write(b []byte) (n int, err error) {
-	du := time.Until(lc.writeDeadline)
-	to := make(chan bool)
-	timer := time.AfterFunc(du, func() {
-		to <- true
-	})
+	var deadline <-chan time.Time
+	if lc.writeDeadlineEnabled {
+		timer := time.NewTimer(time.Until(lc.writeDeadline))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	// the writer may reuse b once Write returns
+	bs := make([]byte, len(b))
+	copy(bs, b)
 	select {
-	case <-to:
+	case lc.going <- bs:
+	case <-deadline:
 		return 0, os.ErrDeadlineExceeded
-	case lc.going <- b:
-		timer.Stop()
+	case <-lc.pipe.closed:
+		return 0, io.ErrClosedPipe
 	}
 	return len(b), nil
 }
 
 func (lc *LocalConn) Close() error {
-	defer func() {
-		if e := recover(); e != nil {
-			fmt.Printf("Warning: channel already closed\n")
-		}
-	}()
-	close(lc.comming)
-	close(lc.going)
+	lc.pipe.once.Do(func() {
+		close(lc.pipe.closed)
+	})
 	return nil
 }
 
@@ -125,19 +148,21 @@ func (lc *LocalConn) SetDeadline(t time.Time) error {
 
 func (lc *LocalConn) SetReadDeadline(t time.Time) error {
 	lc.readDeadline = t
-	lc.readDeadlineEnabled = true
+	lc.readDeadlineEnabled = !t.IsZero()
 	return nil
 }
 
 func (lc *LocalConn) SetWriteDeadline(t time.Time) error {
 	lc.writeDeadline = t
-	lc.writeDeadlineEnabled = true
+	lc.writeDeadlineEnabled = !t.IsZero()
 	return nil
 }
 
-func (lc *LocalConn) StartTLS(*tls.Config) error {
-	return nil
-}
+// StartTLS does nothing, the local conn is always secure
+func (lc *LocalConn) StartTLS(*tls.Config) {}
+
+// StartCompress does nothing, there's no bandwidth to save
+func (lc *LocalConn) StartCompress(BuildCompressor) {}
 
 func (lc *LocalConn) BindTlsUnique(w io.Writer) error {
 	_, err := w.Write([]byte(lc.id))
@@ -1,9 +1,14 @@
 package xmppcore
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type LogLevel int
@@ -17,38 +22,305 @@ const (
 	LogFatal   = LogLevel(4)
 )
 
+func (level LogLevel) String() string {
+	if level < LogDebug || level > LogFatal {
+		return "LEVEL(" + strconv.Itoa(int(level)) + ")"
+	}
+	return []string{"DEBUG", "INFO", "WARNING", "ERROR", "FATAL"}[level]
+}
+
+// the keys of the fields which give the context of a log
+const (
+	LogKeyPart     = "part"
+	LogKeyJID      = "jid"
+	LogKeyRemote   = "remote"
+	LogKeyDir      = "dir"
+	LogKeyListener = "listener"
+	LogKeyErr      = "err"
+)
+
+// the subsystems of which levels can be set apart
+const (
+	LogSubPart     = "part"
+	LogSubChannel  = "channel"
+	LogSubListener = "listener"
+	LogSubAuth     = "auth"
+	LogSubCerts    = "certs"
+	LogSubAdmit    = "admission"
+)
+
 type Logger interface {
 	Printf(level LogLevel, format string, v ...interface{})
 	Writer() io.Writer
 }
 
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+func Field(key string, value interface{}) LogField {
+	return LogField{key, value}
+}
+
+// StructuredLogger logs a message with key/value fields. the loggers derived by With and
+// Sub share the output and the levels of their parent
+type StructuredLogger interface {
+	Logger
+	Log(level LogLevel, msg string, fields ...LogField)
+	// With derives a logger which adds fields to every log
+	With(fields ...LogField) StructuredLogger
+	// Sub derives a logger of a subsystem, which may have its own level
+	Sub(subsystem string) StructuredLogger
+	// Enabled tells if a log of level would be written, so that a costly one can be skipped
+	Enabled(level LogLevel) bool
+	Secrets() LogSecrets
+}
+
+// LogSecrets tells which secrets may be logged as they are, all of them are redacted by
+// default
+type LogSecrets struct {
+	// Credentials are the sasl auth, challenge, response and success
+	Credentials bool
+	// Bodies are the bodies of messages
+	Bodies bool
+}
+
+type LogEntry struct {
+	Time      time.Time
+	Level     LogLevel
+	Subsystem string
+	Msg       string
+	Fields    []LogField
+}
+
+type LogEncoder interface {
+	Encode(w io.Writer, entry LogEntry) error
+}
+
+// TextLogEncoder writes a line like `15:04:05 INFO: msg key=value`
+type TextLogEncoder struct{}
+
+func (TextLogEncoder) Encode(w io.Writer, entry LogEntry) error {
+	var buf bytes.Buffer
+	buf.WriteString(entry.Time.Format("15:04:05 "))
+	buf.WriteString(entry.Level.String())
+	buf.WriteString(": ")
+	buf.WriteString(strings.TrimRight(entry.Msg, "\n"))
+	if entry.Subsystem != "" {
+		writeTextLogField(&buf, Field("subsystem", entry.Subsystem))
+	}
+	for _, field := range entry.Fields {
+		writeTextLogField(&buf, field)
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeTextLogField(buf *bytes.Buffer, field LogField) {
+	value := fmt.Sprint(logValue(field.Value))
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		value = strconv.Quote(value)
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(field.Key)
+	buf.WriteByte('=')
+	buf.WriteString(value)
+}
+
+// JSONLogEncoder writes a json object per line, the fields follow time, level, subsystem
+// and msg in order
+type JSONLogEncoder struct{}
+
+func (JSONLogEncoder) Encode(w io.Writer, entry LogEntry) error {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	writeJSONLogField(&buf, Field("time", entry.Time.Format(time.RFC3339Nano)))
+	buf.WriteByte(',')
+	writeJSONLogField(&buf, Field("level", entry.Level.String()))
+	if entry.Subsystem != "" {
+		buf.WriteByte(',')
+		writeJSONLogField(&buf, Field("subsystem", entry.Subsystem))
+	}
+	buf.WriteByte(',')
+	writeJSONLogField(&buf, Field("msg", entry.Msg))
+	for _, field := range entry.Fields {
+		buf.WriteByte(',')
+		writeJSONLogField(&buf, field)
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeJSONLogField(buf *bytes.Buffer, field LogField) {
+	key, _ := json.Marshal(field.Key)
+	value, err := json.Marshal(logValue(field.Value))
+	if err != nil {
+		value, _ = json.Marshal(fmt.Sprint(field.Value))
+	}
+	buf.Write(key)
+	buf.WriteByte(':')
+	buf.Write(value)
+}
+
+// logValue turns errors and stringers into strings, which encoders can't do better
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+// logOutput is shared by a logger and the ones derived from it
+type logOutput struct {
+	w       io.Writer
+	encoder LogEncoder
+	level   LogLevel
+	levels  map[string]LogLevel
+	secrets LogSecrets
+	mu      sync.Mutex
+}
+
 type XLogger struct {
-	underlying *log.Logger
-	level      LogLevel
+	out       *logOutput
+	subsystem string
+	fields    []LogField
 }
 
 func NewLogger(w io.Writer) *XLogger {
-	return &XLogger{log.New(w, "", log.Ltime), LogDebug}
+	return &XLogger{out: &logOutput{
+		w:       w,
+		encoder: TextLogEncoder{},
+		level:   LogDebug,
+		levels:  map[string]LogLevel{},
+	}}
 }
 
 func (logger *XLogger) SetLogLevel(level LogLevel) {
-	logger.level = level
+	logger.out.mu.Lock()
+	defer logger.out.mu.Unlock()
+	logger.out.level = level
+}
+
+// SetSubsystemLevel sets the level of a subsystem, which overrides the level of the logger
+func (logger *XLogger) SetSubsystemLevel(subsystem string, level LogLevel) {
+	logger.out.mu.Lock()
+	defer logger.out.mu.Unlock()
+	logger.out.levels[subsystem] = level
+}
+
+func (logger *XLogger) SetEncoder(encoder LogEncoder) {
+	logger.out.mu.Lock()
+	defer logger.out.mu.Unlock()
+	logger.out.encoder = encoder
+}
+
+func (logger *XLogger) SetLogSecrets(secrets LogSecrets) {
+	logger.out.mu.Lock()
+	defer logger.out.mu.Unlock()
+	logger.out.secrets = secrets
 }
 
 func (logger *XLogger) Writer() io.Writer {
-	return logger.underlying.Writer()
+	return logger.out.w
 }
 
 func (logger *XLogger) Printf(level LogLevel, format string, v ...interface{}) {
-	if logger.level > level {
+	logger.Log(level, fmt.Sprintf(format, v...))
+}
+
+func (logger *XLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	if !logger.Enabled(level) {
 		return
 	}
-	logger.underlying.Printf("%s: %s", logger.levelString(level), fmt.Sprintf(format, v...))
+	entry := LogEntry{
+		Time:      time.Now(),
+		Level:     level,
+		Subsystem: logger.subsystem,
+		Msg:       msg,
+		Fields:    append(append([]LogField{}, logger.fields...), fields...),
+	}
+	logger.out.mu.Lock()
+	defer logger.out.mu.Unlock()
+	logger.out.encoder.Encode(logger.out.w, entry)
 }
 
-func (logger *XLogger) levelString(level LogLevel) string {
-	if level > 4 {
-		panic("log level overflow")
+func (logger *XLogger) Enabled(level LogLevel) bool {
+	logger.out.mu.Lock()
+	defer logger.out.mu.Unlock()
+	min, ok := logger.out.levels[logger.subsystem]
+	if !ok {
+		min = logger.out.level
 	}
-	return []string{"DEBUG", "INFO", "WARNING", "ERROR", "FATAL"}[level]
+	return level >= min
+}
+
+func (logger *XLogger) Secrets() LogSecrets {
+	logger.out.mu.Lock()
+	defer logger.out.mu.Unlock()
+	return logger.out.secrets
+}
+
+func (logger *XLogger) With(fields ...LogField) StructuredLogger {
+	return &XLogger{
+		out:       logger.out,
+		subsystem: logger.subsystem,
+		fields:    append(append([]LogField{}, logger.fields...), fields...),
+	}
+}
+
+func (logger *XLogger) Sub(subsystem string) StructuredLogger {
+	return &XLogger{out: logger.out, subsystem: subsystem, fields: logger.fields}
+}
+
+// Structured makes a structured logger of logger. the fields are appended to the message
+// of Printf when logger is not structured itself
+func Structured(logger Logger) StructuredLogger {
+	if sl, ok := logger.(StructuredLogger); ok {
+		return sl
+	}
+	return &printfLogger{Logger: logger}
+}
+
+type printfLogger struct {
+	Logger
+	subsystem string
+	fields    []LogField
+}
+
+func (pl *printfLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	var buf bytes.Buffer
+	buf.WriteString(strings.TrimRight(msg, "\n"))
+	if pl.subsystem != "" {
+		writeTextLogField(&buf, Field("subsystem", pl.subsystem))
+	}
+	for _, field := range append(append([]LogField{}, pl.fields...), fields...) {
+		writeTextLogField(&buf, field)
+	}
+	pl.Printf(level, "%s", buf.String())
+}
+
+func (pl *printfLogger) With(fields ...LogField) StructuredLogger {
+	return &printfLogger{
+		Logger:    pl.Logger,
+		subsystem: pl.subsystem,
+		fields:    append(append([]LogField{}, pl.fields...), fields...),
+	}
+}
+
+func (pl *printfLogger) Sub(subsystem string) StructuredLogger {
+	return &printfLogger{Logger: pl.Logger, subsystem: subsystem, fields: pl.fields}
+}
+
+func (pl *printfLogger) Enabled(LogLevel) bool {
+	return true
+}
+
+func (pl *printfLogger) Secrets() LogSecrets {
+	return LogSecrets{}
 }
@@ -0,0 +1,127 @@
+package xmppcore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+func TestTextLogEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf).Sub(LogSubChannel).With(Field(LogKeyPart, "p1"))
+	logger.Log(LogInfo, "hello\n", Field(LogKeyRemote, "127.0.0.1:5222"), Field(LogKeyErr, errors.New("conn reset")))
+	line := buf.String()
+	if !strings.HasSuffix(line, `INFO: hello subsystem=channel part=p1 remote=127.0.0.1:5222 err="conn reset"`+"\n") {
+		t.Fatalf("text log error: %q", line)
+	}
+	buf.Reset()
+	logger.Printf(LogError, "%d streams", 2)
+	if !strings.HasSuffix(buf.String(), "ERROR: 2 streams subsystem=channel part=p1\n") {
+		t.Fatalf("printf log error: %q", buf.String())
+	}
+}
+
+func TestJSONLogEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf)
+	logger.SetEncoder(JSONLogEncoder{})
+	logger.With(Field(LogKeyJID, "juliet@example.com/balcony")).Log(LogWarning, "slow", Field("depth", 42))
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("json log %q error: %s", buf.String(), err.Error())
+	}
+	if entry["level"] != "WARNING" || entry["msg"] != "slow" || entry[LogKeyJID] != "juliet@example.com/balcony" || entry["depth"] != float64(42) {
+		t.Fatalf("json log error: %q", buf.String())
+	}
+	if !strings.HasPrefix(buf.String(), `{"time":`) {
+		t.Fatalf("json log should start with time: %q", buf.String())
+	}
+}
+
+func TestSubsystemLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf)
+	logger.SetLogLevel(LogInfo)
+	logger.SetSubsystemLevel(LogSubChannel, LogDebug)
+	logger.SetSubsystemLevel(LogSubListener, LogError)
+	logger.Log(LogDebug, "root debug")
+	logger.Sub(LogSubChannel).Log(LogDebug, "channel debug")
+	logger.Sub(LogSubListener).Log(LogInfo, "listener info")
+	logger.Sub(LogSubPart).Log(LogInfo, "part info")
+	if got := buf.String(); strings.Contains(got, "root debug") || !strings.Contains(got, "channel debug") ||
+		strings.Contains(got, "listener info") || !strings.Contains(got, "part info") {
+		t.Fatalf("subsystem levels error: %q", got)
+	}
+}
+
+type testPrintfLogger struct {
+	bytes.Buffer
+}
+
+func (l *testPrintfLogger) Printf(level LogLevel, format string, v ...interface{}) {
+	fmt.Fprintf(&l.Buffer, level.String()+" "+format, v...)
+}
+
+func (l *testPrintfLogger) Writer() io.Writer {
+	return &l.Buffer
+}
+
+func TestStructuredPrintfLogger(t *testing.T) {
+	var l testPrintfLogger
+	Structured(&l).With(Field(LogKeyPart, "p1")).Log(LogInfo, "bound", Field(LogKeyJID, "juliet@example.com"))
+	if got := l.String(); got != "INFO bound part=p1 jid=juliet@example.com" {
+		t.Fatalf("printf logger error: %q", got)
+	}
+}
+
+func TestRedactElement(t *testing.T) {
+	auth := stravaganza.NewBuilder("auth").WithAttribute("xmlns", NSSasl).
+		WithAttribute("mechanism", "PLAIN").WithText("AGp1bGlldAByMG0zMG15cjBtMzA=").Build()
+	msg := stravaganza.NewBuilder("message").WithAttribute("to", "romeo@example.net").
+		WithChild(stravaganza.NewBuilder("body").WithText("wherefore art thou").Build()).
+		WithChild(stravaganza.NewBuilder("thread").WithText("t1").Build()).Build()
+	iq := stravaganza.NewBuilder("iq").WithAttribute("type", "get").Build()
+	redacted := RedactElement(auth, LogSecrets{})
+	if redacted.Text() != redactedText || redacted.Attribute("mechanism") != "PLAIN" {
+		t.Fatalf("auth should be redacted: %s", redacted.GoString())
+	}
+	redacted = RedactElement(msg, LogSecrets{})
+	if redacted.Child("body").Text() != redactedText || redacted.Child("thread").Text() != "t1" || redacted.Attribute("to") != "romeo@example.net" {
+		t.Fatalf("body should be redacted: %s", redacted.GoString())
+	}
+	if RedactElement(msg, LogSecrets{Bodies: true}) != msg || RedactElement(auth, LogSecrets{Credentials: true}) != auth {
+		t.Fatalf("secrets allowed should not be redacted")
+	}
+	if RedactElement(iq, LogSecrets{}) != iq {
+		t.Fatalf("nothing to redact should return the element itself")
+	}
+}
+
+func TestXChannelLogRedaction(t *testing.T) {
+	auth := stravaganza.NewBuilder("auth").WithAttribute("xmlns", NSSasl).
+		WithAttribute("mechanism", "PLAIN").WithText("AGp1bGlldAByMG0zMG15cjBtMzA=").Build()
+	for _, secrets := range []LogSecrets{{}, {Credentials: true}} {
+		var buf bytes.Buffer
+		logger := NewLogger(&buf)
+		logger.SetLogSecrets(secrets)
+		xc, peer := openTestChannel(t, DefaultSendQueueConfig)
+		xc.SetLogger(logger.With(Field(LogKeyPart, "p1")))
+		readTestStanzas(peer)
+		xc.SendElement(auth)
+		xc.Close()
+		<-xc.Closed()
+		got := buf.String()
+		if !strings.Contains(got, "dir=out") || !strings.Contains(got, "part=p1") || !strings.Contains(got, "subsystem=channel") {
+			t.Fatalf("traffic log without context: %q", got)
+		}
+		if strings.Contains(got, "AGp1bGlldAByMG0zMG15cjBtMzA=") != secrets.Credentials {
+			t.Fatalf("credentials logged %v while allowed %v: %q", !secrets.Credentials, secrets.Credentials, got)
+		}
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"hash"
 
 	"github.com/google/uuid"
-	scramauth "github.com/yang-zzhong/scram-auth"
 )
 
 type MemoryAuthUser struct {
@@ -63,8 +62,7 @@ func NewMemomryAuthUser(username, password string, hash map[string]func() hash.H
 	u.passwords = make(map[string]string)
 	u.salt = uuid.New().String()
 	for name, hashBuilder := range hash {
-		s := scramauth.NewServerScramAuth(hashBuilder, scramauth.None, nil)
-		u.passwords[name] = string(s.SaltedPassword([]byte(password), []byte(u.salt), u.iterationCount))
+		u.passwords[name] = string(ScramSaltedPassword(hashBuilder, []byte(password), []byte(u.salt), u.iterationCount))
 	}
 	return u
 }
@@ -126,13 +124,24 @@ func (ma *MemoryAuthorized) Authorized(_ string, part Part) {
 }
 
 func (ma *MemoryAuthorized) BindResource(part Part, resource string) (string, error) {
-	part.Attr().JID.Resource = resource
+	if resource == "" {
+		resource = uuid.New().String()
+	}
+	rsc, err := PrepResourcepart(resource)
+	if err != nil {
+		return "", err
+	}
+	part.Attr().JID.Resource = rsc
 	return part.Attr().JID.String(), nil
 }
 
+// FindPart finds the part bound to a full jid, or the first part of the user if jid is bare
 func (ma *MemoryAuthorized) FindPart(jid *JID) Part {
 	for _, part := range ma.parts {
-		if jid.Equal(part.Attr().JID) {
+		if jid.IsFull() && jid.Equal(part.Attr().JID) {
+			return part
+		}
+		if !jid.IsFull() && jid.Equal(part.Attr().JID.Bare()) {
 			return part
 		}
 	}
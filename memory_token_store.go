@@ -0,0 +1,75 @@
+package xmppcore
+
+import (
+	"sync"
+)
+
+// MemoryTokenStore is a TokenStore in memory, of both the server and the client
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string][]FastToken
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{tokens: make(map[string][]FastToken)}
+}
+
+func tokenKey(username, userAgent string) string {
+	return username + "\x00" + userAgent
+}
+
+func (mts *MemoryTokenStore) Tokens(username, userAgent string) ([]FastToken, error) {
+	mts.mu.Lock()
+	defer mts.mu.Unlock()
+	return append([]FastToken{}, mts.tokens[tokenKey(username, userAgent)]...), nil
+}
+
+// SaveToken keeps token and the newest of the ones saved, the expired are dropped
+func (mts *MemoryTokenStore) SaveToken(token FastToken) error {
+	mts.mu.Lock()
+	defer mts.mu.Unlock()
+	key := tokenKey(token.Username, token.UserAgent)
+	tokens := []FastToken{token}
+	for _, t := range mts.tokens[key] {
+		if !t.Expired() {
+			tokens = append(tokens, t)
+			break
+		}
+	}
+	mts.tokens[key] = tokens
+	return nil
+}
+
+func (mts *MemoryTokenStore) UseToken(token FastToken, count uint64) error {
+	mts.mu.Lock()
+	defer mts.mu.Unlock()
+	key := tokenKey(token.Username, token.UserAgent)
+	tokens := mts.tokens[key]
+	for i, t := range tokens {
+		if t.Token != token.Token {
+			continue
+		}
+		if count <= t.Count {
+			return ErrFastTokenReplayed
+		}
+		tokens[i].Count = count
+		mts.tokens[key] = tokens[:i+1]
+		return nil
+	}
+	return ErrFastNoToken
+}
+
+func (mts *MemoryTokenStore) InvalidateTokens(username, userAgent string) error {
+	mts.mu.Lock()
+	defer mts.mu.Unlock()
+	if userAgent != "" {
+		delete(mts.tokens, tokenKey(username, userAgent))
+		return nil
+	}
+	for key := range mts.tokens {
+		if len(key) > len(username) && key[:len(username)+1] == username+"\x00" {
+			delete(mts.tokens, key)
+		}
+	}
+	return nil
+}
@@ -3,7 +3,6 @@ package xmppcore
 import (
 	"encoding/xml"
 	"errors"
-	"fmt"
 	"io"
 
 	"github.com/jackal-xmpp/stravaganza/v2"
@@ -14,6 +13,11 @@ const rootElementIndex = -1
 const (
 	streamName = "stream"
 	openName   = "open"
+
+	NSXML = "http://www.w3.org/XML/1998/namespace"
+
+	xmlPrefix   = "xml"
+	xmlnsPrefix = "xmlns"
 )
 
 // ErrTooLargeStanza will be returned Parse when the size of the incoming stanza is too large.
@@ -27,11 +31,125 @@ var ErrStreamClosedByPeer = errors.New("parser: stream closed by peer")
 // ErrNoElement will be returned by Parse when no elements are available to be parsed in the reader buffer stream.
 var ErrNoElement = errors.New("parser: no elements")
 
+// ErrUnboundPrefix will be returned by Parse when an element or an attribute uses an undeclared prefix.
+var ErrUnboundPrefix = errors.New("parser: unbound prefix")
+
+// ErrParserReleased will be returned by Next once the scratch state of a parser is released.
+var ErrParserReleased = errors.New("parser: released")
+
+// errors of a hardened parser, always wrapped in a ParserError
+var (
+	ErrXMLComment     = errors.New("parser: comment not allowed")
+	ErrXMLProcInst    = errors.New("parser: processing instruction not allowed")
+	ErrXMLDirective   = errors.New("parser: dtd not allowed")
+	ErrTooDeepElement = errors.New("parser: too deep element")
+	ErrTooManyAttrs   = errors.New("parser: too many attributes")
+	ErrTooLargeAttr   = errors.New("parser: too large attribute value")
+	ErrTooLargeText   = errors.New("parser: too large text")
+)
+
+// ParserError is a violation of rfc6120 section 11 or of the parser limits. Condition is
+// the defined condition of the stream error the violation maps to
+type ParserError struct {
+	Condition string
+	Err       error
+}
+
+func (e *ParserError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParserError) Unwrap() error {
+	return e.Err
+}
+
+func restrictedXMLError(err error) error {
+	return &ParserError{Condition: SERestrictedXML, Err: err}
+}
+
+func policyViolationError(err error) error {
+	return &ParserError{Condition: SEPolicyViolation, Err: err}
+}
+
+// ParserLimits makes a parser hardened, zero means unlimited
+type ParserLimits struct {
+	MaxDepth         int
+	MaxAttrs         int
+	MaxAttrValueSize int
+	MaxTextSize      int
+}
+
+var DefaultParserLimits = ParserLimits{
+	MaxDepth:         32,
+	MaxAttrs:         64,
+	MaxAttrValueSize: 4 * 1024,
+	MaxTextSize:      256 * 1024,
+}
+
+// budgetReader refuses to read beyond limit, so that a hardened parser never buffers a too large stanza
+type budgetReader struct {
+	r     io.Reader
+	read  int64
+	limit int64
+}
+
+func (br *budgetReader) Read(b []byte) (int, error) {
+	if br.limit < 0 {
+		n, err := br.r.Read(b)
+		br.read = br.read + int64(n)
+		return n, err
+	}
+	if br.read >= br.limit {
+		return 0, policyViolationError(ErrTooLargeStanza)
+	}
+	if left := br.limit - br.read; int64(len(b)) > left {
+		b = b[:left]
+	}
+	n, err := br.r.Read(b)
+	br.read = br.read + int64(n)
+	return n, err
+}
+
+// the size of the buffer xml.Decoder reads ahead with
+const decoderReadAhead = 4096
+
+// ElementParser parses the top level tokens of a stream, the tokens are xml.ProcInst, xml.StartElement
+// of the stream header, xml.CharData of whitespaces, xml.EndElement of the stream and stravaganza.Element
+type ElementParser interface {
+	Next() (interface{}, error)
+	SetLimits(ParserLimits)
+}
+
+// parserReleaser is a parser whose scratch state can be handed back once it's done
+type parserReleaser interface {
+	Release()
+}
+
+func releaseParser(p ElementParser) {
+	if r, ok := p.(parserReleaser); ok {
+		r.Release()
+	}
+}
+
+// parserFrame is an element under construction
+type parserFrame struct {
+	builder  *stravaganza.Builder
+	name     string            // qualified name as it's in the stream, used to match the end element
+	ns       string            // namespace of the element
+	prefixes map[string]string // namespaces declared on the element, default namespace with the empty prefix
+	text     []byte            // all text runs of the element
+}
+
 // Parser parses arbitrary XML input and builds an array with the structure of all tag and data elements.
+// Elements are built with their local names, the namespace of a top level element is always set as its
+// xmlns attribute, and a child element gets a xmlns attribute once its namespace differs from its parent's.
 type Parser struct {
 	dec           *xml.Decoder
 	nextElement   stravaganza.Element
-	stack         []*stravaganza.Builder
+	stack         []parserFrame
+	streamNS      map[string]string // namespaces declared on the stream header
+	budget        *budgetReader
+	limits        *ParserLimits
 	pIndex        int
 	inElement     bool
 	lastOffset    int64
@@ -40,55 +158,93 @@ type Parser struct {
 
 // New creates an empty Parser instance.
 func NewParser(reader io.Reader, maxStanzaSize int) *Parser {
+	budget := &budgetReader{r: reader, limit: -1}
 	return &Parser{
-		dec:           xml.NewDecoder(reader),
+		dec:           xml.NewDecoder(budget),
+		budget:        budget,
 		pIndex:        rootElementIndex,
+		streamNS:      map[string]string{},
 		maxStanzaSize: int64(maxStanzaSize),
 	}
 }
 
+// SetLimits hardens the parser. a hardened parser enforces restricted xml of rfc6120 section 11,
+// that no comments, processing instructions other than the xml declaration or dtd are allowed,
+// and refuses input exceeding the limits. both fail with a ParserError
+func (p *Parser) SetLimits(limits ParserLimits) {
+	p.limits = &limits
+	p.resetBudget()
+}
+
 // Parse parses next available XML element from reader.
 func (p *Parser) Next() (interface{}, error) {
 	for {
-		t, err := p.dec.Token()
+		t, err := p.dec.RawToken()
 		if err != nil {
+			var pe *ParserError
+			if errors.As(err, &pe) {
+				return nil, pe
+			}
 			return nil, err
 		}
 		off := p.dec.InputOffset()
 		if p.maxStanzaSize > 0 && off-p.lastOffset > p.maxStanzaSize {
+			if p.limits != nil {
+				return nil, policyViolationError(ErrTooLargeStanza)
+			}
 			return nil, ErrTooLargeStanza
 		}
 		switch t1 := t.(type) {
+		case xml.Comment:
+			if p.limits != nil {
+				return nil, restrictedXMLError(ErrXMLComment)
+			}
+		case xml.Directive:
+			if p.limits != nil {
+				return nil, restrictedXMLError(ErrXMLDirective)
+			}
 		case xml.ProcInst:
+			if p.limits != nil && (t1.Target != "xml" || p.inElement) {
+				return nil, restrictedXMLError(ErrXMLProcInst)
+			}
 			if p.inElement {
 				return nil, ErrNoElement
 			}
-			p.lastOffset = p.dec.InputOffset()
-			p.nextElement = nil
-			return t1, nil
+			p.boundary()
+			return t1.Copy(), nil
 		case xml.StartElement:
 			// got <stream>/<open>
-			if t1.Name.Local == streamName || t1.Name.Local == openName {
-				p.lastOffset = p.dec.InputOffset()
-				p.nextElement = nil
-				return t1, nil
+			if p.pIndex == rootElementIndex && (t1.Name.Local == streamName || t1.Name.Local == openName) {
+				header, err := p.streamHeader(t1)
+				if err != nil {
+					return nil, err
+				}
+				p.boundary()
+				return header, nil
+			}
+			if err := p.checkStartElement(t1); err != nil {
+				return nil, err
+			}
+			if err := p.startElement(t1); err != nil {
+				return nil, err
 			}
-			p.startElement(t1)
 		case xml.CharData:
 			if !p.inElement {
 				if err := p.charData(t1); err != nil {
 					return nil, err
 				}
-				p.lastOffset = p.dec.InputOffset()
-				p.nextElement = nil
-				return t1, nil
+				p.boundary()
+				return t1.Copy(), nil
 			}
 			p.setElementText(t1)
+			if p.limits != nil && p.limits.MaxTextSize > 0 && len(p.stack[p.pIndex].text) > p.limits.MaxTextSize {
+				return nil, policyViolationError(ErrTooLargeText)
+			}
 		case xml.EndElement:
-			if t1.Name.Local == streamName {
-				p.lastOffset = p.dec.InputOffset()
-				p.nextElement = nil
-				return t1, nil
+			if p.pIndex == rootElementIndex && t1.Name.Local == streamName {
+				p.boundary()
+				space, _ := p.lookup(t1.Name.Space)
+				return xml.EndElement{Name: xml.Name{Space: space, Local: t1.Name.Local}}, nil
 			}
 			if err := p.endElement(t1); err != nil {
 				return nil, err
@@ -100,39 +256,145 @@ func (p *Parser) Next() (interface{}, error) {
 	}
 
 done:
-	p.lastOffset = p.dec.InputOffset()
 	elem := p.nextElement
-	p.nextElement = nil
+	p.boundary()
 
 	return elem, nil
 }
 
+// boundary marks the end of a top level token
+func (p *Parser) boundary() {
+	p.lastOffset = p.dec.InputOffset()
+	p.nextElement = nil
+	p.resetBudget()
+}
+
+func (p *Parser) resetBudget() {
+	if p.limits == nil || p.maxStanzaSize <= 0 {
+		return
+	}
+	p.budget.limit = p.lastOffset + p.maxStanzaSize + decoderReadAhead
+}
+
+func (p *Parser) checkStartElement(t xml.StartElement) error {
+	if p.limits == nil {
+		return nil
+	}
+	if p.limits.MaxDepth > 0 && len(p.stack) >= p.limits.MaxDepth {
+		return policyViolationError(ErrTooDeepElement)
+	}
+	if p.limits.MaxAttrs > 0 && len(t.Attr) > p.limits.MaxAttrs {
+		return policyViolationError(ErrTooManyAttrs)
+	}
+	if p.limits.MaxAttrValueSize > 0 {
+		for _, a := range t.Attr {
+			if len(a.Value) > p.limits.MaxAttrValueSize {
+				return policyViolationError(ErrTooLargeAttr)
+			}
+		}
+	}
+	return nil
+}
+
 func (p *Parser) charData(bs xml.CharData) error {
 	for _, b := range bs {
-		if b != 10 && b != 32 && b != '\n' && b != '\t' {
+		if b != 10 && b != 32 && b != '\n' && b != '\t' && b != '\r' {
 			return ErrNoElement
 		}
 	}
 	return nil
 }
 
-func (p *Parser) startElement(t xml.StartElement) {
-	name := t.Name.Local
-
-	var attrs []stravaganza.Attribute
+// streamHeader resets the namespaces in scope of the stream, and resolves the names of the
+// header in the same manner as xml.Decoder.Token does
+func (p *Parser) streamHeader(t xml.StartElement) (xml.StartElement, error) {
+	p.streamNS = map[string]string{}
+	declarePrefixes(t.Attr, p.streamNS)
+	space, ok := p.lookup(t.Name.Space)
+	if !ok {
+		return t, ErrUnboundPrefix
+	}
+	header := xml.StartElement{Name: xml.Name{Space: space, Local: t.Name.Local}}
 	for _, a := range t.Attr {
-		name := xmlName(a.Name.Space, a.Name.Local)
-		attrs = append(attrs, stravaganza.Attribute{Label: name, Value: a.Value})
+		name := a.Name
+		if name.Space != "" && name.Space != xmlnsPrefix {
+			if name.Space, ok = p.lookup(name.Space); !ok {
+				return t, ErrUnboundPrefix
+			}
+		}
+		header.Attr = append(header.Attr, xml.Attr{Name: name, Value: a.Value})
 	}
-	builder := stravaganza.NewBuilder(name).WithAttributes(attrs...)
-	p.stack = append(p.stack, builder)
+	return header, nil
+}
 
+func (p *Parser) startElement(t xml.StartElement) error {
+	prefixes := map[string]string{}
+	declarePrefixes(t.Attr, prefixes)
+	p.stack = append(p.stack, parserFrame{name: xmlName(t.Name.Space, t.Name.Local), prefixes: prefixes})
 	p.pIndex = len(p.stack) - 1
+
+	frame := &p.stack[p.pIndex]
+	ns, ok := p.lookup(t.Name.Space)
+	if !ok {
+		return ErrUnboundPrefix
+	}
+	frame.ns = ns
+
+	var attrs []stravaganza.Attribute
+	for _, a := range t.Attr {
+		attrs = append(attrs, stravaganza.Attribute{Label: xmlName(a.Name.Space, a.Name.Local), Value: a.Value})
+		if a.Name.Space == "" || a.Name.Space == xmlnsPrefix || a.Name.Space == xmlPrefix {
+			continue
+		}
+		// keep prefixed attributes bound when the element is serialized on its own
+		if _, declared := prefixes[a.Name.Space]; !declared {
+			uri, ok := p.lookup(a.Name.Space)
+			if !ok {
+				return ErrUnboundPrefix
+			}
+			prefixes[a.Name.Space] = uri
+			attrs = append(attrs, stravaganza.Attribute{Label: xmlName(xmlnsPrefix, a.Name.Space), Value: uri})
+		}
+	}
+	builder := stravaganza.NewBuilder(t.Name.Local).WithAttributes(attrs...)
+	if p.pIndex == 0 || p.stack[p.pIndex-1].ns != ns {
+		if ns != "" {
+			builder.WithAttribute(stravaganza.Namespace, ns)
+		}
+	}
+	frame.builder = builder
 	p.inElement = true
+	return nil
+}
+
+// lookup finds the namespace bound to prefix in scope, the empty prefix refers to the default namespace
+func (p *Parser) lookup(prefix string) (string, bool) {
+	if prefix == xmlPrefix {
+		return NSXML, true
+	}
+	for i := len(p.stack) - 1; i >= 0; i-- {
+		if ns, ok := p.stack[i].prefixes[prefix]; ok {
+			return ns, true
+		}
+	}
+	if ns, ok := p.streamNS[prefix]; ok {
+		return ns, true
+	}
+	return "", prefix == ""
+}
+
+func declarePrefixes(attrs []xml.Attr, prefixes map[string]string) {
+	for _, a := range attrs {
+		if a.Name.Space == "" && a.Name.Local == xmlnsPrefix {
+			prefixes[""] = a.Value
+		} else if a.Name.Space == xmlnsPrefix {
+			prefixes[a.Name.Local] = a.Value
+		}
+	}
 }
 
 func (p *Parser) setElementText(t xml.CharData) {
-	p.stack[p.pIndex] = p.stack[p.pIndex].WithText(string(t))
+	p.stack[p.pIndex].text = append(p.stack[p.pIndex].text, t...)
 }
 
 func (p *Parser) endElement(t xml.EndElement) error {
@@ -143,28 +405,33 @@ func (p *Parser) closeElement(name string) error {
 	if p.pIndex == rootElementIndex {
 		return errUnexpectedEnd(name)
 	}
-	builder := p.stack[p.pIndex]
+	frame := p.stack[p.pIndex]
 	p.stack = p.stack[:p.pIndex]
 
-	element := builder.Build()
-
-	if name != element.Name() {
+	if name != frame.name {
 		return errUnexpectedEnd(name)
 	}
+	if len(frame.text) > 0 {
+		frame.builder.WithText(string(frame.text))
+	}
+	element := frame.builder.Build()
 	p.pIndex = len(p.stack) - 1
 	if p.pIndex == rootElementIndex {
 		p.nextElement = element
 	} else {
-		p.stack[p.pIndex] = p.stack[p.pIndex].WithChild(element)
+		p.stack[p.pIndex].builder = p.stack[p.pIndex].builder.WithChild(element)
 	}
-	p.inElement = false
+	p.inElement = p.pIndex != rootElementIndex
 	return nil
 }
 
 func xmlName(space, local string) string {
-	return local
+	if space == "" {
+		return local
+	}
+	return space + ":" + local
 }
 
 func errUnexpectedEnd(name string) error {
-	return fmt.Errorf("xmppparser: unexpected end element </%s>", name)
+	return &xml.SyntaxError{Msg: "unexpected end element </" + name + ">"}
 }
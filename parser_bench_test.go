@@ -0,0 +1,120 @@
+package xmppcore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+// benchStream builds a stream of n stanzas, a mix of 60% messages, 25% presences and 15% iqs
+// as seen on a busy c2s server
+func benchStream(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(testStreamHeader)
+	for i := 0; i < n; i++ {
+		switch {
+		case i%20 < 12:
+			fmt.Fprintf(&buf, `<message to="romeo@example.net" from="juliet@example.com/balcony" type="chat" id="msg-%d" xml:lang="en">`+
+				`<body>Art thou not Romeo, and a Montague? &lt;%d&gt;</body><thread>e0ffe42b28561960c6b12b944a092794b9683a38</thread>`+
+				`<active xmlns="http://jabber.org/protocol/chatstates"/><request xmlns="urn:xmpp:receipts"/></message>`, i, i)
+		case i%20 < 17:
+			fmt.Fprintf(&buf, `<presence from="juliet@example.com/balcony" id="pres-%d"><show>away</show><status>be right back</status>`+
+				`<priority>0</priority><c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="http://psi-im.org" ver="q07IKJEyjvHSyhy//CH0CxmKi8w="/>`+
+				`<delay xmlns="urn:xmpp:delay" from="example.com" stamp="2002-09-10T23:41:07Z"/></presence>`, i)
+		default:
+			fmt.Fprintf(&buf, `<iq type="get" id="iq-%d" to="example.com"><query xmlns="jabber:iq:roster" ver="ver7"/></iq>`+"\n", i)
+		}
+	}
+	return buf.Bytes()
+}
+
+func benchmarkParser(b *testing.B, build func(io.Reader, int) ElementParser) {
+	stream := benchStream(1000)
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := build(bytes.NewReader(stream), 1024*1024)
+		for {
+			if _, err := p.Next(); err != nil {
+				if err != io.EOF {
+					b.Fatal(err)
+				}
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkParser(b *testing.B) {
+	benchmarkParser(b, func(r io.Reader, size int) ElementParser { return NewParser(r, size) })
+}
+
+func BenchmarkFastParser(b *testing.B) {
+	benchmarkParser(b, func(r io.Reader, size int) ElementParser { return NewFastParser(r, size) })
+}
+
+func BenchmarkHardenedParser(b *testing.B) {
+	benchmarkParser(b, func(r io.Reader, size int) ElementParser {
+		p := NewParser(r, size)
+		p.SetLimits(DefaultParserLimits)
+		return p
+	})
+}
+
+func BenchmarkHardenedFastParser(b *testing.B) {
+	benchmarkParser(b, func(r io.Reader, size int) ElementParser {
+		p := NewFastParser(r, size)
+		p.SetLimits(DefaultParserLimits)
+		return p
+	})
+}
+
+// BenchmarkFastParserBoshBody parses a body per parser, as the bosh requests are
+func BenchmarkFastParserBoshBody(b *testing.B) {
+	body := []byte(`<body rid="101" sid="s1" xmlns="http://jabber.org/protocol/httpbind">` +
+		string(benchStream(3)[len(testStreamHeader):]) + `</body>`)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseBoshBody(bytes.NewReader(body), 1024*1024); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchElements(b *testing.B) []stravaganza.Element {
+	_, elems := parseTestStream(func(r io.Reader, size int) ElementParser { return NewFastParser(r, size) }, string(benchStream(20)[len(testStreamHeader):]))
+	if len(elems) != 20 {
+		b.Fatalf("require 20 elements, got %d", len(elems))
+	}
+	return elems
+}
+
+func BenchmarkSerializeGoString(b *testing.B) {
+	elems := benchElements(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, elem := range elems {
+			_ = []byte(elem.GoString())
+		}
+	}
+}
+
+func BenchmarkSerializeWriteElement(b *testing.B) {
+	elems := benchElements(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, elem := range elems {
+			buf := getXMLBuf()
+			WriteElement(buf, elem)
+			putXMLBuf(buf)
+		}
+	}
+}
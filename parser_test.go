@@ -0,0 +1,196 @@
+package xmppcore
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+const testStreamHeader = `<?xml version='1.0'?>` +
+	`<stream:stream xmlns="jabber:client" xmlns:stream="http://etherx.jabber.org/streams" ` +
+	`to="hello-world.im" version="1.0" xml:lang="en">`
+
+var testParsers = []struct {
+	name  string
+	build func(io.Reader, int) ElementParser
+}{
+	{"Parser", func(r io.Reader, size int) ElementParser { return NewParser(r, size) }},
+	{"FastParser", func(r io.Reader, size int) ElementParser { return NewFastParser(r, size) }},
+}
+
+func eachTestParser(t *testing.T, test func(t *testing.T, build func(io.Reader, int) ElementParser)) {
+	for _, tp := range testParsers {
+		build := tp.build
+		t.Run(tp.name, func(t *testing.T) {
+			test(t, build)
+		})
+	}
+}
+
+func parseTestStream(build func(io.Reader, int) ElementParser, src string) (xml.StartElement, []stravaganza.Element) {
+	p := build(bytes.NewBufferString(testStreamHeader+src), 1024*1024)
+	var header xml.StartElement
+	elems := []stravaganza.Element{}
+	for {
+		i, err := p.Next()
+		if err != nil {
+			return header, elems
+		}
+		switch t1 := i.(type) {
+		case xml.StartElement:
+			header = t1
+		case stravaganza.Element:
+			elems = append(elems, t1)
+		}
+	}
+}
+
+func TestParserStreamHeader(t *testing.T) {
+	eachTestParser(t, func(t *testing.T, build func(io.Reader, int) ElementParser) {
+		header, _ := parseTestStream(build, "")
+		if header.Name.Space != NSStream || header.Name.Local != "stream" {
+			t.Fatalf("stream header name error: %v", header.Name)
+		}
+		var attr PartAttr
+		attr.Domain = "hello-world.im"
+		if err := attr.ParseToServer(header); err != nil {
+			t.Fatalf("parse stream header error: %s", err.Error())
+		}
+		if attr.XmlLang != "en" || attr.Xmlns != "jabber:client" {
+			t.Fatalf("stream header attributes error: %#v", attr)
+		}
+	})
+}
+
+func TestParserNamespaces(t *testing.T) {
+	eachTestParser(t, func(t *testing.T, build func(io.Reader, int) ElementParser) {
+		_, elems := parseTestStream(build,
+			`<stream:features><mechanisms xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><mechanism>PLAIN</mechanism></mechanisms></stream:features>`+
+				`<message to="a@hello-world.im" xml:lang="en"><body>hi</body><x:data xmlns:x="jabber:x:data"><x:field x:var="v"/><value/></x:data></message>`)
+		if len(elems) != 2 {
+			t.Fatalf("require 2 elements, got %d", len(elems))
+		}
+		features := elems[0]
+		if features.Name() != "features" || features.Attribute("xmlns") != NSStream {
+			t.Fatalf("prefixed element namespace error: %s", features.GoString())
+		}
+		mechs := features.ChildNamespace("mechanisms", NSSasl)
+		if mechs == nil || mechs.Child("mechanism").Attribute("xmlns") != "" {
+			t.Fatalf("default namespace declaration error: %s", features.GoString())
+		}
+		msg := elems[1]
+		if msg.Attribute("xmlns") != "jabber:client" || msg.Attribute("xml:lang") != "en" {
+			t.Fatalf("inherited default namespace error: %s", msg.GoString())
+		}
+		if msg.Child("body").Attribute("xmlns") != "" {
+			t.Fatalf("child in the same namespace should not declare it: %s", msg.GoString())
+		}
+		data := msg.ChildNamespace("data", "jabber:x:data")
+		if data == nil {
+			t.Fatalf("prefixed child namespace error: %s", msg.GoString())
+		}
+		field := data.Child("field")
+		if field.Attribute("xmlns") != "" || field.Attribute("x:var") != "v" || field.Attribute("xmlns:x") != "jabber:x:data" {
+			t.Fatalf("prefixed attribute error: %s", field.GoString())
+		}
+		if data.Child("value").Attribute("xmlns") != "jabber:client" {
+			t.Fatalf("default namespace inside prefixed element error: %s", data.GoString())
+		}
+	})
+}
+
+func TestParserReserialize(t *testing.T) {
+	eachTestParser(t, func(t *testing.T, build func(io.Reader, int) ElementParser) {
+		_, elems := parseTestStream(build, `<iq type="set" id="1"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><resource>r</resource></bind></iq>`)
+		if len(elems) != 1 {
+			t.Fatalf("require 1 element, got %d", len(elems))
+		}
+		_, again := parseTestStream(build, elems[0].GoString())
+		if len(again) != 1 || again[0].GoString() != elems[0].GoString() {
+			t.Fatalf("reserialized element not equal: %s", elems[0].GoString())
+		}
+		var ib IqBind
+		if err := ib.FromElem(again[0]); err != nil || ib.Resource != "r" {
+			t.Fatalf("reserialized bind error: %v", err)
+		}
+	})
+}
+
+func TestParserUnboundPrefix(t *testing.T) {
+	eachTestParser(t, func(t *testing.T, build func(io.Reader, int) ElementParser) {
+		p := build(bytes.NewBufferString(testStreamHeader+`<message><y:x/></message>`), 1024)
+		for i := 0; i < 2; i++ {
+			if _, err := p.Next(); err != nil {
+				t.Fatalf("parse header error: %s", err.Error())
+			}
+		}
+		if _, err := p.Next(); err != ErrUnboundPrefix {
+			t.Fatalf("require unbound prefix error, got %v", err)
+		}
+	})
+}
+
+func nextHardened(build func(io.Reader, int) ElementParser, src string, limits ParserLimits, maxStanzaSize int) error {
+	p := build(bytes.NewBufferString(testStreamHeader+src), maxStanzaSize)
+	p.SetLimits(limits)
+	for {
+		i, err := p.Next()
+		if err != nil {
+			return err
+		}
+		if _, ok := i.(stravaganza.Element); ok {
+			return nil
+		}
+	}
+}
+
+func TestParserRestrictedXML(t *testing.T) {
+	eachTestParser(t, func(t *testing.T, build func(io.Reader, int) ElementParser) {
+		cases := []string{
+			`<!-- comment --><message/>`,
+			`<message><!-- comment --></message>`,
+			`<?php echo 1 ?><message/>`,
+			`<!DOCTYPE message [<!ENTITY a "aaaaaaaa">]><message/>`,
+		}
+		for _, src := range cases {
+			var pe *ParserError
+			if err := nextHardened(build, src, DefaultParserLimits, 1024); !errors.As(err, &pe) || pe.Condition != "restricted-xml" {
+				t.Fatalf("%s should be refused as restricted-xml, got %v", src, err)
+			}
+		}
+		if err := nextHardened(build, `<message>&lt;&#65;</message>`, DefaultParserLimits, 1024); err != nil {
+			t.Fatalf("predefined entities and character references should be allowed: %s", err.Error())
+		}
+	})
+}
+
+func TestParserLimits(t *testing.T) {
+	eachTestParser(t, func(t *testing.T, build func(io.Reader, int) ElementParser) {
+		limits := ParserLimits{MaxDepth: 2, MaxAttrs: 2, MaxAttrValueSize: 8, MaxTextSize: 8}
+		cases := []struct {
+			src string
+			err error
+		}{
+			{`<message><body><a/></body></message>`, ErrTooDeepElement},
+			{`<message a="1" b="2" c="3"/>`, ErrTooManyAttrs},
+			{`<message a="123456789"/>`, ErrTooLargeAttr},
+			{`<message><body>123456789</body></message>`, ErrTooLargeText},
+			{`<message><body>` + strings.Repeat("a", 8*1024) + `</body></message>`, ErrTooLargeStanza},
+		}
+		for _, c := range cases {
+			var pe *ParserError
+			err := nextHardened(build, c.src, limits, 1024)
+			if !errors.As(err, &pe) || pe.Condition != "policy-violation" || !errors.Is(err, c.err) {
+				t.Fatalf("%s should be refused with %v, got %v", c.src, c.err, err)
+			}
+		}
+		if err := nextHardened(build, `<message a="1"><body>12345678</body></message>`, limits, 1024); err != nil {
+			t.Fatalf("parse element within limits error: %s", err.Error())
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package xmppcore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the proxy protocol of haproxy, v1 is a text line and v2 is binary, a load balancer tells
+// the address of the client by a header before anything of the conn
+
+var (
+	ErrProxyHeader = errors.New("malformed proxy protocol header")
+)
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// the longest v1 line, with the crlf
+	proxyV1MaxLen = 107
+	// the time a proxy has to send its header
+	proxyHeaderTimeout = time.Second * 5
+)
+
+// TrustedProxies are the networks of the proxies, which are believed to tell where a
+// client comes from
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses cidrs, a bare ip is a network of itself
+func ParseTrustedProxies(cidrs ...string) (TrustedProxies, error) {
+	return parseCIDRs(cidrs)
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.New("invalid cidr " + cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func cidrsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (tp TrustedProxies) trustsIP(ip net.IP) bool {
+	return cidrsContain(tp, ip)
+}
+
+// Trusts tells if addr is of a trusted proxy
+func (tp TrustedProxies) Trusts(addr net.Addr) bool {
+	ip := netAddrIP(addr)
+	return ip != nil && tp.trustsIP(ip)
+}
+
+func netAddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	return addrIP(addr.String())
+}
+
+func addrIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+// ForwardedFor returns the address of the client of a request through trusted proxies,
+// the rightmost of X-Forwarded-For which isn't a trusted proxy, as what's left of it is
+// told by the client. it's nil if the peer isn't trusted or is the client itself
+func (tp TrustedProxies) ForwardedFor(r *http.Request) net.Addr {
+	peer := addrIP(r.RemoteAddr)
+	if peer == nil || !tp.trustsIP(peer) {
+		return nil
+	}
+	hops := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := addrIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !tp.trustsIP(ip) {
+			break
+		}
+	}
+	if client.Equal(peer) {
+		return nil
+	}
+	return &net.TCPAddr{IP: client}
+}
+
+// proxyConn is a conn of which addresses are told by a proxy protocol header, what's
+// buffered reading the header is read first
+type proxyConn struct {
+	net.Conn
+	r             *bufio.Reader
+	remote, local net.Addr
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	return pc.r.Read(b)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	if pc.remote != nil {
+		return pc.remote
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+func (pc *proxyConn) LocalAddr() net.Addr {
+	if pc.local != nil {
+		return pc.local
+	}
+	return pc.Conn.LocalAddr()
+}
+
+// ReadProxyHeader reads a v1 or v2 proxy protocol header of conn, the conn returned has the
+// addresses of the client and the proxied server. a header of a health check or an unknown
+// protocol leaves the addresses of conn
+func ReadProxyHeader(conn net.Conn) (net.Conn, error) {
+	pc := &proxyConn{Conn: conn, r: bufio.NewReaderSize(conn, 256)}
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	sig, err := pc.r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		err = pc.readV2()
+	} else if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		err = pc.readV1()
+	} else {
+		err = ErrProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readV1 reads a line like PROXY TCP4 192.0.2.1 192.0.2.2 56324 5222\r\n
+func (pc *proxyConn) readV1() error {
+	line := make([]byte, 0, proxyV1MaxLen)
+	for {
+		c, err := pc.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) == proxyV1MaxLen {
+			return ErrProxyHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ErrProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return ErrProxyHeader
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	sport, serr := strconv.ParseUint(fields[4], 10, 16)
+	dport, derr := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || serr != nil || derr != nil || (src.To4() != nil) != (fields[1] == "TCP4") {
+		return ErrProxyHeader
+	}
+	pc.remote = &net.TCPAddr{IP: src, Port: int(sport)}
+	pc.local = &net.TCPAddr{IP: dst, Port: int(dport)}
+	return nil
+}
+
+// readV2 reads the binary header, the tlvs after the addresses are skipped
+func (pc *proxyConn) readV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(pc.r, header); err != nil {
+		return err
+	}
+	if header[12]>>4 != 2 {
+		return ErrProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(pc.r, body); err != nil {
+		return err
+	}
+	if cmd := header[12] & 0xf; cmd == 0 {
+		// local, a health check of the proxy itself
+		return nil
+	} else if cmd != 1 {
+		return ErrProxyHeader
+	}
+	switch header[13] {
+	case 0x11:
+		// tcp over ipv4
+		if len(body) < 12 {
+			return ErrProxyHeader
+		}
+		pc.remote = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}
+		pc.local = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:]))}
+	case 0x21:
+		// tcp over ipv6
+		if len(body) < 36 {
+			return ErrProxyHeader
+		}
+		pc.remote = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}
+		pc.local = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:]))}
+	}
+	return nil
+}
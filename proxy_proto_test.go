@@ -0,0 +1,118 @@
+package xmppcore
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(cmd byte, src, dst net.IP, sport, dport uint16) []byte {
+	body := append(append([]byte{}, src.To4()...), dst.To4()...)
+	body = append(body, byte(sport>>8), byte(sport), byte(dport>>8), byte(dport))
+	// a tlv to skip
+	body = append(body, 0x04, 0x00, 0x01, 0x00)
+	header := append(append([]byte{}, proxyV2Sig...), 0x20|cmd, 0x11)
+	header = append(header, byte(len(body)>>8), byte(len(body)))
+	return append(header, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, c := range []struct {
+		header []byte
+		remote string
+		err    error
+	}{
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 5222\r\n"), "192.0.2.1:56324", nil},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 5222\r\n"), "[2001:db8::1]:56324", nil},
+		{[]byte("PROXY UNKNOWN\r\n"), "pipe", nil},
+		{proxyV2Header(1, net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.1"), 56324, 5222), "192.0.2.1:56324", nil},
+		{proxyV2Header(0, net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.1"), 56324, 5222), "pipe", nil},
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"), "", ErrProxyHeader},
+		{[]byte("PROXY TCP4 2001:db8::1 198.51.100.1 56324 5222\r\n"), "", ErrProxyHeader},
+		{[]byte("<?xml version='1.0'?>"), "", ErrProxyHeader},
+	} {
+		server, client := net.Pipe()
+		go func() {
+			client.Write(append(c.header, "<stream>"...))
+		}()
+		conn, err := ReadProxyHeader(server)
+		if err != c.err {
+			t.Fatalf("%q read error %v, expected %v", c.header, err, c.err)
+		}
+		if err == nil {
+			if conn.RemoteAddr().String() != c.remote {
+				t.Fatalf("%q remote %s", c.header, conn.RemoteAddr())
+			}
+			b := make([]byte, 8)
+			if _, err := io.ReadFull(conn, b); err != nil || string(b) != "<stream>" {
+				t.Fatalf("%q what's after the header should be read, got %q", c.header, b)
+			}
+		}
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestProxyProtocolGrabber(t *testing.T) {
+	proxies, err := ParseTrustedProxies("127.0.0.1")
+	if err != nil {
+		t.Fatalf("parse trusted proxies error: %s", err.Error())
+	}
+	grabber := NewTcpConnGrabber("127.0.0.1:0", ForC2S, NewLogger(io.Discard))
+	grabber.AcceptProxyProtocol(proxies)
+	conns := make(chan Conn)
+	if err := grabber.Grab(conns); err != nil {
+		t.Fatalf("grab error: %s", err.Error())
+	}
+	defer grabber.Cancel()
+	client, err := net.Dial("tcp", grabber.ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %s", err.Error())
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 5222\r\n<stream>"))
+	select {
+	case conn := <-conns:
+		defer conn.Close()
+		if conn.RemoteAddr().String() != "192.0.2.1:56324" {
+			t.Fatalf("the remote of the conn should be the client, got %s", conn.RemoteAddr())
+		}
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != "<stream>" {
+			t.Fatalf("what's after the header should be read, got %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("proxied conn not grabbed")
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	proxies, _ := ParseTrustedProxies("10.0.0.0/8", "2001:db8::/32")
+	for _, c := range []struct {
+		peer, xff, client string
+	}{
+		{"10.0.0.1:1234", "192.0.2.1", "192.0.2.1"},
+		{"10.0.0.1:1234", "203.0.113.9, 192.0.2.1, 10.0.0.2", "192.0.2.1"},
+		{"[2001:db8::1]:1234", "192.0.2.1", "192.0.2.1"},
+		{"192.0.2.7:1234", "192.0.2.1", ""},
+		{"10.0.0.1:1234", "", ""},
+	} {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = c.peer
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		addr := proxies.ForwardedFor(r)
+		if c.client == "" {
+			if addr != nil {
+				t.Fatalf("%s %q should not be forwarded, got %s", c.peer, c.xff, addr)
+			}
+			continue
+		}
+		if addr == nil || addr.(*net.TCPAddr).IP.String() != c.client {
+			t.Fatalf("%s %q should be forwarded for %s, got %v", c.peer, c.xff, c.client, addr)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package xmppcore
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type RecordDirection string
+
+const (
+	// RecordIn is data read from the conn, sent by the peer
+	RecordIn RecordDirection = "in"
+	// RecordOut is data written to the conn, sent by us
+	RecordOut RecordDirection = "out"
+)
+
+var (
+	ErrReplayStalled = errors.New("part didn't send what is recorded in time")
+)
+
+// Record is a chunk of data as it's read from or written to the conn. a recording is a
+// json record per line
+type Record struct {
+	Time time.Time       `json:"time"`
+	Dir  RecordDirection `json:"dir"`
+	Data []byte          `json:"data"`
+}
+
+// Recorder writes records to w. writing is best effort, the first error is kept and
+// the records after it are discarded, so that a broken recording never breaks a stream
+type Recorder struct {
+	w   io.Writer
+	enc *json.Encoder
+	mu  sync.Mutex
+	err error
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w, enc: json.NewEncoder(w)}
+}
+
+func (r *Recorder) Record(dir RecordDirection, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.err = r.enc.Encode(Record{Time: time.Now(), Dir: dir, Data: data})
+	return r.err
+}
+
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Close closes w when it's a closer, such as a file
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// LoadRecording reads the records written by a Recorder
+func LoadRecording(r io.Reader) ([]Record, error) {
+	records := []Record{}
+	dec := json.NewDecoder(r)
+	for {
+		var record Record
+		if err := dec.Decode(&record); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// RecordConn is a tap on a conn which records every chunk read and written. the chunks
+// are recorded after tls and compression, so the recording is plain xml
+type RecordConn struct {
+	Conn
+	rec *Recorder
+}
+
+func NewRecordConn(conn Conn, rec *Recorder) *RecordConn {
+	return &RecordConn{Conn: conn, rec: rec}
+}
+
+func (rc *RecordConn) Read(b []byte) (int, error) {
+	n, err := rc.Conn.Read(b)
+	if n > 0 {
+		rc.rec.Record(RecordIn, b[:n])
+	}
+	return n, err
+}
+
+func (rc *RecordConn) Write(b []byte) (int, error) {
+	n, err := rc.Conn.Write(b)
+	if n > 0 {
+		rc.rec.Record(RecordOut, b[:n])
+	}
+	return n, err
+}
+
+// the optional interfaces of the conn tapped are forwarded, so that a recorded stream is
+// framed, bound to its tls channel and authenticated by certificate as it would be
+
+func (rc *RecordConn) framed() bool {
+	return isFramedConn(rc.Conn)
+}
+
+func (rc *RecordConn) TLSState() (tls.ConnectionState, bool) {
+	return connTLSState(rc.Conn)
+}
+
+func (rc *RecordConn) serverCertificate() *x509.Certificate {
+	if c, ok := rc.Conn.(serverCertConn); ok {
+		return c.serverCertificate()
+	}
+	return nil
+}
+
+// ReplayUnit is a top level token of a stream: the header, an element or the end
+type ReplayUnit struct {
+	// Name is the local name of the token, prefixed by "/" for the end of the stream
+	Name string
+	Raw  []byte
+}
+
+type ReplayResult struct {
+	// Expected is what the recorded part sent
+	Expected []ReplayUnit
+	// Got is what the replayed part sent
+	Got []ReplayUnit
+}
+
+// Diverged tells the first unit the replayed part sent differently from the recorded
+// one. units are compared by name, as ids and nonces differ from a run to another
+func (res *ReplayResult) Diverged() error {
+	for i, unit := range res.Expected {
+		if i >= len(res.Got) {
+			return fmt.Errorf("unit %d: expected %s, got nothing", i, unit.Raw)
+		}
+		if res.Got[i].Name != unit.Name {
+			return fmt.Errorf("unit %d: expected %s, got %s", i, unit.Raw, res.Got[i].Raw)
+		}
+	}
+	if len(res.Got) > len(res.Expected) {
+		return fmt.Errorf("unit %d: expected nothing, got %s", len(res.Expected), res.Got[len(res.Expected)].Raw)
+	}
+	return nil
+}
+
+// Replayer plays the peer of a recording. the part replayed runs on the other end of the
+// conn, a LocalConn pair usually. the inbound chunks are written as they're recorded, and
+// before each one the replayer waits the part to send as many units as the recorded part
+// had sent, so that the part sees the same ordering whatever the timing is
+type Replayer struct {
+	records []Record
+	// Timeout is how long to wait the part to send a unit
+	Timeout time.Duration
+}
+
+func NewReplayer(records []Record) *Replayer {
+	return &Replayer{records: records, Timeout: time.Second * 5}
+}
+
+// Replay plays the recording through conn and closes conn at the end
+func (rp *Replayer) Replay(conn Conn) (*ReplayResult, error) {
+	res := &ReplayResult{}
+	var out bytes.Buffer
+	// the size of what the part had sent before each inbound chunk
+	sizes := []int64{}
+	for _, record := range rp.records {
+		switch record.Dir {
+		case RecordOut:
+			out.Write(record.Data)
+		case RecordIn:
+			sizes = append(sizes, int64(out.Len()))
+		}
+	}
+	// the units the part had sent before each inbound chunk
+	waits := make([]int, len(sizes))
+	scanReplayUnits(&out, func(unit ReplayUnit, end int64) {
+		res.Expected = append(res.Expected, unit)
+		for i := range sizes {
+			if sizes[i] >= end {
+				waits[i]++
+			}
+		}
+	})
+
+	units := make(chan ReplayUnit, len(res.Expected)+16)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanReplayUnits(conn, func(unit ReplayUnit, _ int64) {
+			units <- unit
+		})
+	}()
+	got := func(n int) error {
+		timer := time.NewTimer(rp.Timeout)
+		defer timer.Stop()
+		for len(res.Got) < n {
+			select {
+			case unit := <-units:
+				res.Got = append(res.Got, unit)
+			case <-done:
+				// the part closed the conn, take what's left
+				for len(units) > 0 {
+					res.Got = append(res.Got, <-units)
+				}
+				if len(res.Got) < n {
+					return ErrChannelClosed
+				}
+			case <-timer.C:
+				return ErrReplayStalled
+			}
+		}
+		return nil
+	}
+	finish := func(err error) (*ReplayResult, error) {
+		conn.Close()
+		for {
+			select {
+			case unit := <-units:
+				res.Got = append(res.Got, unit)
+			case <-done:
+				for len(units) > 0 {
+					res.Got = append(res.Got, <-units)
+				}
+				return res, err
+			}
+		}
+	}
+	i := 0
+	for _, record := range rp.records {
+		if record.Dir != RecordIn {
+			continue
+		}
+		if err := got(waits[i]); err != nil {
+			return finish(err)
+		}
+		i++
+		if _, err := conn.Write(record.Data); err != nil {
+			return finish(err)
+		}
+	}
+	return finish(got(len(res.Expected)))
+}
+
+// scanReplayUnits splits a stream into its top level tokens, emit is called with each one
+// and the offset where it ends
+func scanReplayUnits(r io.Reader, emit func(ReplayUnit, int64)) {
+	var raw bytes.Buffer
+	dec := xml.NewDecoder(io.TeeReader(r, &raw))
+	dec.Strict = false
+	unit := func(name string, start int64) {
+		end := dec.InputOffset()
+		emit(ReplayUnit{Name: name, Raw: append([]byte{}, raw.Bytes()[start:end]...)}, end)
+	}
+	depth := 0
+	var start int64
+	for {
+		offset := dec.InputOffset()
+		token, err := dec.RawToken()
+		if err != nil {
+			return
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if depth <= 1 {
+				start = offset
+			}
+			depth++
+			if depth == 1 {
+				unit(t.Name.Local, start)
+			}
+		case xml.EndElement:
+			depth--
+			switch depth {
+			case 0:
+				unit("/"+t.Name.Local, offset)
+			case 1:
+				unit(t.Name.Local, start)
+			}
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package xmppcore
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+// recordTestSession records a part answering a ping and closing the stream
+func recordTestSession(t *testing.T) []Record {
+	var recording bytes.Buffer
+	rec := NewRecorder(&recording)
+	pair := NewLocalConnPair(NewLocalConnAddr(":1"), NewLocalConnAddr(":2"))
+	part := NewXPart(NewRecordConn(pair[0], rec), "hello-world.im", NewLogger(io.Discard))
+	part.EnableLiveness(LivenessConfig{})
+	part.Run()
+	tokens := collectTestTokens(pair[1])
+	pair[1].Write([]byte(testClientHeader))
+	waitTestToken(t, tokens, time.Second, func(i interface{}) bool {
+		elem, ok := i.(stravaganza.Element)
+		return ok && elem.Name() == "features"
+	})
+	pair[1].Write([]byte(`<iq type="get" id="c2s1"><ping xmlns="urn:xmpp:ping"/></iq>`))
+	waitTestToken(t, tokens, time.Second, func(i interface{}) bool {
+		elem, ok := i.(stravaganza.Element)
+		return ok && elem.Name() == NameIQ && elem.Attribute("id") == "c2s1"
+	})
+	pair[1].Write([]byte(`</stream:stream>`))
+	waitTestToken(t, tokens, time.Second, isTestEnd)
+	waitTestClosed(t, part.Closed(), time.Second)
+	if err := rec.Err(); err != nil {
+		t.Fatalf("record error: %s", err.Error())
+	}
+	records, err := LoadRecording(&recording)
+	if err != nil {
+		t.Fatalf("load recording error: %s", err.Error())
+	}
+	return records
+}
+
+func TestRecordConn(t *testing.T) {
+	records := recordTestSession(t)
+	var in, out bytes.Buffer
+	for i, record := range records {
+		if i > 0 && record.Time.Before(records[i-1].Time) {
+			t.Fatalf("records out of order")
+		}
+		switch record.Dir {
+		case RecordIn:
+			in.Write(record.Data)
+		case RecordOut:
+			out.Write(record.Data)
+		}
+	}
+	if in.String() != testClientHeader+`<iq type="get" id="c2s1"><ping xmlns="urn:xmpp:ping"/></iq></stream:stream>` {
+		t.Fatalf("inbound data recorded error: %s", in.String())
+	}
+	var units []string
+	scanReplayUnits(&out, func(unit ReplayUnit, _ int64) {
+		units = append(units, unit.Name)
+	})
+	if len(units) != 4 || units[0] != "stream" || units[1] != "features" || units[2] != NameIQ || units[3] != "/stream" {
+		t.Fatalf("outbound data recorded error: %s", out.String())
+	}
+}
+
+func TestReplayer(t *testing.T) {
+	records := recordTestSession(t)
+	pair := NewLocalConnPair(NewLocalConnAddr(":1"), NewLocalConnAddr(":2"))
+	part := NewXPart(pair[0], "hello-world.im", NewLogger(io.Discard))
+	part.EnableLiveness(LivenessConfig{})
+	part.Run()
+	res, err := NewReplayer(records).Replay(pair[1])
+	if err != nil {
+		t.Fatalf("replay error: %s", err.Error())
+	}
+	if err := res.Diverged(); err != nil {
+		t.Fatalf("replay diverged: %s", err.Error())
+	}
+	// without the ping handler, the part doesn't answer as recorded
+	pair = NewLocalConnPair(NewLocalConnAddr(":1"), NewLocalConnAddr(":2"))
+	NewXPart(pair[0], "hello-world.im", NewLogger(io.Discard)).Run()
+	replayer := NewReplayer(records)
+	replayer.Timeout = time.Millisecond * 200
+	if _, err := replayer.Replay(pair[1]); err != ErrReplayStalled {
+		t.Fatalf("require stalled replay, got %v", err)
+	}
+}
+
+// plainTestToAuth authenticates with fixed credentials, so that a replayed client sends
+// what's recorded
+type plainTestToAuth struct{}
+
+func (plainTestToAuth) ToAuth(mech string, part Part) error {
+	elem := stravaganza.NewBuilder("auth").
+		WithAttribute("xmlns", NSSasl).
+		WithAttribute("mechanism", mech).
+		WithText(base64.StdEncoding.EncodeToString([]byte("\x00juliet\x00r0m30myr0m30"))).Build()
+	if err := part.Channel().SendElement(elem); err != nil {
+		return err
+	}
+	if err := part.Channel().NextElement(&elem); err != nil {
+		return err
+	}
+	if elem.Name() != "success" {
+		return errors.New("server failed auth")
+	}
+	return nil
+}
+
+func TestReplayerClientPart(t *testing.T) {
+	const serverHeader = `<?xml version='1.0'?><stream:stream xmlns:stream="http://etherx.jabber.org/streams" ` +
+		`xmlns="jabber:client" version="1.0" from="hello-world.im" id="s2c1">`
+	bind := ClientBindFeature(NewMemoryAuthorized(), "balcony")
+	// the server offers bind first, the client authenticates first anyway, and restarts the
+	// stream after each feature
+	records := []Record{
+		{Dir: RecordOut, Data: []byte(testClientHeader)},
+		{Dir: RecordIn, Data: []byte(serverHeader + `<stream:features>` +
+			`<bind xmlns="` + NSBind + `"/>` +
+			`<mechanisms xmlns="` + NSSasl + `"><mechanism>PLAIN</mechanism></mechanisms>` +
+			`</stream:features>`)},
+		{Dir: RecordOut, Data: []byte(`<auth xmlns="` + NSSasl + `" mechanism="PLAIN">AGp1bGlldAByMG0zMG15cjBtMzA=</auth>`)},
+		{Dir: RecordIn, Data: []byte(`<success xmlns="` + NSSasl + `"/>`)},
+		{Dir: RecordOut, Data: []byte(testClientHeader)},
+		{Dir: RecordIn, Data: []byte(serverHeader + `<stream:features><bind xmlns="` + NSBind + `"/></stream:features>`)},
+		{Dir: RecordOut, Data: []byte(`<iq type="set" id="` + bind.ID() + `"><bind xmlns="` + NSBind + `"><resource>balcony</resource></bind></iq>`)},
+		{Dir: RecordIn, Data: []byte(`<iq type="result" id="` + bind.ID() + `"><bind xmlns="` + NSBind + `">` +
+			`<jid>juliet@hello-world.im/balcony</jid></bind></iq>`)},
+		{Dir: RecordOut, Data: []byte(testClientHeader)},
+		{Dir: RecordIn, Data: []byte(serverHeader + `<stream:features/>`)},
+		{Dir: RecordIn, Data: []byte(`</stream:stream>`)},
+		{Dir: RecordOut, Data: []byte(`</stream:stream>`)},
+	}
+	pair := NewLocalConnPair(NewLocalConnAddr(":1"), NewLocalConnAddr(":2"))
+	client := NewClientPart(pair[0], NewLogger(io.Discard), &PartAttr{
+		JID: JID{Domain: "hello-world.im"}, Version: "1.0", Domain: "hello-world.im"})
+	sasl := ClientSASLFeature()
+	sasl.Support("PLAIN", plainTestToAuth{})
+	client.WithFeature(bind)
+	client.WithFeature(sasl)
+	negotiated := make(chan error, 1)
+	go func() {
+		err := client.Negotiate()
+		if err == nil {
+			// the server closes the stream once negotiated
+			err = <-client.Run()
+		}
+		negotiated <- err
+	}()
+	res, err := NewReplayer(records).Replay(pair[1])
+	if err != nil {
+		t.Fatalf("replay error: %s", err.Error())
+	}
+	if err := res.Diverged(); err != nil {
+		t.Fatalf("replay diverged: %s", err.Error())
+	}
+	if err := <-negotiated; err != nil {
+		t.Fatalf("negotiate error: %s", err.Error())
+	}
+	if client.Attr().JID.Resource != "balcony" {
+		t.Fatalf("client bound to %q", client.Attr().JID.String())
+	}
+}
+
+func TestRecordWsConn(t *testing.T) {
+	var recording bytes.Buffer
+	rec := NewRecorder(&recording)
+	upgrader := websocket.Upgrader{Subprotocols: []string{WsSubprotocol}}
+	parts := make(chan *XPart, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		part := NewXPart(NewRecordConn(NewWsConn(ws), rec), "hello-world.im", NewLogger(io.Discard))
+		part.Run()
+		parts <- part
+	}))
+	defer srv.Close()
+	ws := dialTestWs(t, srv)
+	defer ws.Close()
+	ws.WriteMessage(websocket.TextMessage, []byte(`<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" to="hello-world.im" version="1.0"/>`))
+	if open := readTestFrame(t, ws); !strings.HasPrefix(open, `<open xmlns="urn:ietf:params:xml:ns:xmpp-framing"`) {
+		t.Fatalf("a recorded websocket should be framed, got %s", open)
+	}
+	readTestFrame(t, ws)
+	ws.WriteMessage(websocket.TextMessage, []byte(`<close xmlns="urn:ietf:params:xml:ns:xmpp-framing"/>`))
+	if closing := readTestFrame(t, ws); closing != `<close xmlns="urn:ietf:params:xml:ns:xmpp-framing"/>` {
+		t.Fatalf("close frame error: %s", closing)
+	}
+	waitTestClosed(t, (<-parts).Closed(), time.Second)
+	records, err := LoadRecording(&recording)
+	if err != nil {
+		t.Fatalf("load recording error: %s", err.Error())
+	}
+	var out bytes.Buffer
+	for _, record := range records {
+		if record.Dir == RecordOut {
+			out.Write(record.Data)
+		}
+	}
+	if !strings.HasPrefix(out.String(), `<open`) || !strings.HasSuffix(out.String(), `<close xmlns="urn:ietf:params:xml:ns:xmpp-framing"/>`) {
+		t.Fatalf("frames recorded error: %s", out.String())
+	}
+}
+
+func TestRecordTLSConn(t *testing.T) {
+	serverConn, _ := tlsTestConns(t, tls.VersionTLS12)
+	recorded := NewRecordConn(serverConn, NewRecorder(io.Discard))
+	if ConnServerName(recorded) != "hello-world.im" {
+		t.Fatalf("sni of a recorded conn should be told, got %q", ConnServerName(recorded))
+	}
+	types := ChannelBindingTypes(serverConn)
+	if got := ChannelBindingTypes(recorded); len(got) == 0 || len(got) != len(types) {
+		t.Fatalf("channel bindings of a recorded conn should be %v, got %v", types, got)
+	}
+	for _, cbType := range types {
+		data, _ := ChannelBinding(serverConn, cbType)
+		if got, err := ChannelBinding(recorded, cbType); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s binding of a recorded conn error: %v", cbType, err)
+		}
+	}
+}
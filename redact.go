@@ -0,0 +1,61 @@
+package xmppcore
+
+import (
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+const redactedText = "[redacted]"
+
+// the elements of which text is a credential, at any depth
+var credentialElems = map[string]bool{
+	"auth":      true,
+	"response":  true,
+	"challenge": true,
+	"success":   true,
+	// sasl2
+	"initial-response": true,
+	"additional-data":  true,
+}
+
+// the attributes of which value is a credential, by the elements they're of
+var credentialAttrs = map[string]string{
+	// xep-0484
+	"token": "token",
+}
+
+// RedactElement replaces the texts of the secrets secrets doesn't allow to log. elem
+// itself is returned when there's nothing to redact
+func RedactElement(elem stravaganza.Element, secrets LogSecrets) stravaganza.Element {
+	if secrets.Credentials && secrets.Bodies {
+		return elem
+	}
+	redacted, _ := redactElement(elem, secrets, false)
+	return redacted
+}
+
+func redactElement(elem stravaganza.Element, secrets LogSecrets, inMsg bool) (stravaganza.Element, bool) {
+	name := elem.Name()
+	secret := !secrets.Credentials && credentialElems[name] || !secrets.Bodies && inMsg && name == "body"
+	if secret && elem.Text() != "" {
+		return stravaganza.NewBuilderFromElement(elem).WithText(redactedText).Build(), true
+	}
+	if attr := credentialAttrs[name]; !secrets.Credentials && attr != "" && elem.Attribute(attr) != "" {
+		return stravaganza.NewBuilderFromElement(elem).WithAttribute(attr, redactedText).Build(), true
+	}
+	children := elem.AllChildren()
+	changed := false
+	redacted := make([]stravaganza.Element, len(children))
+	for i, child := range children {
+		var c bool
+		redacted[i], c = redactElement(child, secrets, name == NameMsg)
+		changed = changed || c
+	}
+	if !changed {
+		return elem, false
+	}
+	return stravaganza.NewBuilder(name).
+		WithAttributes(elem.AllAttributes()...).
+		WithText(elem.Text()).
+		WithChildren(redacted...).
+		Build(), true
+}
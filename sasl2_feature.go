@@ -0,0 +1,310 @@
+package xmppcore
+
+import (
+	"errors"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+var (
+	ErrSasl2Continue  = errors.New("sasl2 tasks not supported")
+	ErrSasl2NoSuccess = errors.New("sasl2 authentication not succeeded")
+)
+
+const (
+	NSSasl2 = "urn:xmpp:sasl:2"
+)
+
+// Sasl2UserAgent is the client software authenticating, id stays the same across its logins
+type Sasl2UserAgent struct {
+	ID       string
+	Software string
+	Device   string
+}
+
+func (ua *Sasl2UserAgent) FromElem(elem stravaganza.Element) {
+	ua.ID = elem.Attribute("id")
+	if software := elem.Child("software"); software != nil {
+		ua.Software = software.Text()
+	}
+	if device := elem.Child("device"); device != nil {
+		ua.Device = device.Text()
+	}
+}
+
+func (ua Sasl2UserAgent) ToElem(elem *stravaganza.Element) {
+	b := stravaganza.NewBuilder("user-agent")
+	if ua.ID != "" {
+		b.WithAttribute("id", ua.ID)
+	}
+	if ua.Software != "" {
+		b.WithChild(stravaganza.NewBuilder("software").WithText(ua.Software).Build())
+	}
+	if ua.Device != "" {
+		b.WithChild(stravaganza.NewBuilder("device").WithText(ua.Device).Build())
+	}
+	*elem = b.Build()
+}
+
+// Sasl2Authenticate is what the client asks in its authenticate, the inline features find
+// their own requests in Elem
+type Sasl2Authenticate struct {
+	Mechanism string
+	UserAgent Sasl2UserAgent
+	Elem      stravaganza.Element
+}
+
+func (sa *Sasl2Authenticate) FromElem(elem stravaganza.Element) {
+	sa.Mechanism = elem.Attribute("mechanism")
+	if ua := elem.Child("user-agent"); ua != nil {
+		sa.UserAgent.FromElem(ua)
+	}
+	sa.Elem = elem
+}
+
+// Sasl2AuthenticateOf returns the authenticate an Auth is called for, false if it's called
+// for a sasl authentication
+func Sasl2AuthenticateOf(part Part) (Sasl2Authenticate, bool) {
+	if p, ok := part.(sasl2Part); ok {
+		return p.auth, true
+	}
+	return Sasl2Authenticate{}, false
+}
+
+// Sasl2Inline is a feature negotiated within a sasl2 authentication, such as bind 2 or
+// stream management resumption
+type Sasl2Inline interface {
+	// InlineElem is advertised in the inline of the authentication feature
+	InlineElem() stravaganza.Element
+	// Sasl2Success negotiates what auth asks of it once the client is authenticated, the
+	// elements returned go in the success
+	Sasl2Success(auth Sasl2Authenticate, part Part) ([]stravaganza.Element, error)
+}
+
+// Sasl2Mechanisms is a Sasl2Inline which authenticates with mechanisms of its own, they're
+// advertised inline of it rather than along with the others
+type Sasl2Mechanisms interface {
+	Sasl2Auth(mechanism string) (Auth, bool)
+}
+
+// sasl2Part is the part the mechanisms of Auth and ToAuth run with, which talk sasl2 through
+// its channel
+type sasl2Part struct {
+	Part
+	channel Channel
+	auth    Sasl2Authenticate
+}
+
+func (p sasl2Part) Channel() Channel {
+	return p.channel
+}
+
+func (p sasl2Part) ServerFeatures() []stravaganza.Element {
+	if fp, ok := p.Part.(featuresPart); ok {
+		return fp.ServerFeatures()
+	}
+	return nil
+}
+
+// withXmlns is elem in the namespace xmlns
+func withXmlns(elem stravaganza.Element, xmlns string) stravaganza.Element {
+	return stravaganza.NewBuilderFromElement(elem).WithAttribute("xmlns", xmlns).Build()
+}
+
+// sasl2FailureElem is the failure err tells in sasl2, of which the condition stays in the
+// sasl namespace. errors not meant for the client become a temporary-auth-failure
+func sasl2FailureElem(err error) stravaganza.Element {
+	var f Failure
+	if !errors.As(err, &f) || f.Xmlns != NSSasl {
+		f = Failure{DescTag: SFTemporaryAuthFailure}
+	}
+	children := []stravaganza.Element{stravaganza.NewBuilder(f.DescTag).WithAttribute("xmlns", NSSasl).Build()}
+	if f.More != "" {
+		text := stravaganza.NewBuilder("text").WithText(f.More)
+		if f.MoreLang != "" {
+			text.WithAttribute("xml:lang", f.MoreLang)
+		}
+		children = append(children, text.Build())
+	}
+	return stravaganza.NewBuilder("failure").WithAttribute("xmlns", NSSasl2).WithChildren(children...).Build()
+}
+
+// sasl2Failure is the sasl failure of a sasl2 failure elem
+func sasl2Failure(elem stravaganza.Element) Failure {
+	f := Failure{Xmlns: NSSasl, DescTag: SFTemporaryAuthFailure}
+	for _, child := range elem.AllChildren() {
+		if child.Name() == "text" {
+			f.More = child.Text()
+			f.MoreLang = child.Attribute("xml:lang")
+		} else if child.Attribute("xmlns") == NSSasl {
+			f.DescTag = child.Name()
+		}
+	}
+	return f
+}
+
+// sasl2ServerChannel translates what a mechanism of Auth sends and receives, its success
+// is kept for the success of sasl2, which is sent once the inline features are negotiated
+type sasl2ServerChannel struct {
+	Channel
+	succeeded  bool
+	additional string
+}
+
+func (c *sasl2ServerChannel) SendElement(elem stravaganza.Element) error {
+	if elem.Attribute("xmlns") != NSSasl {
+		return c.Channel.SendElement(elem)
+	}
+	switch elem.Name() {
+	case "challenge":
+		return c.Channel.SendElement(withXmlns(elem, NSSasl2))
+	case "success":
+		c.succeeded = true
+		c.additional = elem.Text()
+		return nil
+	case "failure":
+		var f Failure
+		f.FromElem(elem, NSSasl)
+		return c.Channel.SendElement(sasl2FailureElem(f))
+	}
+	return c.Channel.SendElement(elem)
+}
+
+func (c *sasl2ServerChannel) NextElement(elem *stravaganza.Element) error {
+	if err := c.Channel.NextElement(elem); err != nil {
+		return err
+	}
+	if name := (*elem).Name(); (*elem).Attribute("xmlns") == NSSasl2 && (name == "response" || name == "abort") {
+		*elem = withXmlns(*elem, NSSasl)
+	}
+	return nil
+}
+
+type sasl2Feature struct {
+	sasl    *saslFeature
+	inlines []Sasl2Inline
+	handled bool
+	IDAble
+}
+
+// SASL2Feature authenticates with the mechanisms sasl supports, xep-0388. the client
+// authenticates with either of them, so one handled is both handled
+func SASL2Feature(sasl *saslFeature) sasl2Feature {
+	return sasl2Feature{sasl: sasl, IDAble: CreateIDAble()}
+}
+
+// WithInline negotiates inline along with the authentication
+func (f *sasl2Feature) WithInline(inline Sasl2Inline) {
+	f.inlines = append(f.inlines, inline)
+}
+
+func (f sasl2Feature) Mandatory() bool {
+	return true
+}
+
+func (f sasl2Feature) Handled() bool {
+	return f.handled || f.sasl.handled
+}
+
+// RestartsStream is false once the client is authenticated by sasl2, the stream goes on
+// with the features left
+func (f sasl2Feature) RestartsStream() bool {
+	return !f.handled
+}
+
+func (f sasl2Feature) Elem() stravaganza.Element {
+	children := []stravaganza.Element{}
+	for name := range f.sasl.supported {
+		children = append(children, stravaganza.NewBuilder("mechanism").WithText(name).Build())
+	}
+	if len(f.inlines) > 0 {
+		inlines := []stravaganza.Element{}
+		for _, inline := range f.inlines {
+			inlines = append(inlines, inline.InlineElem())
+		}
+		children = append(children, stravaganza.NewBuilder("inline").WithChildren(inlines...).Build())
+	}
+	return stravaganza.NewBuilder("authentication").
+		WithAttribute("xmlns", NSSasl2).
+		WithChildren(children...).Build()
+}
+
+func (f sasl2Feature) Match(elem stravaganza.Element) bool {
+	return elem.Name() == "authenticate" && elem.Attribute("xmlns") == NSSasl2
+}
+
+func (f sasl2Feature) auth(mechanism string) (Auth, bool) {
+	if auth, ok := f.sasl.supported[mechanism]; ok {
+		return auth, true
+	}
+	for _, inline := range f.inlines {
+		if m, ok := inline.(Sasl2Mechanisms); ok {
+			if auth, ok := m.Sasl2Auth(mechanism); ok {
+				return auth, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (f *sasl2Feature) Handle(elem stravaganza.Element, part Part) (catched bool, err error) {
+	if !f.Match(elem) {
+		return false, nil
+	}
+	catched = true
+	var req Sasl2Authenticate
+	req.FromElem(elem)
+	auth, ok := f.auth(req.Mechanism)
+	if !ok {
+		err = SaslFailureError(SFInvalidMechanism, "")
+		part.Channel().SendElement(sasl2FailureElem(err))
+		return
+	}
+	var initial string
+	if ir := elem.Child("initial-response"); ir != nil {
+		initial = ir.Text()
+	}
+	channel := &sasl2ServerChannel{Channel: part.Channel()}
+	username, err := auth.Auth(req.Mechanism, initial, sasl2Part{Part: part, channel: channel, auth: req})
+	if err == nil && !channel.succeeded {
+		err = ErrSasl2NoSuccess
+	}
+	if err != nil {
+		part.Channel().SendElement(sasl2FailureElem(err))
+		return
+	}
+	jid, err := authorizedJID(username, part)
+	if err != nil {
+		part.Channel().SendElement(sasl2FailureElem(err))
+		return
+	}
+	// the part is authorized once every inline feature succeeds
+	unauthenticated := part.Attr().JID
+	part.Attr().JID = *jid
+	results := []stravaganza.Element{}
+	for _, inline := range f.inlines {
+		elems, e := inline.Sasl2Success(req, part)
+		if e != nil {
+			err = e
+			part.Attr().JID = unauthenticated
+			part.Channel().SendElement(sasl2FailureElem(err))
+			return
+		}
+		results = append(results, elems...)
+	}
+	f.sasl.authorized.Authorized(jid.String(), part)
+	f.handled = true
+	f.sasl.handled = true
+	part.Logger().Sub(LogSubAuth).Log(LogDebug, "sasl2 authenticated",
+		Field("mechanism", req.Mechanism), Field("user_agent", req.UserAgent.ID))
+	children := []stravaganza.Element{}
+	if channel.additional != "" {
+		children = append(children, stravaganza.NewBuilder("additional-data").WithText(channel.additional).Build())
+	}
+	// the inline features such as bind may have changed the jid
+	children = append(children, stravaganza.NewBuilder("authorization-identifier").WithText(part.Attr().JID.String()).Build())
+	err = part.Channel().SendElement(stravaganza.NewBuilder("success").
+		WithAttribute("xmlns", NSSasl2).
+		WithChildren(append(children, results...)...).Build())
+	return
+}
@@ -0,0 +1,136 @@
+package xmppcore
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"testing"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+// echoInline echoes the user agent of a client asking for it
+type echoInline struct{}
+
+func (echoInline) InlineElem() stravaganza.Element {
+	return stravaganza.NewBuilder("echo").WithAttribute("xmlns", "urn:test:echo").Build()
+}
+
+func (echoInline) Sasl2Success(auth Sasl2Authenticate, part Part) ([]stravaganza.Element, error) {
+	if auth.Elem.Child("echo") == nil {
+		return nil, nil
+	}
+	return []stravaganza.Element{stravaganza.NewBuilder("echoed").
+		WithAttribute("xmlns", "urn:test:echo").WithText(auth.UserAgent.ID).Build()}, nil
+}
+
+type clientEchoInline struct {
+	echoed string
+}
+
+func (cei *clientEchoInline) Sasl2Request(mechanism string, inline stravaganza.Element, part Part) []stravaganza.Element {
+	if inline == nil || inline.Child("echo") == nil {
+		return nil
+	}
+	return []stravaganza.Element{echoInline{}.InlineElem()}
+}
+
+func (cei *clientEchoInline) Sasl2Success(success stravaganza.Element, part Part) error {
+	if echoed := success.Child("echoed"); echoed != nil {
+		cei.echoed = echoed.Text()
+	}
+	return nil
+}
+
+func TestSasl2Authentication(t *testing.T) {
+	for _, c := range []struct {
+		password string
+		sasl2    bool
+		failure  string
+	}{
+		{"r0m30myr0m30", true, ""},
+		{"r0m30", true, SFNotAuthorized},
+		// a client without sasl2 authenticates by sasl
+		{"r0m30myr0m30", false, ""},
+	} {
+		serverConn, clientConn := tlsTestConns(t, tls.VersionTLS13)
+		sasl := SASLFeature(NewMemoryAuthorized())
+		sasl.AdvertiseChannelBindings(serverConn)
+		sasl.Support(SM_SCRAM_SHA_256_PLUS, NewScramAuth(scramTestUsers(), sha256.New, true))
+		sasl2 := SASL2Feature(&sasl)
+		sasl2.WithInline(echoInline{})
+
+		toAuth := NewScramToAuth("juliet", c.password, SM_SCRAM_SHA_256_PLUS, true)
+		clientEcho := &clientEchoInline{}
+		var clientFeature ElemHandler
+		if c.sasl2 {
+			clientSasl2 := ClientSASL2Feature(Sasl2UserAgent{ID: "d4565fa7-4d72-4749-b3d3-740edbf87770", Software: "test"})
+			clientSasl2.Support(SM_SCRAM_SHA_256_PLUS, toAuth)
+			clientSasl2.WithInline(clientEcho)
+			clientFeature = clientSasl2
+		} else {
+			clientSasl := ClientSASLFeature()
+			clientSasl.Support(SM_SCRAM_SHA_256_PLUS, toAuth)
+			clientFeature = clientSasl
+		}
+		server, client, err := negotiateParts(t, serverConn, clientConn, []Feature{&sasl, &sasl2}, []ElemHandler{clientFeature})
+		if c.failure != "" {
+			var f Failure
+			if !errors.As(err, &f) || f.DescTag != c.failure {
+				t.Fatalf("%+v should fail with %s, got %v", c, c.failure, err)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("%+v negotiate error: %s", c, err.Error())
+			}
+			if server.Attr().JID.String() != "juliet@hello-world.im" {
+				t.Fatalf("%+v authenticated as %q", c, server.Attr().JID.String())
+			}
+			if !sasl2.Handled() {
+				t.Fatalf("%+v sasl2 should be handled along with sasl", c)
+			}
+		}
+		if c.sasl2 && c.failure == "" {
+			if client.Attr().JID.String() != "juliet@hello-world.im" {
+				t.Fatalf("client told it's %q", client.Attr().JID.String())
+			}
+			if clientEcho.echoed != "d4565fa7-4d72-4749-b3d3-740edbf87770" {
+				t.Fatalf("inline should be negotiated, echoed %q", clientEcho.echoed)
+			}
+		}
+	}
+}
+
+// failingInline fails whatever is asked
+type failingInline struct{}
+
+func (failingInline) InlineElem() stravaganza.Element {
+	return stravaganza.NewBuilder("fail").WithAttribute("xmlns", "urn:test:fail").Build()
+}
+
+func (failingInline) Sasl2Success(auth Sasl2Authenticate, part Part) ([]stravaganza.Element, error) {
+	return nil, SaslFailureError(SFTemporaryAuthFailure, "inline failed")
+}
+
+func TestSasl2InlineFailure(t *testing.T) {
+	serverConn, clientConn := tlsTestConns(t, tls.VersionTLS13)
+	authorized := NewMemoryAuthorized()
+	sasl := SASLFeature(authorized)
+	sasl.AdvertiseChannelBindings(serverConn)
+	sasl.Support(SM_SCRAM_SHA_256_PLUS, NewScramAuth(scramTestUsers(), sha256.New, true))
+	sasl2 := SASL2Feature(&sasl)
+	sasl2.WithInline(failingInline{})
+	clientSasl2 := ClientSASL2Feature(Sasl2UserAgent{ID: "d4565fa7-4d72-4749-b3d3-740edbf87770"})
+	clientSasl2.Support(SM_SCRAM_SHA_256_PLUS, NewScramToAuth("juliet", "r0m30myr0m30", SM_SCRAM_SHA_256_PLUS, true))
+	server, _, err := negotiateParts(t, serverConn, clientConn, []Feature{&sasl, &sasl2}, []ElemHandler{clientSasl2})
+	var f Failure
+	if !errors.As(err, &f) || f.DescTag != SFTemporaryAuthFailure {
+		t.Fatalf("a failed inline should fail the authentication, got %v", err)
+	}
+	if part := authorized.FindPart(&JID{Username: "juliet", Domain: "hello-world.im"}); part != nil {
+		t.Fatalf("a part which failed an inline step shouldn't be authorized")
+	}
+	if server.Attr().JID.Username != "" {
+		t.Fatalf("a part which failed an inline step shouldn't be authenticated as %q", server.Attr().JID.String())
+	}
+}
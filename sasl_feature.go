@@ -36,12 +36,14 @@ func SaslFailureElem(tagName, desc string) stravaganza.Element {
 	return elem
 }
 
+// SaslFailureError is a sasl failure as an error, Auth returns it to tell the client why
+// the authentication failed
 func SaslFailureError(tagName, desc string) error {
-	tagName = strings.ReplaceAll(tagName, "-", " ")
-	if desc == "" {
-		return errors.New(tagName)
+	f := Failure{Xmlns: NSSasl, DescTag: tagName, More: desc}
+	if desc != "" {
+		f.MoreLang = "en"
 	}
-	return fmt.Errorf("%s: %s", tagName, desc)
+	return f
 }
 
 var AllSaslFailures = []string{
@@ -57,23 +59,21 @@ var AllSaslFailures = []string{
 	SFNotAuthorized,
 	SFTemporaryAuthFailure}
 
+// SaslFailureElemFromError finds the sasl failure in the chain of err. errors not meant
+// for the client become a temporary-auth-failure
 func SaslFailureElemFromError(err error) stravaganza.Element {
-	ea := strings.Split(err.Error(), ":")
-	f := strings.ReplaceAll(ea[0], " ", "-")
-	desc := ""
-	if len(ea) > 0 {
-		desc = ea[1]
-	}
-	for _, failure := range AllSaslFailures {
-		if failure == f {
-			return SaslFailureElem(failure, desc)
-		}
+	var f Failure
+	if errors.As(err, &f) && f.Xmlns == NSSasl {
+		var elem stravaganza.Element
+		f.ToElem(&elem)
+		return elem
 	}
 	return SaslFailureElem(SFTemporaryAuthFailure, "")
 }
 
 const (
-	NSSasl = "urn:ietf:params:xml:ns:xmpp-sasl"
+	NSSasl   = "urn:ietf:params:xml:ns:xmpp-sasl"
+	NSSaslCB = "urn:xmpp:sasl-cb:0"
 
 	SM_EXTERNAL           = "EXTERNAL"           // where authentication is implicit in the context (e.g., for protocols already using IPsec or TLS)
 	SM_ANONYMOUS          = "ANONYMOUS"          // for unauthenticated guest access
@@ -112,6 +112,8 @@ type saslFeature struct {
 	supported  map[string]Auth
 	authorized Authorized
 	handled    bool
+	// the conn of which channel binding types are advertised
+	cbConn Conn
 	IDAble
 }
 
@@ -133,6 +135,29 @@ func (mf saslFeature) Elem() stravaganza.Element {
 		WithChildren(ms...).Build()
 }
 
+// Elems are the mechanisms, and the channel binding types of xep-0440 if advertised
+func (mf saslFeature) Elems() []stravaganza.Element {
+	elems := []stravaganza.Element{mf.Elem()}
+	if mf.cbConn == nil {
+		return elems
+	}
+	if types := ChannelBindingTypes(mf.cbConn); len(types) > 0 {
+		cbs := []stravaganza.Element{}
+		for _, cbType := range types {
+			cbs = append(cbs, stravaganza.NewBuilder("channel-binding").WithAttribute("type", cbType).Build())
+		}
+		elems = append(elems, stravaganza.NewBuilder("sasl-channel-binding").
+			WithAttribute("xmlns", NSSaslCB).WithChildren(cbs...).Build())
+	}
+	return elems
+}
+
+// AdvertiseChannelBindings advertises the channel binding types of the conn along with
+// the mechanisms, as xep-0440 defines
+func (mf *saslFeature) AdvertiseChannelBindings(conn Conn) {
+	mf.cbConn = conn
+}
+
 func (mf *saslFeature) Support(name string, auth Auth) {
 	mf.supported[name] = auth
 }
@@ -169,12 +194,30 @@ func (mf *saslFeature) Handle(elem stravaganza.Element, part Part) (catched bool
 		part.Channel().SendElement(SaslFailureElemFromError(err))
 		return
 	}
-	part.Attr().JID.Username = username
-	part.Attr().JID.Domain = part.Attr().Domain
-	mf.authorized.Authorized(part.Attr().JID.String(), part)
+	jid, err := authorizedJID(username, part)
+	if err != nil {
+		part.Channel().SendElement(SaslFailureElemFromError(err))
+		return
+	}
+	part.Attr().JID = *jid
+	mf.authorized.Authorized(jid.String(), part)
 	return
 }
 
+// authorizedJID is the jid of the account username at the domain of part, account names
+// are mapped to localparts with xep-0106 escaping
+func authorizedJID(username string, part Part) (*JID, error) {
+	localpart, err := EscapeLocalpart(username)
+	if err != nil {
+		return nil, SaslFailureError(SFInvalidAuthzid, "")
+	}
+	jid, err := NewJID(localpart, part.Attr().Domain, "")
+	if err != nil {
+		return nil, SaslFailureError(SFInvalidAuthzid, "")
+	}
+	return jid, nil
+}
+
 func (mf saslFeature) Handled() bool {
 	return mf.handled
 }
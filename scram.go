@@ -0,0 +1,263 @@
+package xmppcore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// rfc5802 messages, the gs2 header carries the channel binding type, of which data is
+// bound in the client final message
+
+var (
+	ErrScramMalformed      = errors.New("malformed scram message")
+	ErrScramNonce          = errors.New("scram nonce mismatch")
+	ErrScramServerSign     = errors.New("scram server signature mismatch")
+	ErrScramChannelBinding = errors.New("scram channel binding mismatch")
+)
+
+// ScramSaltedPassword is what a ScramAuthUser keeps as the password of a hash
+func ScramSaltedPassword(hashBuild func() hash.Hash, password, salt []byte, iter int) []byte {
+	return pbkdf2.Key(password, salt, iter, hashBuild().Size(), hashBuild)
+}
+
+func scramNonce() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// saslname escapes , and = of a name, rfc5802 5.1
+func saslname(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+func unsaslname(name string) (string, error) {
+	if strings.Count(name, "=") != strings.Count(name, "=3D")+strings.Count(name, "=2C") {
+		return "", ErrScramMalformed
+	}
+	return strings.NewReplacer("=3D", "=", "=2C", ",").Replace(name), nil
+}
+
+// scramAttrs parses attributes like r=...,s=...,i=...
+func scramAttrs(msg string) (map[byte]string, error) {
+	attrs := map[byte]string{}
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return nil, ErrScramMalformed
+		}
+		attrs[attr[0]] = attr[2:]
+	}
+	return attrs, nil
+}
+
+type scramKeys struct {
+	hashBuild func() hash.Hash
+}
+
+func (k scramKeys) hmac(key, msg []byte) []byte {
+	m := hmac.New(k.hashBuild, key)
+	m.Write(msg)
+	return m.Sum(nil)
+}
+
+func (k scramKeys) hash(b []byte) []byte {
+	h := k.hashBuild()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func (k scramKeys) clientSignature(salted []byte, authMsg string) (clientKey, signature []byte) {
+	clientKey = k.hmac(salted, []byte("Client Key"))
+	return clientKey, k.hmac(k.hash(clientKey), []byte(authMsg))
+}
+
+func (k scramKeys) serverSignature(salted []byte, authMsg string) []byte {
+	return k.hmac(k.hmac(salted, []byte("Server Key")), []byte(authMsg))
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// gs2Header of the cb flag, p=type if the channel is bound, y if the client binds but the
+// server seems not, n otherwise
+func gs2Header(cbFlag, authzid string) string {
+	header := cbFlag + ","
+	if authzid != "" {
+		header += "a=" + saslname(authzid)
+	}
+	return header + ","
+}
+
+type scramClient struct {
+	scramKeys
+	gs2       string
+	cbData    []byte
+	nonce     string
+	firstBare string
+	authMsg   string
+	salted    []byte
+}
+
+func newScramClient(hashBuild func() hash.Hash, cbFlag string, cbData []byte) *scramClient {
+	return &scramClient{scramKeys: scramKeys{hashBuild}, gs2: gs2Header(cbFlag, ""), cbData: cbData}
+}
+
+func (c *scramClient) first(username string) string {
+	c.nonce = scramNonce()
+	c.firstBare = "n=" + saslname(username) + ",r=" + c.nonce
+	return c.gs2 + c.firstBare
+}
+
+func (c *scramClient) final(serverFirst, password string) (string, error) {
+	attrs, err := scramAttrs(serverFirst)
+	if err != nil {
+		return "", err
+	}
+	nonce, salt64 := attrs['r'], attrs['s']
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return "", ErrScramNonce
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return "", ErrScramMalformed
+	}
+	iter, err := strconv.Atoi(attrs['i'])
+	if err != nil || iter <= 0 {
+		return "", ErrScramMalformed
+	}
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(append([]byte(c.gs2), c.cbData...)) + ",r=" + nonce
+	c.authMsg = c.firstBare + "," + serverFirst + "," + withoutProof
+	c.salted = ScramSaltedPassword(c.hashBuild, []byte(password), salt, iter)
+	clientKey, signature := c.clientSignature(c.salted, c.authMsg)
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(xorBytes(clientKey, signature)), nil
+}
+
+func (c *scramClient) verify(serverFinal string) error {
+	attrs, err := scramAttrs(serverFinal)
+	if err != nil {
+		return err
+	}
+	if e, ok := attrs['e']; ok {
+		return errors.New("scram server error: " + e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err != nil {
+		return ErrScramMalformed
+	}
+	if !hmac.Equal(signature, c.serverSignature(c.salted, c.authMsg)) {
+		return ErrScramServerSign
+	}
+	return nil
+}
+
+type scramServer struct {
+	scramKeys
+	// the cb flag and the type if it's p
+	cbFlag    byte
+	cbType    string
+	username  string
+	gs2       string
+	nonce     string
+	firstBare string
+	first     string
+	authMsg   string
+}
+
+func newScramServer(hashBuild func() hash.Hash) *scramServer {
+	return &scramServer{scramKeys: scramKeys{hashBuild}}
+}
+
+// readFirst parses the client first message, what the channel binding flag means is up to
+// the caller
+func (s *scramServer) readFirst(msg string) error {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return ErrScramMalformed
+	}
+	switch s.cbFlag = parts[0][0]; s.cbFlag {
+	case 'n', 'y':
+		if len(parts[0]) != 1 {
+			return ErrScramMalformed
+		}
+	case 'p':
+		if !strings.HasPrefix(parts[0], "p=") || len(parts[0]) == 2 {
+			return ErrScramMalformed
+		}
+		s.cbType = parts[0][2:]
+	default:
+		return ErrScramMalformed
+	}
+	s.gs2 = parts[0] + "," + parts[1] + ","
+	s.firstBare = parts[2]
+	attrs, err := scramAttrs(s.firstBare)
+	if err != nil {
+		return err
+	}
+	if _, ok := attrs['m']; ok {
+		return ErrScramMalformed
+	}
+	if s.username, err = unsaslname(attrs['n']); err != nil || s.username == "" || attrs['r'] == "" {
+		return ErrScramMalformed
+	}
+	s.nonce = attrs['r'] + scramNonce()
+	return nil
+}
+
+func (s *scramServer) challenge(salt []byte, iter int) string {
+	s.first = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(salt) + ",i=" + strconv.Itoa(iter)
+	return s.first
+}
+
+// verify checks the channel binding and the proof of the client final message, returns
+// the server final message
+func (s *scramServer) verify(msg string, cbData, salted []byte) (string, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return "", ErrScramMalformed
+	}
+	withoutProof := msg[:i]
+	attrs, err := scramAttrs(withoutProof)
+	if err != nil {
+		return "", err
+	}
+	cb, err := base64.StdEncoding.DecodeString(attrs['c'])
+	if err != nil {
+		return "", ErrScramMalformed
+	}
+	if !bytes.Equal(cb, append([]byte(s.gs2), cbData...)) {
+		return "", ErrScramChannelBinding
+	}
+	if attrs['r'] != s.nonce {
+		return "", ErrScramNonce
+	}
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil {
+		return "", ErrScramMalformed
+	}
+	s.authMsg = s.firstBare + "," + s.first + "," + withoutProof
+	_, signature := s.clientSignature(salted, s.authMsg)
+	if len(proof) != len(signature) {
+		return "", ErrScramMalformed
+	}
+	// the stored key got from the proof must be the one of the salted password
+	clientKey := xorBytes(proof, signature)
+	storedKey := s.hash(s.hmac(salted, []byte("Client Key")))
+	if subtle.ConstantTimeCompare(s.hash(clientKey), storedKey) != 1 {
+		return "", SaslFailureError(SFNotAuthorized, "")
+	}
+	return "v=" + base64.StdEncoding.EncodeToString(s.serverSignature(salted, s.authMsg)), nil
+}
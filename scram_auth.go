@@ -1,13 +1,11 @@
 package xmppcore
 
 import (
-	"bytes"
-	"fmt"
+	"encoding/base64"
 	"hash"
 	"strings"
 
 	"github.com/jackal-xmpp/stravaganza/v2"
-	scramauth "github.com/yang-zzhong/scram-auth"
 )
 
 // rfc5802
@@ -34,6 +32,8 @@ type ScramAuth struct {
 	user        ScramAuthUser
 }
 
+// NewScramAuth authenticates with the hash, useCB tells the server binds channels, so a
+// client which could bind but thinks the server can't is refused as a downgrade
 func NewScramAuth(userFetcher ScramAuthUserFetcher, hashBuild func() hash.Hash, useCB bool) *ScramAuth {
 	return &ScramAuth{
 		hashBuild:   hashBuild,
@@ -42,30 +42,25 @@ func NewScramAuth(userFetcher ScramAuthUserFetcher, hashBuild func() hash.Hash,
 }
 
 func (scram *ScramAuth) Auth(mechanism, authInfo string, part Part) (username string, err error) {
-	var auth *scramauth.ServerScramAuth
-	if scram.useCB {
-		var buf bytes.Buffer
-		if err := part.Conn().BindTlsUnique(&buf); err != nil {
-			return "", err
-		}
-		fmt.Printf("server challenge bind string: %s\n", buf.String())
-		auth = scramauth.NewServerScramAuth(scram.hashBuild, scramauth.TlsUnique, buf.Bytes())
-	} else {
-		auth = scramauth.NewServerScramAuth(scram.hashBuild, scramauth.None, []byte{})
+	var first string
+	if err = AuthPayload(authInfo, &first); err != nil {
+		return
 	}
-	r := bytes.NewBuffer([]byte(authInfo))
-	var buf bytes.Buffer
-	if err := auth.WriteChallengeMsg(r, func(username []byte) ([]byte, int, error) {
-		if err := scram.initUser(username); err != nil {
-			return nil, 0, err
-		}
-		return []byte(scram.user.Salt()), scram.user.IterationCount(), nil
-	}, &buf); err != nil {
-		return "", err
+	server := newScramServer(scram.hashBuild)
+	if err = server.readFirst(first); err != nil {
+		return "", SaslFailureError(SFMalformedRequest, err.Error())
+	}
+	cbData, err := scram.channelBinding(mechanism, server, part)
+	if err != nil {
+		return
+	}
+	if err = scram.initUser(server.username); err != nil {
+		return
 	}
+	challenge := server.challenge([]byte(scram.user.Salt()), scram.user.IterationCount())
 	msg := stravaganza.NewBuilder("challenge").
 		WithAttribute(stravaganza.Namespace, NSSasl).
-		WithText(buf.String()).
+		WithText(base64.StdEncoding.EncodeToString([]byte(challenge))).
 		Build()
 	if err = part.Channel().SendElement(msg); err != nil {
 		return
@@ -74,15 +69,41 @@ func (scram *ScramAuth) Auth(mechanism, authInfo string, part Part) (username st
 		return
 	}
 	hashName := scram.hashNameFromMechanism(mechanism)
-	if err = scram.verifyPassword(auth, part, &msg, hashName); err != nil {
+	if err = scram.verifyPassword(server, cbData, part, &msg, hashName); err != nil {
 		return
 	}
-	return
+	return server.username, nil
 }
 
-func (scram *ScramAuth) initUser(username []byte) error {
+// channelBinding returns the data the client must have bound, nil if it binds nothing
+func (scram *ScramAuth) channelBinding(mechanism string, server *scramServer, part Part) ([]byte, error) {
+	plus := strings.HasSuffix(mechanism, "-PLUS")
+	switch server.cbFlag {
+	case 'p':
+		if !plus {
+			return nil, SaslFailureError(SFMalformedRequest, "channel binding requires a -PLUS mechanism")
+		}
+		data, err := ChannelBinding(part.Conn(), server.cbType)
+		if err != nil {
+			return nil, SaslFailureError(SFMalformedRequest, "channel binding type "+server.cbType+" not supported")
+		}
+		part.Logger().Sub(LogSubAuth).Log(LogDebug, "scram channel binding", Field("type", server.cbType), Field("size", len(data)))
+		return data, nil
+	case 'y':
+		// the client binds but thinks the server doesn't, the -PLUS mechanisms are stripped
+		if scram.useCB && len(ChannelBindingTypes(part.Conn())) > 0 {
+			return nil, SaslFailureError(SFNotAuthorized, "channel binding downgraded")
+		}
+	}
+	if plus {
+		return nil, SaslFailureError(SFMalformedRequest, "-PLUS mechanism requires channel binding")
+	}
+	return nil, nil
+}
+
+func (scram *ScramAuth) initUser(username string) error {
 	var err error
-	scram.user, err = scram.userFetcher.UserByUsername(string(username))
+	scram.user, err = scram.userFetcher.UserByUsername(username)
 	if err != nil {
 		return SaslFailureError(SFTemporaryAuthFailure, err.Error())
 	}
@@ -104,21 +125,25 @@ func (scram *ScramAuth) hashNameFromMechanism(mechanism string) string {
 	return strings.Replace(hashName, "-PLUS", "", 1)
 }
 
-func (scram *ScramAuth) verifyPassword(auth *scramauth.ServerScramAuth, part Part, msg *stravaganza.Element, hashName string) error {
+func (scram *ScramAuth) verifyPassword(server *scramServer, cbData []byte, part Part, msg *stravaganza.Element, hashName string) error {
 	password, err := scram.user.Password(hashName)
 	if err != nil {
 		return SaslFailureError(SFTemporaryAuthFailure, err.Error())
 	}
-	r := bytes.NewBuffer([]byte((*msg).Text()))
-	if err := auth.Verify(r, []byte(password)); err != nil {
-		return SaslFailureError(SFTemporaryAuthFailure, err.Error())
+	var final string
+	if err := AuthPayload((*msg).Text(), &final); err != nil {
+		return err
 	}
-	var buf bytes.Buffer
-	if err := auth.WriteSignatureMsg(r, []byte(password), &buf); err != nil {
-		return SaslFailureError(SFTemporaryAuthFailure, err.Error())
+	signature, err := server.verify(final, cbData, []byte(password))
+	if err == ErrScramChannelBinding {
+		return SaslFailureError(SFNotAuthorized, err.Error())
+	} else if err == ErrScramMalformed || err == ErrScramNonce {
+		return SaslFailureError(SFMalformedRequest, err.Error())
+	} else if err != nil {
+		return err
 	}
 	return part.Channel().SendElement(stravaganza.NewBuilder("success").
 		WithAttribute(stravaganza.Namespace, NSSasl).
-		WithText(buf.String()).
+		WithText(base64.StdEncoding.EncodeToString([]byte(signature))).
 		Build())
 }
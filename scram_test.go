@@ -0,0 +1,217 @@
+package xmppcore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+func TestScramMessages(t *testing.T) {
+	salt := []byte("QSXCR+Q6sek8bf92")
+	salted := ScramSaltedPassword(sha256.New, []byte("pencil"), salt, 4096)
+	for _, c := range []struct {
+		clientCB, serverCB []byte
+		err                error
+	}{
+		{[]byte("cb data"), []byte("cb data"), nil},
+		{[]byte("cb data"), []byte("other data"), ErrScramChannelBinding},
+	} {
+		client := newScramClient(sha256.New, "p="+CBTlsExporter, c.clientCB)
+		server := newScramServer(sha256.New)
+		if err := server.readFirst(client.first("user,=name")); err != nil {
+			t.Fatalf("read client first error: %s", err.Error())
+		}
+		if server.username != "user,=name" || server.cbFlag != 'p' || server.cbType != CBTlsExporter {
+			t.Fatalf("client first parsed as %q %c %q", server.username, server.cbFlag, server.cbType)
+		}
+		final, err := client.final(server.challenge(salt, 4096), "pencil")
+		if err != nil {
+			t.Fatalf("client final error: %s", err.Error())
+		}
+		signature, err := server.verify(final, c.serverCB, salted)
+		if err != c.err {
+			t.Fatalf("verify got %v, expected %v", err, c.err)
+		}
+		if err == nil {
+			if err := client.verify(signature); err != nil {
+				t.Fatalf("server signature error: %s", err.Error())
+			}
+		}
+	}
+	client := newScramClient(sha256.New, "n", nil)
+	server := newScramServer(sha256.New)
+	server.readFirst(client.first("user"))
+	final, _ := client.final(server.challenge(salt, 4096), "wrong")
+	if _, err := server.verify(final, nil, salted); err == nil {
+		t.Fatalf("wrong password should fail")
+	}
+}
+
+func TestSelectChannelBinding(t *testing.T) {
+	supported := []string{CBTlsExporter, CBTlsServerEndPoint}
+	if cb := SelectChannelBinding(nil, supported); cb != CBTlsExporter {
+		t.Fatalf("without offer the preferred supported should be selected, got %s", cb)
+	}
+	if cb := SelectChannelBinding([]string{CBTlsUnique, CBTlsServerEndPoint}, supported); cb != CBTlsServerEndPoint {
+		t.Fatalf("the supported one offered should be selected, got %s", cb)
+	}
+	if cb := SelectChannelBinding([]string{CBTlsUnique}, supported); cb != "" {
+		t.Fatalf("nothing in common should select nothing, got %s", cb)
+	}
+}
+
+// tlsTestConns connects a server and a client TcpConn over tls of the version
+func tlsTestConns(t *testing.T, version uint16) (server, client *TcpConn) {
+	cert := testCertificate(t, time.Now().Add(time.Hour), "hello-world.im")
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	return tlsTestConnsWith(t,
+		&tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: version},
+		&tls.Config{RootCAs: roots, ServerName: "hello-world.im", MaxVersion: version})
+}
+
+func tlsTestConnsWith(t *testing.T, serverConf, clientConf *tls.Config) (server, client *TcpConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %s", err.Error())
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %s", err.Error())
+	}
+	server = NewTcpConn(<-accepted, false)
+	server.StartTLS(serverConf)
+	client = NewTcpConn(raw, true)
+	client.StartTLS(clientConf)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.underlying.(*tls.Conn).Handshake()
+	}()
+	if err := client.underlying.(*tls.Conn).Handshake(); err != nil {
+		t.Fatalf("client handshake error: %s", err.Error())
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("server handshake error: %s", err.Error())
+	}
+	return
+}
+
+// negotiateParts runs a server part of serverFeatures and negotiates a client part of
+// clientFeatures with it. the stream is closed once negotiated, the server part must quit
+func negotiateParts(t *testing.T, serverConn, clientConn Conn, serverFeatures []Feature, clientFeatures []ElemHandler) (*XPart, *ClientPart, error) {
+	server := NewXPart(serverConn, "hello-world.im", NewLogger(io.Discard))
+	for _, f := range serverFeatures {
+		server.WithFeature(f)
+	}
+	serverErr := server.Run()
+	client := NewClientPart(clientConn, NewLogger(io.Discard), &PartAttr{
+		JID: JID{Domain: "hello-world.im"}, Version: "1.0", Domain: "hello-world.im"})
+	for _, f := range clientFeatures {
+		client.WithFeature(f)
+	}
+	err := client.Negotiate()
+	client.Channel().Close()
+	select {
+	case <-serverErr:
+	case <-time.After(time.Second):
+		t.Fatalf("server part should quit")
+	}
+	return server, client, err
+}
+
+// sentScramHeader returns the gs2 header of the scram authentication recorded
+func sentScramHeader(t *testing.T, recording io.Reader) string {
+	records, err := LoadRecording(recording)
+	if err != nil {
+		t.Fatalf("load recording error: %s", err.Error())
+	}
+	var sent bytes.Buffer
+	for _, r := range records {
+		if r.Dir == RecordOut {
+			sent.Write(r.Data)
+		}
+	}
+	p := NewFastParser(&sent, 1024*1024)
+	for {
+		i, err := p.Next()
+		if err != nil {
+			t.Fatalf("no authentication sent")
+		}
+		if elem, ok := i.(stravaganza.Element); ok && elem.Name() == "auth" {
+			msg, _ := base64.StdEncoding.DecodeString(elem.Text())
+			return string(msg[:bytes.Index(msg, []byte("n="))])
+		}
+	}
+}
+
+func TestChannelBindingTypes(t *testing.T) {
+	server, client := tlsTestConns(t, tls.VersionTLS13)
+	defer server.Close()
+	defer client.Close()
+	expected := CBTlsExporter + "," + CBTlsServerEndPoint
+	if types := strings.Join(ChannelBindingTypes(server), ","); types != expected {
+		t.Fatalf("tls 1.3 channel bindings %s", types)
+	}
+	for _, cbType := range []string{CBTlsExporter, CBTlsServerEndPoint} {
+		s, _ := ChannelBinding(server, cbType)
+		c, _ := ChannelBinding(client, cbType)
+		if len(s) == 0 || string(s) != string(c) {
+			t.Fatalf("%s of both sides should be the same", cbType)
+		}
+	}
+	if err := server.BindTlsUnique(io.Discard); err != ErrBindTlsUniqueNotSupported {
+		t.Fatalf("tls-unique is undefined for tls 1.3")
+	}
+	server, client = tlsTestConns(t, tls.VersionTLS12)
+	defer server.Close()
+	defer client.Close()
+	expected = CBTlsExporter + "," + CBTlsServerEndPoint + "," + CBTlsUnique
+	if types := strings.Join(ChannelBindingTypes(client), ","); types != expected {
+		t.Fatalf("tls 1.2 channel bindings %s", types)
+	}
+}
+
+func scramTestUsers() *MemoryAuthUserFetcher {
+	users := NewMemoryAuthUserFetcher()
+	users.Add(NewMemomryAuthUser("juliet", "r0m30myr0m30", map[string]func() hash.Hash{"SHA-256": sha256.New}, 4096))
+	return users
+}
+
+func TestScramPlusOverTls(t *testing.T) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		serverConn, clientConn := tlsTestConns(t, version)
+		sasl := SASLFeature(NewMemoryAuthorized())
+		sasl.AdvertiseChannelBindings(serverConn)
+		sasl.Support(SM_SCRAM_SHA_256_PLUS, NewScramAuth(scramTestUsers(), sha256.New, true))
+		clientSasl := ClientSASLFeature()
+		clientSasl.Support(SM_SCRAM_SHA_256_PLUS, NewScramToAuth("juliet", "r0m30myr0m30", SM_SCRAM_SHA_256_PLUS, true))
+		var recording bytes.Buffer
+		server, _, err := negotiateParts(t, serverConn, NewRecordConn(clientConn, NewRecorder(&recording)),
+			[]Feature{&sasl}, []ElemHandler{clientSasl})
+		if err != nil {
+			t.Fatalf("tls %x negotiate error: %s", version, err.Error())
+		}
+		if gs2 := sentScramHeader(t, &recording); gs2 != "p="+CBTlsExporter+",," {
+			t.Fatalf("tls %x should bind tls-exporter, sent %q", version, gs2)
+		}
+		if server.Attr().JID.String() != "juliet@hello-world.im" {
+			t.Fatalf("tls %x authenticated as %q", version, server.Attr().JID.String())
+		}
+	}
+}
@@ -1,32 +1,29 @@
 package xmppcore
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/base64"
 	"errors"
-	"fmt"
 	"hash"
-	"io"
+	"strings"
 
-	"github.com/google/uuid"
 	"github.com/jackal-xmpp/stravaganza/v2"
-	scramauth "github.com/yang-zzhong/scram-auth"
 )
 
 type ScramToAuth struct {
-	authzid   string
 	username  string
 	password  string
 	mechanism string
 	useCB     bool
 }
 
+// NewScramToAuth authenticates with the mechanism, a -PLUS one binds the best channel
+// binding type both sides support, useCB tells the client could bind with the others
 func NewScramToAuth(u, p string, mechanism string, useCB bool) *ScramToAuth {
 	return &ScramToAuth{
 		useCB:     useCB,
-		authzid:   uuid.New().String(),
 		mechanism: mechanism,
 		username:  u, password: p}
 }
@@ -50,79 +47,153 @@ func (sta *ScramToAuth) hashBuild() func() hash.Hash {
 }
 
 func (sta *ScramToAuth) ToAuth(mechemism string, part Part) error {
-	var auth *scramauth.ClientScramAuth
 	hashBuild := sta.hashBuild()
 	if hashBuild == nil {
 		return errors.New("hash not supported")
 	}
-	if sta.useCB {
-		var buf bytes.Buffer
-		if err := part.Conn().BindTlsUnique(&buf); err != nil {
-			return err
-		}
-		fmt.Printf("client challenge bind string: %s\n", buf.String())
-		auth = scramauth.NewClientScramAuth(hashBuild, scramauth.TlsUnique, buf.Bytes())
-	} else {
-		auth = scramauth.NewClientScramAuth(hashBuild, scramauth.None, []byte{})
+	cbFlag, cbData, err := sta.channelBinding(part)
+	if err != nil {
+		return err
 	}
-	if err := sta.sendRequest(auth, part); err != nil {
+	client := newScramClient(hashBuild, cbFlag, cbData)
+	if err := sta.sendRequest(client, part); err != nil {
 		return err
 	}
 	cha, err := sta.challenge(part)
 	if err != nil {
 		return err
 	}
-	if err := sta.sendResponse(auth, cha, part); err != nil {
+	if err := sta.sendResponse(client, cha, part); err != nil {
 		return err
 	}
 	sign, err := sta.signature(part)
 	if err != nil {
 		return err
 	}
-	return auth.Verify(bytes.NewBuffer(sign), sta.password)
+	return client.verify(sign)
+}
+
+// channelBinding returns the gs2 cb flag and the data bound
+func (sta *ScramToAuth) channelBinding(part Part) (string, []byte, error) {
+	supported := ChannelBindingTypes(part.Conn())
+	if !strings.HasSuffix(sta.mechanism, "-PLUS") {
+		if sta.useCB && len(supported) > 0 && !offeredPlus(part) {
+			return "y", nil, nil
+		}
+		return "n", nil, nil
+	}
+	cbType := SelectChannelBinding(offeredChannelBindings(part), supported)
+	if cbType == "" {
+		return "", nil, ErrChannelBindingNotSupported
+	}
+	data, err := ChannelBinding(part.Conn(), cbType)
+	if err != nil {
+		return "", nil, err
+	}
+	part.Logger().Sub(LogSubAuth).Log(LogDebug, "scram channel binding", Field("type", cbType), Field("size", len(data)))
+	return "p=" + cbType, data, nil
+}
+
+// SelectChannelBinding picks the first of supported the server offers, the first of
+// supported if the server doesn't tell what it offers
+func SelectChannelBinding(offered, supported []string) string {
+	for _, cbType := range supported {
+		if offered == nil {
+			return cbType
+		}
+		for _, o := range offered {
+			if o == cbType {
+				return cbType
+			}
+		}
+	}
+	return ""
+}
+
+// offeredChannelBindings returns the types of xep-0440 the server offered, nil if it
+// doesn't tell
+func offeredChannelBindings(part Part) []string {
+	fp, ok := part.(featuresPart)
+	if !ok {
+		return nil
+	}
+	for _, f := range fp.ServerFeatures() {
+		if f.Name() != "sasl-channel-binding" || f.Attribute("xmlns") != NSSaslCB {
+			continue
+		}
+		types := []string{}
+		for _, cb := range f.Children("channel-binding") {
+			types = append(types, cb.Attribute("type"))
+		}
+		return types
+	}
+	return nil
 }
 
-func (sta *ScramToAuth) signature(part Part) ([]byte, error) {
+func offeredPlus(part Part) bool {
+	fp, ok := part.(featuresPart)
+	if !ok {
+		return false
+	}
+	for _, f := range fp.ServerFeatures() {
+		if f.Name() != "mechanisms" && f.Name() != "authentication" {
+			continue
+		}
+		for _, m := range f.Children("mechanism") {
+			if strings.HasSuffix(m.Text(), "-PLUS") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (sta *ScramToAuth) signature(part Part) (string, error) {
 	var elem stravaganza.Element
 	if err := part.Channel().NextElement(&elem); err != nil {
-		return nil, err
+		return "", err
 	}
 	if elem.Name() != "success" {
-		return nil, errors.New("server failed auth")
+		return "", errors.New("server failed auth")
 	}
-	return []byte(elem.Text()), nil
+	var sign string
+	if err := AuthPayload(elem.Text(), &sign); err != nil {
+		return "", err
+	}
+	return sign, nil
 }
 
-func (sta *ScramToAuth) sendResponse(auth *scramauth.ClientScramAuth, r io.Reader, part Part) error {
-	var wr bytes.Buffer
-	if err := auth.WriteResMsg(r, sta.password, &wr); err != nil {
+func (sta *ScramToAuth) sendResponse(client *scramClient, challenge string, part Part) error {
+	final, err := client.final(challenge, sta.password)
+	if err != nil {
 		return err
 	}
 	elem := stravaganza.NewBuilder("response").
 		WithAttribute("xmlns", NSSasl).
-		WithText(wr.String()).Build()
+		WithText(base64.StdEncoding.EncodeToString([]byte(final))).Build()
 
 	return part.Channel().SendElement(elem)
 }
 
-func (sta *ScramToAuth) challenge(part Part) (io.Reader, error) {
+func (sta *ScramToAuth) challenge(part Part) (string, error) {
 	var elem stravaganza.Element
 	if err := part.Channel().NextElement(&elem); err != nil {
-		return nil, err
+		return "", err
 	}
 	if elem.Name() != "challenge" {
-		return nil, errors.New("not a challenge element")
+		return "", errors.New("not a challenge element")
 	}
-	return bytes.NewBuffer([]byte(elem.Text())), nil
+	var challenge string
+	if err := AuthPayload(elem.Text(), &challenge); err != nil {
+		return "", err
+	}
+	return challenge, nil
 }
 
-func (sta *ScramToAuth) sendRequest(auth *scramauth.ClientScramAuth, part Part) error {
-	var buf bytes.Buffer
-	if err := auth.WriteReqMsg(sta.authzid, sta.username, &buf); err != nil {
-		return err
-	}
+func (sta *ScramToAuth) sendRequest(client *scramClient, part Part) error {
 	elem := stravaganza.NewBuilder("auth").
 		WithAttribute("mechanism", sta.mechanism).
-		WithAttribute("xmlns", NSSasl).WithText(buf.String()).Build()
+		WithAttribute("xmlns", NSSasl).
+		WithText(base64.StdEncoding.EncodeToString([]byte(client.first(sta.username)))).Build()
 	return part.Channel().SendElement(elem)
 }
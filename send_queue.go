@@ -0,0 +1,375 @@
+package xmppcore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerBlock blocks the senders until the queue has room
+	SlowConsumerBlock SlowConsumerPolicy = iota
+	// SlowConsumerDrop drops droppable stanzas and blocks on the others
+	SlowConsumerDrop
+	// SlowConsumerClose closes the stream with a resource-constraint stream error
+	SlowConsumerClose
+)
+
+var ErrSlowConsumer = errors.New("send queue full")
+
+// errQueueFull tells the pusher to wait for room with pushWait, buf is still its own
+var errQueueFull = errors.New("send queue full, wait")
+
+// SendQueueConfig configures the outbound queue of a channel
+type SendQueueConfig struct {
+	// Size is the max number of stanzas waiting to be written
+	Size int
+	// CoalesceSize is the max number of bytes written to the conn at once
+	CoalesceSize int
+	Policy       SlowConsumerPolicy
+	// Droppable tells the stanzas which SlowConsumerDrop may drop
+	Droppable func(stravaganza.Element) bool
+	// Bounce receives the stanzas queued but never written, because the stream is closed
+	// or broken, so that their senders can be told
+	Bounce func(stravaganza.Element)
+}
+
+var DefaultSendQueueConfig = SendQueueConfig{
+	Size:         256,
+	CoalesceSize: 16 * 1024,
+	Policy:       SlowConsumerBlock,
+	Droppable:    DroppableStanza,
+}
+
+// DroppableStanza tells presence broadcasts and messages without body, such as chat states,
+// from the stanzas which can't be missed
+func DroppableStanza(elem stravaganza.Element) bool {
+	switch elem.Name() {
+	case NamePresence:
+		t := StanzaType(elem.Attribute("type"))
+		return t == "" || t == TypeUnavailable
+	case NameMsg:
+		return elem.Child("body") == nil && StanzaType(elem.Attribute("type")) != TypeError
+	}
+	return false
+}
+
+type SendQueueStats struct {
+	Depth    int // stanzas waiting to be written
+	MaxDepth int // high watermark of Depth
+	Enqueued uint64
+	Dropped  uint64
+	Written  uint64 // bytes written to the conn
+	Writes   uint64 // writes to the conn, each one coalesces one or more stanzas
+}
+
+type sendItem struct {
+	buf *bytes.Buffer
+	// the stanza serialized into buf, nil for the other elements and stream level data
+	elem stravaganza.Element
+	// not nil for a flush marker
+	done chan error
+	// the end of the stream, what's queued after is dropped
+	last bool
+}
+
+// sendQueue serializes writes to a conn in its own goroutine. stanzas queued while a write
+// is in progress are coalesced into the next write
+type sendQueue struct {
+	// 64-bit atomic counters first to be aligned on 32-bit platforms
+	maxDepth int64
+	enqueued uint64
+	dropped  uint64
+	written  uint64
+	writes   uint64
+
+	conf  SendQueueConfig
+	items chan sendItem
+	// told when an item is taken, to a pusher waiting for room
+	room     chan struct{}
+	quit     chan struct{}
+	exited   chan struct{}
+	stopOnce sync.Once
+	w        *bufio.Writer
+	// stanzas in w not flushed yet, bounced when flushing fails
+	buffered []stravaganza.Element
+	// the end of the stream is written
+	ended bool
+	err   error
+	errMu sync.Mutex
+}
+
+type countWriter struct {
+	w  io.Writer
+	sq *sendQueue
+}
+
+func (cw countWriter) Write(bs []byte) (int, error) {
+	n, err := cw.w.Write(bs)
+	atomic.AddUint64(&cw.sq.written, uint64(n))
+	atomic.AddUint64(&cw.sq.writes, 1)
+	return n, err
+}
+
+func newSendQueue(w io.Writer, conf SendQueueConfig) *sendQueue {
+	sq := &sendQueue{
+		conf:   conf,
+		items:  make(chan sendItem, conf.Size),
+		room:   make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	sq.w = bufio.NewWriterSize(countWriter{w, sq}, conf.CoalesceSize)
+	go sq.run()
+	return sq
+}
+
+func (sq *sendQueue) run() {
+	defer close(sq.exited)
+	for {
+		select {
+		case item := <-sq.items:
+			select {
+			case sq.room <- struct{}{}:
+			default:
+			}
+			sq.write(item)
+			if len(sq.items) == 0 {
+				sq.flush()
+			}
+		case <-sq.quit:
+			sq.setErr(ErrChannelClosed)
+			sq.bounceBuffered()
+			sq.discard(ErrChannelClosed)
+			return
+		}
+	}
+}
+
+func (sq *sendQueue) write(item sendItem) {
+	if item.done != nil {
+		item.done <- sq.flush()
+		return
+	}
+	if sq.Err() != nil || sq.ended {
+		sq.drop(item)
+		return
+	}
+	// flush what's buffered first, so that bufio never flushes on its own
+	if sq.w.Buffered() > 0 && item.buf.Len() > sq.w.Available() && sq.flush() != nil {
+		sq.drop(item)
+		return
+	}
+	if _, err := sq.w.Write(item.buf.Bytes()); err != nil {
+		sq.setErr(err)
+		sq.drop(item)
+		sq.bounceBuffered()
+		return
+	}
+	putXMLBuf(item.buf)
+	if item.last {
+		sq.ended = true
+	}
+	if item.elem != nil && sq.w.Buffered() > 0 {
+		sq.buffered = append(sq.buffered, item.elem)
+	}
+}
+
+// drop releases an item which is not going to be written, and bounces its stanza
+func (sq *sendQueue) drop(item sendItem) {
+	putXMLBuf(item.buf)
+	if item.elem != nil && sq.conf.Bounce != nil {
+		sq.conf.Bounce(item.elem)
+	}
+}
+
+func (sq *sendQueue) flush() error {
+	if sq.Err() == nil {
+		if err := sq.w.Flush(); err != nil {
+			sq.setErr(err)
+		}
+	}
+	if sq.Err() != nil {
+		sq.bounceBuffered()
+	}
+	sq.buffered = sq.buffered[:0]
+	return sq.Err()
+}
+
+func (sq *sendQueue) bounceBuffered() {
+	if sq.conf.Bounce != nil {
+		for _, elem := range sq.buffered {
+			sq.conf.Bounce(elem)
+		}
+	}
+	sq.buffered = sq.buffered[:0]
+}
+
+// discard drops the queued items, the ones being written are not affected
+func (sq *sendQueue) discard(err error) {
+	for {
+		select {
+		case item := <-sq.items:
+			if item.done != nil {
+				item.done <- err
+			} else {
+				sq.drop(item)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// discardStanzas drops the queued stanzas but keeps stream level data, such as headers,
+// in order. it doesn't block, kept data which has no room anymore because of a flush
+// marker pushed meanwhile is dropped
+func (sq *sendQueue) discardStanzas(err error) {
+	kept := []sendItem{}
+	for drained := false; !drained; {
+		select {
+		case item := <-sq.items:
+			if item.done != nil {
+				item.done <- err
+			} else if item.elem != nil {
+				sq.drop(item)
+			} else {
+				kept = append(kept, item)
+			}
+		default:
+			drained = true
+		}
+	}
+	for _, item := range kept {
+		select {
+		case sq.items <- item:
+		default:
+			sq.drop(item)
+		}
+	}
+}
+
+// push queues buf which is owned by the queue since then. it doesn't block: when the
+// queue is full, a droppable stanza is dropped by SlowConsumerDrop, everything is refused
+// by SlowConsumerClose, and errQueueFull is returned otherwise. a refused stanza is not
+// bounced, the caller is told
+func (sq *sendQueue) push(buf *bytes.Buffer, elem stravaganza.Element, droppable bool) error {
+	item := sendItem{buf: buf, elem: elem}
+	if err := sq.Err(); err != nil {
+		putXMLBuf(buf)
+		return err
+	}
+	select {
+	case sq.items <- item:
+	default:
+		if sq.conf.Policy == SlowConsumerDrop && droppable {
+			atomic.AddUint64(&sq.dropped, 1)
+			putXMLBuf(buf)
+			return nil
+		}
+		if sq.conf.Policy == SlowConsumerClose {
+			putXMLBuf(buf)
+			return ErrSlowConsumer
+		}
+		return errQueueFull
+	}
+	sq.pushed()
+	return nil
+}
+
+// pushWait queues item whatever the policy is, it blocks until the queue has room
+func (sq *sendQueue) pushWait(item sendItem) error {
+	select {
+	case sq.items <- item:
+	case <-sq.quit:
+		putXMLBuf(item.buf)
+		return ErrChannelClosed
+	}
+	sq.pushed()
+	return nil
+}
+
+// pushEnd queues the end of the stream whatever the policy is. it doesn't block, when the
+// queue is full the end waits for room in its own goroutine, until the queue is stopped
+func (sq *sendQueue) pushEnd(buf *bytes.Buffer) {
+	item := sendItem{buf: buf, last: true}
+	select {
+	case sq.items <- item:
+		sq.pushed()
+	default:
+		go sq.pushWait(item)
+	}
+}
+
+// waitRoom blocks until an item is taken from the queue, another pusher may take the room
+// before the one waiting
+func (sq *sendQueue) waitRoom() error {
+	select {
+	case <-sq.room:
+		return nil
+	case <-sq.quit:
+		return ErrChannelClosed
+	}
+}
+
+func (sq *sendQueue) pushed() {
+	atomic.AddUint64(&sq.enqueued, 1)
+	depth := int64(len(sq.items))
+	if depth > atomic.LoadInt64(&sq.maxDepth) {
+		atomic.StoreInt64(&sq.maxDepth, depth)
+	}
+}
+
+// wait blocks until everything queued so far is written
+func (sq *sendQueue) wait() error {
+	done := make(chan error, 1)
+	select {
+	case sq.items <- sendItem{done: done}:
+	case <-sq.quit:
+		return ErrChannelClosed
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-sq.exited:
+		return ErrChannelClosed
+	}
+}
+
+func (sq *sendQueue) stop() {
+	sq.stopOnce.Do(func() {
+		close(sq.quit)
+	})
+}
+
+func (sq *sendQueue) Err() error {
+	sq.errMu.Lock()
+	defer sq.errMu.Unlock()
+	return sq.err
+}
+
+func (sq *sendQueue) setErr(err error) {
+	sq.errMu.Lock()
+	defer sq.errMu.Unlock()
+	if sq.err == nil {
+		sq.err = err
+	}
+}
+
+func (sq *sendQueue) stats() SendQueueStats {
+	return SendQueueStats{
+		Depth:    len(sq.items),
+		MaxDepth: int(atomic.LoadInt64(&sq.maxDepth)),
+		Enqueued: atomic.LoadUint64(&sq.enqueued),
+		Dropped:  atomic.LoadUint64(&sq.dropped),
+		Written:  atomic.LoadUint64(&sq.written),
+		Writes:   atomic.LoadUint64(&sq.writes),
+	}
+}
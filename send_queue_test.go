@@ -0,0 +1,194 @@
+package xmppcore
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+func openTestChannel(t *testing.T, config SendQueueConfig) (*XChannel, *LocalConn) {
+	pair := NewLocalConnPair(NewLocalConnAddr(":1"), NewLocalConnAddr(":2"))
+	xc := NewXChannel(pair[0], true)
+	xc.SetSendQueueConfig(config)
+	if err := xc.Open(&PartAttr{ID: "1", Domain: "hello-world.im", Version: "1.0"}); err != nil {
+		t.Fatalf("open channel error: %s", err.Error())
+	}
+	return xc, pair[1]
+}
+
+// readTestStanzas counts the stanzas by name until the end of the stream
+func readTestStanzas(conn *LocalConn) chan map[string]int {
+	res := make(chan map[string]int, 1)
+	go func() {
+		counts := map[string]int{}
+		p := NewFastParser(conn, 1024*1024)
+		for {
+			i, err := p.Next()
+			if err != nil {
+				break
+			}
+			if _, ok := i.(xml.EndElement); ok {
+				break
+			}
+			if elem, ok := i.(stravaganza.Element); ok {
+				counts[elem.Name()]++
+			}
+		}
+		res <- counts
+	}()
+	return res
+}
+
+func TestXChannelConcurrentSend(t *testing.T) {
+	const senders, stanzas = 8, 200
+	xc, peer := openTestChannel(t, DefaultSendQueueConfig)
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < stanzas; j++ {
+				xc.SendElement(stravaganza.NewBuilder("message").
+					WithAttribute("id", fmt.Sprintf("%d-%d", i, j)).
+					WithChild(stravaganza.NewBuilder("body").WithText("wherefore art thou").Build()).Build())
+			}
+		}(i)
+	}
+	received := make(chan error, 1)
+	go func() {
+		p := NewFastParser(peer, 1024*1024)
+		next := make([]int, senders)
+		for count := 0; count < senders*stanzas; {
+			i, err := p.Next()
+			if err != nil {
+				received <- err
+				return
+			}
+			elem, ok := i.(stravaganza.Element)
+			if !ok {
+				continue
+			}
+			var s, n int
+			fmt.Sscanf(elem.Attribute("id"), "%d-%d", &s, &n)
+			if n != next[s] || elem.Child("body") == nil {
+				received <- fmt.Errorf("stanza %s interleaved or out of order", elem.GoString())
+				return
+			}
+			next[s]++
+			count++
+		}
+		received <- nil
+	}()
+	wg.Wait()
+	if err := <-received; err != nil {
+		t.Fatalf("receive stanzas error: %s", err.Error())
+	}
+	if err := xc.Flush(); err != nil {
+		t.Fatalf("flush error: %s", err.Error())
+	}
+	stats := xc.SendQueueStats()
+	if stats.Enqueued != senders*stanzas+1 || stats.Depth != 0 || stats.Writes == 0 || stats.Writes > stats.Enqueued {
+		t.Fatalf("send queue stats error: %#v", stats)
+	}
+}
+
+func TestXChannelDropSlowConsumer(t *testing.T) {
+	config := DefaultSendQueueConfig
+	config.Size = 2
+	config.CoalesceSize = 16
+	config.Policy = SlowConsumerDrop
+	xc, peer := openTestChannel(t, config)
+	// nobody reads, the first write blocks and the queue is soon full
+	for i := 0; i < 10; i++ {
+		if err := xc.SendElement(stravaganza.NewBuilder("presence").Build()); err != nil {
+			t.Fatalf("droppable stanza should be dropped silently, got %s", err.Error())
+		}
+	}
+	stats := xc.SendQueueStats()
+	if stats.Dropped < 8 || stats.Enqueued+stats.Dropped != 11 {
+		t.Fatalf("send queue stats error: %#v", stats)
+	}
+	counts := readTestStanzas(peer)
+	xc.SendElement(stravaganza.NewBuilder("message").
+		WithChild(stravaganza.NewBuilder("body").WithText("must arrive").Build()).Build())
+	xc.Close()
+	got := <-counts
+	if got["presence"] != 10-int(stats.Dropped) || got["message"] != 1 {
+		t.Fatalf("received %v, while %d presences dropped", got, stats.Dropped)
+	}
+}
+
+func TestXChannelCloseSlowConsumer(t *testing.T) {
+	config := DefaultSendQueueConfig
+	config.Size = 2
+	config.CoalesceSize = 16
+	config.Policy = SlowConsumerClose
+	xc, peer := openTestChannel(t, config)
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = xc.SendElement(stravaganza.NewBuilder("message").Build())
+	}
+	if err != ErrSlowConsumer {
+		t.Fatalf("require slow consumer error, got %v", err)
+	}
+	if err := xc.SendElement(stravaganza.NewBuilder("message").Build()); err != ErrChannelClosed {
+		t.Fatalf("channel should be closed, got %v", err)
+	}
+	client := NewXChannel(peer, false)
+	var head xml.StartElement
+	if err := client.WaitHeader(&head); err != nil {
+		t.Fatalf("wait header error: %s", err.Error())
+	}
+	for err == ErrSlowConsumer || err == nil {
+		var elem stravaganza.Element
+		err = client.NextElement(&elem)
+	}
+	var se StreamError
+	if !errors.As(err, &se) || se.Condition != SEResourceConstraint {
+		t.Fatalf("require resource-constraint stream error, got %v", err)
+	}
+}
+
+func TestXChannelBlockedSenderDoesntBlockClose(t *testing.T) {
+	config := DefaultSendQueueConfig
+	config.Size = 2
+	config.CoalesceSize = 16
+	xc, _ := openTestChannel(t, config)
+	xc.WaitSecOnClose(1)
+	// nobody reads, the sender blocks once the queue is full
+	sent := make(chan error, 1)
+	go func() {
+		var err error
+		for err == nil {
+			err = xc.SendElement(stravaganza.NewBuilder("message").
+				WithChild(stravaganza.NewBuilder("body").WithText("wherefore art thou").Build()).Build())
+		}
+		sent <- err
+	}()
+	for xc.SendQueueStats().Depth < config.Size {
+		time.Sleep(time.Millisecond)
+	}
+	closed := make(chan error, 1)
+	go func() {
+		xc.Activity()
+		closed <- xc.CloseWithStreamError(StreamError{Condition: SESystemShutdown})
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("close shouldn't wait on the blocked sender")
+	}
+	select {
+	case err := <-sent:
+		if err != ErrChannelClosed {
+			t.Fatalf("blocked sender should be told the channel is closed, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("blocked sender should quit once the conn is closed")
+	}
+}
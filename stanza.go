@@ -43,29 +43,131 @@ type ElementableError interface {
 	ToElem(*stravaganza.Element)
 }
 
-type ErrDesc struct {
-	Tag   string
-	Xmlns string
+// rfc6120 section 8.3
+
+const (
+	NSStanza = "urn:ietf:params:xml:ns:xmpp-stanzas"
+
+	ETAuth     = "auth"
+	ETCancel   = "cancel"
+	ETContinue = "continue"
+	ETModify   = "modify"
+	ETWait     = "wait"
+
+	ECBadRequest            = "bad-request"
+	ECConflict              = "conflict"
+	ECFeatureNotImplemented = "feature-not-implemented"
+	ECForbidden             = "forbidden"
+	ECGone                  = "gone"
+	ECInternalServerError   = "internal-server-error"
+	ECItemNotFound          = "item-not-found"
+	ECJIDMalformed          = "jid-malformed"
+	ECNotAcceptable         = "not-acceptable"
+	ECNotAllowed            = "not-allowed"
+	ECNotAuthorized         = "not-authorized"
+	ECPolicyViolation       = "policy-violation"
+	ECRecipientUnavailable  = "recipient-unavailable"
+	ECRedirect              = "redirect"
+	ECRegistrationRequired  = "registration-required"
+	ECRemoteServerNotFound  = "remote-server-not-found"
+	ECRemoteServerTimeout   = "remote-server-timeout"
+	ECResourceConstraint    = "resource-constraint"
+	ECServiceUnavailable    = "service-unavailable"
+	ECSubscriptionRequired  = "subscription-required"
+	ECUndefinedCondition    = "undefined-condition"
+	ECUnexpectedRequest     = "unexpected-request"
+)
+
+// DefaultErrTypes are the error types rfc6120 8.3.3 suggests for each defined condition
+var DefaultErrTypes = map[string]string{
+	ECBadRequest:            ETModify,
+	ECConflict:              ETCancel,
+	ECFeatureNotImplemented: ETCancel,
+	ECForbidden:             ETAuth,
+	ECGone:                  ETCancel,
+	ECInternalServerError:   ETCancel,
+	ECItemNotFound:          ETCancel,
+	ECJIDMalformed:          ETModify,
+	ECNotAcceptable:         ETModify,
+	ECNotAllowed:            ETCancel,
+	ECNotAuthorized:         ETAuth,
+	ECPolicyViolation:       ETModify,
+	ECRecipientUnavailable:  ETWait,
+	ECRedirect:              ETModify,
+	ECRegistrationRequired:  ETAuth,
+	ECRemoteServerNotFound:  ETCancel,
+	ECRemoteServerTimeout:   ETWait,
+	ECResourceConstraint:    ETWait,
+	ECServiceUnavailable:    ETCancel,
+	ECSubscriptionRequired:  ETAuth,
+	ECUndefinedCondition:    ETCancel,
+	ECUnexpectedRequest:     ETWait,
 }
 
+// Err is the <error/> child of a stanza. Redirect is the alternate address of gone and
+// redirect, App is an optional application specific condition
 type Err struct {
-	Type string
-	Desc []ErrDesc
+	Type      string
+	By        string
+	Condition string
+	Redirect  string
+	Text      string
+	Lang      string
+	App       stravaganza.Element
+	cause     error
 }
 
-type Stanza struct {
-	Name string
-	Type StanzaType
-	ID   string
-	From string
-	To   string
+// NewErr creates a stanza error of condition with the default type of the condition
+func NewErr(condition, text string) Err {
+	err := Err{Type: DefaultErrTypes[condition], Condition: condition, Text: text}
+	if err.Type == "" {
+		err.Type = ETCancel
+	}
+	if text != "" {
+		err.Lang = "en"
+	}
+	return err
+}
+
+// WrapErr creates a stanza error of condition caused by cause, the cause is reachable with
+// errors.Is and errors.As but never sent to the peer
+func WrapErr(condition string, cause error) Err {
+	err := NewErr(condition, "")
+	err.cause = cause
+	return err
+}
+
+// ErrFromError finds the stanza error in the chain of err. errors not meant for the peer
+// become an internal-server-error
+func ErrFromError(err error) Err {
+	var se Err
+	var jidErr *JIDError
+	switch {
+	case errors.As(err, &se):
+		return se
+	case errors.As(err, &jidErr):
+		return WrapErr(jidErr.Condition(), err)
+	}
+	return WrapErr(ECInternalServerError, err)
 }
 
 func (err *Err) FromElem(elem stravaganza.Element) {
-	err.Type = elem.Attribute("type")
-	err.Desc = []ErrDesc{}
-	for _, desc := range elem.AllChildren() {
-		err.Desc = append(err.Desc, ErrDesc{Tag: desc.Name(), Xmlns: desc.Attribute("xmlns")})
+	*err = Err{Type: elem.Attribute("type"), By: elem.Attribute("by")}
+	for _, child := range elem.AllChildren() {
+		if child.Attribute("xmlns") != NSStanza {
+			err.App = child
+		} else if child.Name() == "text" {
+			err.Text = child.Text()
+			err.Lang = child.Attribute("xml:lang")
+		} else {
+			err.Condition = child.Name()
+			if err.Condition == ECGone || err.Condition == ECRedirect {
+				err.Redirect = child.Text()
+			}
+		}
+	}
+	if err.Condition == "" {
+		err.Condition = ECUndefinedCondition
 	}
 }
 
@@ -74,24 +176,56 @@ func (err Err) ToElem(elem *stravaganza.Element) {
 	if err.Type != "" {
 		ee.WithAttribute("type", err.Type)
 	}
-	elems := []stravaganza.Element{}
-	for _, desc := range err.Desc {
-		elems = append(elems, stravaganza.NewBuilder(desc.Tag).WithAttribute("xmlns", desc.Xmlns).Build())
+	if err.By != "" {
+		ee.WithAttribute("by", err.By)
+	}
+	cond := stravaganza.NewBuilder(err.Condition).WithAttribute("xmlns", NSStanza)
+	if err.Redirect != "" && (err.Condition == ECGone || err.Condition == ECRedirect) {
+		cond.WithText(err.Redirect)
+	}
+	ee.WithChild(cond.Build())
+	if err.Text != "" {
+		text := stravaganza.NewBuilder("text").WithAttribute("xmlns", NSStanza).WithText(err.Text)
+		if err.Lang != "" {
+			text.WithAttribute("xml:lang", err.Lang)
+		}
+		ee.WithChild(text.Build())
+	}
+	if err.App != nil {
+		ee.WithChild(err.App)
 	}
-	*elem = ee.WithChildren(elems...).Build()
+	*elem = ee.Build()
 }
 
 func (err Err) Error() string {
-	msg := ""
-	for i, desc := range err.Desc {
-		if i < len(err.Desc)-1 {
-			msg = msg + ":"
-		}
-		msg = msg + strings.ReplaceAll(desc.Tag, "-", " ")
+	msg := err.Type + ": " + strings.ReplaceAll(err.Condition, "-", " ")
+	if err.Text != "" {
+		msg = msg + ": " + err.Text
+	}
+	if err.cause != nil {
+		msg = msg + ": " + err.cause.Error()
 	}
 	return msg
 }
 
+func (err Err) Unwrap() error {
+	return err.cause
+}
+
+type Stanza struct {
+	Name string
+	Type StanzaType
+	ID   string
+	From string
+	To   string
+}
+
+// IsStanza tells message, presence and iq from the other top level elements
+func IsStanza(elem stravaganza.Element) bool {
+	name := elem.Name()
+	return name == NameMsg || name == NamePresence || name == NameIQ
+}
+
 func (stanza *Stanza) FromElem(elem stravaganza.Element, name string) error {
 	stanza.Name = elem.Name()
 	if stanza.Name != name {
@@ -144,7 +278,7 @@ func (f *Failure) FromElem(elem stravaganza.Element, xmlns string) error {
 }
 
 func (f Failure) ToElem(elem *stravaganza.Element) {
-	err := []stravaganza.Element{stravaganza.NewBuilder(f.DescTag).WithAttribute("xmlns", f.Xmlns).Build()}
+	err := []stravaganza.Element{stravaganza.NewBuilder(f.DescTag).Build()}
 	if f.More != "" {
 		more := stravaganza.NewBuilder("text").WithText(f.More)
 		if f.MoreLang != "" {
@@ -152,11 +286,15 @@ func (f Failure) ToElem(elem *stravaganza.Element) {
 		}
 		err = append(err, more.Build())
 	}
-	*elem = stravaganza.NewBuilder("failure").WithChildren(err...).Build()
+	*elem = stravaganza.NewBuilder("failure").WithAttribute("xmlns", f.Xmlns).WithChildren(err...).Build()
 }
 
 func (f Failure) Error() string {
-	return strings.ReplaceAll(f.DescTag, "-", " ")
+	msg := strings.ReplaceAll(f.DescTag, "-", " ")
+	if f.More != "" {
+		msg = msg + ": " + f.More
+	}
+	return msg
 }
 
 type StanzaErr struct {
@@ -170,6 +308,39 @@ func (se StanzaErr) ToElem(elem *stravaganza.Element) {
 	*elem = se.Stanza.ToElemBuilder().WithChild(err).Build()
 }
 
+// ReplyErr is the error reply of stanza caused by err, addressed back to the sender of
+// stanza with the original id. a stanza of type error must never be replied
+func ReplyErr(stanza stravaganza.Element, err error) StanzaErr {
+	return StanzaErr{
+		Stanza: Stanza{
+			Name: stanza.Name(),
+			Type: TypeError,
+			ID:   stanza.Attribute("id"),
+			From: stanza.Attribute("to"),
+			To:   stanza.Attribute("from"),
+		},
+		Err: ErrFromError(err),
+	}
+}
+
+// SendErrReply sends the error reply of stanza caused by err
+func SendErrReply(part Part, stanza stravaganza.Element, err error) error {
+	if StanzaType(stanza.Attribute("type")) == TypeError {
+		return nil
+	}
+	var elem stravaganza.Element
+	ReplyErr(stanza, err).ToElem(&elem)
+	return part.Channel().SendElement(elem)
+}
+
+func (se StanzaErr) Error() string {
+	return se.Err.Error()
+}
+
+func (se StanzaErr) Unwrap() error {
+	return se.Err
+}
+
 func (se *StanzaErr) FromElem(elem stravaganza.Element, name string) error {
 	if err := se.Stanza.FromElem(elem, name); err != nil {
 		return err
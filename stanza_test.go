@@ -0,0 +1,116 @@
+package xmppcore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+func parseTestElem(t *testing.T, elem stravaganza.Element) stravaganza.Element {
+	_, elems := parseTestStream(func(r io.Reader, size int) ElementParser { return NewFastParser(r, size) }, elem.GoString())
+	if len(elems) != 1 {
+		t.Fatalf("require 1 element from %s, got %d", elem.GoString(), len(elems))
+	}
+	return elems[0]
+}
+
+func TestErrDefaultType(t *testing.T) {
+	for cond, typ := range DefaultErrTypes {
+		if err := NewErr(cond, ""); err.Type != typ || err.Condition != cond {
+			t.Fatalf("%s should be of type %s, got %s", cond, typ, err.Type)
+		}
+	}
+	if err := NewErr("x-unknown", ""); err.Type != ETCancel {
+		t.Fatalf("unknown condition should be of type cancel, got %s", err.Type)
+	}
+}
+
+func TestErrElem(t *testing.T) {
+	app := stravaganza.NewBuilder("unsupported").WithAttribute("xmlns", "http://jabber.org/protocol/pubsub#errors").Build()
+	cases := []Err{
+		NewErr(ECItemNotFound, ""),
+		{Type: ETModify, Condition: ECBadRequest, Text: "missing id", Lang: "en", App: app, By: "example.net"},
+		{Type: ETCancel, Condition: ECGone, Redirect: "xmpp:romeo@afterlife.example.net"},
+	}
+	for _, c := range cases {
+		var elem stravaganza.Element
+		c.ToElem(&elem)
+		var err Err
+		err.FromElem(parseTestElem(t, elem))
+		if err.Type != c.Type || err.Condition != c.Condition || err.Text != c.Text ||
+			err.Lang != c.Lang || err.By != c.By || err.Redirect != c.Redirect {
+			t.Fatalf("stanza error %s parsed as %#v", elem.GoString(), err)
+		}
+		if (c.App == nil) != (err.App == nil) || c.App != nil && err.App.Name() != c.App.Name() {
+			t.Fatalf("app specific condition of %s error", elem.GoString())
+		}
+	}
+}
+
+func TestErrFromError(t *testing.T) {
+	cause := errors.New("roster storage down")
+	cases := []struct {
+		err       error
+		condition string
+	}{
+		{fmt.Errorf("roster: %w", NewErr(ECItemNotFound, "")), ECItemNotFound},
+		{WrapErr(ECServiceUnavailable, cause), ECServiceUnavailable},
+		{&JIDError{Part: JIDResourcepart, Err: ErrJIDEmptyPart}, ECJIDMalformed},
+		{BEConflict, ECConflict},
+		{cause, ECInternalServerError},
+	}
+	for _, c := range cases {
+		if err := ErrFromError(c.err); err.Condition != c.condition {
+			t.Fatalf("%v should map to %s, got %s", c.err, c.condition, err.Condition)
+		}
+	}
+	if err := ErrFromError(cause); !errors.Is(err, cause) || err.Text != "" {
+		t.Fatalf("internal errors should be wrapped but not told to the peer: %#v", err)
+	}
+}
+
+func TestReplyErr(t *testing.T) {
+	iq := stravaganza.NewBuilder("iq").
+		WithAttribute("type", "get").
+		WithAttribute("id", "roster_1").
+		WithAttribute("from", "juliet@example.com/balcony").
+		WithAttribute("to", "example.com").Build()
+	var elem stravaganza.Element
+	ReplyErr(iq, NewErr(ECFeatureNotImplemented, "")).ToElem(&elem)
+	var se StanzaErr
+	if err := se.FromElem(parseTestElem(t, elem), NameIQ); err != nil {
+		t.Fatalf("parse error reply %s error: %s", elem.GoString(), err.Error())
+	}
+	if se.Stanza.ID != "roster_1" || se.Stanza.To != "juliet@example.com/balcony" || se.Stanza.From != "example.com" {
+		t.Fatalf("error reply addressing error: %s", elem.GoString())
+	}
+	var err Err
+	if !errors.As(se, &err) || err.Condition != ECFeatureNotImplemented || err.Type != ETCancel {
+		t.Fatalf("error reply condition error: %s", elem.GoString())
+	}
+}
+
+func TestSaslFailureElemFromError(t *testing.T) {
+	cases := []struct {
+		err     error
+		failure string
+		text    string
+	}{
+		{SaslFailureError(SFNotAuthorized, "password error"), SFNotAuthorized, "password error"},
+		{fmt.Errorf("plain: %w", SaslFailureError(SFIncorrectEncoding, "")), SFIncorrectEncoding, ""},
+		{errors.New("no colon at all"), SFTemporaryAuthFailure, ""},
+		{errors.New("not authorized: but not typed"), SFTemporaryAuthFailure, ""},
+	}
+	for _, c := range cases {
+		var f Failure
+		if err := f.FromElem(parseTestElem(t, SaslFailureElemFromError(c.err)), NSSasl); err != nil {
+			t.Fatalf("parse failure of %v error: %s", c.err, err.Error())
+		}
+		if f.DescTag != c.failure || f.More != c.text {
+			t.Fatalf("%v should be %s failure, got %#v", c.err, c.failure, f)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package xmppcore
+
+import (
+	"encoding/xml"
+	"errors"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+// rfc6120 section 4.9
+
+const (
+	NSStreamError = "urn:ietf:params:xml:ns:xmpp-streams"
+
+	SEBadFormat              = "bad-format"
+	SEBadNamespacePrefix     = "bad-namespace-prefix"
+	SEConflict               = "conflict"
+	SEConnectionTimeout      = "connection-timeout"
+	SEHostGone               = "host-gone"
+	SEHostUnknown            = "host-unknown"
+	SEImproperAddressing     = "improper-addressing"
+	SEInternalServerError    = "internal-server-error"
+	SEInvalidFrom            = "invalid-from"
+	SEInvalidNamespace       = "invalid-namespace"
+	SEInvalidXML             = "invalid-xml"
+	SENotAuthorized          = "not-authorized"
+	SENotWellFormed          = "not-well-formed"
+	SEPolicyViolation        = "policy-violation"
+	SERemoteConnectionFailed = "remote-connection-failed"
+	SEReset                  = "reset"
+	SEResourceConstraint     = "resource-constraint"
+	SERestrictedXML          = "restricted-xml"
+	SESeeOtherHost           = "see-other-host"
+	SESystemShutdown         = "system-shutdown"
+	SEUndefinedCondition     = "undefined-condition"
+	SEUnsupportedEncoding    = "unsupported-encoding"
+	SEUnsupportedFeature     = "unsupported-feature"
+	SEUnsupportedStanzaType  = "unsupported-stanza-type"
+	SEUnsupportedVersion     = "unsupported-version"
+)
+
+var AllStreamErrors = []string{
+	SEBadFormat,
+	SEBadNamespacePrefix,
+	SEConflict,
+	SEConnectionTimeout,
+	SEHostGone,
+	SEHostUnknown,
+	SEImproperAddressing,
+	SEInternalServerError,
+	SEInvalidFrom,
+	SEInvalidNamespace,
+	SEInvalidXML,
+	SENotAuthorized,
+	SENotWellFormed,
+	SEPolicyViolation,
+	SERemoteConnectionFailed,
+	SEReset,
+	SEResourceConstraint,
+	SERestrictedXML,
+	SESeeOtherHost,
+	SESystemShutdown,
+	SEUndefinedCondition,
+	SEUnsupportedEncoding,
+	SEUnsupportedFeature,
+	SEUnsupportedStanzaType,
+	SEUnsupportedVersion}
+
+var ErrNotStreamError = errors.New("parsed element not a stream error")
+
+// StreamError is an unrecoverable error of a stream. OtherHost is the alternate host of
+// see-other-host, App is an optional application specific condition
+type StreamError struct {
+	Condition string
+	Text      string
+	Lang      string
+	OtherHost string
+	App       stravaganza.Element
+}
+
+func (se StreamError) Error() string {
+	msg := "stream error: " + se.Condition
+	if se.OtherHost != "" {
+		msg = msg + " " + se.OtherHost
+	}
+	if se.Text != "" {
+		msg = msg + ": " + se.Text
+	}
+	return msg
+}
+
+func (se StreamError) ToElem(elem *stravaganza.Element) {
+	cond := stravaganza.NewBuilder(se.Condition).WithAttribute("xmlns", NSStreamError)
+	if se.Condition == SESeeOtherHost {
+		cond.WithText(se.OtherHost)
+	}
+	children := []stravaganza.Element{cond.Build()}
+	if se.Text != "" {
+		text := stravaganza.NewBuilder("text").WithAttribute("xmlns", NSStreamError).WithText(se.Text)
+		if se.Lang != "" {
+			text.WithAttribute("xml:lang", se.Lang)
+		}
+		children = append(children, text.Build())
+	}
+	if se.App != nil {
+		children = append(children, se.App)
+	}
+	*elem = stravaganza.NewBuilder("error").
+		WithAttribute("xmlns", NSStream).
+		WithChildren(children...).Build()
+}
+
+func (se *StreamError) FromElem(elem stravaganza.Element) error {
+	if elem.Name() != "error" || elem.Attribute("xmlns") != NSStream {
+		return ErrNotStreamError
+	}
+	*se = StreamError{}
+	for _, child := range elem.AllChildren() {
+		if child.Attribute("xmlns") != NSStreamError {
+			se.App = child
+		} else if child.Name() == "text" {
+			se.Text = child.Text()
+			se.Lang = child.Attribute("xml:lang")
+		} else {
+			se.Condition = child.Name()
+			if se.Condition == SESeeOtherHost {
+				se.OtherHost = child.Text()
+			}
+		}
+	}
+	if se.Condition == "" {
+		se.Condition = SEUndefinedCondition
+	}
+	return nil
+}
+
+// StreamErrorFromError maps errors of parsing a stream or its header to stream errors. errors
+// which are not a fault of the peer, such as io errors, are not mapped
+func StreamErrorFromError(err error) (StreamError, bool) {
+	var se StreamError
+	var pe *ParserError
+	var jidErr *JIDError
+	var syntaxErr *xml.SyntaxError
+	switch {
+	case errors.As(err, &se):
+		return se, true
+	case errors.As(err, &pe):
+		return StreamError{Condition: pe.Condition, Text: pe.Err.Error()}, true
+	case errors.As(err, &jidErr):
+		return StreamError{Condition: SEInvalidFrom, Text: jidErr.Error()}, true
+	case errors.As(err, &syntaxErr):
+		return StreamError{Condition: SENotWellFormed, Text: syntaxErr.Msg}, true
+	case errors.Is(err, ErrTooLargeStanza):
+		return StreamError{Condition: SEPolicyViolation}, true
+	case errors.Is(err, ErrUnboundPrefix):
+		return StreamError{Condition: SEBadNamespacePrefix}, true
+	case errors.Is(err, ErrNotForThisDomainHead):
+		return StreamError{Condition: SEHostUnknown}, true
+	case errors.Is(err, ErrNotHeaderStart):
+		return StreamError{Condition: SEInvalidNamespace}, true
+	case errors.Is(err, ErrUnproperFromAttr):
+		return StreamError{Condition: SEInvalidFrom}, true
+	case errors.Is(err, ErrUnexpectedToken), errors.Is(err, ErrNoElement):
+		return StreamError{Condition: SEBadFormat}, true
+	}
+	return se, false
+}
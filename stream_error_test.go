@@ -0,0 +1,106 @@
+package xmppcore
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+func TestStreamErrorElem(t *testing.T) {
+	app := stravaganza.NewBuilder("too-many-hosts").WithAttribute("xmlns", "urn:example:app").Build()
+	cases := []StreamError{
+		{Condition: SEHostUnknown},
+		{Condition: SEPolicyViolation, Text: "too large", Lang: "en", App: app},
+		{Condition: SESeeOtherHost, OtherHost: "[2001:41D0:1:A49b::1]:9222"},
+	}
+	for _, c := range cases {
+		var elem stravaganza.Element
+		c.ToElem(&elem)
+		_, elems := parseTestStream(func(r io.Reader, size int) ElementParser { return NewFastParser(r, size) }, elem.GoString())
+		if len(elems) != 1 {
+			t.Fatalf("require 1 element from %s, got %d", elem.GoString(), len(elems))
+		}
+		var se StreamError
+		if err := se.FromElem(elems[0]); err != nil {
+			t.Fatalf("parse stream error %s error: %s", elems[0].GoString(), err.Error())
+		}
+		if se.Condition != c.Condition || se.Text != c.Text || se.Lang != c.Lang || se.OtherHost != c.OtherHost {
+			t.Fatalf("stream error %s parsed as %#v", elem.GoString(), se)
+		}
+		if (c.App == nil) != (se.App == nil) || c.App != nil && se.App.Name() != c.App.Name() {
+			t.Fatalf("app specific condition of %s error", elem.GoString())
+		}
+	}
+	var se StreamError
+	if err := se.FromElem(stravaganza.NewBuilder("error").WithAttribute("xmlns", NSClient).Build()); err != ErrNotStreamError {
+		t.Fatalf("stanza error should not be a stream error")
+	}
+}
+
+func TestStreamErrorFromError(t *testing.T) {
+	cases := []struct {
+		err       error
+		condition string
+	}{
+		{StreamError{Condition: SEConflict}, SEConflict},
+		{restrictedXMLError(ErrXMLComment), SERestrictedXML},
+		{policyViolationError(ErrTooDeepElement), SEPolicyViolation},
+		{&xml.SyntaxError{Msg: "unexpected EOF"}, SENotWellFormed},
+		{fmt.Errorf("header: %w", &JIDError{Part: JIDLocalpart, Err: ErrJIDEmptyPart}), SEInvalidFrom},
+		{ErrTooLargeStanza, SEPolicyViolation},
+		{ErrUnboundPrefix, SEBadNamespacePrefix},
+		{ErrNotForThisDomainHead, SEHostUnknown},
+		{ErrNotHeaderStart, SEInvalidNamespace},
+		{ErrUnexpectedToken, SEBadFormat},
+	}
+	for _, c := range cases {
+		se, ok := StreamErrorFromError(c.err)
+		if !ok || se.Condition != c.condition {
+			t.Fatalf("%v should map to %s, got %v", c.err, c.condition, se)
+		}
+	}
+	for _, err := range []error{io.EOF, ErrChannelClosed, errors.New("handler failed")} {
+		if _, ok := StreamErrorFromError(err); ok {
+			t.Fatalf("%v should not map to a stream error", err)
+		}
+	}
+}
+
+func TestXPartSendsStreamError(t *testing.T) {
+	header := `<?xml version='1.0'?><stream:stream xmlns:stream="http://etherx.jabber.org/streams" xmlns="jabber:client" version="1.0" to="%s">`
+	cases := []struct {
+		src       string
+		condition string
+	}{
+		{fmt.Sprintf(header, "other.im"), SEHostUnknown},
+		{fmt.Sprintf(header, "hello-world.im") + `<message><body></message>`, SENotWellFormed},
+		{fmt.Sprintf(header, "hello-world.im") + `<message><x:body/></message>`, SEBadNamespacePrefix},
+		{`<?xml version='1.0'?><stream xmlns="jabber:client" version="1.0" to="hello-world.im">`, SEInvalidNamespace},
+	}
+	for _, c := range cases {
+		pair := NewLocalConnPair(NewLocalConnAddr(":1"), NewLocalConnAddr(":2"))
+		part := NewXPart(pair[0], "hello-world.im", NewLogger(io.Discard))
+		part.Run()
+		if _, err := pair[1].Write([]byte(c.src)); err != nil {
+			t.Fatalf("write stream error: %s", err.Error())
+		}
+		client := NewXChannel(pair[1], false)
+		var head xml.StartElement
+		if err := client.WaitHeader(&head); err != nil {
+			t.Fatalf("%s: wait header error: %s", c.src, err.Error())
+		}
+		var err error
+		for err == nil {
+			var elem stravaganza.Element
+			err = client.NextElement(&elem)
+		}
+		var se StreamError
+		if !errors.As(err, &se) || se.Condition != c.condition {
+			t.Fatalf("%s: require stream error %s, got %v", c.src, c.condition, err)
+		}
+	}
+}
@@ -1,15 +1,14 @@
 package xmppcore
 
 import (
-	"crypto/tls"
-
 	"github.com/jackal-xmpp/stravaganza/v2"
 )
 
 type tlsFeature struct {
-	certFile  string
-	keyFile   string
-	mandatory bool
+	certs       *CertStore
+	certErr     error
+	mandatory   bool
+	clientCerts ClientCertPolicy
 
 	handled bool
 	IDAble
@@ -23,15 +22,29 @@ const (
 	NSTls = "urn:ietf:params:xml:ns:xmpp-tls"
 )
 
+// TlsFeature loads the certificate once, use CertsTlsFeature to share a store among parts
 func TlsFeature(certFile, keyFile string, mandatory bool) tlsFeature {
+	certs := NewCertStore()
+	err := certs.AddFile(certFile, keyFile)
+	tf := CertsTlsFeature(certs, mandatory)
+	tf.certErr = err
+	return tf
+}
+
+// CertsTlsFeature picks the certificate by sni from the store, which is reloaded apart
+func CertsTlsFeature(certs *CertStore, mandatory bool) tlsFeature {
 	return tlsFeature{
-		certFile:  certFile,
-		keyFile:   keyFile,
+		certs:     certs,
 		mandatory: mandatory,
 		handled:   false,
 		IDAble:    CreateIDAble()}
 }
 
+// RequestClientCerts asks the client for a certificate by the policy after starttls
+func (tf *tlsFeature) RequestClientCerts(policy ClientCertPolicy) {
+	tf.clientCerts = policy
+}
+
 func (tf tlsFeature) Elem() stravaganza.Element {
 	elem := stravaganza.NewBuilder("starttls").
 		WithAttribute("xmlns", NSTls)
@@ -52,15 +65,21 @@ func (tf *tlsFeature) Handle(elem stravaganza.Element, part Part) (catched bool,
 		return false, nil
 	}
 	tf.handled = true
-	cert, err := tls.LoadX509KeyPair(tf.certFile, tf.keyFile)
+	catched = true
+	if err = tf.certErr; err == nil && len(tf.certs.Domains()) == 0 {
+		err = ErrNoCertificate
+	}
 	if err != nil {
 		part.Channel().SendElement(TlsFailureElem())
-		part.Logger().Printf(LogError, "create tls cert error: %s\n", err.Error())
+		part.Logger().Log(LogError, "create tls cert error", Field(LogKeyErr, err))
 		return
 	}
 	msg := stravaganza.NewBuilder("proceed").WithAttribute("xmlns", NSTls).Build()
 	part.Channel().SendElement(msg)
-	part.Conn().StartTLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+	if err = part.Channel().Flush(); err != nil {
+		return
+	}
+	part.Conn().StartTLS(tf.clientCerts.apply(tf.certs.TLSConfig()))
 	return
 }
 
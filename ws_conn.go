@@ -0,0 +1,153 @@
+package xmppcore
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// rfc7395 3.1
+const WsSubprotocol = "xmpp"
+
+var (
+	ErrWsBinaryFrame = errors.New("websocket binary frame, xmpp requires text frames")
+)
+
+const wsControlTimeout = time.Second * 5
+
+// WsConn is a conn over a websocket as rfc7395 defines. what's written is split into top
+// level elements, each one is sent in a text frame. a whitespace keepalive is sent as a
+// ping frame, as it's not allowed in a text frame
+type WsConn struct {
+	ws *websocket.Conn
+	// the rest of the frame being read
+	reader    io.Reader
+	framer    elemFramer
+	wmu       sync.Mutex
+	closeOnce sync.Once
+	// the client told by a trusted proxy
+	remote  net.Addr
+	release func()
+}
+
+func NewWsConn(ws *websocket.Conn) *WsConn {
+	return &WsConn{ws: ws}
+}
+
+// IsWsRequest tells a websocket handshake which asks for the xmpp subprotocol
+func IsWsRequest(r *http.Request) bool {
+	if !websocket.IsWebSocketUpgrade(r) {
+		return false
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if protocol == WsSubprotocol {
+			return true
+		}
+	}
+	return false
+}
+
+func (wc *WsConn) Read(b []byte) (int, error) {
+	for {
+		if wc.reader == nil {
+			typ, r, err := wc.ws.NextReader()
+			if err != nil {
+				if _, ok := err.(*websocket.CloseError); ok {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if typ != websocket.TextMessage {
+				return 0, ErrWsBinaryFrame
+			}
+			wc.reader = r
+		}
+		n, err := wc.reader.Read(b)
+		if err == io.EOF {
+			wc.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (wc *WsConn) Write(b []byte) (int, error) {
+	wc.wmu.Lock()
+	defer wc.wmu.Unlock()
+	err := wc.framer.write(b, func(frame []byte) error {
+		if isXMLSpace(frame) {
+			return wc.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsControlTimeout))
+		}
+		return wc.ws.WriteMessage(websocket.TextMessage, frame)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends a close frame and closes the conn, the close element must be sent before
+func (wc *WsConn) Close() error {
+	wc.closeOnce.Do(func() {
+		if wc.release != nil {
+			wc.release()
+		}
+		wc.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(wsControlTimeout))
+	})
+	return wc.ws.Close()
+}
+
+func (wc *WsConn) framed() bool {
+	return true
+}
+
+func (wc *WsConn) LocalAddr() net.Addr {
+	return wc.ws.LocalAddr()
+}
+
+func (wc *WsConn) RemoteAddr() net.Addr {
+	if wc.remote != nil {
+		return wc.remote
+	}
+	return wc.ws.RemoteAddr()
+}
+
+func (wc *WsConn) SetDeadline(t time.Time) error {
+	if err := wc.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return wc.ws.SetWriteDeadline(t)
+}
+
+func (wc *WsConn) SetReadDeadline(t time.Time) error {
+	return wc.ws.SetReadDeadline(t)
+}
+
+func (wc *WsConn) SetWriteDeadline(t time.Time) error {
+	return wc.ws.SetWriteDeadline(t)
+}
+
+// StartTLS does nothing, rfc7395 3.7 secures the websocket itself, not the stream
+func (wc *WsConn) StartTLS(*tls.Config) {}
+
+// StartCompress does nothing, rfc7395 3.8 leaves compression to the websocket
+func (wc *WsConn) StartCompress(BuildCompressor) {}
+
+func (wc *WsConn) TLSState() (tls.ConnectionState, bool) {
+	return tlsState(wc.ws.UnderlyingConn())
+}
+
+func (wc *WsConn) BindTlsUnique(w io.Writer) error {
+	return bindTlsUnique(wc.ws.UnderlyingConn(), w)
+}
@@ -0,0 +1,158 @@
+package xmppcore
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestElemFramer(t *testing.T) {
+	stream := `<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" to="hello-world.im"/>` +
+		`<message to="a>b" id='x/>'><body>wherefore &lt;art&gt; thou</body><active/></message>` +
+		` ` +
+		`<close xmlns="urn:ietf:params:xml:ns:xmpp-framing"/>`
+	expected := []string{
+		`<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" to="hello-world.im"/>`,
+		`<message to="a>b" id='x/>'><body>wherefore &lt;art&gt; thou</body><active/></message>`,
+		` `,
+		`<close xmlns="urn:ietf:params:xml:ns:xmpp-framing"/>`,
+	}
+	for _, size := range []int{1, 3, 7, 64, len(stream)} {
+		var f elemFramer
+		frames := []string{}
+		for i := 0; i < len(stream); i += size {
+			end := i + size
+			if end > len(stream) {
+				end = len(stream)
+			}
+			f.write([]byte(stream[i:end]), func(frame []byte) error {
+				frames = append(frames, string(frame))
+				return nil
+			})
+		}
+		if strings.Join(frames, "|") != strings.Join(expected, "|") {
+			t.Fatalf("written by %d bytes, frames: %q", size, frames)
+		}
+	}
+}
+
+func TestIsWsRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/xmpp", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-Websocket-Protocol", "chat, xmpp")
+	if !IsWsRequest(r) {
+		t.Fatalf("xmpp subprotocol requested")
+	}
+	r.Header.Set("Sec-Websocket-Protocol", "chat")
+	if IsWsRequest(r) {
+		t.Fatalf("xmpp subprotocol not requested")
+	}
+}
+
+// serveTestWsPart runs a part for each websocket of the server returned
+func serveTestWsPart(t *testing.T, conf LivenessConfig, parts chan *XPart) *httptest.Server {
+	upgrader := websocket.Upgrader{Subprotocols: []string{WsSubprotocol}}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsWsRequest(r) {
+			http.Error(w, "xmpp subprotocol required", http.StatusBadRequest)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		part := NewXPart(NewWsConn(ws), "hello-world.im", NewLogger(io.Discard))
+		part.EnableLiveness(conf)
+		part.Run()
+		parts <- part
+	}))
+}
+
+func dialTestWs(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	dialer := websocket.Dialer{Subprotocols: []string{WsSubprotocol}}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial websocket error: %s", err.Error())
+	}
+	if ws.Subprotocol() != WsSubprotocol {
+		t.Fatalf("xmpp subprotocol not negotiated")
+	}
+	return ws
+}
+
+func readTestFrame(t *testing.T, ws *websocket.Conn) string {
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	typ, frame, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read frame error: %s", err.Error())
+	}
+	if typ != websocket.TextMessage {
+		t.Fatalf("require text frame, got %d", typ)
+	}
+	return string(frame)
+}
+
+func TestXPartOverWebSocket(t *testing.T) {
+	parts := make(chan *XPart, 1)
+	srv := serveTestWsPart(t, LivenessConfig{}, parts)
+	defer srv.Close()
+	ws := dialTestWs(t, srv)
+	defer ws.Close()
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" to="hello-world.im" version="1.0"/>`))
+	open := readTestFrame(t, ws)
+	if !strings.HasPrefix(open, `<open xmlns="urn:ietf:params:xml:ns:xmpp-framing"`) || !strings.HasSuffix(open, `/>`) ||
+		!strings.Contains(open, `from="hello-world.im"`) {
+		t.Fatalf("open frame error: %s", open)
+	}
+	if features := readTestFrame(t, ws); !strings.HasPrefix(features, `<features xmlns="http://etherx.jabber.org/streams"`) {
+		t.Fatalf("features frame error: %s", features)
+	}
+	ws.WriteMessage(websocket.TextMessage, []byte(`<iq type="get" id="c2s1"><ping xmlns="urn:xmpp:ping"/></iq>`))
+	if pong := readTestFrame(t, ws); !strings.HasPrefix(pong, `<iq`) || !strings.Contains(pong, `xmlns="jabber:client"`) ||
+		!strings.Contains(pong, `id="c2s1"`) {
+		t.Fatalf("pong frame error: %s", pong)
+	}
+	ws.WriteMessage(websocket.TextMessage, []byte(`<close xmlns="urn:ietf:params:xml:ns:xmpp-framing"/>`))
+	if closing := readTestFrame(t, ws); closing != `<close xmlns="urn:ietf:params:xml:ns:xmpp-framing"/>` {
+		t.Fatalf("close frame error: %s", closing)
+	}
+	part := <-parts
+	waitTestClosed(t, part.Closed(), time.Second)
+	if err := part.Channel().Err(); err != nil {
+		t.Fatalf("graceful close should have no error, got %s", err.Error())
+	}
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("require close frame, got %v", err)
+	}
+}
+
+func TestWsKeepaliveIsPing(t *testing.T) {
+	parts := make(chan *XPart, 1)
+	srv := serveTestWsPart(t, LivenessConfig{KeepaliveInterval: time.Millisecond * 40}, parts)
+	defer srv.Close()
+	ws := dialTestWs(t, srv)
+	defer ws.Close()
+	pinged := make(chan struct{}, 16)
+	ws.SetPingHandler(func(string) error {
+		pinged <- struct{}{}
+		return nil
+	})
+	ws.WriteMessage(websocket.TextMessage, []byte(`<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" to="hello-world.im" version="1.0"/>`))
+	readTestFrame(t, ws)
+	readTestFrame(t, ws)
+	// control frames are handled while reading, no text frame is expected
+	go ws.ReadMessage()
+	select {
+	case <-pinged:
+	case <-time.After(time.Second):
+		t.Fatalf("keepalive should be sent as a ping frame")
+	}
+}
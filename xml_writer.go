@@ -0,0 +1,112 @@
+package xmppcore
+
+import (
+	"bytes"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+var xmlBufPool = sync.Pool{
+	New: func() interface{} {
+		return &bytes.Buffer{}
+	},
+}
+
+func getXMLBuf() *bytes.Buffer {
+	return xmlBufPool.Get().(*bytes.Buffer)
+}
+
+func putXMLBuf(buf *bytes.Buffer) {
+	// don't keep buffers grown by huge stanzas
+	if buf.Cap() > 64*1024 {
+		return
+	}
+	buf.Reset()
+	xmlBufPool.Put(buf)
+}
+
+// WriteElement serializes elem into buf. unlike Element.ToXML, it walks the proto tree without
+// copying attributes and children, and escapes attribute values as well as text. attributes
+// with empty value are omitted the same way as Element.ToXML does
+func WriteElement(buf *bytes.Buffer, elem stravaganza.Element) {
+	writePBElement(buf, elem.Proto())
+}
+
+func writePBElement(buf *bytes.Buffer, pb *stravaganza.PBElement) {
+	buf.WriteByte('<')
+	buf.WriteString(pb.Name)
+	for _, attr := range pb.Attributes {
+		if len(attr.Value) == 0 {
+			continue
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(attr.Label)
+		buf.WriteString(`="`)
+		escapeXML(buf, attr.Value, true)
+		buf.WriteByte('"')
+	}
+	if len(pb.Elements) == 0 && len(pb.Text) == 0 {
+		buf.WriteString("/>")
+		return
+	}
+	buf.WriteByte('>')
+	escapeXML(buf, pb.Text, false)
+	for _, child := range pb.Elements {
+		writePBElement(buf, child)
+	}
+	buf.WriteString("</")
+	buf.WriteString(pb.Name)
+	buf.WriteByte('>')
+}
+
+func escapeXML(buf *bytes.Buffer, s string, inAttr bool) {
+	last := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		var esc string
+		width := 1
+		switch c {
+		case '&':
+			esc = "&amp;"
+		case '<':
+			esc = "&lt;"
+		case '>':
+			esc = "&gt;"
+		case '"':
+			if inAttr {
+				esc = "&quot;"
+			}
+		case '\t':
+			if inAttr {
+				esc = "&#x9;"
+			}
+		case '\n':
+			if inAttr {
+				esc = "&#xA;"
+			}
+		case '\r':
+			esc = "&#xD;"
+		default:
+			if c >= utf8.RuneSelf {
+				r, size := utf8.DecodeRuneInString(s[i:])
+				width = size
+				if r == utf8.RuneError && size == 1 || !isInCharacterRange(r) {
+					esc = "\uFFFD"
+				}
+			} else if c < 0x20 {
+				esc = "\uFFFD"
+			}
+		}
+		if esc == "" {
+			i = i + width
+			continue
+		}
+		buf.WriteString(s[last:i])
+		buf.WriteString(esc)
+		i = i + width
+		last = i
+	}
+	buf.WriteString(s[last:])
+}
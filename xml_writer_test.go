@@ -0,0 +1,31 @@
+package xmppcore
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/jackal-xmpp/stravaganza/v2"
+)
+
+func TestWriteElement(t *testing.T) {
+	elem := stravaganza.NewBuilder("message").
+		WithAttribute("id", `a"b<c>&d`).
+		WithAttribute("empty", "").
+		WithChild(stravaganza.NewBuilder("body").WithText("x < y & \"z\"\n").Build()).
+		WithChild(stravaganza.NewBuilder("active").WithAttribute("xmlns", "http://jabber.org/protocol/chatstates").Build()).
+		Build()
+	var buf bytes.Buffer
+	WriteElement(&buf, elem)
+	require := `<message id="a&quot;b&lt;c&gt;&amp;d"><body>x &lt; y &amp; "z"` + "\n" +
+		`</body><active xmlns="http://jabber.org/protocol/chatstates"/></message>`
+	if buf.String() != require {
+		t.Fatalf("write element error.\nrequire: %s\ngot:     %s", require, buf.String())
+	}
+	_, elems := parseTestStream(func(r io.Reader, size int) ElementParser {
+		return NewFastParser(r, size)
+	}, buf.String())
+	if len(elems) != 1 || elems[0].Attribute("id") != `a"b<c>&d` || elems[0].Child("body").Text() != "x < y & \"z\"\n" {
+		t.Fatalf("written element not parsed back: %v", elems)
+	}
+}
@@ -23,6 +23,29 @@ type Feature interface {
 	ElemHandler
 }
 
+// MultiElemFeature is a feature advertised with more than one element
+type MultiElemFeature interface {
+	Elems() []stravaganza.Element
+}
+
+func featureElems(f Feature) []stravaganza.Element {
+	if mf, ok := f.(MultiElemFeature); ok {
+		return mf.Elems()
+	}
+	return []stravaganza.Element{f.Elem()}
+}
+
+// StreamRestarter is a feature which tells if the stream is restarted once it's
+// negotiated, a feature which isn't one always restarts it
+type StreamRestarter interface {
+	RestartsStream() bool
+}
+
+func restartsStream(h interface{}) bool {
+	r, ok := h.(StreamRestarter)
+	return !ok || r.RestartsStream()
+}
+
 type ElemHandler interface {
 	ID() string
 	Handle(elem stravaganza.Element, part Part) (catched bool, err error)
@@ -45,12 +68,15 @@ type Part interface {
 	Attr() *PartAttr
 	Channel() Channel
 	WithElemHandler(ElemHandler)
-	Logger() Logger
+	Logger() StructuredLogger
 	Conn() Conn
 
 	OnOpenHeader(header xml.StartElement) error
 	OnCloseToken()
 	OnWhiteSpace([]byte)
+
+	CloseWithError(error)
+	Closed() <-chan struct{}
 }
 
 type elemRunner struct {
@@ -103,29 +129,34 @@ func (er *elemRunner) Run(part Part) chan error {
 			if err != nil {
 				if er.quit {
 					errChan <- nil
-					part.Logger().Printf(LogInfo, "quit!")
+					part.Logger().Log(LogInfo, "part quit")
 					return
 				}
-				part.Logger().Printf(LogError, "a error from part instance [%s] message handler: %s", part.ID(), err.Error())
+				part.Logger().Log(LogError, "read stream error", Field(LogKeyErr, err))
+				er.closeWithStreamError(err)
 				errChan <- err
 				return
 			}
 			switch t := i.(type) {
 			case xml.StartElement:
 				if err := part.OnOpenHeader(t); err != nil {
+					er.closeWithStreamError(err)
 					errChan <- err
 					return
 				}
 			case xml.CharData:
 				part.OnWhiteSpace(t)
 			case xml.EndElement:
+				// the peer closed the stream gracefully
 				part.OnCloseToken()
+				errChan <- nil
+				return
 			case stravaganza.Element:
 				for _, handler := range er.elemHandlers {
 					if catched, err := handler.Handle(t, part); catched {
 						er.handled = er.handled + 1
 					} else if err != nil {
-						part.Logger().Printf(LogError, "a error occured from part instance [%s] message handler: %s", part.ID(), err.Error())
+						part.Logger().Log(LogError, "element handler error", Field(LogKeyErr, err))
 						errChan <- err
 					}
 				}
@@ -140,6 +171,30 @@ func (er *elemRunner) Run(part Part) chan error {
 	return errChan
 }
 
+// closeWithStreamError tells the peer why the stream is going to be closed when err is
+// a fault of the peer
+func (er *elemRunner) closeWithStreamError(err error) {
+	if se, ok := StreamErrorFromError(err); ok {
+		er.channel.CloseWithStreamError(se)
+	}
+}
+
+// partLogger adds the context of a part to logger
+func partLogger(logger Logger, id string, conn Conn) StructuredLogger {
+	fields := []LogField{Field(LogKeyPart, id)}
+	if addr := conn.RemoteAddr(); addr != nil {
+		fields = append(fields, Field(LogKeyRemote, addr.String()))
+	}
+	return Structured(logger).Sub(LogSubPart).With(fields...)
+}
+
+func withJIDLogger(logger StructuredLogger, jid JID) StructuredLogger {
+	if jid.Domain == "" {
+		return logger
+	}
+	return logger.With(Field(LogKeyJID, jid.String()))
+}
+
 type PartAttr struct {
 	ID      string
 	JID     JID    // client's jid
@@ -178,7 +233,7 @@ func (attr *PartAttr) head(elem *xml.StartElement, from, to string) {
 		eattr = append(eattr, xml.Attr{Name: xml.Name{Local: "to"}, Value: to})
 	}
 	if attr.XmlLang != "" {
-		eattr = append(eattr, xml.Attr{Name: xml.Name{Local: "lang", Space: "xml"}, Value: attr.XmlLang})
+		eattr = append(eattr, xml.Attr{Name: xml.Name{Local: "lang", Space: NSXML}, Value: attr.XmlLang})
 	}
 	// if attr.Xmlns != "" {
 	// 	eattr = append(eattr, xml.Attr{Name: xml.Name{Local: "xmlns"}, Value: attr.Xmlns})
@@ -206,7 +261,11 @@ func (sa *PartAttr) ParseToServer(elem xml.StartElement) error {
 				return err
 			}
 		} else if attr.Name.Local == "to" {
-			if attr.Value != sa.Domain {
+			domain, err := PrepDomainpart(attr.Value)
+			if err != nil {
+				return ErrNotForThisDomainHead
+			}
+			if domain != sa.Domain {
 				return ErrNotForThisDomainHead
 			}
 		} else if attr.Name.Local == "xmlns" {
@@ -215,7 +274,7 @@ func (sa *PartAttr) ParseToServer(elem xml.StartElement) error {
 			sa.Version = attr.Value
 		} else if attr.Name.Local == "id" && attr.Value != "" {
 			sa.ID = attr.Value
-		} else if attr.Name.Local == "xml:lang" {
+		} else if attr.Name.Local == "lang" && attr.Name.Space == NSXML {
 			sa.XmlLang = attr.Value
 		}
 	}
@@ -238,7 +297,7 @@ func (sa *PartAttr) ParseToClient(elem xml.StartElement) error {
 				return ErrNotForThisDomainHead
 			}
 		} else if attr.Name.Local == "from" {
-			sa.Domain = attr.Value
+			sa.Domain = prepDomain(attr.Value)
 		} else if attr.Name.Local == "version" {
 			sa.Version = attr.Value
 		} else if attr.Name.Local == "id" && attr.Value != "" {
@@ -251,20 +310,31 @@ func (sa *PartAttr) ParseToClient(elem xml.StartElement) error {
 type XPart struct {
 	channel  Channel
 	features []Feature
-	logger   Logger
+	logger   StructuredLogger
 	conn     Conn
 	attr     PartAttr
+	liveness *Liveness
 	elemRunner
 }
 
+// prepDomain prepares the domain of a part once, so that it compares with the domains of the
+// jids parsed. a domain that can't be prepared is kept as it is
+func prepDomain(domain string) string {
+	if prepped, err := PrepDomainpart(domain); err == nil {
+		return prepped
+	}
+	return domain
+}
+
 func NewXPart(conn Conn, domain string, logger Logger) *XPart {
 	channel := NewXChannel(conn, true)
+	id := uuid.New().String()
 	return &XPart{
 		channel:    channel,
 		features:   []Feature{},
-		logger:     logger,
+		logger:     partLogger(logger, id, conn),
 		conn:       conn,
-		attr:       PartAttr{Domain: domain, ID: uuid.New().String()},
+		attr:       PartAttr{Domain: prepDomain(domain), ID: id},
 		elemRunner: ElemRunner(channel),
 	}
 }
@@ -285,8 +355,18 @@ func (part *XPart) WithFeature(f Feature) {
 	part.features = append(part.features, f)
 }
 
+// EnableLiveness keeps the stream alive and closes it once the client is dead while the
+// part is running
+func (part *XPart) EnableLiveness(conf LivenessConfig) {
+	part.liveness = newLiveness(part, true, conf)
+	part.WithElemHandler(part.liveness)
+}
+
 func (part *XPart) Run() chan error {
-	part.logger.Printf(LogInfo, "part instance [%s] start running", part.attr.ID)
+	part.logger.Log(LogInfo, "part start running")
+	if part.liveness != nil {
+		part.liveness.Start()
+	}
 	return part.elemRunner.Run(part)
 }
 
@@ -339,12 +419,15 @@ func (part *XPart) Attr() *PartAttr {
 // +<-------------------------- {restart mandatory?} ------------>+
 //              no                                     yes
 func (part *XPart) handleFeatures(header xml.StartElement) error {
+	restart := true
 	for {
-		if err := part.Attr().ParseToServer(header); err != nil {
-			return err
-		}
-		if err := part.Channel().Open(part.Attr()); err != nil {
-			return err
+		if restart {
+			if err := part.Attr().ParseToServer(header); err != nil {
+				return err
+			}
+			if err := part.Channel().Open(part.Attr()); err != nil {
+				return err
+			}
 		}
 		features, hasMandatory := part.unresolvedFeatures()
 		if !hasMandatory {
@@ -355,7 +438,7 @@ func (part *XPart) handleFeatures(header xml.StartElement) error {
 		runner.SetHandleLimit(1)
 		for _, f := range features {
 			runner.WithElemHandler(f)
-			elems = append(elems, f.Elem())
+			elems = append(elems, featureElems(f)...)
 		}
 		if err := part.notifyFeatures(elems...); err != nil {
 			return err
@@ -364,6 +447,14 @@ func (part *XPart) handleFeatures(header xml.StartElement) error {
 		if err := <-errChan; err != nil {
 			return err
 		}
+		// the features left are offered at once if the stream isn't restarted
+		restart = true
+		for _, f := range features {
+			restart = restart && restartsStream(f)
+		}
+		if !restart {
+			continue
+		}
 		if err := part.Channel().WaitHeader(&header); err != nil {
 			return err
 		}
@@ -373,7 +464,7 @@ func (part *XPart) handleFeatures(header xml.StartElement) error {
 func (part *XPart) handleUnmandatoryFeatures(features []Feature) error {
 	elems := []stravaganza.Element{}
 	for _, f := range features {
-		elems = append(elems, f.Elem())
+		elems = append(elems, featureElems(f)...)
 		part.WithElemHandler(f)
 	}
 	part.notifyFeatures(elems...)
@@ -394,18 +485,39 @@ func (part *XPart) unresolvedFeatures() (features []Feature, hasMandatory bool)
 }
 
 func (part *XPart) notifyFeatures(elems ...stravaganza.Element) error {
-	return part.Channel().SendElement(stravaganza.NewBuilder("features").WithChildren(elems...).Build())
+	return part.Channel().SendElement(stravaganza.NewBuilder("features").WithAttribute("xmlns", NSStream).WithChildren(elems...).Build())
 }
 
-func (part *XPart) Logger() Logger {
-	return part.logger
+// Logger logs with the context of the part, the jid included once it's bound
+func (part *XPart) Logger() StructuredLogger {
+	return withJIDLogger(part.logger, part.attr.JID)
 }
 
 func (part *XPart) Stop() {
+	if part.liveness != nil {
+		part.liveness.Stop()
+	}
 	part.Quit()
 }
 
-func (part *XPart) OnCloseToken() {}
+// CloseWithError closes the stream because of err, see Channel.CloseWithError
+func (part *XPart) CloseWithError(err error) {
+	if part.liveness != nil {
+		part.liveness.Stop()
+	}
+	part.channel.CloseWithError(err)
+}
+
+// Closed is closed once the stream and its conn are closed, Channel().Err() tells why
+func (part *XPart) Closed() <-chan struct{} {
+	return part.channel.Closed()
+}
+
+func (part *XPart) OnCloseToken() {
+	if part.liveness != nil {
+		part.liveness.Stop()
+	}
+}
 
 func (part *XPart) OnOpenHeader(header xml.StartElement) error {
 	return part.handleFeatures(header)